@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-engine/mainWAF/collections"
+	"waf-engine/mainWAF/rules"
+)
+
+// ==========================
+// Rule actions: initcol, setvar, expirevar (persistent collections and TX)
+// ==========================
+
+// macroPattern finds %{...} macros in action and operator arguments
+var macroPattern = regexp.MustCompile(`%\{([^}]+)\}`)
+
+// runActions executes the state-changing actions of a matched rule
+func (e *Evaluator) runActions(rule rules.Rule, req *Request, tx *Transaction) {
+	for _, spec := range rule.InitCol {
+		name, key, ok := strings.Cut(spec, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !ok || !collections.IsCollection(name) {
+			slog.Warn("invalid initcol", "rule", rule.ID, "spec", spec)
+			continue
+		}
+		tx.Collections[name] = e.expandMacros(key, rule, req, tx)
+	}
+
+	for _, spec := range rule.SetVar {
+		e.setVar(spec, rule, req, tx)
+	}
+
+	for _, spec := range rule.ExpireVar {
+		target, secs, _ := strings.Cut(spec, "=")
+		col, name, ok := e.resolveTarget(target, rule, req, tx)
+		if !ok || col == "TX" {
+			// TX variables never outlive the transaction anyway
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(e.expandMacros(secs, rule, req, tx)))
+		if err != nil || n <= 0 {
+			slog.Warn("invalid expirevar", "rule", rule.ID, "spec", spec)
+			continue
+		}
+		if err := e.store.Expire(col, tx.Collections[col], name, time.Duration(n)*time.Second); err != nil {
+			slog.Warn("expirevar failed", "rule", rule.ID, "err", err)
+		}
+	}
+}
+
+// setVar applies one setvar action:
+//
+//	col.name=value   set
+//	col.name=+N/-N   atomic increment / decrement
+//	!col.name        delete
+//	col.name         set to an empty value
+func (e *Evaluator) setVar(spec string, rule rules.Rule, req *Request, tx *Transaction) {
+	target, value, hasValue := strings.Cut(spec, "=")
+	remove := strings.HasPrefix(target, "!")
+	target = strings.TrimPrefix(target, "!")
+
+	col, name, ok := e.resolveTarget(target, rule, req, tx)
+	if !ok {
+		return
+	}
+	key := tx.Collections[col]
+	value = e.expandMacros(value, rule, req, tx)
+
+	var err error
+	switch {
+	case remove && col == "TX":
+		delete(tx.TX, name)
+	case remove:
+		err = e.store.Delete(col, key, name)
+	case hasValue && len(value) > 1 && (value[0] == '+' || value[0] == '-'):
+		delta, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			slog.Warn("non-numeric setvar increment", "rule", rule.ID, "spec", spec)
+			return
+		}
+		if col == "TX" {
+			current, _ := strconv.ParseInt(tx.TX[name], 10, 64)
+			tx.TX[name] = strconv.FormatInt(current+delta, 10)
+			return
+		}
+		_, err = e.store.Incr(col, key, name, delta, 0)
+	case col == "TX":
+		tx.TX[name] = value
+	default:
+		err = e.store.Set(col, key, name, value, 0)
+	}
+	if err != nil {
+		slog.Warn("setvar failed", "rule", rule.ID, "err", err)
+	}
+}
+
+// resolveTarget splits "ip.counter" into its collection and variable name.
+// Only collections opened by initcol are writable; GLOBAL and the
+// transaction collection TX are always open.
+func (e *Evaluator) resolveTarget(target string, rule rules.Rule, req *Request, tx *Transaction) (col, name string, ok bool) {
+	target = e.expandMacros(strings.TrimSpace(target), rule, req, tx)
+	col, name, ok = strings.Cut(target, ".")
+	col = strings.ToUpper(col)
+	if ok && name != "" && col == "TX" {
+		return col, strings.ToLower(name), true
+	}
+	if !ok || name == "" || !collections.IsCollection(col) {
+		return "", "", false
+	}
+	if _, open := tx.Collections[col]; !open {
+		if col != "GLOBAL" {
+			return "", "", false
+		}
+		tx.Collections[col] = "global"
+	}
+	return col, strings.ToLower(name), true
+}
+
+// ==========================
+// Macro expansion
+// ==========================
+
+// expandMacros replaces %{VAR} and %{COLLECTION.name} macros; unknown
+// variables expand to an empty string like in ModSecurity
+func (e *Evaluator) expandMacros(s string, rule rules.Rule, req *Request, tx *Transaction) string {
+	if !strings.Contains(s, "%{") {
+		return s
+	}
+	return macroPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return e.lookupMacro(m[2:len(m)-1], rule, req, tx)
+	})
+}
+
+func (e *Evaluator) lookupMacro(name string, rule rules.Rule, req *Request, tx *Transaction) string {
+	switch strings.ToLower(name) {
+	case "rule.id":
+		return rule.ID
+	case "rule.msg":
+		return rule.Name
+	case "rule.severity":
+		return rule.Severity
+	case "matched_var":
+		return tx.MatchedVar
+	case "matched_var_name":
+		return tx.MatchedVarName
+	case "request_method":
+		return req.Method
+	}
+
+	col, member, _ := strings.Cut(name, ".")
+	col = strings.ToUpper(col)
+	if col == "TX" {
+		return tx.TX[strings.ToLower(member)]
+	}
+	if collections.IsCollection(col) {
+		key, ok := tx.Collections[col]
+		if !ok {
+			return ""
+		}
+		v, _ := e.store.Get(col, key, member)
+		return v
+	}
+
+	variable := col
+	if member != "" {
+		// Header names are stored lower-cased in the flatten cache
+		if col == "REQUEST_HEADERS" {
+			member = strings.ToLower(member)
+		}
+		variable += ":" + member
+	}
+	if vs := req.FlattenCache[variable]; len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
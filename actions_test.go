@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"waf-engine/mainWAF/collections"
+)
+
+// expiryStore records the expirevar calls reaching the store
+type expiryStore struct {
+	collections.Store
+	mu      sync.Mutex
+	expired []string
+}
+
+func (s *expiryStore) Expire(collection, key, name string, ttl time.Duration) error {
+	s.mu.Lock()
+	s.expired = append(s.expired, collection+"/"+key+"/"+name+"="+ttl.String())
+	s.mu.Unlock()
+	return s.Store.Expire(collection, key, name, ttl)
+}
+
+// counterRules count the requests of every client IP and user agent,
+// block the third one and exercise each form of setvar on TX
+const counterRules = `
+- id: "1"
+  name: count requests
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+  nolog: true
+  initcol: ["ip=%{REMOTE_ADDR}_%{REQUEST_HEADERS.User-Agent}"]
+  setvar: ["ip.hits=+1", "tx.score=+5", "tx.score=-2", "tx.gone=1", "!tx.gone", "tx.rule=%{rule.id}"]
+  expirevar: ["ip.hits=60"]
+- id: "2"
+  name: too many requests
+  variable: IP:hits
+  regex: "@ge 3"
+  phase: 2
+  block: true
+- id: "3"
+  name: setvar adds and subtracts
+  variable: TX:score
+  regex: "@eq 3"
+  phase: 2
+- id: "4"
+  name: deleted TX variable
+  variable: TX:gone
+  regex: "@streq 1"
+  phase: 2
+- id: "5"
+  name: macro value
+  variable: TX:rule
+  regex: "@streq 1"
+  phase: 2
+- id: "6"
+  name: reset the counter
+  variable: ARGS:reset
+  regex: "@streq 1"
+  phase: 2
+  nolog: true
+  setvar: ["!ip.hits"]
+`
+
+func TestCollectionActions(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, counterRules))
+	store := &expiryStore{Store: collections.NewMemoryStore(0)}
+	eval.SetCollectionStore(store)
+
+	send := func(ip, target string) []string {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("User-Agent", "curl")
+		got := matches(eval, r)
+		sort.Strings(got)
+		return got
+	}
+
+	perRequest := []string{"3@TX:score", "5@TX:rule"}
+	for i, tc := range []struct {
+		ip, target string
+		want       []string
+	}{
+		{"192.0.2.1", "/", perRequest},
+		{"192.0.2.1", "/", perRequest},
+		// the third request of the same IP is over the limit
+		{"192.0.2.1", "/", []string{"2@IP:hits", "3@TX:score", "5@TX:rule"}},
+		// another IP has its own counter
+		{"192.0.2.2", "/", perRequest},
+		// the counter is deleted after rule 2 saw its fourth request
+		{"192.0.2.1", "/?reset=1", []string{"2@IP:hits", "3@TX:score", "5@TX:rule"}},
+		{"192.0.2.1", "/", perRequest},
+	} {
+		if got := send(tc.ip, tc.target); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("request %d from %s: matched %v, want %v", i, tc.ip, got, tc.want)
+		}
+	}
+
+	// The collection key is the expanded macro
+	if v, _ := store.Get("IP", "192.0.2.1_curl", "hits"); v != "1" {
+		t.Errorf("IP 192.0.2.1_curl hits = %q, want 1", v)
+	}
+	if v, _ := store.Get("IP", "192.0.2.2_curl", "hits"); v != "1" {
+		t.Errorf("IP 192.0.2.2_curl hits = %q, want 1", v)
+	}
+	if len(store.expired) != 6 || store.expired[0] != "IP/192.0.2.1_curl/hits=1m0s" || store.expired[3] != "IP/192.0.2.2_curl/hits=1m0s" {
+		t.Errorf("expirevar calls %v", store.expired)
+	}
+}
+
+func TestExpirevarEndsCounter(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "1"
+  name: count requests
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+  nolog: true
+  initcol: ["ip=%{REMOTE_ADDR}"]
+  setvar: ["ip.hits=+1"]
+  expirevar: ["ip.hits=1"]
+- id: "2"
+  name: second request
+  variable: IP:hits
+  regex: "@ge 2"
+  phase: 2
+  block: true
+`))
+	blocked := func() bool {
+		dec, _ := eval.InspectPhases(BuildRequest(httptest.NewRequest(http.MethodGet, "/", nil)))
+		return dec.Block
+	}
+
+	if blocked() || !blocked() {
+		t.Fatal("the second request within the expiry was not blocked")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if blocked() {
+		t.Error("the counter outlived its expirevar")
+	}
+}
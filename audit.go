@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Transaction logging (waf.log + audit log)
+// ==========================
+
+// auditLog is the audit log opened by serve; nil when it is off
+var auditLog *utils.AuditLogger
+
+// logTransaction writes the request log line and, when enabled, the audit
+// log entry of an inspected request
+func logTransaction(clientAddr string, req *Request, dec Decision, matchedRules []utils.MatchedRuleLog) {
+	utils.LogRequest(clientAddr, req.Method, req.Path, matchedRules, dec.Score, dec.Block)
+	if auditLog == nil {
+		return
+	}
+
+	entry := utils.AuditEntry{
+		Time:           time.Now(),
+		ClientIP:       clientAddr,
+		Method:         req.Method,
+		URI:            req.Path,
+		Protocol:       "HTTP/1.1",
+		RequestHeaders: req.Headers,
+		Status:         http.StatusOK,
+		Score:          dec.Score,
+		Blocked:        dec.Block,
+		Matches:        matchedRules,
+	}
+	if host, port, err := net.SplitHostPort(clientAddr); err == nil {
+		entry.ClientIP = host
+		entry.ClientPort, _ = strconv.Atoi(port)
+	}
+	if proto := req.FlattenCache["REQUEST_PROTOCOL"]; len(proto) > 0 && proto[0] != "" {
+		entry.Protocol = proto[0]
+	}
+	if body := req.FlattenCache["REQUEST_BODY"]; len(body) > 0 {
+		entry.RequestBody = body[0]
+	}
+	if dec.Block {
+		entry.Status = http.StatusForbidden
+	}
+	if err := auditLog.Log(entry); err != nil {
+		slog.Warn("writing audit log failed", "err", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ==========================
+// nginx auth_request verdicts (/auth_request)
+// ==========================
+// nginx sends a body-less subrequest for every client request, carrying
+// the original request line in X-Original-* headers. Only the rules of
+// phase 1 are evaluated: they see the request line, the headers and the
+// query string arguments, which are all of ARGS here. Phase-2 rules,
+// including those reading the body, never run under auth_request; send
+// the request to /inspect when they are needed.
+//
+// nginx configuration:
+//
+//	location = /_waf {
+//	    internal;
+//	    proxy_pass              http://waf:8080/auth_request;
+//	    proxy_pass_request_body off;
+//	    proxy_set_header        Content-Length "";
+//	    proxy_set_header        X-Original-URI $request_uri;
+//	    proxy_set_header        X-Original-Method $request_method;
+//	    proxy_set_header        X-Original-Host $host;
+//	    proxy_set_header        X-Real-IP $remote_addr;
+//	}
+//
+//	location / {
+//	    auth_request     /_waf;
+//	    auth_request_set $waf_rules $upstream_http_x_waf_rules;
+//	    proxy_pass       http://app;
+//	}
+//
+// X-Original-Host is needed because the Host of the subrequest is the WAF
+// upstream (or whatever proxy_set_header Host says), not the host the
+// client asked for. Without it X-Forwarded-Host is used, then the Host of
+// the subrequest.
+
+const authRequestPath = "/auth_request"
+
+// authRequestLastPhase is the last phase evaluated for a subrequest: nginx
+// asks for the verdict before it reads the request body
+const authRequestLastPhase = 1
+
+// authRequestHeaders are set by nginx for the subrequest itself and are not
+// part of the original client request
+var authRequestHeaders = []string{"X-Original-Uri", "X-Original-Method", "X-Original-Host", "X-Real-Ip"}
+
+// AuthRequestHandler answers nginx auth_request subrequests with 200 or 403
+// and X-WAF-* headers carrying the score and matched rule IDs
+func AuthRequestHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		original, err := originalRequest(r)
+		if err != nil {
+			http.Error(w, "invalid X-Original-URI", http.StatusBadRequest)
+			return
+		}
+
+		req := BuildRequest(original)
+		dec, matchedRules := eval.InspectUpToPhase(req, authRequestLastPhase)
+		logTransaction(original.RemoteAddr, req, dec, matchedRules)
+
+		for k, vs := range verdictHeaders(dec, matchedRules) {
+			w.Header()[k] = vs
+		}
+		if dec.Block {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// originalRequest rebuilds the client request described by the subrequest
+func originalRequest(r *http.Request) (*http.Request, error) {
+	uri := r.Header.Get("X-Original-URI")
+	if uri == "" {
+		uri = "/"
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	method := r.Header.Get("X-Original-Method")
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	original := &http.Request{
+		Method:     strings.ToUpper(method),
+		URL:        u,
+		RequestURI: uri,
+		Proto:      r.Proto,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+		Header:     r.Header.Clone(),
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Body:       http.NoBody,
+	}
+	// Host: X-Original-Host, else X-Forwarded-Host, else the subrequest's
+	if host := r.Header.Get("X-Original-Host"); host != "" {
+		original.Host = host
+	} else if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		original.Host = host
+	}
+
+	// Client address: X-Real-IP, else the first X-Forwarded-For hop
+	clientIP := r.Header.Get("X-Real-IP")
+	if clientIP == "" {
+		clientIP, _, _ = strings.Cut(r.Header.Get("X-Forwarded-For"), ",")
+		clientIP = strings.TrimSpace(clientIP)
+	}
+	if clientIP != "" {
+		original.RemoteAddr = net.JoinHostPort(clientIP, "0")
+	}
+
+	for _, h := range authRequestHeaders {
+		original.Header.Del(h)
+	}
+	return original, nil
+}
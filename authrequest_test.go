@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authRequestRules block query arguments in phase 1 and have a phase-2 rule
+// auth_request must never run
+const authRequestRules = `
+- id: "100"
+  name: XSS in arguments
+  variable: ARGS
+  regex: (?i)<script
+  phase: 1
+  block: true
+- id: "200"
+  name: SQL injection in arguments
+  variable: ARGS
+  regex: (?i)union\s+select
+  phase: 2
+  block: true
+`
+
+func TestAuthRequestInspectsPhaseOne(t *testing.T) {
+	handler := AuthRequestHandler(NewEvaluator(loadTestRules(t, authRequestRules)))
+
+	for target, want := range map[string]int{
+		"/search?q=shoes":        http.StatusOK,
+		"/search?q=%3Cscript%3E": http.StatusForbidden,
+		// phase 2 is not evaluated
+		"/search?q=union+select+1": http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, authRequestPath, nil)
+		r.Header.Set("X-Original-URI", target)
+		r.Header.Set("X-Original-Method", "GET")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", target, rec.Code, want)
+		}
+		if want == http.StatusForbidden && rec.Header().Get("X-WAF-Rules") != "100" {
+			t.Errorf("%s: X-WAF-Rules %q, want 100", target, rec.Header().Get("X-WAF-Rules"))
+		}
+	}
+}
+
+func TestOriginalRequestHost(t *testing.T) {
+	for _, tc := range []struct {
+		headers map[string]string
+		want    string
+	}{
+		{map[string]string{"X-Original-Host": "shop.example.com", "X-Forwarded-Host": "proxy.internal"}, "shop.example.com"},
+		{map[string]string{"X-Forwarded-Host": "shop.example.com"}, "shop.example.com"},
+		{nil, "waf:8080"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "http://waf:8080"+authRequestPath, nil)
+		r.Header.Set("X-Original-URI", "/cart?id=1")
+		r.Header.Set("X-Real-IP", "203.0.113.9")
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		original, err := originalRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if original.Host != tc.want {
+			t.Errorf("%v: host %q, want %q", tc.headers, original.Host, tc.want)
+		}
+		if original.RequestURI != "/cart?id=1" || original.RemoteAddr != "203.0.113.9:0" {
+			t.Errorf("original request %s from %s", original.RequestURI, original.RemoteAddr)
+		}
+		for _, h := range authRequestHeaders {
+			if original.Header.Get(h) != "" {
+				t.Errorf("subrequest header %s kept", h)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ==========================
+// Benchmark requests (go test -bench, waf loadtest)
+// ==========================
+
+// benchCase is one request shape the engine is benchmarked with
+type benchCase struct {
+	name  string
+	build func() *http.Request
+}
+
+// browserHeaders are the headers of an ordinary browser request
+var browserHeaders = map[string]string{
+	"User-Agent":      "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 Chrome/126.0 Safari/537.36",
+	"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+	"Accept-Language": "en-US,en;q=0.5",
+	"Accept-Encoding": "gzip, deflate, br",
+	"Cookie":          "session=4f2a9c1e7b; theme=dark",
+	"Referer":         "https://shop.example.com/products",
+}
+
+// benchRequest builds a request as the HTTP server hands it to a handler
+func benchRequest(method, target string, body io.Reader) *http.Request {
+	r, err := http.NewRequest(method, "http://example.com"+target, body)
+	if err != nil {
+		panic(err)
+	}
+	r.RequestURI, r.RemoteAddr = target, "192.0.2.1:1234"
+	return r
+}
+
+func benchGet(target string, headers map[string]string) func() *http.Request {
+	return func() *http.Request {
+		r := benchRequest(http.MethodGet, target, nil)
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+}
+
+func benchPost(target, contentType, body string) func() *http.Request {
+	return func() *http.Request {
+		r := benchRequest(http.MethodPost, target, strings.NewReader(body))
+		for k, v := range browserHeaders {
+			r.Header.Set(k, v)
+		}
+		r.Header.Set("Content-Type", contentType)
+		return r
+	}
+}
+
+// manyHeaders returns the browser headers plus n-len(browserHeaders)
+// X-Custom headers
+func manyHeaders(n int) map[string]string {
+	h := make(map[string]string, n)
+	for k, v := range browserHeaders {
+		h[k] = v
+	}
+	for i := len(h); i < n; i++ {
+		h[fmt.Sprintf("X-Custom-%03d", i)] = fmt.Sprintf("value-%d-%x", i, i*2654435761)
+	}
+	return h
+}
+
+// formBody returns a form of about size bytes in 64-byte text fields
+func formBody(size int) string {
+	v := url.Values{}
+	for i := 0; i*64 < size; i++ {
+		v.Set(fmt.Sprintf("field%d", i), strings.Repeat("lorem ipsum dolor sit amet ", 3)[:48])
+	}
+	return v.Encode()
+}
+
+// jsonBody returns a JSON array of about size bytes of order objects
+func jsonBody(size int) string {
+	var b strings.Builder
+	b.WriteString(`{"orders":[`)
+	for i := 0; b.Len() < size; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id":%d,"sku":"SKU-%05d","qty":%d,"note":"deliver between 9 and 5"}`, i, i*7, i%5+1)
+	}
+	b.WriteString(`]}`)
+	return b.String()
+}
+
+func benchCases() []benchCase {
+	return []benchCase{
+		// Benign and malicious requests
+		{"get/static", benchGet("/assets/app.js", browserHeaders)},
+		{"get/search", benchGet("/search?q=running+shoes&page=2&sort=price", browserHeaders)},
+		{"get/sqli", benchGet("/items?id=1%27%20UNION%20SELECT%20password%20FROM%20users--", browserHeaders)},
+		{"get/xss", benchGet("/search?q=%3Cscript%3Ealert(document.cookie)%3C/script%3E", browserHeaders)},
+		{"get/traversal", benchGet("/download?file=..%2F..%2F..%2Fetc%2Fpasswd", browserHeaders)},
+		{"get/rce", benchGet("/ping?host=127.0.0.1%3Bcat+/etc/shadow", browserHeaders)},
+		{"post/form", benchPost("/login", "application/x-www-form-urlencoded",
+			"username=alice&password=correct+horse+battery+staple&remember=on")},
+		{"post/json", benchPost("/api/orders", "application/json",
+			`{"customer":{"name":"Alice","email":"alice@example.com"},"items":[{"sku":"A-1","qty":2},{"sku":"B-7","qty":1}],"note":"leave at the door"}`)},
+		{"post/json-attack", benchPost("/api/orders", "application/json",
+			`{"customer":{"name":"x' or 1=1--","email":"<img src=x onerror=alert(1)>"},"items":[]}`)},
+
+		// Body sizes
+		{"body/form-1k", benchPost("/submit", "application/x-www-form-urlencoded", formBody(1<<10))},
+		{"body/form-8k", benchPost("/submit", "application/x-www-form-urlencoded", formBody(8<<10))},
+		{"body/form-64k", benchPost("/submit", "application/x-www-form-urlencoded", formBody(64<<10))},
+		{"body/json-1k", benchPost("/api/orders", "application/json", jsonBody(1<<10))},
+		{"body/json-8k", benchPost("/api/orders", "application/json", jsonBody(8<<10))},
+		{"body/json-64k", benchPost("/api/orders", "application/json", jsonBody(64<<10))},
+
+		// Header counts
+		{"headers/10", benchGet("/", manyHeaders(10))},
+		{"headers/50", benchGet("/", manyHeaders(50))},
+		{"headers/200", benchGet("/", manyHeaders(200))},
+	}
+}
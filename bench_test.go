@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+// BenchmarkInspectPhases times the compiled plan against the per-request
+// path it replaced; compare them with
+//
+//	go test -run '^$' -bench InspectPhases -count 10 > bench.txt
+//	benchstat -col /path bench.txt
+func BenchmarkInspectPhases(b *testing.B) {
+	eval := NewEvaluator(loadParsedRules(b))
+	for _, bc := range benchCases() {
+		// Inspection does not modify the request, so one serves every run
+		req := BuildRequest(bc.build())
+		b.Run(bc.name+"/path=plan", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				eval.InspectPhases(req)
+			}
+		})
+		b.Run(bc.name+"/path=legacy", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				eval.legacyInspect(req)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"waf-engine/mainWAF/collections"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Server configuration (waf_config.yaml)
+// ==========================
+
+// Config holds the settings of the serve command. Every field is optional;
+// DefaultConfig documents the values used when it is left out.
+type Config struct {
+	Listen      string                `yaml:"listen"`
+	RulesDir    string                `yaml:"rules_dir"`
+	SPOA        SPOAConfig            `yaml:"spoa"`
+	Admin       AdminConfig           `yaml:"admin"`
+	Collections CollectionsConfig     `yaml:"collections"`
+	Logging     LoggingConfig         `yaml:"logging"`
+	AuditLog    utils.AuditConfig     `yaml:"audit_log"`
+	Redaction   utils.RedactionConfig `yaml:"redaction"`
+	Regex       RegexConfig           `yaml:"regex"`
+	TX          map[string]string     `yaml:"tx"` // TX variables every transaction starts with, on top of the CRS defaults
+}
+
+// SPOAConfig enables the HAProxy SPOE agent on its own TCP listener
+type SPOAConfig struct {
+	Listen string `yaml:"listen"` // e.g. ":12345", empty disables the agent
+}
+
+// AdminConfig places the /metrics and /admin/profile endpoints on their own
+// listener. Without a listen address neither is served.
+type AdminConfig struct {
+	Listen  string `yaml:"listen"`  // e.g. "127.0.0.1:9090"
+	Profile bool   `yaml:"profile"` // profile rule evaluation from startup
+}
+
+// RegexConfig bounds the time spent in backtracking regexes, i.e. @rx
+// patterns with PCRE-only syntax; RE2 patterns run in linear time
+type RegexConfig struct {
+	MatchTimeout      time.Duration `yaml:"match_timeout"`      // one regex on one value
+	TransactionBudget time.Duration `yaml:"transaction_budget"` // all backtracking regexes of a request
+	OnTimeout         string        `yaml:"on_timeout"`         // fail_closed (block, the default), fail_open or score
+	TimeoutScore      int           `yaml:"timeout_score"`      // added by "score" to the score and the CRS inbound anomaly score
+
+	// PCREFallback runs @rx patterns RE2 rejects on the backtracking engine;
+	// off, the rules using them stay disabled
+	PCREFallback bool `yaml:"pcre_fallback"`
+}
+
+// CollectionsConfig selects where persistent collections (IP, SESSION, ...) live
+type CollectionsConfig struct {
+	Backend       string        `yaml:"backend"` // "memory" or "file"
+	Path          string        `yaml:"path"`    // journal of the file backend
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+	DefaultTTL    time.Duration `yaml:"default_ttl"` // expiry of variables set without expirevar, 0 = never
+	MaxEntries    int           `yaml:"max_entries"` // least recently written variables are evicted beyond it, 0 = no limit
+}
+
+// LoggingConfig controls the process log and per-request debug tracing of
+// rule evaluation. Tracing is off unless a request carries a valid signed
+// X-WAF-Debug header (see `waf debug-token`) or is picked by sampling.
+type LoggingConfig struct {
+	Level           string  `yaml:"level"`             // debug, info, warn or error
+	Format          string  `yaml:"format"`            // text or json
+	DebugSecret     string  `yaml:"debug_secret"`      // HMAC key of X-WAF-Debug tokens, empty disables them
+	DebugSampleRate float64 `yaml:"debug_sample_rate"` // fraction of requests traced, e.g. 0.001
+
+	Output     utils.SinkConfig `yaml:"output"`      // process log, stderr by default
+	RequestLog utils.SinkConfig `yaml:"request_log"` // one JSON line per inspected request
+}
+
+// DefaultConfig returns the configuration used without a config file
+func DefaultConfig() Config {
+	return Config{
+		Listen:   ":8080",
+		RulesDir: "parsed_rules",
+		Collections: CollectionsConfig{
+			Backend:       "memory",
+			Path:          "collections.db",
+			SweepInterval: time.Minute,
+			DefaultTTL:    24 * time.Hour,
+			MaxEntries:    1_000_000,
+		},
+		Logging: LoggingConfig{
+			Level:      "info",
+			Format:     "text",
+			Output:     utils.SinkConfig{Type: "stderr"},
+			RequestLog: utils.SinkConfig{Type: "file", Path: "waf.log"},
+		},
+		AuditLog: utils.AuditConfig{
+			Engine:     "off",
+			Parts:      "ABFHZ",
+			Type:       "serial",
+			Format:     "native",
+			Path:       "audit.log",
+			StorageDir: "audit",
+			BodyLimit:  8 << 10,
+		},
+		Redaction: utils.DefaultRedaction(),
+		Regex:     defaultRegexConfig(),
+		TX:        defaultTX(),
+	}
+}
+
+// LoadConfig reads a YAML config file on top of DefaultConfig
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = yaml.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// openCollectionStore creates the configured collection backend
+func openCollectionStore(cfg CollectionsConfig) (collections.Store, error) {
+	limits := collections.Limits{DefaultTTL: cfg.DefaultTTL, MaxEntries: cfg.MaxEntries}
+	switch cfg.Backend {
+	case "", "memory":
+		store := collections.NewMemoryStore(cfg.SweepInterval)
+		store.SetLimits(limits)
+		return store, nil
+	case "file":
+		store, err := collections.OpenFileStore(cfg.Path, cfg.SweepInterval)
+		if err != nil {
+			return nil, err
+		}
+		store.SetLimits(limits)
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown collections backend %q", cfg.Backend)
+	}
+}
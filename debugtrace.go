@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Per-request debug tracing
+// ==========================
+
+// debugHeader carries a signed token that turns on tracing for one request:
+// "<expiry unix seconds>.<hex HMAC-SHA256 of the expiry>"
+const debugHeader = "X-WAF-Debug"
+
+// debugTracing decides which requests get a rule evaluation trace
+type debugTracing struct {
+	secret     []byte
+	sampleRate float64
+}
+
+// SetDebugTracing enables tracing for requests with a valid debug token
+// signed with secret, and for a sampleRate fraction of all requests
+func (e *Evaluator) SetDebugTracing(secret string, sampleRate float64) {
+	e.tracing = debugTracing{secret: []byte(secret), sampleRate: sampleRate}
+}
+
+// tracer returns the trace logger of a request, nil when it is not traced
+func (t debugTracing) tracer(req *Request) *slog.Logger {
+	reason := ""
+	switch {
+	case len(t.secret) > 0 && validDebugToken(t.secret, req.Headers[strings.ToLower(debugHeader)], time.Now()):
+		reason = "header"
+	case t.sampleRate > 0 && rand.Float64() < t.sampleRate:
+		reason = "sampled"
+	default:
+		return nil
+	}
+	return utils.TraceLogger().With("trace", reason, "method", req.Method, "path", req.Path)
+}
+
+// signDebugToken creates a token that is valid until expiry
+func signDebugToken(secret []byte, expiry time.Time) string {
+	ts := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	return ts + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validDebugToken checks the signature and expiry of a token
+func validDebugToken(secret []byte, token string, now time.Time) bool {
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	expiry, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || now.Unix() > expiry {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// runDebugToken prints an X-WAF-Debug header for the configured secret
+func runDebugToken(args []string) {
+	fs := flag.NewFlagSet("debug-token", flag.ExitOnError)
+	configPath := fs.String("config", "", "YAML config file with logging.debug_secret")
+	secret := fs.String("secret", "", "debug secret (overrides the config file)")
+	ttl := fs.Duration("ttl", 10*time.Minute, "how long the token stays valid")
+	_ = fs.Parse(args)
+
+	if *secret == "" {
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("❌ Failed to load config: %v", err)
+		}
+		*secret = cfg.Logging.DebugSecret
+	}
+	if *secret == "" {
+		fmt.Fprintln(os.Stderr, "no debug secret: pass -secret or set logging.debug_secret")
+		os.Exit(2)
+	}
+	fmt.Printf("%s: %s\n", debugHeader, signDebugToken([]byte(*secret), time.Now().Add(*ttl)))
+}
@@ -2,18 +2,16 @@ package main
 
 import (
 	"fmt"
+	"log/slog"
+
 	"waf-engine/mainWAF/rules"
 	"waf-engine/mainWAF/utils"
 )
 
 func CheckAgainstRules(tx *Transaction, variable, value string) {
 	for _, rule := range rules.AllRules {
-		fmt.Printf("\n=== Rule Evaluation ===\n")
-		fmt.Printf("Rule ID: %s | Name: %s | Variable: %s | Regex: %s\n", rule.ID, rule.Name, variable, rule.Regex)
-		fmt.Printf("Target Value: %s\n", value)
-
 		if utils.MatchRegex(rule.Regex, value) {
-			fmt.Printf("✅ MATCHED Rule %s (ID %s) on value: %s\n", rule.Name, rule.ID, value)
+			slog.Debug("legacy rule check matched", "rule", rule.ID, "variable", variable)
 
 			msg := fmt.Sprintf("[Rule %s] %s matched in %s: %q",
 				rule.ID, rule.Name, variable, value)
@@ -31,8 +29,6 @@ func CheckAgainstRules(tx *Transaction, variable, value string) {
 			if rule.Block {
 				tx.Block = true
 			}
-		} else {
-			fmt.Printf("❌ No match for Rule %s (ID %s)\n", rule.Name, rule.ID)
 		}
 	}
 }
@@ -2,12 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"waf-engine/mainWAF/collections"
 	"waf-engine/mainWAF/rules"
 	"waf-engine/mainWAF/utils"
 )
@@ -15,6 +23,7 @@ import (
 type Request struct {
 	Method       string
 	Path         string
+	ClientIP     string
 	Query        map[string][]string
 	Headers      map[string]string
 	Body         map[string]any
@@ -28,6 +37,29 @@ type Transaction struct {
 	CriticalScore int      // critical rule score
 	Block         bool
 	Critical      int // should block request
+
+	TX             map[string]string // transaction variables set with setvar:tx.name=value
+	Collections    map[string]string // persistent collections opened by initcol: name -> key
+	MatchedVar     string            // value of the last matched variable
+	MatchedVarName string            // name of the last matched variable
+
+	tracer *slog.Logger // set when rule evaluation of this request is traced
+
+	// Operator inputs of the rule being evaluated, kept for the profiler
+	inputs, inputBytes, maxInput int
+
+	literalsFound map[prefilterKey][]uint64 // prefilter scans of this request
+	view          *requestView              // collections shared by all rules
+
+	regexTime    time.Duration // spent in backtracking regexes
+	regexFailure *regexFailure // set once a regex hit a time limit
+}
+
+// trace logs a rule evaluation step of a traced request
+func (tx *Transaction) trace(msg string, args ...any) {
+	if tx.tracer != nil {
+		tx.tracer.Debug(msg, args...)
+	}
 }
 
 // Decision struct for WAF response
@@ -38,217 +70,603 @@ type Decision struct {
 	MatchedRuleID string
 }
 
+// candidate is a single value produced by expanding a rule target, together
+// with the concrete variable it came from (e.g. "ARGS:user").
+type candidate struct {
+	Name  string
+	Value string
+}
+
+// phases lists the request/response phases in the order they are evaluated.
+var phases = []int{1, 2, 3, 4, 5}
+
+// rulePhase returns the phase a rule runs in; ModSecurity defaults to phase 2.
+func rulePhase(rule rules.Rule) int {
+	if rule.Phase == 0 {
+		return 2
+	}
+	return rule.Phase
+}
+
+// exclusions tracks ctl:ruleRemoveById / ctl:ruleRemoveTargetById actions
+// applied during a single request.
+type exclusions struct {
+	rules   map[string]bool
+	targets map[string][]string
+}
+
+// apply records the supported ctl actions of a matched rule.
+func (x *exclusions) apply(controls []string) {
+	for _, ctl := range controls {
+		name, arg, _ := strings.Cut(ctl, "=")
+		switch name {
+		case "ruleRemoveById":
+			for _, id := range strings.Fields(strings.ReplaceAll(arg, ",", " ")) {
+				x.rules[id] = true
+			}
+		case "ruleRemoveTargetById":
+			id, target, ok := strings.Cut(arg, ";")
+			if ok {
+				x.targets[id] = append(x.targets[id], target)
+			}
+		}
+	}
+}
+
+// removed reports whether the given variable was excluded for a rule.
+func (x *exclusions) removed(ruleID, name string) bool {
+	for _, target := range x.targets[ruleID] {
+		if strings.EqualFold(target, name) {
+			return true
+		}
+		// A bare collection (e.g. "ARGS") removes every member of it
+		if !strings.Contains(target, ":") && strings.HasPrefix(strings.ToUpper(name), strings.ToUpper(target)+":") {
+			return true
+		}
+	}
+	return false
+}
+
 // ==========================
 // Evaluator + Constructor
 // ==========================
 type Evaluator struct {
-	rules []rules.Rule
+	rules      []rules.Rule
+	plan       *rulePlan
+	store      collections.Store
+	tracing    debugTracing
+	profiler   atomic.Pointer[ruleProfiler] // nil unless profiling is on
+	prefilter  *prefilter                   // nil runs every operator
+	regex      regexLimits
+	txDefaults map[string]string // TX variables every transaction starts with
 }
 
 func NewEvaluator(rules []rules.Rule) *Evaluator {
-	fmt.Println("🔹 [DEBUG] NewEvaluator initialized with rules:", len(rules))
-	return &Evaluator{rules: rules}
+	slog.Debug("evaluator initialized", "rules", len(rules))
+	return &Evaluator{
+		rules:      rules,
+		plan:       buildPlan(rules),
+		store:      collections.NewMemoryStore(time.Minute),
+		prefilter:  buildPrefilter(rules),
+		regex:      regexLimitsOf(defaultRegexConfig()),
+		txDefaults: defaultTX(),
+	}
+}
+
+// SetPrefilter turns the regex prefilter on (the default) or off
+func (e *Evaluator) SetPrefilter(on bool) {
+	e.prefilter = nil
+	if on {
+		e.prefilter = buildPrefilter(e.rules)
+	}
+}
+
+// SetCollectionStore replaces the default in-memory store used for the
+// persistent IP/SESSION/USER/GLOBAL/RESOURCE collections
+func (e *Evaluator) SetCollectionStore(store collections.Store) {
+	e.store.Close()
+	e.store = store
 }
 
 // ==========================
 // InspectPhases (CRS style with variable expansion)
 // ==========================
 func (e *Evaluator) InspectPhases(req *Request) (Decision, []utils.MatchedRuleLog) {
-	fmt.Println("\n🔹 [DEBUG] InspectPhases called")
-	fmt.Printf("   Method=%s Path=%s\n", req.Method, req.Path)
+	return e.InspectUpToPhase(req, phases[len(phases)-1])
+}
 
+// InspectUpToPhase evaluates only the rules of phases 1..lastPhase, for
+// callers that never see later parts of the transaction (e.g. no body)
+func (e *Evaluator) InspectUpToPhase(req *Request, lastPhase int) (Decision, []utils.MatchedRuleLog) {
 	dec := Decision{Block: false, Score: 0, Message: ""}
+	tx := e.newTransaction()
+	tx.tracer = e.tracing.tracer(req)
+	tx.trace("inspection started", "last_phase", lastPhase)
 	firedRules := make(map[string]bool)
 	matchedRules := []utils.MatchedRuleLog{}
 
-	for _, rule := range e.rules {
-		if rule.Compiled == nil {
-			fmt.Printf("   ⚠️ Skipping Rule %s (no compiled regex)\n", rule.ID)
-			continue
+	excluded := &exclusions{rules: make(map[string]bool), targets: make(map[string][]string)}
+	profiler := e.profiler.Load()
+
+phaseLoop:
+	for _, phase := range phases {
+		if phase > lastPhase {
+			break
+		}
+		phaseStart := time.Now()
+		// skip / skipAfter only jump forward within the current phase
+		skipN, skipTo := 0, ""
+		for _, rule := range e.plan.phases[phase] {
+			if rule.Marker != "" {
+				if rule.Marker == skipTo {
+					skipTo = ""
+				}
+				continue
+			}
+			if excluded.rules[rule.ID] {
+				continue
+			}
+			if skipTo != "" {
+				continue
+			}
+			if skipN > 0 {
+				skipN--
+				continue
+			}
+			if rule.Op == nil {
+				tx.trace("rule skipped", "rule", rule.ID, "reason", "unsupported operator")
+				continue
+			}
+			if firedRules[rule.ID] {
+				continue
+			}
+			// None of the collections the rule reads are in this request
+			if rule.reads&tx.requestView(req).present == 0 {
+				tx.trace("rule skipped", "rule", rule.ID, "reason", "no inputs")
+				continue
+			}
+			ruleStart := time.Now()
+			tx.inputs, tx.inputBytes, tx.maxInput = 0, 0, 0
+			varName, c, matched := e.matchRule(rule, rule.ID, req, tx, excluded)
+			elapsed := time.Since(ruleStart)
+			evaluations, seconds := rule.metrics()
+			evaluations.Inc()
+			seconds.Add(elapsed.Seconds())
+			if profiler != nil {
+				profiler.stats(rule.Rule).record(elapsed, tx.inputs, tx.inputBytes, tx.maxInput)
+			}
+			entry, stop := e.regexFailed(rule, phase, req, tx, &dec)
+			if entry != nil {
+				matchedRules = append(matchedRules, *entry)
+			}
+			if stop {
+				phaseDuration.With(phaseLabels[phase]).Observe(time.Since(phaseStart).Seconds())
+				break phaseLoop
+			}
+			if !matched {
+				tx.trace("rule did not match", "rule", rule.ID, "phase", phase)
+				continue
+			}
+
+			tx.trace("rule matched", "rule", rule.ID, "phase", phase, "variable", c.Name, "value", utils.Redaction().MatchedData(c.Name, c.Value))
+			firedRules[rule.ID] = true
+			for _, r := range chainOf(rule.Rule) {
+				e.runActions(r, req, tx)
+				excluded.apply(r.Controls)
+				if r.Skip > 0 {
+					skipN = r.Skip
+				}
+				if r.SkipAfter != "" {
+					skipTo = r.SkipAfter
+				}
+			}
+
+			// Pass-through rules (exclusions, nolog state updates) neither score nor log
+			if rule.NoLog || (len(rule.Controls) > 0 && !rule.Block) {
+				continue
+			}
+
+			dec.Score++
+			if rule.Block {
+				dec.Block = true
+			}
+
+			matchedRules = append(matchedRules, utils.MatchedRuleLog{
+				RuleID:      rule.ID,
+				RuleName:    e.expandMacros(rule.Name, rule.Rule, req, tx),
+				Variable:    varName,
+				Parameter:   c.Name,
+				Severity:    rule.Severity,
+				Category:    rule.Category,
+				Block:       rule.Block,
+				Phase:       phase,
+				Operator:    rule.Regex,
+				MatchedData: utils.Redaction().MatchedData(c.Name, c.Value),
+				Tags:        rule.Tags,
+				Description: fmt.Sprintf("%s by rule %s: %s in %s",
+					func() string {
+						if rule.Block {
+							return "🚫 Blocked"
+						} else {
+							return "⚠️ Detected"
+						}
+					}(),
+					rule.ID, rule.Name, varName),
+			})
 		}
+		phaseDuration.With(phaseLabels[phase]).Observe(time.Since(phaseStart).Seconds())
+	}
+
+	tx.trace("inspection finished", "score", dec.Score, "block", dec.Block)
+	recordDecision(dec, matchedRules)
+	return dec, matchedRules
+}
 
-		fmt.Printf("\n=== Rule Evaluation ===\n")
-		fmt.Printf("Rule ID: %s | Name: %s | Variable: %s | Regex: %s\n",
-			rule.ID, rule.Name, rule.Variable, rule.Regex)
+// matchRule evaluates a rule and, once it matched, every rule chained to it.
+// It returns the target and candidate that matched the rule itself; the
+// target/exclusion checks of chained rules use the id of the chain starter.
+func (e *Evaluator) matchRule(rule *planRule, id string, req *Request, tx *Transaction, excluded *exclusions) (string, candidate, bool) {
+	if rule.Op == nil {
+		return "", candidate{}, false
+	}
+	arg := rule.Op.Arg
+	if rule.Op.Macros {
+		arg = e.expandMacros(arg, rule.Rule, req, tx)
+	}
 
-		varNames := strings.Split(rule.Variable, "|")
-		for _, varName := range varNames {
-			candidates := e.expandVariable(varName, req)
-			fmt.Printf("   ↪ Variable %s expanded to %d candidates: %v\n", varName, len(candidates), candidates)
+	// SecAction: no target, the operator runs once on an empty value
+	if rule.Variable == "" {
+		if !rule.Op.Match("", arg) {
+			return "", candidate{}, false
+		}
+		return "", candidate{}, e.matchChain(rule, id, req, tx, excluded)
+	}
 
-			for _, val := range candidates {
-				if val == "" {
-					continue
-				}
+	for _, target := range rule.targets {
+		candidates := e.candidates(target, req, tx)
+		tx.trace("variable expanded", "rule", id, "variable", target.name, "candidates", len(candidates))
 
-				if rule.Compiled.MatchString(val) && !firedRules[rule.ID] {
-					fmt.Printf("   ✅ MATCHED Rule %s (ID %s) on value: %s\n", rule.Name, rule.ID, val)
-					firedRules[rule.ID] = true
-					dec.Score++
-					if rule.Block {
-						dec.Block = true
-					}
-
-					matchedRules = append(matchedRules, utils.MatchedRuleLog{
-						RuleID:   rule.ID,
-						RuleName: rule.Name,
-						Variable: varName,
-						Block:    rule.Block,
-						Description: fmt.Sprintf("%s by rule %s: %s in %s",
-							func() string {
-								if rule.Block {
-									return "🚫 Blocked"
-								} else {
-									return "⚠️ Detected"
-								}
-							}(),
-							rule.ID, rule.Name, varName),
-					})
-				} else {
-					fmt.Printf("   ❌ No match for Rule %s (ID %s) on value: %s\n", rule.Name, rule.ID, val)
+		for _, c := range candidates {
+			if c.Value == "" || excluded.removed(id, c.Name) || isSkipped(rule.skipped, c.Name) {
+				continue
+			}
+			// The operator sees the transformed value (t:lowercase, t:urlDecodeUni, ...)
+			c.Value = utils.ApplyTransforms(rule.Transforms, c.Value)
+			if !e.prefilter.mayMatch(rule.Op, c.Value, tx) {
+				continue
+			}
+			tx.inputs++
+			tx.inputBytes += len(c.Value)
+			tx.maxInput = max(tx.maxInput, len(c.Value))
+			matched, err := e.matchOperator(rule.Op, c.Value, arg, tx)
+			if err != nil {
+				if tx.regexFailure == nil {
+					tx.regexFailure = &regexFailure{variable: c.Name, err: err}
 				}
+				continue
+			}
+			if !matched {
+				continue
 			}
+			tx.MatchedVar, tx.MatchedVarName = c.Value, c.Name
+			return target.name, c, e.matchChain(rule, id, req, tx, excluded)
 		}
 	}
+	return "", candidate{}, false
+}
 
-	fmt.Printf("✅ [DEBUG] InspectPhases finished. Score=%d Block=%v\n", dec.Score, dec.Block)
-	return dec, matchedRules
+// matchChain reports whether every rule chained to rule matches as well
+func (e *Evaluator) matchChain(rule *planRule, id string, req *Request, tx *Transaction, excluded *exclusions) bool {
+	for _, link := range rule.chain {
+		if _, _, ok := e.matchRule(link, id, req, tx, excluded); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// chainOf flattens a rule and the rules chained to it, in evaluation order
+func chainOf(rule rules.Rule) []rules.Rule {
+	out := []rules.Rule{rule}
+	for _, link := range rule.Chain {
+		out = append(out, chainOf(link)...)
+	}
+	return out
+}
+
+func isSkipped(skipped []string, name string) bool {
+	for _, s := range skipped {
+		if strings.EqualFold(s, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // ==========================
-// HTTPHandler (flatten and normalize correctly)
+// BuildRequest (flatten and normalize correctly)
 // ==========================
-func HTTPHandler(eval *Evaluator) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("\n================ New Request ================")
-		method, _, _, _, _ := utils.NormalizeHTTP(r)
-		fmt.Printf("🔹 [DEBUG] HTTPHandler received %s %s\n", method, r.RequestURI)
+func BuildRequest(r *http.Request) *Request {
+	method, _, _, _, _ := utils.NormalizeHTTP(r)
+
+	uri := r.RequestURI
+	if uri == "" {
+		// Client-side requests (replay, HAR) have no RequestURI set
+		uri = r.URL.RequestURI()
+	}
+
+	clientIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	req := &Request{
+		Method:       method,
+		Path:         uri,
+		ClientIP:     clientIP,
+		Query:        make(map[string][]string),
+		Headers:      make(map[string]string),
+		Body:         make(map[string]any),
+		FlattenCache: make(map[string][]string),
+	}
+
+	// Query parameters
+	qParams, _ := url.ParseQuery(r.URL.RawQuery)
+	req.addQuery(qParams)
 
-		req := &Request{
-			Method:       method,
-			Path:         r.RequestURI,
-			Query:        make(map[string][]string),
-			Headers:      make(map[string]string),
-			Body:         make(map[string]any),
-			FlattenCache: make(map[string][]string),
+	// Body
+	// Hand-built requests may carry no body at all
+	if (r.Method == http.MethodPost || r.Method == http.MethodPut) && r.Body != nil {
+		bodyBytes, err := io.ReadAll(r.Body)
+		if err != nil {
+			bodyParseErrors.With("read").Inc()
 		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		req.addBody(bodyBytes, r.Header.Get("Content-Type"))
+	}
 
-		// Query parameters
-		qParams, _ := url.ParseQuery(r.URL.RawQuery)
-		for k, v := range qParams {
+	// Headers
+	for k, v := range r.Header {
+		if len(v) > 0 {
+			req.Headers[strings.ToLower(k)] = v[0]
+			req.FlattenCache["REQUEST_HEADERS:"+strings.ToLower(k)] = []string{v[0]}
+		}
+	}
+
+	// net/http moves the Host header out of r.Header
+	if r.Host != "" {
+		req.Headers["host"] = r.Host
+		req.FlattenCache["REQUEST_HEADERS:host"] = []string{r.Host}
+	}
+
+	// Cookies
+	for _, c := range r.Cookies() {
+		req.Body["REQUEST_COOKIES:"+c.Name] = c.Value
+		req.FlattenCache["REQUEST_COOKIES:"+c.Name] = []string{c.Value}
+	}
+
+	// Request URI
+	req.FlattenCache["REQUEST_URI"] = []string{req.Path}
+	req.FlattenCache["REQUEST_URI_RAW"] = []string{uri}
+	req.FlattenCache["REQUEST_LINE"] = []string{r.Method + " " + uri + " " + r.Proto}
+	req.FlattenCache["REQUEST_FILENAME"] = []string{r.URL.Path}
+	req.FlattenCache["REQUEST_BASENAME"] = []string{basename(r.URL.Path)}
+	req.FlattenCache["REQUEST_PROTOCOL"] = []string{r.Proto}
+	if r.URL.RawQuery != "" {
+		req.FlattenCache["QUERY_STRING"] = []string{r.URL.RawQuery}
+	}
+	if req.ClientIP != "" {
+		req.FlattenCache["REMOTE_ADDR"] = []string{req.ClientIP}
+	}
+
+	return req
+}
+
+// addQuery adds the query string parameters as ARGS and ARGS_GET
+func (req *Request) addQuery(query map[string][]string) {
+	for k, v := range query {
+		req.Query[k] = v
+		req.Body[k] = strings.Join(v, ",")
+		req.FlattenCache["ARGS:"+k] = v
+		req.FlattenCache["ARGS_GET:"+k] = v
+	}
+}
+
+// basename returns the last segment of a URL path, e.g. "login.php"
+func basename(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+// addBody adds the request body as REQUEST_BODY and its parameters as
+// ARGS: JSON bodies as ARGS:json.path.to.value, URL-encoded forms by field
+// name. Live and ingested requests both go through here, so a replayed
+// request is inspected like the one served.
+func (req *Request) addBody(body []byte, contentType string) {
+	req.Body["_raw"] = string(body)
+	req.FlattenCache["REQUEST_BODY"] = []string{string(body)}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasSuffix(mediaType, "json"):
+		var doc any
+		if err := json.Unmarshal(body, &doc); err != nil {
+			bodyParseErrors.With("json").Inc()
+			return
+		}
+		for k, v := range utils.JSONArgs(doc) {
+			req.FlattenCache["ARGS:"+k] = []string{v}
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			bodyParseErrors.With("form").Inc()
+		}
+		for k, v := range form {
 			req.Query[k] = v
-			req.Body[k] = strings.Join(v, ",")
 			req.FlattenCache["ARGS:"+k] = v
-			fmt.Printf("   ↪ Parsed query param %s=%v\n", k, v)
 		}
+	}
+}
 
-		// Body
-		if r.Method == http.MethodPost || r.Method == http.MethodPut {
-			bodyBytes, _ := io.ReadAll(r.Body)
-			r.Body.Close()
-			r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			req.Body["_raw"] = string(bodyBytes)
-			req.FlattenCache["REQUEST_BODY"] = []string{string(bodyBytes)}
-			fmt.Printf("   📦 Raw body: %s\n", string(bodyBytes))
+// ==========================
+// NewRequestFromIngest (JSON-ingested events)
+// ==========================
+func NewRequestFromIngest(in *utils.Ingest) *Request {
+	method, path, query, headers, body, _ := utils.NormalizeIngest(in)
 
-			_ = r.ParseForm()
-			for k, v := range r.PostForm {
-				req.Query[k] = v
-				req.FlattenCache["ARGS:"+k] = v
-				fmt.Printf("   ↪ Parsed form field %s=%v\n", k, v)
-			}
+	// HTTP/2 pseudo-headers are not headers; ":authority" stands in for Host
+	for k, v := range headers {
+		if !strings.HasPrefix(k, ":") {
+			continue
+		}
+		if k == ":authority" && headers["host"] == "" {
+			headers["host"] = v
 		}
+		delete(headers, k)
+	}
 
-		// Headers
-		for k, v := range r.Header {
-			if len(v) > 0 {
-				req.Headers[strings.ToLower(k)] = v[0]
-				req.FlattenCache["REQUEST_HEADERS:"+strings.ToLower(k)] = []string{v[0]}
-				fmt.Printf("   ↪ Header %s=%s\n", strings.ToLower(k), v[0])
-			}
+	// The path may carry its own query string in addition to the query map
+	filename, rawQuery, _ := strings.Cut(path, "?")
+	if qParams, err := url.ParseQuery(rawQuery); err == nil {
+		for k, v := range qParams {
+			query[k] = append(query[k], v...)
 		}
+	}
+
+	uri := filename
+	if len(query) > 0 {
+		uri += "?" + url.Values(query).Encode()
+	}
+
+	req := &Request{
+		Method:       method,
+		Path:         uri,
+		ClientIP:     in.ClientIP,
+		Query:        make(map[string][]string),
+		Headers:      headers,
+		Body:         make(map[string]any),
+		FlattenCache: make(map[string][]string),
+	}
 
-		// Cookies
-		for _, c := range r.Cookies() {
+	req.addQuery(query)
+
+	// The body of an event is a JSON document, inspected like a JSON
+	// request body
+	if len(body) > 0 {
+		raw, _ := json.Marshal(body)
+		req.addBody(raw, "application/json")
+	}
+
+	for k, v := range headers {
+		req.FlattenCache["REQUEST_HEADERS:"+k] = []string{v}
+	}
+
+	if cookie, ok := headers["cookie"]; ok {
+		cookies, _ := http.ParseCookie(cookie)
+		for _, c := range cookies {
 			req.Body["REQUEST_COOKIES:"+c.Name] = c.Value
 			req.FlattenCache["REQUEST_COOKIES:"+c.Name] = []string{c.Value}
-			fmt.Printf("   🍪 Cookie %s=%s\n", c.Name, c.Value)
 		}
+	}
+
+	// Events carry no protocol version, so there is no REQUEST_LINE
+	req.FlattenCache["REQUEST_URI"] = []string{req.Path}
+	req.FlattenCache["REQUEST_URI_RAW"] = []string{in.Path}
+	req.FlattenCache["REQUEST_FILENAME"] = []string{filename}
+	req.FlattenCache["REQUEST_BASENAME"] = []string{basename(filename)}
+	if _, query, ok := strings.Cut(req.Path, "?"); ok {
+		req.FlattenCache["QUERY_STRING"] = []string{query}
+	}
+	if req.ClientIP != "" {
+		req.FlattenCache["REMOTE_ADDR"] = []string{req.ClientIP}
+	}
+	return req
+}
 
-		// Request URI
-		req.FlattenCache["REQUEST_URI"] = []string{req.Path}
-		fmt.Printf("   🌐 Request URI stored: %s\n", req.Path)
+// ==========================
+// HTTPHandler
+// ==========================
+func HTTPHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := BuildRequest(r)
 
 		// Inspect request
 		dec, matchedRules := eval.InspectPhases(req)
 
 		// Structured logging
-		utils.LogRequest(
-			r.RemoteAddr,
-			req.Method,
-			req.Path,
-			matchedRules,
-			dec.Score,
-			dec.Block,
-		)
+		logTransaction(r.RemoteAddr, req, dec, matchedRules)
 
 		// Respond
 		if dec.Block {
-			fmt.Println("🚫 [DEBUG] Blocking request due to rule match")
 			http.Error(w, "🚫 Request blocked by WAF", http.StatusForbidden)
 			return
 		}
 
-		fmt.Printf("✅ [DEBUG] Allowed request. Final Score=%d, Matches=%d\n", dec.Score, len(matchedRules))
 		fmt.Fprintf(w, "✅ Allowed. Score=%d. MatchedRules=%d", dec.Score, len(matchedRules))
 	})
 }
 
 // ==========================
-// expandVariable helper
+// Variable helpers
 // ==========================
-func (e *Evaluator) expandVariable(variable string, req *Request) []string {
-	upper := strings.ToUpper(variable)
-	fmt.Printf("   🔎 [DEBUG] expandVariable called for %s\n", variable)
 
-	switch {
-	case upper == "ARGS":
-		var out []string
-		for k, vs := range req.FlattenCache {
-			if strings.HasPrefix(k, "ARGS:") || (strings.HasPrefix(k, "BODY:") && k != "_raw") {
-				out = append(out, vs...)
-			}
+// txCandidates reads TX:name (or the whole TX collection) of the transaction
+func txCandidates(variable string, tx *Transaction) []candidate {
+	if _, name, ok := strings.Cut(variable, ":"); ok {
+		name = strings.ToLower(name)
+		if v, ok := tx.TX[name]; ok {
+			return []candidate{{Name: "TX:" + name, Value: v}}
 		}
-		return out
+		return nil
+	}
 
-	case upper == "ARGS_NAMES":
-		var out []string
-		for k := range req.FlattenCache {
-			if strings.HasPrefix(k, "ARGS:") || (strings.HasPrefix(k, "BODY:") && k != "_raw") {
-				name := strings.TrimPrefix(k, "ARGS:")
-				name = strings.TrimPrefix(name, "BODY:")
-				out = append(out, name)
-			}
-		}
-		return out
+	names := make([]string, 0, len(tx.TX))
+	for n := range tx.TX {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	out := make([]candidate, 0, len(names))
+	for _, n := range names {
+		out = append(out, candidate{Name: "TX:" + n, Value: tx.TX[n]})
+	}
+	return out
+}
 
-	case upper == "REQUEST_BODY":
-		return req.FlattenCache["_raw"]
+// collectionCandidates reads IP:name (or the whole IP collection) from the
+// persistent store; collections not opened with initcol are empty
+func (e *Evaluator) collectionCandidates(variable string, tx *Transaction) []candidate {
+	col, name, _ := strings.Cut(variable, ":")
+	key, ok := tx.Collections[col]
+	if !ok {
+		return nil
+	}
 
-	case strings.HasPrefix(upper, "REQUEST_HEADERS"), strings.HasPrefix(upper, "REQUEST_COOKIES"):
-		if vals, ok := req.FlattenCache[variable]; ok {
-			return vals
+	if name != "" {
+		if v, ok := e.store.Get(col, key, name); ok {
+			return []candidate{{Name: col + ":" + strings.ToLower(name), Value: v}}
 		}
 		return nil
+	}
 
-	case upper == "REQUEST_URI":
-		return req.FlattenCache["REQUEST_URI"]
+	all := e.store.All(col, key)
+	names := make([]string, 0, len(all))
+	for n := range all {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	out := make([]candidate, 0, len(names))
+	for _, n := range names {
+		out = append(out, candidate{Name: col + ":" + n, Value: all[n]})
+	}
+	return out
+}
 
-	default:
-		var out []string
-		for _, vs := range req.FlattenCache {
-			out = append(out, vs...)
-		}
-		return out
+// candidatesOf pairs every value with the variable name it was read from.
+func candidatesOf(name string, values []string) []candidate {
+	out := make([]candidate, 0, len(values))
+	for _, v := range values {
+		out = append(out, candidate{Name: name, Value: v})
 	}
+	return out
 }
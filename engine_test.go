@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+func TestMain(m *testing.M) {
+	// Handlers write every request to the request log
+	utils.Logger = log.New(io.Discard, "", 0)
+	// A short match timeout for the regex limit tests; regexp2 reads its
+	// check period concurrently once matching started, so it is set here
+	utils.SetRegexTimeout(5 * time.Millisecond)
+	os.Exit(m.Run())
+}
+
+// loadTestRules loads YAML rules the way `waf serve` does, from a
+// temporary rules directory
+func loadTestRules(t testing.TB, yamlRules string) []rules.Rule {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rules_test.yaml"), []byte(yamlRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules.AllRules = nil
+	defer func() { rules.AllRules = nil }()
+	if err := rules.LoadRules(dir); err != nil {
+		t.Fatalf("loading rules: %v", err)
+	}
+	return rules.AllRules
+}
+
+// matches returns rule@parameter of every rule the request matched
+func matches(eval *Evaluator, r *http.Request) []string {
+	_, matched := eval.InspectPhases(BuildRequest(r))
+	ids := make([]string, 0, len(matched))
+	for _, m := range matched {
+		ids = append(ids, m.RuleID+"@"+m.Parameter)
+	}
+	return ids
+}
+
+const xssRule = `
+- id: "100"
+  name: XSS in arguments
+  variable: ARGS
+  regex: (?i)<script
+  phase: 2
+  block: true
+`
+
+func TestInspectRecordsMatchedParameter(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	got := matches(eval, httptest.NewRequest(http.MethodGet, "/search?page=1&q=%3Cscript%3E", nil))
+	if strings.Join(got, ",") != "100@ARGS:q" {
+		t.Fatalf("matched %v, want rule 100 on ARGS:q", got)
+	}
+}
+
+func TestPhasesRunInOrder(t *testing.T) {
+	// The exclusion comes after the rule it removes in file order, but runs
+	// first because it is a phase-1 rule
+	eval := NewEvaluator(loadTestRules(t, xssRule+`
+- id: "9000"
+  name: remove rule 100 on /preview
+  variable: REQUEST_FILENAME
+  regex: ^/preview$
+  phase: 1
+  controls: [ruleRemoveById=100]
+`))
+	if got := matches(eval, httptest.NewRequest(http.MethodGet, "/preview?q=%3Cscript%3E", nil)); len(got) != 0 {
+		t.Errorf("/preview matched %v, want rule 100 removed", got)
+	}
+	if got := matches(eval, httptest.NewRequest(http.MethodGet, "/search?q=%3Cscript%3E", nil)); len(got) != 1 {
+		t.Errorf("/search matched %v, want rule 100", got)
+	}
+}
+
+func TestInspectUpToPhase(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	req := BuildRequest(httptest.NewRequest(http.MethodGet, "/search?q=%3Cscript%3E", nil))
+	if dec, _ := eval.InspectUpToPhase(req, 1); dec.Block || dec.Score != 0 {
+		t.Errorf("phase 1 only: %+v, want no phase-2 rule evaluated", dec)
+	}
+	if dec, _ := eval.InspectUpToPhase(req, 2); !dec.Block {
+		t.Errorf("up to phase 2: %+v, want blocked", dec)
+	}
+}
+
+// matchedIDs returns the IDs of the rules a GET of target matched
+func matchedIDs(eval *Evaluator, target string) []string {
+	var ids []string
+	for _, m := range matches(eval, httptest.NewRequest(http.MethodGet, target, nil)) {
+		id, _, _ := strings.Cut(m, "@")
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSkip(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "1"
+  variable: ARGS:skip
+  regex: "@streq 1"
+  phase: 2
+  skip: 2
+- marker: NOT-COUNTED
+- id: "2"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+  chain:
+    - variable: REQUEST_METHOD
+      regex: "@unconditionalMatch"
+- id: "3"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+- id: "4"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+- id: "5"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+`))
+	if got := matchedIDs(eval, "/"); !reflect.DeepEqual(got, []string{"3", "2", "4", "5"}) {
+		t.Errorf("without skip: matched %v", got)
+	}
+	// Markers and the rules of other phases are not counted, a chain is one rule
+	if got := matchedIDs(eval, "/?skip=1"); !reflect.DeepEqual(got, []string{"3", "1", "5"}) {
+		t.Errorf("skip:2 matched %v, want rules 2 and 4 skipped", got)
+	}
+}
+
+func TestSkipAfter(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "10"
+  variable: ARGS:to
+  regex: "@streq same"
+  phase: 2
+  skip_after: END-SAME
+- id: "11"
+  variable: ARGS:to
+  regex: "@streq later"
+  phase: 1
+  skip_after: END-LATER
+- id: "12"
+  variable: ARGS:to
+  regex: "@streq missing"
+  phase: 2
+  skip_after: NOWHERE
+- id: "20"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+- id: "21"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+- marker: END-SAME
+- id: "22"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+- id: "23"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+- marker: END-LATER
+- id: "24"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 1
+- id: "25"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+- id: "26"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 3
+`))
+	for _, tc := range []struct {
+		name, target string
+		want         []string
+	}{
+		{"no jump", "/", []string{"21", "23", "24", "20", "22", "25", "26"}},
+		{"marker in the same phase", "/?to=same", []string{"21", "23", "24", "10", "22", "25", "26"}},
+		// The phase-1 jump passes END-SAME and stops at END-LATER; the
+		// phase-2 rules before END-LATER still run
+		{"marker after rules of a later phase", "/?to=later", []string{"11", "24", "20", "22", "25", "26"}},
+		// Without its marker the jump ends with the phase
+		{"missing marker", "/?to=missing", []string{"21", "23", "24", "12", "26"}},
+	} {
+		if got := matchedIDs(eval, tc.target); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: matched %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSkipAfterInChain(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "30"
+  variable: ARGS:a
+  regex: "@streq 1"
+  phase: 2
+  chain:
+    - variable: ARGS:b
+      regex: "@streq 1"
+      skip_after: END
+- id: "31"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+- marker: END
+- id: "32"
+  variable: REQUEST_METHOD
+  regex: "@unconditionalMatch"
+  phase: 2
+`))
+	// The skipAfter of a chain link applies once the whole chain matched
+	if got := matchedIDs(eval, "/?a=1&b=1"); !reflect.DeepEqual(got, []string{"30", "32"}) {
+		t.Errorf("whole chain: matched %v, want rule 31 skipped", got)
+	}
+	if got := matchedIDs(eval, "/?a=1"); !reflect.DeepEqual(got, []string{"31", "32"}) {
+		t.Errorf("chain starter only: matched %v, want no jump", got)
+	}
+
+	// A marker cannot be a chain link: no skipAfter could land inside a chain
+	dir := t.TempDir()
+	yaml := `
+- id: "40"
+  variable: ARGS:a
+  regex: "@streq 1"
+  phase: 2
+  chain:
+    - marker: INSIDE
+`
+	if err := os.WriteFile(filepath.Join(dir, "rules_test.yaml"), []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rules.AllRules = nil
+	defer func() { rules.AllRules = nil }()
+	if err := rules.LoadRules(dir); err == nil || !strings.Contains(err.Error(), `marker "INSIDE" inside a chain`) {
+		t.Errorf("marker as a chain link: err = %v", err)
+	}
+}
+
+func TestConditionVerdicts(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "200"
+  name: admin area without the admin role
+  phase: 1
+  block: true
+  when:
+    all:
+      - path: /admin/**
+      - not: {header: X-Role, equals: admin}
+- id: "201"
+  name: debug switch or trace
+  phase: 2
+  when:
+    any:
+      - {arg: debug, present: true}
+      - method: TRACE
+- id: "202"
+  name: admin role set from outside the office
+  phase: 2
+  block: true
+  when:
+    all:
+      - {json: /user/role, equals: admin}
+      - not: {client_ip: 10.0.0.0/8}
+`))
+	request := func(method, target, role, ip, body string) *http.Request {
+		var r *http.Request
+		if body != "" {
+			r = httptest.NewRequest(method, target, strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		if role != "" {
+			r.Header.Set("X-Role", role)
+		}
+		if ip != "" {
+			r.RemoteAddr = ip + ":1234"
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		name  string
+		r     *http.Request
+		block bool
+		want  []string
+	}{
+		// not: {header: X-Role, equals: admin} holds for an absent header
+		{"admin area without header", request(http.MethodGet, "/admin/users", "", "", ""), true, []string{"200"}},
+		{"admin area as user", request(http.MethodGet, "/admin/users", "user", "", ""), true, []string{"200"}},
+		{"admin area as admin", request(http.MethodGet, "/admin/users", "admin", "", ""), false, nil},
+		{"outside the admin area", request(http.MethodGet, "/public", "", "", ""), false, nil},
+		{"debug argument", request(http.MethodGet, "/?debug=1", "", "", ""), false, []string{"201"}},
+		{"trace", request(http.MethodTrace, "/", "", "", ""), false, []string{"201"}},
+		{"role from outside", request(http.MethodPost, "/profile", "", "192.0.2.1", `{"user":{"role":"admin"}}`), true, []string{"202"}},
+		{"role from the office", request(http.MethodPost, "/profile", "", "10.1.2.3", `{"user":{"role":"admin"}}`), false, nil},
+		{"other role", request(http.MethodPost, "/profile", "", "192.0.2.1", `{"user":{"role":"user"}}`), false, nil},
+	} {
+		dec, matched := eval.InspectPhases(BuildRequest(tc.r))
+		var got []string
+		for _, m := range matched {
+			got = append(got, m.RuleID)
+		}
+		if dec.Block != tc.block || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: blocked %v by %v, want %v by %v", tc.name, dec.Block, got, tc.block, tc.want)
+		}
+	}
+}
+
+func TestVirtualPatch(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "300"
+  name: order lookup
+  phase: 2
+  virtual_patch:
+    method: GET
+    path: /api/orders/*
+    params:
+      id:   {type: int, required: true, min: 1, max: 1000}
+      sort: {pattern: "^(asc|desc)$"}
+      q:    {max_length: 8}
+`))
+	for _, tc := range []struct {
+		method, target string
+		violation      string // "" when allowed
+	}{
+		{http.MethodGet, "/api/orders/1?id=5", ""},
+		{http.MethodGet, "/api/orders/1?id=1000&sort=asc&q=shoes", ""},
+		{http.MethodGet, "/api/orders/1?id=5&debug=1", "undeclared parameter"},
+		{http.MethodGet, "/api/orders/1?sort=asc", "missing parameter id"},
+		{http.MethodGet, "/api/orders/1?id=abc", "parameter id is not of type int"},
+		{http.MethodGet, "/api/orders/1?id=5&id=x", "parameter id is not of type int"},
+		{http.MethodGet, "/api/orders/1?id=5&sort=random", "parameter sort does not match its pattern"},
+		{http.MethodGet, "/api/orders/1?id=5&q=123456789", "parameter q is longer than 8"},
+		{http.MethodGet, "/api/orders/1?id=0", "parameter id is below 1"},
+		{http.MethodGet, "/api/orders/1?id=1001", "parameter id is above 1000"},
+		// the path is normalized before the endpoint is matched
+		{http.MethodGet, "/api//orders/1?id=x", "parameter id is not of type int"},
+		{http.MethodGet, "/api/orders/./1?id=x", "parameter id is not of type int"},
+		{http.MethodGet, "/api/x/../orders/1?id=x", "parameter id is not of type int"},
+		{http.MethodGet, "/api/orders/1/?id=x", "parameter id is not of type int"},
+		// other endpoints are not constrained
+		{http.MethodGet, "/api/orders/1/items?id=x", ""},
+		{http.MethodGet, "/api/users/1?id=x", ""},
+		{http.MethodPost, "/api/orders/1?id=x", ""},
+	} {
+		dec, matched := eval.InspectPhases(BuildRequest(httptest.NewRequest(tc.method, tc.target, nil)))
+		if tc.violation == "" {
+			if dec.Block || len(matched) != 0 {
+				t.Errorf("%s %s: blocked %v by %+v, want allowed", tc.method, tc.target, dec.Block, matched)
+			}
+			continue
+		}
+		if !dec.Block || len(matched) != 1 || matched[0].RuleName != "order lookup ("+tc.violation+")" {
+			t.Errorf("%s %s: blocked %v by %+v, want %s", tc.method, tc.target, dec.Block, matched, tc.violation)
+		}
+	}
+}
+
+// TestTuneExclusionsApply checks that the rules `waf tune` proposes remove
+// the excluded rule or target on their path only
+func TestTuneExclusionsApply(t *testing.T) {
+	ranked := []*tuneGroup{
+		{tuneKey: tuneKey{RuleID: "100", Path: "/cms/save", Parameter: "ARGS:content"}},
+		{tuneKey: tuneKey{RuleID: "100", Path: "/preview"}},
+	}
+	var proposed bytes.Buffer
+	if err := writeExclusions(&proposed, ranked, 9000); err != nil {
+		t.Fatal(err)
+	}
+	eval := NewEvaluator(loadTestRules(t, xssRule+proposed.String()))
+
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{"/cms/save?content=%3Cscript%3E", ""},
+		{"/cms/save?content=%3Cscript%3E&title=%3Cscript%3E", "100@ARGS:title"},
+		{"/cms/other?content=%3Cscript%3E", "100@ARGS:content"},
+		{"/preview?content=%3Cscript%3E&title=%3Cscript%3E", ""},
+	} {
+		got := strings.Join(matches(eval, httptest.NewRequest(http.MethodGet, tc.target, nil)), ",")
+		if got != tc.want {
+			t.Errorf("%s: matched %q, want %q", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestExclusionsRemoved(t *testing.T) {
+	x := &exclusions{rules: make(map[string]bool), targets: make(map[string][]string)}
+	x.apply([]string{"ruleRemoveById=1, 2", "ruleRemoveTargetById=3;ARGS:pass", "ruleRemoveTargetById=4;REQUEST_COOKIES", "ruleRemoveTargetById=5"})
+
+	if !x.rules["1"] || !x.rules["2"] {
+		t.Errorf("rules removed: %v, want 1 and 2", x.rules)
+	}
+	for _, tc := range []struct {
+		id, name string
+		want     bool
+	}{
+		{"3", "ARGS:pass", true},
+		{"3", "args:PASS", true},
+		{"3", "ARGS:password", false},
+		{"4", "REQUEST_COOKIES:session", true},
+		{"4", "REQUEST_COOKIES_NAMES:session", false},
+		{"5", "ARGS:pass", false},
+	} {
+		if got := x.removed(tc.id, tc.name); got != tc.want {
+			t.Errorf("removed(%s, %s) = %v, want %v", tc.id, tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestIngestArgsMatchLive checks that an ingested event yields the same
+// ARGS, and so the same verdict, as the request it was recorded from
+func TestIngestArgsMatchLive(t *testing.T) {
+	const body = `{"name":"<script>","items":[{"sku":"A-1"}],"gift":true}`
+	r := httptest.NewRequest(http.MethodPost, "/api/orders?debug=1", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	live := BuildRequest(r)
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	ingested := NewRequestFromIngest(&utils.Ingest{
+		Method:  "POST",
+		Path:    "/api/orders",
+		Query:   map[string][]string{"debug": {"1"}},
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    doc,
+	})
+
+	args := func(req *Request) map[string][]string {
+		out := make(map[string][]string)
+		for k, v := range req.FlattenCache {
+			if strings.HasPrefix(k, "ARGS:") {
+				out[k] = v
+			}
+		}
+		return out
+	}
+	if got, want := args(ingested), args(live); !reflect.DeepEqual(got, want) {
+		t.Errorf("ingested ARGS %v, want %v as served", got, want)
+	}
+
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	_, liveMatched := eval.InspectPhases(live)
+	_, ingestMatched := eval.InspectPhases(ingested)
+	if len(liveMatched) != 1 || len(ingestMatched) != 1 || liveMatched[0].Parameter != ingestMatched[0].Parameter {
+		t.Errorf("ingested matched %+v, served matched %+v", ingestMatched, liveMatched)
+	}
+}
+
+func TestFormBodyArgs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/login?next=%2Fhome", strings.NewReader("user=alice&pass=x%27+or+1%3D1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req := BuildRequest(r)
+	for name, want := range map[string]string{"ARGS:next": "/home", "ARGS:user": "alice", "ARGS:pass": "x' or 1=1"} {
+		if got := req.FlattenCache[name]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTXDefaults(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "911100"
+  name: Method is not allowed by policy
+  variable: REQUEST_METHOD
+  regex: '!@within %{tx.allowed_methods}'
+  phase: 1
+  block: true
+`))
+	for method, want := range map[string]int{"GET": 0, "OPTIONS": 0, "DELETE": 1} {
+		if got := matches(eval, httptest.NewRequest(method, "/", nil)); len(got) != want {
+			t.Errorf("%s with the CRS defaults matched %v", method, got)
+		}
+	}
+
+	eval.SetTXDefaults(map[string]string{"Allowed_Methods": "GET DELETE"})
+	if got := matches(eval, httptest.NewRequest(http.MethodDelete, "/", nil)); len(got) != 0 {
+		t.Errorf("DELETE allowed by tx.allowed_methods matched %v", got)
+	}
+	if got := matches(eval, httptest.NewRequest(http.MethodPost, "/", nil)); len(got) != 1 {
+		t.Errorf("POST no longer allowed matched %v, want rule 911100", got)
+	}
+}
+
+// crsScoringRules are CRS-style attack rules that add to the inbound
+// anomaly score, in the files CRS keeps them in
+var crsScoringRules = map[string]string{
+	"REQUEST-920-PROTOCOL-ENFORCEMENT.conf": `
+SecRule REQUEST_HEADERS:X-Evil "@rx ." \
+    "id:920999,phase:1,block,msg:'Evil header',severity:'CRITICAL',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+`,
+	"REQUEST-941-APPLICATION-ATTACK-XSS.conf": `
+SecRule ARGS "@rx (?i)<script" \
+    "id:941100,phase:2,block,msg:'XSS script tag',severity:'CRITICAL',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+SecRule ARGS "@rx (?i)javascript:" \
+    "id:941200,phase:2,block,msg:'javascript URI',severity:'WARNING',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.warning_anomaly_score}'"
+SecRule ARGS "@rx (?i)onerror" \
+    "id:941210,phase:2,block,msg:'event handler',severity:'WARNING',chain"
+    SecRule MATCHED_VAR "@rx =" \
+        "setvar:'tx.inbound_anomaly_score_pl1=+%{tx.warning_anomaly_score}'"
+SecRule ARGS:deny "@streq 1" "id:941999,phase:2,deny,msg:'explicit deny'"
+`,
+	"REQUEST-949-BLOCKING-EVALUATION.conf": `
+SecMarker "BEGIN-REQUEST-BLOCKING-EVAL"
+SecAction "id:949051,phase:1,pass,nolog,setvar:'tx.blocking_inbound_anomaly_score=0'"
+SecAction "id:949052,phase:2,pass,nolog,setvar:'tx.blocking_inbound_anomaly_score=0'"
+SecRule TX:BLOCKING_PARANOIA_LEVEL "@ge 1" \
+    "id:949050,phase:1,pass,nolog,setvar:'tx.blocking_inbound_anomaly_score=+%{tx.inbound_anomaly_score_pl1}'"
+SecRule TX:BLOCKING_PARANOIA_LEVEL "@ge 1" \
+    "id:949060,phase:2,pass,nolog,setvar:'tx.blocking_inbound_anomaly_score=+%{tx.inbound_anomaly_score_pl1}'"
+SecRule TX:BLOCKING_PARANOIA_LEVEL "@ge 2" \
+    "id:949061,phase:2,pass,nolog,setvar:'tx.blocking_inbound_anomaly_score=+%{tx.inbound_anomaly_score_pl2}'"
+SecRule TX:BLOCKING_INBOUND_ANOMALY_SCORE "@ge %{tx.inbound_anomaly_score_threshold}" \
+    "id:949110,phase:2,deny,t:none,msg:'Inbound Anomaly Score Exceeded (Total Score: %{TX.BLOCKING_INBOUND_ANOMALY_SCORE})',\
+    tag:'anomaly-evaluation',severity:'CRITICAL'"
+SecRule TX:EARLY_BLOCKING "@eq 1" \
+    "id:949111,phase:1,deny,t:none,msg:'Inbound Anomaly Score Exceeded in phase 1',severity:'CRITICAL',chain"
+    SecRule TX:BLOCKING_INBOUND_ANOMALY_SCORE "@ge %{tx.inbound_anomaly_score_threshold}" "t:none"
+SecMarker "END-REQUEST-949-BLOCKING-EVALUATION"
+`,
+}
+
+func TestCRSAnomalyScoring(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range crsScoringRules {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules.AllRules = nil
+	defer func() { rules.AllRules = nil }()
+	if err := rules.LoadRules(dir); err != nil {
+		t.Fatal(err)
+	}
+	eval := NewEvaluator(rules.AllRules)
+
+	check := func(name string, r *http.Request, wantBlock bool, wantRules ...string) {
+		t.Helper()
+		dec, matched := eval.InspectPhases(BuildRequest(r))
+		var got []string
+		for _, m := range matched {
+			got = append(got, m.RuleID)
+		}
+		if dec.Block != wantBlock || !reflect.DeepEqual(got, wantRules) {
+			t.Errorf("%s: blocked %v by %v, want %v by %v", name, dec.Block, got, wantBlock, wantRules)
+		}
+	}
+
+	// A warning (3) stays under the threshold of 5, two of them do not
+	check("one warning", httptest.NewRequest(http.MethodGet, "/?q=javascript:x", nil), false, "941200")
+	check("two warnings", httptest.NewRequest(http.MethodGet, "/?q=javascript:x&r=onerror%3D1", nil), true,
+		"941200", "941210", "949110")
+	check("critical", httptest.NewRequest(http.MethodGet, "/?q=%3Cscript%3E", nil), true, "941100", "949110")
+	// deny does not wait for the evaluation
+	check("deny", httptest.NewRequest(http.MethodGet, "/?deny=1", nil), true, "941999")
+
+	evil := httptest.NewRequest(http.MethodGet, "/", nil)
+	evil.Header.Set("X-Evil", "1")
+	check("phase-1 score blocked in phase 2", evil, true, "920999", "949110")
+
+	tx := defaultTX()
+	tx["early_blocking"] = "1"
+	eval.SetTXDefaults(tx)
+	// Evaluation goes on after a block, so 949110 reports the score again
+	check("early blocking", evil, true, "920999", "949111", "949110")
+
+	tx = defaultTX()
+	tx["inbound_anomaly_score_threshold"] = "10"
+	eval.SetTXDefaults(tx)
+	check("raised threshold", httptest.NewRequest(http.MethodGet, "/?q=%3Cscript%3E", nil), false, "941100")
+}
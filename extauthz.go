@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ==========================
+// Envoy ext_authz (gRPC + HTTP)
+// ==========================
+// Envoy's external authorization filter asks the WAF for a verdict before
+// routing a request. Both transports are served on the main listener: the
+// gRPC service over h2c and the HTTP service under extAuthzHTTPPrefix.
+
+const (
+	extAuthzGRPCPath   = "/envoy.service.auth.v3.Authorization/Check"
+	extAuthzHTTPPrefix = "/ext_authz"
+
+	// maxGRPCMessage matches the default gRPC receive limit (4 MB)
+	maxGRPCMessage = 4 << 20
+
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+)
+
+// checkAttributes holds the parts of envoy.service.auth.v3.CheckRequest
+// the engine needs
+type checkAttributes struct {
+	SourceAddress string
+	SourcePort    uint64
+	Method        string
+	Path          string
+	Host          string
+	Scheme        string
+	Headers       map[string]string
+	Body          []byte
+}
+
+// ==========================
+// CheckRequest decoding
+// ==========================
+
+// decodeCheckRequest parses CheckRequest -> AttributeContext
+func decodeCheckRequest(b []byte) (*checkAttributes, error) {
+	attrs := &checkAttributes{Headers: make(map[string]string)}
+
+	fields, err := decodeProto(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if f.Num == 1 && f.Type == wireBytes { // CheckRequest.attributes
+			if err := attrs.decodeAttributeContext(f.Bytes); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return attrs, nil
+}
+
+func (a *checkAttributes) decodeAttributeContext(b []byte) error {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == wireBytes: // source Peer
+			if err := a.decodePeer(f.Bytes); err != nil {
+				return err
+			}
+		case f.Num == 4 && f.Type == wireBytes: // request Request
+			reqFields, err := decodeProto(f.Bytes)
+			if err != nil {
+				return err
+			}
+			for _, rf := range reqFields {
+				if rf.Num == 2 && rf.Type == wireBytes { // Request.http
+					if err := a.decodeHTTPRequest(rf.Bytes); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodePeer reads Peer.address.socket_address
+func (a *checkAttributes) decodePeer(b []byte) error {
+	peer, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	for _, pf := range peer {
+		if pf.Num != 1 || pf.Type != wireBytes { // Peer.address
+			continue
+		}
+		addr, err := decodeProto(pf.Bytes)
+		if err != nil {
+			return err
+		}
+		for _, af := range addr {
+			if af.Num != 1 || af.Type != wireBytes { // Address.socket_address
+				continue
+			}
+			sock, err := decodeProto(af.Bytes)
+			if err != nil {
+				return err
+			}
+			for _, sf := range sock {
+				switch {
+				case sf.Num == 2 && sf.Type == wireBytes:
+					a.SourceAddress = string(sf.Bytes)
+				case sf.Num == 3 && sf.Type == wireVarint:
+					a.SourcePort = sf.Varint
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// decodeHTTPRequest reads AttributeContext.HttpRequest
+func (a *checkAttributes) decodeHTTPRequest(b []byte) error {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	for _, f := range fields {
+		if f.Type != wireBytes {
+			continue
+		}
+		switch f.Num {
+		case 2:
+			a.Method = string(f.Bytes)
+		case 3: // map<string, string> headers
+			k, v, err := decodeStringPair(f.Bytes)
+			if err != nil {
+				return err
+			}
+			a.Headers[k] = v
+		case 4:
+			a.Path = string(f.Bytes)
+		case 5:
+			a.Host = string(f.Bytes)
+		case 6:
+			a.Scheme = string(f.Bytes)
+		case 11: // body (UTF-8)
+			body = f.Bytes
+		case 12: // raw_body, preferred when Envoy packs the body as bytes
+			a.Body = f.Bytes
+		case 13: // header_map, used instead of headers with encode_raw_headers
+			hm, err := decodeProto(f.Bytes)
+			if err != nil {
+				return err
+			}
+			for _, hf := range hm {
+				if hf.Num != 1 || hf.Type != wireBytes {
+					continue
+				}
+				if err := a.decodeHeaderValue(hf.Bytes); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if a.Body == nil {
+		a.Body = body
+	}
+	return nil
+}
+
+// decodeHeaderValue reads config.core.v3.HeaderValue {key, value, raw_value}
+func (a *checkAttributes) decodeHeaderValue(b []byte) error {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return err
+	}
+	var key, value string
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == wireBytes:
+			key = string(f.Bytes)
+		case (f.Num == 2 || f.Num == 3) && f.Type == wireBytes:
+			value = string(f.Bytes)
+		}
+	}
+	if prev, ok := a.Headers[key]; ok {
+		value = prev + "," + value
+	}
+	a.Headers[key] = value
+	return nil
+}
+
+// decodeStringPair reads a map<string, string> entry
+func decodeStringPair(b []byte) (key, value string, err error) {
+	fields, err := decodeProto(b)
+	if err != nil {
+		return "", "", err
+	}
+	for _, f := range fields {
+		switch {
+		case f.Num == 1 && f.Type == wireBytes:
+			key = string(f.Bytes)
+		case f.Num == 2 && f.Type == wireBytes:
+			value = string(f.Bytes)
+		}
+	}
+	return key, value, nil
+}
+
+// httpRequest rebuilds the original request as seen by Envoy
+func (a *checkAttributes) httpRequest() (*http.Request, error) {
+	method := a.Method
+	if method == "" {
+		method = a.Headers[":method"]
+	}
+	path := a.Path
+	if path == "" {
+		path = a.Headers[":path"]
+	}
+	host := a.Host
+	if host == "" {
+		host = a.Headers[":authority"]
+	}
+
+	r, err := http.NewRequest(method, path, bytes.NewReader(a.Body))
+	if err != nil {
+		return nil, err
+	}
+	r.RequestURI = path
+	r.Host = host
+	for k, v := range a.Headers {
+		// Pseudo-headers (":method", ":path", ...) were consumed above
+		if strings.HasPrefix(k, ":") {
+			continue
+		}
+		r.Header.Set(k, v)
+	}
+	if a.SourceAddress != "" {
+		r.RemoteAddr = net.JoinHostPort(a.SourceAddress, strconv.FormatUint(a.SourcePort, 10))
+	}
+	return r, nil
+}
+
+// encodeCheckRequest is the inverse of decodeCheckRequest, for clients
+// such as `waf extauthz-check`
+func encodeCheckRequest(a *checkAttributes) []byte {
+	httpMsg := protoMessage{}.
+		appendString(2, a.Method).
+		appendString(4, a.Path).
+		appendString(5, a.Host).
+		appendString(6, a.Scheme).
+		appendString(10, "HTTP/1.1")
+	names := make([]string, 0, len(a.Headers))
+	for k := range a.Headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		httpMsg = httpMsg.appendMapEntry(3, k, a.Headers[k])
+	}
+	if len(a.Body) > 0 {
+		httpMsg = httpMsg.appendBytes(12, a.Body)
+	}
+
+	sock := protoMessage{}.appendString(2, a.SourceAddress).appendVarint(3, a.SourcePort)
+	peer := protoMessage{}.appendBytes(1, protoMessage{}.appendBytes(1, sock))
+	attrs := protoMessage{}.
+		appendBytes(1, peer).
+		appendBytes(4, protoMessage{}.appendBytes(2, httpMsg))
+	return protoMessage{}.appendBytes(1, attrs)
+}
+
+// ==========================
+// CheckResponse encoding
+// ==========================
+
+// encodeCheckResponse builds an allow (OkHttpResponse) or deny
+// (DeniedHttpResponse, 403) answer carrying the verdict headers
+func encodeCheckResponse(dec Decision, headers http.Header) []byte {
+	var options []protoMessage
+	for k, vs := range headers {
+		for _, v := range vs {
+			hv := protoMessage{}.appendString(1, strings.ToLower(k)).appendString(2, v)
+			options = append(options, protoMessage{}.appendBytes(1, hv)) // HeaderValueOption.header
+		}
+	}
+
+	code := grpcOK
+	if dec.Block {
+		code = grpcPermissionDenied
+	}
+	status := protoMessage{}.appendVarint(1, uint64(code))
+	resp := protoMessage{}.appendBytes(1, status)
+
+	if dec.Block {
+		httpStatus := protoMessage{}.appendVarint(1, http.StatusForbidden)
+		denied := protoMessage{}.appendBytes(1, httpStatus)
+		for _, opt := range options {
+			denied = denied.appendBytes(2, opt)
+		}
+		denied = denied.appendString(3, "Request blocked by WAF")
+		return resp.appendBytes(2, denied)
+	}
+
+	ok := protoMessage{}
+	for _, opt := range options {
+		ok = ok.appendBytes(2, opt)
+	}
+	return resp.appendBytes(3, ok)
+}
+
+// ==========================
+// gRPC transport
+// ==========================
+
+// readGRPCMessage reads one length-prefixed, uncompressed gRPC message
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxGRPCMessage {
+		return nil, fmt.Errorf("gRPC message of %d bytes exceeds limit", size)
+	}
+	msg := make([]byte, size)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// grpcStatus finishes a gRPC response with only a status (no message)
+func grpcStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ExtAuthzGRPCHandler implements envoy.service.auth.v3.Authorization/Check
+func ExtAuthzGRPCHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.URL.Path != extAuthzGRPCPath {
+			grpcStatus(w, grpcUnimplemented, "unknown method "+r.URL.Path)
+			return
+		}
+
+		msg, err := readGRPCMessage(r.Body)
+		if err != nil {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		attrs, err := decodeCheckRequest(msg)
+		if err != nil {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		httpReq, err := attrs.httpRequest()
+		if err != nil {
+			grpcStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		dec, headers := checkRequest(eval, httpReq)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		if err := writeGRPCMessage(w, encodeCheckResponse(dec, headers)); err != nil {
+			slog.Warn("ext_authz: failed to write response", "err", err)
+			return
+		}
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcOK))
+	})
+}
+
+// ==========================
+// HTTP transport
+// ==========================
+
+// ExtAuthzHTTPHandler implements Envoy's HTTP authorization service: the
+// original request is forwarded with its path prefixed by extAuthzHTTPPrefix
+// (configure the same value as path_prefix in Envoy)
+func ExtAuthzHTTPHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		original := strings.TrimPrefix(r.RequestURI, extAuthzHTTPPrefix)
+		if original == "" || original[0] != '/' {
+			original = "/" + original
+		}
+		u, err := url.ParseRequestURI(original)
+		if err != nil {
+			http.Error(w, "invalid original URI", http.StatusBadRequest)
+			return
+		}
+		r.URL = u
+		r.RequestURI = original
+
+		dec, headers := checkRequest(eval, r)
+		for k, vs := range headers {
+			w.Header()[k] = vs
+		}
+		if dec.Block {
+			http.Error(w, "Request blocked by WAF", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// checkRequest inspects and logs an authorization request and returns the
+// decision together with the X-WAF-* headers describing it
+func checkRequest(eval *Evaluator, r *http.Request) (Decision, http.Header) {
+	req := BuildRequest(r)
+	dec, matchedRules := eval.InspectPhases(req)
+	logTransaction(r.RemoteAddr, req, dec, matchedRules)
+	return dec, verdictHeaders(dec, matchedRules)
+}
+
+// ==========================
+// Local test harness (waf extauthz-check)
+// ==========================
+
+// headerFlags collects repeated -H "Name: value" flags
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+// runExtAuthzCheck sends a CheckRequest to the gRPC service over h2c and
+// prints the decoded verdict, without needing an Envoy in front
+func runExtAuthzCheck(args []string) {
+	fs := flag.NewFlagSet("extauthz-check", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "WAF listener")
+	method := fs.String("method", "GET", "original request method")
+	path := fs.String("path", "/", "original request path including query")
+	host := fs.String("host", "example.com", "original request host")
+	body := fs.String("body", "", "original request body")
+	source := fs.String("source", "127.0.0.1", "downstream client address")
+	var headers headerFlags
+	fs.Var(&headers, "H", "original request header \"Name: value\" (repeatable)")
+	_ = fs.Parse(args)
+
+	attrs := &checkAttributes{
+		SourceAddress: *source,
+		SourcePort:    40000,
+		Method:        *method,
+		Path:          *path,
+		Host:          *host,
+		Scheme:        "http",
+		Headers:       map[string]string{":method": *method, ":path": *path, ":authority": *host},
+		Body:          []byte(*body),
+	}
+	for _, h := range headers {
+		k, v, _ := strings.Cut(h, ":")
+		attrs.Headers[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(v)
+	}
+	checkReq := encodeCheckRequest(attrs)
+
+	var frame bytes.Buffer
+	_ = writeGRPCMessage(&frame, checkReq)
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: tr}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://"+*addr+extAuthzGRPCPath, &frame)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("❌ Check call failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	msg, err := readGRPCMessage(resp.Body)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		log.Fatalf("❌ No CheckResponse (grpc-status=%s %s): %v",
+			resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"), err)
+	}
+	printCheckResponse(os.Stdout, msg, resp.Trailer.Get("Grpc-Status"))
+}
+
+// printCheckResponse decodes a CheckResponse for humans
+func printCheckResponse(w io.Writer, msg []byte, grpcCode string) {
+	fmt.Fprintf(w, "grpc-status: %s\n", grpcCode)
+	fields, err := decodeProto(msg)
+	if err != nil {
+		fmt.Fprintf(w, "invalid CheckResponse: %v\n", err)
+		return
+	}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			st, _ := decodeProto(f.Bytes)
+			code := uint64(0)
+			for _, sf := range st {
+				if sf.Num == 1 {
+					code = sf.Varint
+				}
+			}
+			fmt.Fprintf(w, "status.code: %d\n", code)
+		case 2, 3:
+			kind := map[int]string{2: "denied_response", 3: "ok_response"}[f.Num]
+			fmt.Fprintln(w, kind+":")
+			sub, _ := decodeProto(f.Bytes)
+			for _, sf := range sub {
+				switch {
+				case sf.Num == 2: // HeaderValueOption
+					opt, _ := decodeProto(sf.Bytes)
+					for _, of := range opt {
+						if of.Num == 1 {
+							k, v, _ := decodeStringPair(of.Bytes)
+							fmt.Fprintf(w, "  header %s: %s\n", k, v)
+						}
+					}
+				case f.Num == 2 && sf.Num == 1:
+					hs, _ := decodeProto(sf.Bytes)
+					for _, hf := range hs {
+						fmt.Fprintf(w, "  http status: %d\n", hf.Varint)
+					}
+				case f.Num == 2 && sf.Num == 3:
+					fmt.Fprintf(w, "  body: %s\n", sf.Bytes)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCheckRequestRoundTrip(t *testing.T) {
+	want := &checkAttributes{
+		SourceAddress: "203.0.113.7",
+		SourcePort:    51234,
+		Method:        "POST",
+		Path:          "/login?next=%2F",
+		Host:          "shop.example.com",
+		Scheme:        "https",
+		Headers:       map[string]string{":method": "POST", "content-type": "application/x-www-form-urlencoded"},
+		Body:          []byte("user=alice"),
+	}
+	got, err := decodeCheckRequest(encodeCheckRequest(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeCheckRequestHeaderMap(t *testing.T) {
+	// With encode_raw_headers Envoy sends header_map (13) instead of
+	// headers (3); repeated headers are joined
+	headerMap := protoMessage{}.
+		appendBytes(1, protoMessage{}.appendString(1, "accept").appendString(3, "text/html")).
+		appendBytes(1, protoMessage{}.appendString(1, "accept").appendString(3, "*/*"))
+	httpMsg := protoMessage{}.appendString(2, "GET").appendBytes(13, headerMap).appendString(11, "text body")
+	msg := protoMessage{}.appendBytes(1, protoMessage{}.appendBytes(4, protoMessage{}.appendBytes(2, httpMsg)))
+
+	attrs, err := decodeCheckRequest(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := attrs.Headers["accept"]; got != "text/html,*/*" {
+		t.Errorf("accept = %q, want both values", got)
+	}
+	if string(attrs.Body) != "text body" {
+		t.Errorf("body = %q, want the UTF-8 body", attrs.Body)
+	}
+}
+
+func TestDecodeCheckRequestMalformed(t *testing.T) {
+	// A length-delimited field whose contents are cut short, nested at
+	// every level of the message
+	bad := []byte{0x22, 0x05, 'G'}
+	for name, msg := range map[string][]byte{
+		"check request": bad,
+		"attributes":    protoMessage{}.appendBytes(1, bad),
+		"peer":          protoMessage{}.appendBytes(1, protoMessage{}.appendBytes(1, bad)),
+		"http request": protoMessage{}.appendBytes(1,
+			protoMessage{}.appendBytes(4, protoMessage{}.appendBytes(2, bad))),
+		"header entry": protoMessage{}.appendBytes(1,
+			protoMessage{}.appendBytes(4, protoMessage{}.appendBytes(2, protoMessage{}.appendBytes(3, bad)))),
+	} {
+		if _, err := decodeCheckRequest(msg); err == nil {
+			t.Errorf("%s: decoded a malformed message", name)
+		}
+	}
+
+	// Truncating a valid message anywhere must fail cleanly or decode a
+	// prefix of it, never panic
+	full := encodeCheckRequest(&checkAttributes{Method: "GET", Path: "/", Host: "example.com",
+		Headers: map[string]string{"user-agent": "curl"}, SourceAddress: "192.0.2.1", SourcePort: 443})
+	for n := range full {
+		_, _ = decodeCheckRequest(full[:n])
+	}
+}
+
+// newExtAuthzServer serves the gRPC handler over h2c, as `waf serve` does
+func newExtAuthzServer(t *testing.T) (*httptest.Server, *http.Client) {
+	t.Helper()
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	srv := httptest.NewUnstartedServer(ExtAuthzGRPCHandler(eval))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	tr := &http.Transport{Protocols: new(http.Protocols)}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(tr.CloseIdleConnections)
+	return srv, &http.Client{Transport: tr}
+}
+
+// callCheck posts one gRPC frame and returns the response with its body
+// read, so the trailers are available
+func callCheck(t *testing.T, srv *httptest.Server, client *http.Client, path, contentType string, frame []byte) (*http.Response, []byte) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader(frame))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("TE", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("served over %s, want HTTP/2", resp.Proto)
+	}
+	return resp, body
+}
+
+func grpcFrame(msg []byte) []byte {
+	var frame bytes.Buffer
+	_ = writeGRPCMessage(&frame, msg)
+	return frame.Bytes()
+}
+
+// checkVerdict is a decoded CheckResponse
+type checkVerdict struct {
+	code       uint64
+	denied     bool
+	httpStatus uint64
+	headers    map[string]string
+}
+
+func decodeCheckResponse(t *testing.T, msg []byte) checkVerdict {
+	t.Helper()
+	v := checkVerdict{headers: make(map[string]string)}
+	fields, err := decodeProto(msg)
+	if err != nil {
+		t.Fatalf("invalid CheckResponse: %v", err)
+	}
+	for _, f := range fields {
+		sub, err := decodeProto(f.Bytes)
+		if err != nil {
+			t.Fatalf("invalid CheckResponse field %d: %v", f.Num, err)
+		}
+		switch f.Num {
+		case 1: // status
+			for _, sf := range sub {
+				if sf.Num == 1 {
+					v.code = sf.Varint
+				}
+			}
+		case 2, 3: // denied_response, ok_response
+			v.denied = f.Num == 2
+			for _, sf := range sub {
+				switch {
+				case sf.Num == 2: // HeaderValueOption
+					opt, _ := decodeProto(sf.Bytes)
+					for _, of := range opt {
+						k, val, _ := decodeStringPair(of.Bytes)
+						v.headers[k] = val
+					}
+				case f.Num == 2 && sf.Num == 1:
+					st, _ := decodeProto(sf.Bytes)
+					for _, hf := range st {
+						v.httpStatus = hf.Varint
+					}
+				}
+			}
+		}
+	}
+	return v
+}
+
+func TestExtAuthzGRPCHandler(t *testing.T) {
+	srv, client := newExtAuthzServer(t)
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		code     uint64
+		headers  map[string]string
+		rulesHdr string
+	}{
+		{"allow", "/search?q=shoes", grpcOK, map[string]string{"x-waf-decision": "allow", "x-waf-score": "0"}, ""},
+		{"deny", "/search?q=%3Cscript%3E", grpcPermissionDenied, map[string]string{"x-waf-decision": "block", "x-waf-score": "1"}, "100"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := encodeCheckRequest(&checkAttributes{
+				SourceAddress: "192.0.2.10", SourcePort: 40000,
+				Method: "GET", Path: tc.path, Host: "shop.example.com",
+				Headers: map[string]string{"user-agent": "Mozilla/5.0"},
+			})
+			resp, body := callCheck(t, srv, client, extAuthzGRPCPath, "application/grpc", grpcFrame(msg))
+			if got := resp.Trailer.Get("Grpc-Status"); got != "0" {
+				t.Fatalf("grpc-status %q, want 0", got)
+			}
+			reply, err := readGRPCMessage(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := decodeCheckResponse(t, reply)
+			if v.code != tc.code || v.denied != (tc.code != grpcOK) {
+				t.Errorf("status %d denied=%v, want %d", v.code, v.denied, tc.code)
+			}
+			if v.denied && v.httpStatus != http.StatusForbidden {
+				t.Errorf("denied with HTTP %d, want 403", v.httpStatus)
+			}
+			for k, want := range tc.headers {
+				if v.headers[k] != want {
+					t.Errorf("%s = %q, want %q", k, v.headers[k], want)
+				}
+			}
+			if v.headers["x-waf-rules"] != tc.rulesHdr {
+				t.Errorf("x-waf-rules = %q, want %q", v.headers["x-waf-rules"], tc.rulesHdr)
+			}
+		})
+	}
+}
+
+func TestExtAuthzGRPCHandlerErrors(t *testing.T) {
+	srv, client := newExtAuthzServer(t)
+
+	truncatedFrame := make([]byte, 5, 15)
+	binary.BigEndian.PutUint32(truncatedFrame[1:], 100)
+	truncatedFrame = append(truncatedFrame, "0123456789"...)
+
+	for _, tc := range []struct {
+		name string
+		path string
+		ct   string
+		body []byte
+		code int // gRPC status; zero for a plain HTTP error
+		http int
+	}{
+		{"not grpc", extAuthzGRPCPath, "application/json", []byte("{}"), 0, http.StatusUnsupportedMediaType},
+		{"unknown method", "/envoy.service.auth.v3.Authorization/Other", "application/grpc", grpcFrame(nil), grpcUnimplemented, http.StatusOK},
+		{"empty stream", extAuthzGRPCPath, "application/grpc", nil, grpcInvalidArgument, http.StatusOK},
+		{"truncated frame", extAuthzGRPCPath, "application/grpc", truncatedFrame, grpcInvalidArgument, http.StatusOK},
+		{"compressed frame", extAuthzGRPCPath, "application/grpc", []byte{1, 0, 0, 0, 0}, grpcInvalidArgument, http.StatusOK},
+		{"oversized frame", extAuthzGRPCPath, "application/grpc", []byte{0, 0xff, 0xff, 0xff, 0xff}, grpcInvalidArgument, http.StatusOK},
+		{"malformed message", extAuthzGRPCPath, "application/grpc", grpcFrame([]byte{0x0a, 0x05, 0x22}), grpcInvalidArgument, http.StatusOK},
+		{"invalid method", extAuthzGRPCPath, "application/grpc+proto",
+			grpcFrame(encodeCheckRequest(&checkAttributes{Method: "BAD METHOD", Path: "/"})), grpcInvalidArgument, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, _ := callCheck(t, srv, client, tc.path, tc.ct, tc.body)
+			if resp.StatusCode != tc.http {
+				t.Fatalf("HTTP %d, want %d", resp.StatusCode, tc.http)
+			}
+			if tc.code == 0 {
+				return
+			}
+			// Errors are trailers-only responses: the status is in the headers
+			if got := resp.Header.Get("Grpc-Status"); got != strconv.Itoa(tc.code) {
+				t.Errorf("grpc-status %q (%s), want %d", got, resp.Header.Get("Grpc-Message"), tc.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+
+	"waf-engine/mainWAF/rules"
+)
+
+// ==========================
+// CRS regression tests in the go-ftw format (waf ftw)
+// ==========================
+
+// ftwFile is one go-ftw test file, e.g. tests/regression/tests/.../942100.yaml
+type ftwFile struct {
+	Meta struct {
+		Name    string `yaml:"name"`
+		Enabled *bool  `yaml:"enabled"`
+	} `yaml:"meta"`
+	RuleID int       `yaml:"rule_id"`
+	Tests  []ftwTest `yaml:"tests"`
+}
+
+type ftwTest struct {
+	Title  string     `yaml:"test_title"` // "942100-1" in older files
+	ID     int        `yaml:"test_id"`
+	Desc   string     `yaml:"desc"`
+	Stages []ftwStage `yaml:"stages"`
+}
+
+type ftwStage struct {
+	Input  ftwInput  `yaml:"input"`
+	Output ftwOutput `yaml:"output"`
+	Stage  *ftwStage `yaml:"stage"` // older files wrap input/output in "stage"
+}
+
+type ftwInput struct {
+	Method              *string           `yaml:"method"`
+	URI                 *string           `yaml:"uri"`
+	Version             *string           `yaml:"version"`
+	Headers             map[string]string `yaml:"headers"`
+	OrderedHeaders      []ftwHeader       `yaml:"ordered_headers"`
+	Data                ftwData           `yaml:"data"`
+	EncodedRequest      string            `yaml:"encoded_request"`
+	RawRequest          string            `yaml:"raw_request"`
+	AutocompleteHeaders *bool             `yaml:"autocomplete_headers"`
+}
+
+type ftwHeader struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type ftwOutput struct {
+	Status        ftwStatus `yaml:"status"`
+	LogContains   string    `yaml:"log_contains"`
+	NoLogContains string    `yaml:"no_log_contains"`
+	Log           struct {
+		ExpectIDs    []int  `yaml:"expect_ids"`
+		NoExpectIDs  []int  `yaml:"no_expect_ids"`
+		MatchRegex   string `yaml:"match_regex"`
+		NoMatchRegex string `yaml:"no_match_regex"`
+	} `yaml:"log"`
+	ExpectError bool `yaml:"expect_error"`
+}
+
+// ftwData is a request body given either as a string or as a list of lines
+type ftwData string
+
+func (d *ftwData) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.SequenceNode {
+		var lines []string
+		if err := n.Decode(&lines); err != nil {
+			return err
+		}
+		*d = ftwData(strings.Join(lines, "\r\n"))
+		return nil
+	}
+	var s string
+	err := n.Decode(&s)
+	*d = ftwData(s)
+	return err
+}
+
+// ftwStatus is the expected response status, a single code or a list
+type ftwStatus []int
+
+func (s *ftwStatus) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.SequenceNode {
+		return n.Decode((*[]int)(s))
+	}
+	var code int
+	if err := n.Decode(&code); err != nil {
+		return err
+	}
+	*s = ftwStatus{code}
+	return nil
+}
+
+// ftwResult is the outcome of one test (all of its stages)
+type ftwResult struct {
+	File    string   `json:"file"`
+	RuleID  string   `json:"rule_id"`
+	Test    string   `json:"test"`
+	Passed  bool     `json:"passed"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+func runFTW(args []string) {
+	fs := flag.NewFlagSet("ftw", flag.ExitOnError)
+	rulesDir := fs.String("rules", "parsed_rules", "directory with YAML or .conf rules")
+	only := fs.String("rule", "", "only run the tests of this rule id")
+	out := fs.String("out", "", "write every test result as JSON to this file")
+	verbose := fs.Bool("v", false, "print why each failed test failed")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: waf ftw [flags] tests_dir|test.yaml ...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := rules.LoadRules(*rulesDir); err != nil {
+		log.Fatalf("❌ Failed to load rules: %v", err)
+	}
+	eval := NewEvaluator(rules.AllRules)
+
+	var files []string
+	for _, arg := range fs.Args() {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && (filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml") {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatalf("❌ Failed to read %s: %v", arg, err)
+		}
+	}
+
+	var results []ftwResult
+	for _, path := range files {
+		rs, err := runFTWFile(eval, path, *only)
+		if err != nil {
+			log.Printf("⚠️ Skipping %s: %v", path, err)
+			continue
+		}
+		results = append(results, rs...)
+	}
+
+	if *out != "" {
+		data, _ := json.MarshalIndent(results, "", "  ")
+		if err := os.WriteFile(*out, append(data, '\n'), 0o644); err != nil {
+			log.Fatalf("❌ Failed to write %s: %v", *out, err)
+		}
+	}
+
+	failed := printFTWSummary(os.Stderr, results, rules.AllRules, *verbose)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runFTWFile runs every test of one file in-process
+func runFTWFile(eval *Evaluator, path, only string) ([]ftwResult, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f ftwFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f.Meta.Enabled != nil && !*f.Meta.Enabled {
+		return nil, nil
+	}
+
+	var out []ftwResult
+	for _, t := range f.Tests {
+		res := ftwResult{File: path, RuleID: ftwRuleID(f, t, path), Test: t.Title, Passed: true}
+		if res.Test == "" {
+			res.Test = fmt.Sprintf("%s-%d", res.RuleID, t.ID)
+		}
+		if only != "" && res.RuleID != only {
+			continue
+		}
+		for i, st := range t.Stages {
+			if st.Stage != nil {
+				st = *st.Stage
+			}
+			for _, reason := range runFTWStage(eval, st) {
+				res.Passed = false
+				res.Reasons = append(res.Reasons, fmt.Sprintf("stage %d: %s", i+1, reason))
+			}
+		}
+		out = append(out, res)
+	}
+	return out, nil
+}
+
+// ftwRuleID finds the rule a test belongs to: rule_id, the test title
+// prefix ("942100-1") or the file name ("942100.yaml")
+func ftwRuleID(f ftwFile, t ftwTest, path string) string {
+	if f.RuleID != 0 {
+		return strconv.Itoa(f.RuleID)
+	}
+	if id, _, ok := strings.Cut(t.Title, "-"); ok {
+		return id
+	}
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// runFTWStage sends one stage through the engine and returns the unmet
+// expectations
+func runFTWStage(eval *Evaluator, st ftwStage) []string {
+	r, err := ftwRequest(st.Input)
+	if err != nil {
+		if st.Output.ExpectError {
+			return nil
+		}
+		return []string{"request could not be built: " + err.Error()}
+	}
+	if st.Output.ExpectError {
+		return []string{"expected an error, the request was accepted"}
+	}
+
+	dec, matched := eval.InspectPhases(BuildRequest(r))
+	ids := make(map[int]bool)
+	var logLines []string
+	for _, m := range matched {
+		id, _ := strconv.Atoi(m.RuleID)
+		ids[id] = true
+		logLines = append(logLines, fmt.Sprintf("[id %q] [msg %q] [severity %q]", m.RuleID, m.RuleName, m.Severity))
+	}
+	logText := strings.Join(logLines, "\n")
+
+	var reasons []string
+	want := st.Output
+	for _, id := range want.Log.ExpectIDs {
+		if !ids[id] {
+			reasons = append(reasons, fmt.Sprintf("rule %d did not match", id))
+		}
+	}
+	for _, id := range want.Log.NoExpectIDs {
+		if ids[id] {
+			reasons = append(reasons, fmt.Sprintf("rule %d matched unexpectedly", id))
+		}
+	}
+	for _, c := range []struct {
+		pattern string
+		present bool
+	}{
+		{want.LogContains, true}, {want.Log.MatchRegex, true},
+		{want.NoLogContains, false}, {want.Log.NoMatchRegex, false},
+	} {
+		if c.pattern == "" {
+			continue
+		}
+		re, err := regexp.Compile(c.pattern)
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("invalid log pattern %q: %v", c.pattern, err))
+			continue
+		}
+		if re.MatchString(logText) != c.present {
+			reasons = append(reasons, fmt.Sprintf("log match %q: want %v", c.pattern, c.present))
+		}
+	}
+	if len(want.Status) > 0 {
+		status := http.StatusOK
+		if dec.Block {
+			status = http.StatusForbidden
+		}
+		ok := false
+		for _, s := range want.Status {
+			ok = ok || s == status
+		}
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("status %d, want %v", status, []int(want.Status)))
+		}
+	}
+	return reasons
+}
+
+// ftwRequest turns a test input into a server-side request, parsed by the
+// same HTTP reader a real listener would use
+func ftwRequest(in ftwInput) (*http.Request, error) {
+	raw := in.RawRequest
+	if in.EncodedRequest != "" {
+		b, err := base64.StdEncoding.DecodeString(in.EncodedRequest)
+		if err != nil {
+			return nil, fmt.Errorf("encoded_request: %w", err)
+		}
+		raw = string(b)
+	}
+	if raw == "" {
+		raw = ftwRawRequest(in)
+	}
+
+	r, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		return nil, err
+	}
+	// Buffer the body so the engine can read it after the parser
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(strings.NewReader(string(body)))
+	r.RemoteAddr = "127.0.0.1:0"
+	return r, nil
+}
+
+// ftwRawRequest renders the structured input as an HTTP/1.x request
+func ftwRawRequest(in ftwInput) string {
+	method, uri, version := "GET", "/", "HTTP/1.1"
+	if in.Method != nil {
+		method = *in.Method
+	}
+	if in.URI != nil {
+		uri = *in.URI
+	}
+	if in.Version != nil {
+		version = *in.Version
+	}
+
+	headers := append([]ftwHeader(nil), in.OrderedHeaders...)
+	names := make([]string, 0, len(in.Headers))
+	for name := range in.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		headers = append(headers, ftwHeader{Name: name, Value: in.Headers[name]})
+	}
+
+	data := string(in.Data)
+	if in.AutocompleteHeaders == nil || *in.AutocompleteHeaders {
+		hasLength := false
+		for _, h := range headers {
+			hasLength = hasLength || strings.EqualFold(h.Name, "Content-Length") || strings.EqualFold(h.Name, "Transfer-Encoding")
+		}
+		if data != "" && !hasLength {
+			headers = append(headers, ftwHeader{Name: "Content-Length", Value: strconv.Itoa(len(data))})
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\n", method, uri, version)
+	for _, h := range headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", h.Name, h.Value)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(data)
+	return b.String()
+}
+
+// printFTWSummary prints per-rule results and coverage of the loaded
+// ruleset; it returns the number of failed tests
+func printFTWSummary(w io.Writer, results []ftwResult, loaded []rules.Rule, verbose bool) int {
+	type ruleStats struct{ passed, failed int }
+	perRule := make(map[string]*ruleStats)
+	failed := 0
+	for _, r := range results {
+		st := perRule[r.RuleID]
+		if st == nil {
+			st = &ruleStats{}
+			perRule[r.RuleID] = st
+		}
+		if r.Passed {
+			st.passed++
+			continue
+		}
+		st.failed++
+		failed++
+		if verbose {
+			fmt.Fprintf(w, "FAIL %s (%s)\n", r.Test, r.File)
+			for _, reason := range r.Reasons {
+				fmt.Fprintf(w, "     %s\n", reason)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(perRule))
+	for id := range perRule {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nRULE\tTESTS\tPASSED\tFAILED")
+	for _, id := range ids {
+		st := perRule[id]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", id, st.passed+st.failed, st.passed, st.failed)
+	}
+	tw.Flush()
+
+	// when: and virtual_patch expand one rule into several entries, so the
+	// coverage counts rule IDs
+	total, tested, passing := 0, 0, 0
+	seen := make(map[string]bool, len(loaded))
+	for _, r := range loaded {
+		if r.ID == "" || seen[r.ID] {
+			continue
+		}
+		seen[r.ID] = true
+		total++
+		if st, ok := perRule[r.ID]; ok {
+			tested++
+			if st.failed == 0 {
+				passing++
+			}
+		}
+	}
+	fmt.Fprintf(w, "\nRan %d tests: %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	fmt.Fprintf(w, "Coverage: %d of %d loaded rules have tests (%s), %d pass all of them (%s)\n",
+		tested, total, percent(tested, total), passing, percent(passing, total))
+	return failed
+}
+
+func percent(n, total int) string {
+	if total == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"waf-engine/mainWAF/rules"
+)
+
+func TestFTWCoverageCountsRuleIDs(t *testing.T) {
+	// Rule 100 is loaded three times, as when: and virtual_patch expand it
+	loaded := []rules.Rule{{ID: "100"}, {ID: "100"}, {ID: "100"}, {ID: "200"}, {ID: "300"}, {ID: "300"}, {}}
+	results := []ftwResult{
+		{RuleID: "100", Test: "100-1", Passed: true},
+		{RuleID: "300", Test: "300-1", Passed: false},
+	}
+
+	var out strings.Builder
+	if failed := printFTWSummary(&out, results, loaded, false); failed != 1 {
+		t.Errorf("failed = %d, want 1", failed)
+	}
+	want := "Coverage: 2 of 3 loaded rules have tests (66.7%), 1 pass all of them (33.3%)"
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("summary:\n%s\nwant %q", out.String(), want)
+	}
+}
@@ -3,6 +3,6 @@ module waf-engine
 go 1.24.5
 
 require (
-	github.com/dlclark/regexp2 v1.11.5 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/dlclark/regexp2 v1.11.5
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Verdict API (/inspect, /inspect/batch)
+// ==========================
+
+const (
+	// maxInspectBatch caps how many events a single batch call may carry
+	maxInspectBatch = 100
+	// maxInspectBatchSize limits the size of a batch request body (16 MB)
+	maxInspectBatchSize = 16 << 20
+)
+
+// InspectResult is the verdict returned for one ingested event
+type InspectResult struct {
+	Decision     string                 `json:"decision"` // "allow" or "block"
+	Blocked      bool                   `json:"blocked"`
+	Score        int                    `json:"score"`
+	MatchedRules []utils.MatchedRuleLog `json:"matched_rules"`
+}
+
+// inspectError is returned instead of a verdict when the call is malformed
+type inspectError struct {
+	Error string `json:"error"`
+}
+
+// inspectIngest runs one ingested event through the engine and logs it
+func inspectIngest(eval *Evaluator, in *utils.Ingest, remoteAddr string) InspectResult {
+	req := NewRequestFromIngest(in)
+	dec, matchedRules := eval.InspectPhases(req)
+
+	clientIP := in.ClientIP
+	if clientIP == "" {
+		clientIP = remoteAddr
+	}
+	logTransaction(clientIP, req, dec, matchedRules)
+
+	res := InspectResult{
+		Decision:     "allow",
+		Blocked:      dec.Block,
+		Score:        dec.Score,
+		MatchedRules: matchedRules,
+	}
+	if dec.Block {
+		res.Decision = "block"
+	}
+	if res.MatchedRules == nil {
+		res.MatchedRules = []utils.MatchedRuleLog{}
+	}
+	return res
+}
+
+// InspectHandler accepts a single utils.Ingest JSON document and returns its verdict
+func InspectHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, inspectError{"method not allowed"})
+			return
+		}
+
+		var in utils.Ingest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, utils.MaxJSONSize)).Decode(&in); err != nil {
+			writeDecodeError(w, "invalid ingest document: ", err)
+			return
+		}
+
+		res := inspectIngest(eval, &in, r.RemoteAddr)
+		// The verdict is also in the headers, as for ext_authz and auth_request
+		for k, vs := range verdictHeaders(Decision{Block: res.Blocked, Score: res.Score}, res.MatchedRules) {
+			w.Header()[k] = vs
+		}
+		writeJSON(w, http.StatusOK, res)
+	})
+}
+
+// InspectBatchHandler accepts a JSON array of utils.Ingest documents and
+// returns the verdicts in the same order
+func InspectBatchHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, inspectError{"method not allowed"})
+			return
+		}
+
+		var batch []utils.Ingest
+		body := http.MaxBytesReader(w, r.Body, maxInspectBatchSize)
+		if err := json.NewDecoder(body).Decode(&batch); err != nil {
+			writeDecodeError(w, "invalid ingest batch: ", err)
+			return
+		}
+		if len(batch) > maxInspectBatch {
+			writeJSON(w, http.StatusRequestEntityTooLarge, inspectError{"too many events in batch"})
+			return
+		}
+
+		results := make([]InspectResult, 0, len(batch))
+		for i := range batch {
+			results = append(results, inspectIngest(eval, &batch[i], r.RemoteAddr))
+		}
+		writeJSON(w, http.StatusOK, results)
+	})
+}
+
+// verdictHeaders describes a decision as X-WAF-* headers for proxies that
+// ask the WAF for a verdict (Envoy ext_authz, nginx auth_request)
+func verdictHeaders(dec Decision, matchedRules []utils.MatchedRuleLog) http.Header {
+	h := http.Header{}
+	if dec.Block {
+		h.Set("X-WAF-Decision", "block")
+	} else {
+		h.Set("X-WAF-Decision", "allow")
+	}
+	h.Set("X-WAF-Score", strconv.Itoa(dec.Score))
+
+	ids := make([]string, 0, len(matchedRules))
+	for _, m := range matchedRules {
+		ids = append(ids, m.RuleID)
+	}
+	if len(ids) > 0 {
+		h.Set("X-WAF-Rules", strings.Join(ids, ","))
+	}
+	return h
+}
+
+// writeDecodeError rejects a request body that could not be decoded: 413
+// when it was over the size limit, 400 otherwise
+func writeDecodeError(w http.ResponseWriter, prefix string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSON(w, http.StatusRequestEntityTooLarge, inspectError{"request body too large"})
+		return
+	}
+	writeJSON(w, http.StatusBadRequest, inspectError{prefix + err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"waf-engine/mainWAF/utils"
+)
+
+func postInspect(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestInspectHandler(t *testing.T) {
+	h := InspectHandler(NewEvaluator(loadTestRules(t, xssRule)))
+
+	for _, tc := range []struct {
+		name, body string
+		status     int
+		decision   string
+		rules      string
+	}{
+		{"benign", `{"method":"GET","path":"/search","query":{"q":["shoes"]}}`, http.StatusOK, "allow", ""},
+		{"attack", `{"method":"POST","path":"/comment","body":{"text":"<script>alert(1)</script>"}}`, http.StatusOK, "block", "100"},
+		{"malformed json", `{"method":`, http.StatusBadRequest, "", ""},
+		{"wrong type", `{"query":"q=1"}`, http.StatusBadRequest, "", ""},
+		{"over 1MB", `{"path":"` + strings.Repeat("a", utils.MaxJSONSize) + `"}`, http.StatusRequestEntityTooLarge, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postInspect(h, "/inspect", tc.body)
+			if rec.Code != tc.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("content type %q", ct)
+			}
+			if tc.status != http.StatusOK {
+				var e inspectError
+				if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.Error == "" {
+					t.Errorf("error body %s: %v", rec.Body, err)
+				}
+				if rec.Header().Get("X-WAF-Decision") != "" {
+					t.Error("verdict headers on a rejected call")
+				}
+				return
+			}
+
+			var res InspectResult
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Decision != tc.decision || res.Blocked != (tc.decision == "block") || res.MatchedRules == nil {
+				t.Errorf("verdict %+v, want %s", res, tc.decision)
+			}
+			if got := rec.Header().Get("X-WAF-Decision"); got != tc.decision {
+				t.Errorf("X-WAF-Decision %q, want %q", got, tc.decision)
+			}
+			if got, want := rec.Header().Get("X-WAF-Score"), strconv.Itoa(res.Score); got != want {
+				t.Errorf("X-WAF-Score %q, want %q", got, want)
+			}
+			if got := rec.Header().Get("X-WAF-Rules"); got != tc.rules {
+				t.Errorf("X-WAF-Rules %q, want %q", got, tc.rules)
+			}
+		})
+	}
+}
+
+func TestInspectHandlerMethod(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	for path, h := range map[string]http.Handler{"/inspect": InspectHandler(eval), "/inspect/batch": InspectBatchHandler(eval)} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("GET %s: status %d, Allow %q", path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+}
+
+// batchOf returns a JSON array of n events, every third one an attack
+func batchOf(n int) string {
+	events := make([]string, n)
+	for i := range events {
+		if i%3 == 2 {
+			events[i] = `{"method":"GET","path":"/search","query":{"q":["<script>"]}}`
+		} else {
+			events[i] = `{"method":"GET","path":"/search","query":{"q":["shoes"]}}`
+		}
+	}
+	return "[" + strings.Join(events, ",") + "]"
+}
+
+func TestInspectBatchHandler(t *testing.T) {
+	h := InspectBatchHandler(NewEvaluator(loadTestRules(t, xssRule)))
+
+	t.Run("100 events", func(t *testing.T) {
+		rec := postInspect(h, "/inspect/batch", batchOf(maxInspectBatch))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var results []InspectResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != maxInspectBatch {
+			t.Fatalf("%d verdicts, want %d", len(results), maxInspectBatch)
+		}
+		// Verdicts come back in the order of the events
+		for i, res := range results {
+			if want := i%3 == 2; res.Blocked != want {
+				t.Errorf("event %d: blocked %v, want %v", i, res.Blocked, want)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		name, body string
+		status     int
+	}{
+		{"101 events", batchOf(maxInspectBatch + 1), http.StatusRequestEntityTooLarge},
+		{"over 16MB", `[{"path":"` + strings.Repeat("a", maxInspectBatchSize) + `"}]`, http.StatusRequestEntityTooLarge},
+		{"malformed json", `[{"method":"GET"},`, http.StatusBadRequest},
+		{"not an array", `{"method":"GET"}`, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := postInspect(h, "/inspect/batch", tc.body)
+			if rec.Code != tc.status {
+				t.Errorf("status %d, want %d: %.200s", rec.Code, tc.status, rec.Body)
+			}
+		})
+	}
+
+	t.Run("empty batch", func(t *testing.T) {
+		rec := postInspect(h, "/inspect/batch", `[]`)
+		if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+			t.Errorf("status %d, body %s", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestVerdictHeaders(t *testing.T) {
+	h := verdictHeaders(Decision{Block: true, Score: 2}, []utils.MatchedRuleLog{{RuleID: "941100"}, {RuleID: "942100"}})
+	if h.Get("X-WAF-Decision") != "block" || h.Get("X-WAF-Score") != "2" || h.Get("X-WAF-Rules") != "941100,942100" {
+		t.Errorf("headers %v", h)
+	}
+	h = verdictHeaders(Decision{}, nil)
+	if h.Get("X-WAF-Decision") != "allow" || h.Get("X-WAF-Score") != "0" || h.Values("X-WAF-Rules") != nil {
+		t.Errorf("headers %v", h)
+	}
+}
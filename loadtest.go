@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// In-process load generator (waf loadtest)
+// ==========================
+
+// loadResult is what one worker measured
+type loadResult struct {
+	latencies []time.Duration
+	statuses  map[int]int
+}
+
+// runLoadTest drives the HTTP handler from concurrent workers, cycling
+// through the benchmark cases, and reports throughput, latency
+// percentiles and allocations per request
+func runLoadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	rulesDir := fs.String("rules", "parsed_rules", "directory with YAML rules")
+	run := fs.String("run", "", "only send the benchmark cases matching this regexp")
+	workers := fs.Int("c", runtime.GOMAXPROCS(0), "concurrent workers")
+	duration := fs.Duration("d", 10*time.Second, "how long to send requests")
+	total := fs.Int("n", 0, "stop after this many requests instead of after -d")
+	requestLog := fs.String("request-log", "", "write the request log to this file instead of discarding it")
+	_ = fs.Parse(args)
+	if *workers < 1 {
+		fmt.Fprintln(os.Stderr, "-c must be at least 1")
+		os.Exit(2)
+	}
+
+	filter, err := regexp.Compile(*run)
+	if err != nil {
+		log.Fatalf("❌ Invalid -run: %v", err)
+	}
+	var cases []benchCase
+	for _, bc := range benchCases() {
+		if filter.MatchString(bc.name) {
+			cases = append(cases, bc)
+		}
+	}
+	if len(cases) == 0 {
+		fmt.Fprintf(os.Stderr, "no benchmark case matches %q\n", *run)
+		os.Exit(2)
+	}
+
+	// The handler writes every request to the request log
+	utils.Logger = log.New(io.Discard, "", 0)
+	if *requestLog != "" {
+		if err := utils.InitLogger(utils.SinkConfig{Type: "file", Path: *requestLog}); err != nil {
+			log.Fatalf("❌ Failed to open request log: %v", err)
+		}
+		defer utils.CloseSinks()
+	}
+
+	if err := rules.LoadRules(*rulesDir); err != nil {
+		log.Fatalf("❌ Failed to load rules: %v", err)
+	}
+	handler := HTTPHandler(NewEvaluator(rules.AllRules))
+
+	var (
+		sent    atomic.Int64
+		wg      sync.WaitGroup
+		results = make([]loadResult, *workers)
+	)
+	deadline := time.Now().Add(*duration)
+	more := func() bool {
+		if *total > 0 {
+			return sent.Add(1) <= int64(*total)
+		}
+		sent.Add(1)
+		return time.Now().Before(deadline)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for w := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := loadResult{statuses: make(map[int]int)}
+			for i := w; more(); i++ {
+				r := cases[i%len(cases)].build()
+				rec := &statusRecorder{header: make(http.Header)}
+				t := time.Now()
+				handler.ServeHTTP(rec, r)
+				res.latencies = append(res.latencies, time.Since(t))
+				res.statuses[rec.status()]++
+			}
+			results[w] = res
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	printLoadTest(os.Stdout, results, elapsed, *workers, len(cases), after.Mallocs-before.Mallocs, after.TotalAlloc-before.TotalAlloc)
+}
+
+// statusRecorder keeps the status of a response and discards its body
+type statusRecorder struct {
+	header http.Header
+	code   int
+}
+
+func (s *statusRecorder) Header() http.Header { return s.header }
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
+
+func (s *statusRecorder) status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
+
+func printLoadTest(w io.Writer, results []loadResult, elapsed time.Duration, workers, cases int, mallocs, allocBytes uint64) {
+	var latencies []time.Duration
+	statuses := make(map[int]int)
+	for _, r := range results {
+		latencies = append(latencies, r.latencies...)
+		for code, n := range r.statuses {
+			statuses[code] += n
+		}
+	}
+	n := len(latencies)
+	if n == 0 {
+		fmt.Fprintln(w, "No requests were sent")
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[min(n-1, int(float64(n)*p))]
+	}
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+
+	fmt.Fprintf(w, "Sent %d requests (%d cases, %d workers) in %s: %.0f req/s\n",
+		n, cases, workers, elapsed.Round(time.Millisecond), float64(n)/elapsed.Seconds())
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %d %s: %d\n", code, http.StatusText(code), statuses[code])
+	}
+	fmt.Fprintf(w, "Allocations: %d allocs/req, %d B/req (including building the requests)\n\n",
+		mallocs/uint64(n), allocBytes/uint64(n))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "MEAN\tP50\tP90\tP99\tP99.9\tMAX\t")
+	fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n",
+		sum/time.Duration(n), percentile(0.50), percentile(0.90), percentile(0.99), percentile(0.999), latencies[n-1])
+	tw.Flush()
+}
@@ -0,0 +1,307 @@
+package collections
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// compactEvery is the number of journal records after which the journal is
+// rewritten, provided it holds at least twice as many records as live values
+const compactEvery = 10000
+
+// FileStore is a Store persisted to a single append-only journal file.
+// Every mutation is queued as one JSON line and written by a background
+// goroutine, so requests never wait for the disk: the changes queued while
+// a batch is written go out together in the next one. The file is replayed
+// on open, then periodically compacted down to the live variables. Batches
+// are flushed to the OS but not fsync'ed; changes still queued when the
+// process dies are lost.
+type FileStore struct {
+	mem  *MemoryStore
+	path string
+
+	pending []journalRecord // queued changes, guarded by mem.mu
+	wake    chan struct{}   // a batch is pending
+	closing chan struct{}
+	done    chan struct{} // the writer has stopped
+	once    sync.Once
+
+	errMu sync.Mutex
+	err   error // first write error
+
+	// Owned by the writer goroutine once the store is open
+	f   *os.File
+	w   *bufio.Writer
+	ops int // records in the journal
+}
+
+// journalRecord is one line of the journal
+type journalRecord struct {
+	Op         string `json:"op"` // "set" or "del"
+	Collection string `json:"c"`
+	Key        string `json:"k"`
+	Name       string `json:"n"`
+	Value      string `json:"v,omitempty"`
+	Expires    int64  `json:"e,omitempty"` // unix nanoseconds, 0 = never
+}
+
+// OpenFileStore loads (or creates) the journal at path
+func OpenFileStore(path string, sweepInterval time.Duration) (*FileStore, error) {
+	s := &FileStore{
+		mem:     NewMemoryStore(sweepInterval),
+		path:    path,
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if f, err := os.Open(path); err == nil {
+		s.mem.mu.Lock()
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			var rec journalRecord
+			// A torn last line (crash mid-write) is simply ignored
+			if json.Unmarshal(sc.Bytes(), &rec) != nil {
+				continue
+			}
+			s.replayLocked(rec)
+		}
+		s.mem.mu.Unlock()
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	s.mem.onEvict = func(k entryKey) { s.queueLocked("del", k, entry{}) }
+	go s.writeLoop()
+	return s, nil
+}
+
+// SetLimits applies a default TTL and an entry cap; evicted variables are
+// deleted from the journal as well
+func (s *FileStore) SetLimits(l Limits) {
+	s.mem.SetLimits(l)
+}
+
+func (s *FileStore) replayLocked(rec journalRecord) {
+	k := newEntryKey(rec.Collection, rec.Key, rec.Name)
+	switch rec.Op {
+	case "set":
+		e := entry{Value: rec.Value}
+		if rec.Expires != 0 {
+			e.Expires = time.Unix(0, rec.Expires)
+		}
+		s.mem.putLocked(k, e)
+	case "del":
+		s.mem.deleteLocked(k)
+	}
+}
+
+// queueLocked journals one change; the caller holds s.mem.mu. It returns
+// the first error the writer ran into, if any.
+func (s *FileStore) queueLocked(op string, k entryKey, e entry) error {
+	rec := journalRecord{Op: op, Collection: k.Collection, Key: k.Key, Name: k.Name, Value: e.Value}
+	if !e.Expires.IsZero() {
+		rec.Expires = e.Expires.UnixNano()
+	}
+	s.pending = append(s.pending, rec)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return s.failure()
+}
+
+// writeLoop writes the queued changes until the store is closed
+func (s *FileStore) writeLoop() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.wake:
+			s.writePending()
+		case <-s.closing:
+			s.writePending()
+			return
+		}
+	}
+}
+
+// writePending writes and flushes the queued changes as one batch, then
+// compacts the journal once it mostly holds superseded records
+func (s *FileStore) writePending() {
+	s.mem.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	live := len(s.mem.entries)
+	s.mem.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	for _, rec := range batch {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		if _, err := s.w.Write(append(data, '\n')); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	if err := s.w.Flush(); err != nil {
+		s.fail(err)
+		return
+	}
+
+	s.ops += len(batch)
+	if s.ops >= compactEvery && s.ops >= 2*live {
+		s.fail(s.compact())
+	}
+}
+
+// compact rewrites the journal with only the live variables. The snapshot
+// covers every queued change, so those are dropped.
+func (s *FileStore) compact() error {
+	s.mem.mu.Lock()
+	now := s.mem.now()
+	live := make([]journalRecord, 0, len(s.mem.entries))
+	for k, e := range s.mem.entries {
+		if e.expired(now) {
+			s.mem.deleteLocked(k)
+			continue
+		}
+		rec := journalRecord{Op: "set", Collection: k.Collection, Key: k.Key, Name: k.Name, Value: e.Value}
+		if !e.Expires.IsZero() {
+			rec.Expires = e.Expires.UnixNano()
+		}
+		live = append(live, rec)
+	}
+	s.pending = nil
+	s.mem.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, rec := range live {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+
+	if s.f != nil {
+		s.f.Close()
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.f, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	s.w = bufio.NewWriter(s.f)
+	s.ops = len(live)
+	return nil
+}
+
+// fail records the first write error; later changes are still applied in
+// memory but no longer persisted reliably
+func (s *FileStore) fail(err error) {
+	if err == nil {
+		return
+	}
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	if s.err == nil {
+		s.err = err
+		slog.Error("collection journal write failed", "path", s.path, "err", err)
+	}
+}
+
+func (s *FileStore) failure() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
+
+func (s *FileStore) Get(collection, key, name string) (string, bool) {
+	return s.mem.Get(collection, key, name)
+}
+
+func (s *FileStore) All(collection, key string) map[string]string {
+	return s.mem.All(collection, key)
+}
+
+func (s *FileStore) Set(collection, key, name, value string, ttl time.Duration) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	k := newEntryKey(collection, key, name)
+	return s.queueLocked("set", k, s.mem.setLocked(k, value, ttl))
+}
+
+func (s *FileStore) Incr(collection, key, name string, delta int64, ttl time.Duration) (int64, error) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	k := newEntryKey(collection, key, name)
+	v, e := s.mem.incrLocked(k, delta, ttl)
+	return v, s.queueLocked("set", k, e)
+}
+
+func (s *FileStore) Expire(collection, key, name string, ttl time.Duration) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	k := newEntryKey(collection, key, name)
+	now := s.mem.now()
+	e, ok := s.mem.entries[k]
+	if !ok || e.expired(now) {
+		return nil
+	}
+	e.Expires = now.Add(ttl)
+	s.mem.putLocked(k, e)
+	return s.queueLocked("set", k, e)
+}
+
+func (s *FileStore) Delete(collection, key, name string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	k := newEntryKey(collection, key, name)
+	s.mem.deleteLocked(k)
+	return s.queueLocked("del", k, entry{})
+}
+
+// Close writes the queued changes, closes the journal and stops the
+// background sweep
+func (s *FileStore) Close() error {
+	s.mem.Close()
+	s.once.Do(func() {
+		close(s.closing)
+		<-s.done
+		s.fail(s.f.Close())
+	})
+	return s.failure()
+}
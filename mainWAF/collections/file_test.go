@@ -0,0 +1,146 @@
+package collections
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openTestFileStore(t *testing.T, path string) *FileStore {
+	t.Helper()
+	s, err := OpenFileStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		n++
+	}
+	return n
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collections.db")
+	s := openTestFileStore(t, path)
+	_ = s.Set("IP", "192.0.2.1", "block", "1", time.Hour)
+	_, _ = s.Incr("IP", "192.0.2.1", "hits", 5, 0)
+	_, _ = s.Incr("IP", "192.0.2.1", "hits", 2, 0)
+	_ = s.Set("SESSION", "abc", "user", "alice", 0)
+	_ = s.Delete("SESSION", "abc", "user")
+	_ = s.Set("GLOBAL", "global", "gone", "1", time.Nanosecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	if got := s.All("IP", "192.0.2.1"); len(got) != 2 || got["block"] != "1" || got["hits"] != "7" {
+		t.Errorf("IP collection after reopening: %v", got)
+	}
+	if _, ok := s.Get("SESSION", "abc", "user"); ok {
+		t.Error("deleted variable came back")
+	}
+	if _, ok := s.Get("GLOBAL", "global", "gone"); ok {
+		t.Error("expired variable came back")
+	}
+}
+
+// TestFileStoreCrashReplay opens a journal left behind by a crash: the
+// last line was torn mid-write and a compaction never got to its rename
+func TestFileStoreCrashReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "collections.db")
+	journal := `{"op":"set","c":"IP","k":"192.0.2.1","n":"hits","v":"1"}
+{"op":"set","c":"IP","k":"192.0.2.1","n":"hits","v":"2"}
+{"op":"set","c":"IP","k":"192.0.2.2","n":"hits","v":"9"}
+{"op":"del","c":"IP","k":"192.0.2.2","n":"hits"}
+{"op":"set","c":"IP","k":"192.0.2.1","n":"hi`
+	if err := os.WriteFile(path, []byte(journal), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	stale := `{"op":"set","c":"IP","k":"192.0.2.2","n":"hits","v":"9"}` + "\n"
+	if err := os.WriteFile(path+".tmp", []byte(stale), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestFileStore(t, path)
+	if v, _ := s.Get("IP", "192.0.2.1", "hits"); v != "2" {
+		t.Errorf("hits = %q, want the last complete record", v)
+	}
+	if _, ok := s.Get("IP", "192.0.2.2", "hits"); ok {
+		t.Error("the unfinished compaction was replayed")
+	}
+	// Opening compacts, dropping the torn line
+	if n := journalLines(t, path); n != 1 {
+		t.Errorf("journal has %d lines after opening, want 1", n)
+	}
+	_, _ = s.Incr("IP", "192.0.2.1", "hits", 1, 0)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	if v, _ := s.Get("IP", "192.0.2.1", "hits"); v != "3" {
+		t.Errorf("hits = %q after reopening, want 3", v)
+	}
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collections.db")
+	s := openTestFileStore(t, path)
+	const n = 3 * compactEvery
+	for i := 0; i < n; i++ {
+		if _, err := s.Incr("IP", "192.0.2."+strconv.Itoa(i%4), "hits", 1, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if lines := journalLines(t, path); lines >= compactEvery {
+		t.Errorf("journal has %d lines after %d changes, want it compacted", lines, n)
+	}
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	for i := 0; i < 4; i++ {
+		if v, _ := s.Get("IP", "192.0.2."+strconv.Itoa(i), "hits"); v != strconv.Itoa(n/4) {
+			t.Errorf("192.0.2.%d hits = %q after compaction, want %d", i, v, n/4)
+		}
+	}
+}
+
+func TestFileStoreEvictionIsJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "collections.db")
+	s := openTestFileStore(t, path)
+	s.SetLimits(Limits{MaxEntries: 2})
+	for _, ip := range []string{"a", "b", "c"} {
+		_ = s.Set("IP", ip, "n", "1", 0)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestFileStore(t, path)
+	defer s.Close()
+	if _, ok := s.Get("IP", "a", "n"); ok {
+		t.Error("evicted variable came back after reopening")
+	}
+	if len(s.All("IP", "c")) != 1 {
+		t.Error("latest variable lost")
+	}
+}
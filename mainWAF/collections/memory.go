@@ -0,0 +1,205 @@
+package collections
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits bound the memory a store may use
+type Limits struct {
+	// DefaultTTL is the expiry of variables set without one (no expirevar);
+	// zero keeps them until they are deleted
+	DefaultTTL time.Duration
+	// MaxEntries caps the number of variables; beyond it the least recently
+	// written ones are evicted. Zero means no limit.
+	MaxEntries int
+}
+
+// MemoryStore is a process-local Store. Expired variables are hidden on
+// read and removed by a periodic sweep.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[entryKey]entry
+	limits  Limits
+	written *list.List                 // entry keys, least recently written first
+	order   map[entryKey]*list.Element // position of each key in written
+	onEvict func(entryKey)             // called with mu held
+	now     func() time.Time
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewMemoryStore creates an in-memory store sweeping expired variables every
+// sweepInterval (no background sweep when it is zero)
+func NewMemoryStore(sweepInterval time.Duration) *MemoryStore {
+	s := &MemoryStore{
+		entries: make(map[entryKey]entry),
+		written: list.New(),
+		order:   make(map[entryKey]*list.Element),
+		now:     time.Now,
+		stop:    make(chan struct{}),
+	}
+	if sweepInterval > 0 {
+		go s.sweepLoop(sweepInterval)
+	}
+	return s
+}
+
+// SetLimits applies a default TTL and an entry cap, evicting the least
+// recently written variables already over the cap
+func (s *MemoryStore) SetLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = l
+	s.evictLocked()
+}
+
+func (s *MemoryStore) sweepLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.Sweep()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Sweep removes every expired variable
+func (s *MemoryStore) Sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for k, e := range s.entries {
+		if e.expired(now) {
+			s.deleteLocked(k)
+		}
+	}
+}
+
+// putLocked stores an entry as the most recently written one and evicts
+// beyond the entry cap
+func (s *MemoryStore) putLocked(k entryKey, e entry) {
+	s.entries[k] = e
+	if el, ok := s.order[k]; ok {
+		s.written.MoveToBack(el)
+	} else {
+		s.order[k] = s.written.PushBack(k)
+	}
+	s.evictLocked()
+}
+
+func (s *MemoryStore) deleteLocked(k entryKey) {
+	if el, ok := s.order[k]; ok {
+		s.written.Remove(el)
+		delete(s.order, k)
+	}
+	delete(s.entries, k)
+}
+
+// evictLocked removes the least recently written variables beyond
+// MaxEntries
+func (s *MemoryStore) evictLocked() {
+	for s.limits.MaxEntries > 0 && len(s.entries) > s.limits.MaxEntries {
+		oldest := s.written.Front().Value.(entryKey)
+		s.deleteLocked(oldest)
+		if s.onEvict != nil {
+			s.onEvict(oldest)
+		}
+	}
+}
+
+func (s *MemoryStore) Get(collection, key, name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[newEntryKey(collection, key, name)]
+	if !ok || e.expired(s.now()) {
+		return "", false
+	}
+	return e.Value, true
+}
+
+func (s *MemoryStore) All(collection, key string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := newEntryKey(collection, key, "")
+	now := s.now()
+	out := make(map[string]string)
+	for k, e := range s.entries {
+		if k.Collection == prefix.Collection && k.Key == prefix.Key && !e.expired(now) {
+			out[k.Name] = e.Value
+		}
+	}
+	return out
+}
+
+func (s *MemoryStore) Set(collection, key, name, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setLocked(newEntryKey(collection, key, name), value, ttl)
+	return nil
+}
+
+// setLocked stores value, keeping the previous expiry when ttl is zero;
+// a variable without any expiry gets the default TTL
+func (s *MemoryStore) setLocked(k entryKey, value string, ttl time.Duration) entry {
+	now := s.now()
+	e := entry{Value: value}
+	if prev, ok := s.entries[k]; ok && !prev.expired(now) {
+		e.Expires = prev.Expires
+	}
+	if ttl > 0 {
+		e.Expires = now.Add(ttl)
+	} else if e.Expires.IsZero() && s.limits.DefaultTTL > 0 {
+		e.Expires = now.Add(s.limits.DefaultTTL)
+	}
+	s.putLocked(k, e)
+	return e
+}
+
+// Incr atomically adds delta to a numeric variable (missing or non-numeric
+// values count as 0) and returns the new value
+func (s *MemoryStore) Incr(collection, key, name string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, _ := s.incrLocked(newEntryKey(collection, key, name), delta, ttl)
+	return v, nil
+}
+
+func (s *MemoryStore) incrLocked(k entryKey, delta int64, ttl time.Duration) (int64, entry) {
+	var current int64
+	if e, ok := s.entries[k]; ok && !e.expired(s.now()) {
+		current, _ = strconv.ParseInt(e.Value, 10, 64)
+	}
+	current += delta
+	return current, s.setLocked(k, strconv.FormatInt(current, 10), ttl)
+}
+
+func (s *MemoryStore) Expire(collection, key, name string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := newEntryKey(collection, key, name)
+	now := s.now()
+	if e, ok := s.entries[k]; ok && !e.expired(now) {
+		e.Expires = now.Add(ttl)
+		s.putLocked(k, e)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(collection, key, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(newEntryKey(collection, key, name))
+	return nil
+}
+
+// Close stops the background sweep
+func (s *MemoryStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
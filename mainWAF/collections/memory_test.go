@@ -0,0 +1,78 @@
+package collections
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source for the expiry tests
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestMemoryStore(t *testing.T, l Limits) (*MemoryStore, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	s := NewMemoryStore(0)
+	s.now = clock.now
+	s.SetLimits(l)
+	t.Cleanup(func() { s.Close() })
+	return s, clock
+}
+
+func TestMemoryStoreDefaultTTL(t *testing.T) {
+	s, clock := newTestMemoryStore(t, Limits{DefaultTTL: time.Minute})
+
+	_ = s.Set("IP", "192.0.2.1", "seen", "1", 0)
+	_ = s.Set("IP", "192.0.2.1", "block", "1", 10*time.Minute)
+	_, _ = s.Incr("IP", "192.0.2.1", "hits", 1, 0)
+	clock.advance(30 * time.Second)
+	// Rewriting keeps the expiry the variable got when it was created
+	_, _ = s.Incr("IP", "192.0.2.1", "hits", 1, 0)
+	clock.advance(31 * time.Second)
+
+	if v, ok := s.Get("ip", "192.0.2.1", "SEEN"); ok {
+		t.Errorf("seen = %q, want expired after the default TTL", v)
+	}
+	if _, ok := s.Get("IP", "192.0.2.1", "hits"); ok {
+		t.Error("hits kept past the default TTL of its first write")
+	}
+	if v, ok := s.Get("IP", "192.0.2.1", "block"); !ok || v != "1" {
+		t.Errorf("block = %q, %v; an explicit TTL wins over the default", v, ok)
+	}
+
+	s.Sweep()
+	if n := len(s.entries); n != 1 {
+		t.Errorf("%d entries after the sweep, want 1", n)
+	}
+}
+
+func TestMemoryStoreMaxEntries(t *testing.T) {
+	s, _ := newTestMemoryStore(t, Limits{MaxEntries: 3})
+
+	for _, ip := range []string{"a", "b", "c"} {
+		_ = s.Set("IP", ip, "n", "1", 0)
+	}
+	_, _ = s.Incr("IP", "a", "n", 1, 0) // a is now the most recently written
+	_ = s.Set("IP", "d", "n", "1", 0)
+
+	for ip, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := s.Get("IP", ip, "n"); ok != want {
+			t.Errorf("IP %s present = %v, want %v", ip, ok, want)
+		}
+	}
+
+	// Lowering the cap evicts right away
+	s.SetLimits(Limits{MaxEntries: 1})
+	if len(s.entries) != 1 || len(s.order) != 1 || s.written.Len() != 1 {
+		t.Fatalf("%d entries (%d ordered) after lowering the cap to 1", len(s.entries), s.written.Len())
+	}
+	if _, ok := s.Get("IP", "d", "n"); !ok {
+		t.Error("the most recently written variable was evicted")
+	}
+
+	_ = s.Delete("IP", "d", "n")
+	if len(s.entries) != 0 || len(s.order) != 0 || s.written.Len() != 0 {
+		t.Errorf("delete left %d entries, %d ordered", len(s.entries), s.written.Len())
+	}
+}
@@ -0,0 +1,58 @@
+package collections
+
+import (
+	"strings"
+	"time"
+)
+
+// Store keeps persistent collection variables (IP, SESSION, USER, GLOBAL,
+// RESOURCE) across requests. A variable is addressed by the collection name,
+// the collection key (e.g. the client IP for IP) and the variable name.
+// A ttl of zero keeps the current expiry, or none for new variables.
+type Store interface {
+	Get(collection, key, name string) (string, bool)
+	All(collection, key string) map[string]string
+	Set(collection, key, name, value string, ttl time.Duration) error
+	Incr(collection, key, name string, delta int64, ttl time.Duration) (int64, error)
+	Expire(collection, key, name string, ttl time.Duration) error
+	Delete(collection, key, name string) error
+	Close() error
+}
+
+// Names lists the collections that can be initialized with initcol
+var Names = []string{"IP", "SESSION", "USER", "GLOBAL", "RESOURCE"}
+
+// IsCollection reports whether name is a persistent collection
+func IsCollection(name string) bool {
+	for _, n := range Names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// entryKey is the normalized address of one variable
+type entryKey struct {
+	Collection string
+	Key        string
+	Name       string
+}
+
+func newEntryKey(collection, key, name string) entryKey {
+	return entryKey{
+		Collection: strings.ToUpper(collection),
+		Key:        key,
+		Name:       strings.ToLower(name),
+	}
+}
+
+// entry is a stored value with an optional absolute expiry
+type entry struct {
+	Value   string
+	Expires time.Time
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
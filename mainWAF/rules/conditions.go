@@ -0,0 +1,279 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"waf-engine/mainWAF/utils"
+)
+
+// Condition is the higher-level rule syntax for app teams. A rule with a
+// "when:" block needs no variable/regex; e.g.
+//
+//	when:
+//	  all:
+//	    - method: POST
+//	    - path: /api/*/users/**
+//	    - not: {header: X-Internal, present: true}
+//	    - any:
+//	        - json: /user/role
+//	          equals: admin
+//	        - arg: debug
+//	          present: true
+//
+// Each condition is either a combination (all/any/not) or a single test on
+// method, path, header, arg, json or client_ip. Header, arg and json tests
+// take one of equals/contains/matches, or present (the default).
+type Condition struct {
+	All []Condition `yaml:"all,omitempty"`
+	Any []Condition `yaml:"any,omitempty"`
+	Not *Condition  `yaml:"not,omitempty"`
+
+	Method   string `yaml:"method,omitempty"`    // space separated, e.g. "PUT DELETE"
+	Path     string `yaml:"path,omitempty"`      // glob: * within a segment, ** across segments
+	Header   string `yaml:"header,omitempty"`    // request header name
+	Arg      string `yaml:"arg,omitempty"`       // query or form argument name
+	JSON     string `yaml:"json,omitempty"`      // JSON pointer into the body, e.g. /user/role
+	ClientIP string `yaml:"client_ip,omitempty"` // comma separated addresses and CIDR blocks
+
+	Equals   string `yaml:"equals,omitempty"`
+	Contains string `yaml:"contains,omitempty"`
+	Matches  string `yaml:"matches,omitempty"` // regular expression
+	Present  *bool  `yaml:"present,omitempty"`
+}
+
+// maxAlternatives bounds the rules one condition tree expands to
+const maxAlternatives = 32
+
+// compileConditions turns a rule with a when: block into chained rules in
+// disjunctive normal form: one rule per alternative, all sharing the ID,
+// severity and actions of r, each chaining the tests of its alternative
+func compileConditions(r Rule) ([]Rule, error) {
+	if r.Variable != "" || r.Regex != "" || len(r.Chain) > 0 {
+		return nil, fmt.Errorf("when cannot be combined with variable, regex or chain")
+	}
+	alts, err := r.When.dnf(false)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Rule, 0, len(alts))
+	for _, tests := range alts {
+		for i := range tests {
+			// Transformations apply to values, not to methods, addresses or &counts
+			v := tests[i].Variable
+			if v != "REQUEST_METHOD" && v != "REMOTE_ADDR" && !strings.HasPrefix(v, "&") {
+				tests[i].Transforms = r.Transforms
+			}
+		}
+		head := r
+		head.When = nil
+		head.Variable, head.Regex, head.Transforms = tests[0].Variable, tests[0].Regex, tests[0].Transforms
+		head.Chain = tests[1:]
+		out = append(out, head)
+	}
+	return out, nil
+}
+
+// dnf returns the alternatives of a condition, each a list of tests that
+// must all match; negate pushes a surrounding "not" down to the tests
+func (c *Condition) dnf(negate bool) ([][]Rule, error) {
+	combinators := 0
+	for _, set := range []bool{c.All != nil, c.Any != nil, c.Not != nil} {
+		if set {
+			combinators++
+		}
+	}
+	if combinators > 1 || (combinators == 1 && c.subject() != "") {
+		return nil, fmt.Errorf("a condition must be exactly one of all, any, not or a single test")
+	}
+
+	switch {
+	case c.Not != nil:
+		return c.Not.dnf(!negate)
+	case c.All != nil || c.Any != nil:
+		children := c.All
+		if c.Any != nil {
+			children = c.Any
+		}
+		if len(children) == 0 {
+			return nil, fmt.Errorf("empty all/any condition")
+		}
+		// not(all) is any(not), not(any) is all(not)
+		conjunction := (c.All != nil) != negate
+		var out [][]Rule
+		for i, child := range children {
+			alts, err := child.dnf(negate)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case i == 0:
+				out = alts
+			case conjunction:
+				out = crossProduct(out, alts)
+			default:
+				out = append(out, alts...)
+			}
+			if len(out) > maxAlternatives {
+				return nil, fmt.Errorf("condition expands to more than %d alternatives", maxAlternatives)
+			}
+		}
+		return out, nil
+	default:
+		return c.tests(negate)
+	}
+}
+
+func crossProduct(a, b [][]Rule) [][]Rule {
+	out := make([][]Rule, 0, len(a)*len(b))
+	for _, x := range a {
+		for _, y := range b {
+			alt := append(append([]Rule{}, x...), y...)
+			out = append(out, alt)
+		}
+	}
+	return out
+}
+
+// subject names the single test of a leaf condition, "" for combinations
+func (c *Condition) subject() string {
+	var set []string
+	for name, v := range map[string]string{
+		"method": c.Method, "path": c.Path, "header": c.Header,
+		"arg": c.Arg, "json": c.JSON, "client_ip": c.ClientIP,
+	} {
+		if v != "" {
+			set = append(set, name)
+		}
+	}
+	if len(set) != 1 {
+		sort.Strings(set)
+		return strings.Join(set, "+")
+	}
+	return set[0]
+}
+
+// tests compiles a leaf condition. A negated value test also matches when
+// the variable is missing, so it yields two alternatives.
+func (c *Condition) tests(negate bool) ([][]Rule, error) {
+	not := ""
+	if negate {
+		not = "!"
+	}
+	one := func(variable, op string) [][]Rule {
+		return [][]Rule{{{Variable: variable, Regex: not + op}}}
+	}
+	hasValueTest := c.Equals != "" || c.Contains != "" || c.Matches != "" || c.Present != nil
+
+	subject := c.subject()
+	switch subject {
+	case "method", "path", "client_ip":
+		if hasValueTest {
+			return nil, fmt.Errorf("%s does not take equals/contains/matches/present", subject)
+		}
+	case "header", "arg", "json":
+	case "":
+		return nil, fmt.Errorf("empty condition")
+	default:
+		return nil, fmt.Errorf("a condition tests exactly one of method, path, header, arg, json or client_ip (got %s)", subject)
+	}
+
+	switch subject {
+	case "method":
+		if strings.TrimSpace(c.Method) == "" {
+			return nil, fmt.Errorf("method names no method")
+		}
+		return one("REQUEST_METHOD", "@rx "+methodRegexp(c.Method)), nil
+	case "path":
+		return one("REQUEST_FILENAME", "@rx "+globRegexp(c.Path)), nil
+	case "client_ip":
+		if _, err := parsePrefixes(c.ClientIP); err != nil {
+			return nil, fmt.Errorf("client_ip: %w", err)
+		}
+		return one("REMOTE_ADDR", "@ipMatch "+c.ClientIP), nil
+	}
+
+	variable := "REQUEST_HEADERS:" + strings.ToLower(c.Header)
+	switch subject {
+	case "arg":
+		variable = "ARGS:" + c.Arg
+	case "json":
+		if c.JSON != "" && !strings.HasPrefix(c.JSON, "/") {
+			return nil, fmt.Errorf("json %q is not a JSON pointer", c.JSON)
+		}
+		variable = "ARGS:" + utils.JSONPointerArg(c.JSON)
+	}
+
+	valueTests := 0
+	var op string
+	if c.Equals != "" {
+		valueTests, op = valueTests+1, "@streq "+c.Equals
+	}
+	if c.Contains != "" {
+		valueTests, op = valueTests+1, "@contains "+c.Contains
+	}
+	if c.Matches != "" {
+		if _, err := regexp.Compile(c.Matches); err != nil {
+			return nil, fmt.Errorf("matches: %w", err)
+		}
+		valueTests, op = valueTests+1, "@rx "+c.Matches
+	}
+	if valueTests > 1 || (valueTests == 1 && c.Present != nil) {
+		return nil, fmt.Errorf("%s takes only one of equals, contains, matches or present", subject)
+	}
+	if strings.Contains(op, "%{") {
+		return nil, fmt.Errorf("values must not contain %%{")
+	}
+
+	if valueTests == 0 {
+		present := c.Present == nil || *c.Present
+		if present == negate {
+			return [][]Rule{{{Variable: "&" + variable, Regex: "@eq 0"}}}, nil
+		}
+		return [][]Rule{{{Variable: "&" + variable, Regex: "@gt 0"}}}, nil
+	}
+	if !negate {
+		return one(variable, op), nil
+	}
+	return [][]Rule{
+		{{Variable: "&" + variable, Regex: "@eq 0"}},
+		{{Variable: variable, Regex: "!" + op}},
+	}, nil
+}
+
+// methodRegexp matches any of the space separated methods
+func methodRegexp(methods string) string {
+	names := strings.Fields(strings.ToUpper(methods))
+	for i, m := range names {
+		names[i] = regexp.QuoteMeta(m)
+	}
+	return "^(?:" + strings.Join(names, "|") + ")$"
+}
+
+// globRegexp anchors a path glob: * matches within one segment, ** across
+// segments, **/ zero or more whole segments and ? a single character
+func globRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,169 @@
+package rules
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// compileWhen compiles a when: block given in YAML and renders every
+// alternative as its tests joined by " & "
+func compileWhen(t *testing.T, when string) ([]string, error) {
+	t.Helper()
+	var c Condition
+	if err := yaml.Unmarshal([]byte(when), &c); err != nil {
+		t.Fatal(err)
+	}
+	alts, err := compileConditions(Rule{ID: "1", When: &c})
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, alt := range alts {
+		tests := []string{alt.Variable + " " + alt.Regex}
+		for _, link := range alt.Chain {
+			tests = append(tests, link.Variable+" "+link.Regex)
+		}
+		out = append(out, strings.Join(tests, " & "))
+	}
+	return out, nil
+}
+
+func TestConditionDNF(t *testing.T) {
+	for _, tc := range []struct {
+		name, when string
+		want       []string
+	}{
+		{"method", `method: get post`, []string{"REQUEST_METHOD @rx ^(?:GET|POST)$"}},
+		{"path", `path: /api/*`, []string{`REQUEST_FILENAME @rx ^/api/[^/]*$`}},
+		{"client ip", `client_ip: 10.0.0.0/8, 192.0.2.1`, []string{"REMOTE_ADDR @ipMatch 10.0.0.0/8, 192.0.2.1"}},
+		{"header present by default", `header: X-Api-Key`, []string{"&REQUEST_HEADERS:x-api-key @gt 0"}},
+		{"arg absent", `{arg: debug, present: false}`, []string{"&ARGS:debug @eq 0"}},
+		{"json equals", `{json: /user/role, equals: admin}`, []string{"ARGS:json.user.role @streq admin"}},
+		{"all", `all: [{method: POST}, {arg: q, contains: x}]`,
+			[]string{"REQUEST_METHOD @rx ^(?:POST)$ & ARGS:q @contains x"}},
+		{"any", `any: [{method: POST}, {arg: q, contains: x}]`,
+			[]string{"REQUEST_METHOD @rx ^(?:POST)$", "ARGS:q @contains x"}},
+		{"double negation", `not: {not: {method: GET}}`, []string{"REQUEST_METHOD @rx ^(?:GET)$"}},
+		// not(all) is any(not)
+		{"not all", `not: {all: [{method: GET}, {path: /a}]}`,
+			[]string{"REQUEST_METHOD !@rx ^(?:GET)$", "REQUEST_FILENAME !@rx ^/a$"}},
+		// not(any) is all(not)
+		{"not any", `not: {any: [{method: GET}, {path: /a}]}`,
+			[]string{"REQUEST_METHOD !@rx ^(?:GET)$ & REQUEST_FILENAME !@rx ^/a$"}},
+		{"not present", `not: {header: X-Internal, present: true}`, []string{"&REQUEST_HEADERS:x-internal @eq 0"}},
+		{"not absent", `not: {header: X-Internal, present: false}`, []string{"&REQUEST_HEADERS:x-internal @gt 0"}},
+		// A negated value test also holds when the value is missing
+		{"negated value test", `not: {header: X-Role, equals: admin}`,
+			[]string{"&REQUEST_HEADERS:x-role @eq 0", "REQUEST_HEADERS:x-role !@streq admin"}},
+		{"cross product", `all: [{any: [{method: GET}, {method: HEAD}]}, {any: [{path: /a}, {path: /b}]}]`,
+			[]string{
+				"REQUEST_METHOD @rx ^(?:GET)$ & REQUEST_FILENAME @rx ^/a$",
+				"REQUEST_METHOD @rx ^(?:GET)$ & REQUEST_FILENAME @rx ^/b$",
+				"REQUEST_METHOD @rx ^(?:HEAD)$ & REQUEST_FILENAME @rx ^/a$",
+				"REQUEST_METHOD @rx ^(?:HEAD)$ & REQUEST_FILENAME @rx ^/b$",
+			}},
+		{"cross product with a negated value test", `all: [{method: POST}, {not: {arg: token, matches: "^[a-f0-9]{32}$"}}]`,
+			[]string{
+				"REQUEST_METHOD @rx ^(?:POST)$ & &ARGS:token @eq 0",
+				"REQUEST_METHOD @rx ^(?:POST)$ & ARGS:token !@rx ^[a-f0-9]{32}$",
+			}},
+	} {
+		got, err := compileWhen(t, tc.when)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\ngot  %q\nwant %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestConditionErrors(t *testing.T) {
+	sixPairs := "all:" + strings.Repeat("\n  - any: [{method: GET}, {method: HEAD}]", 6)
+	for _, tc := range []struct {
+		name, when, err string
+	}{
+		{"too many alternatives", sixPairs, "more than 32 alternatives"},
+		{"combination and test", `{all: [{method: GET}], path: /a}`, "exactly one of all, any, not"},
+		{"two combinations", `{all: [{method: GET}], any: [{method: GET}]}`, "exactly one of all, any, not"},
+		{"two subjects", `{method: GET, path: /a}`, "got method+path"},
+		{"empty all", `all: []`, "empty all/any"},
+		{"empty condition", `equals: x`, "empty condition"},
+		{"blank method", `method: " "`, "method names no method"},
+		{"value test on path", `{path: /a, equals: /a}`, "path does not take"},
+		{"two value tests", `{arg: a, equals: x, contains: y}`, "only one of"},
+		{"value test and present", `{arg: a, equals: x, present: true}`, "only one of"},
+		{"json pointer", `{json: user.role, equals: x}`, "not a JSON pointer"},
+		{"bad regexp", `{arg: a, matches: "("}`, "matches: "},
+		{"macro in value", `{arg: a, equals: "%{tx.x}"}`, "must not contain %{"},
+		{"bad client ip", `client_ip: 10.0.0.0/33`, "client_ip: "},
+	} {
+		if _, err := compileWhen(t, tc.when); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: err = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+
+	if _, err := compileConditions(Rule{ID: "1", Variable: "ARGS", When: &Condition{Method: "GET"}}); err == nil {
+		t.Error("when combined with variable compiled")
+	}
+}
+
+// The alternatives share the ID and actions of the rule; transformations
+// apply to values only
+func TestConditionAlternativesShareRule(t *testing.T) {
+	var c Condition
+	if err := yaml.Unmarshal([]byte(`any: [{all: [{method: POST}, {arg: q, contains: x}]}, {client_ip: 192.0.2.1}]`), &c); err != nil {
+		t.Fatal(err)
+	}
+	alts, err := compileConditions(Rule{ID: "7", Name: "n", Severity: "CRITICAL", Block: true, Phase: 2,
+		Transforms: []string{"lowercase"}, When: &c})
+	if err != nil || len(alts) != 2 {
+		t.Fatalf("%d alternatives, err %v", len(alts), err)
+	}
+	for _, a := range alts {
+		if a.ID != "7" || a.Name != "n" || a.Severity != "CRITICAL" || !a.Block || a.Phase != 2 || a.When != nil {
+			t.Errorf("alternative %+v", a)
+		}
+	}
+	if alts[0].Transforms != nil || !reflect.DeepEqual(alts[0].Chain[0].Transforms, []string{"lowercase"}) || alts[1].Transforms != nil {
+		t.Errorf("transforms %v, %v and %v", alts[0].Transforms, alts[0].Chain[0].Transforms, alts[1].Transforms)
+	}
+}
+
+func TestGlobRegexp(t *testing.T) {
+	for _, tc := range []struct {
+		glob     string
+		match    []string
+		mismatch []string
+	}{
+		{"/api/*/users", []string{"/api/v1/users", "/api//users"}, []string{"/api/v1/v2/users", "/api/users/", "/xapi/v1/users"}},
+		{"/api/**", []string{"/api/", "/api/a/b/c"}, []string{"/api", "/apix"}},
+		{"/api/**/users", []string{"/api/users", "/api/a/users", "/api/a/b/users"}, []string{"/api/ausers", "/api/users/1"}},
+		{"/file?.txt", []string{"/file1.txt"}, []string{"/file/.txt", "/file.txt", "/file1xtxt"}},
+		{"/a+b/(c)[d]", []string{"/a+b/(c)[d]"}, []string{"/aab/c"}},
+	} {
+		re := regexp.MustCompile(globRegexp(tc.glob))
+		for _, p := range tc.match {
+			if !re.MatchString(p) {
+				t.Errorf("%s (%s) does not match %s", tc.glob, re, p)
+			}
+		}
+		for _, p := range tc.mismatch {
+			if re.MatchString(p) {
+				t.Errorf("%s (%s) matches %s", tc.glob, re, p)
+			}
+		}
+	}
+}
+
+func TestMethodRegexp(t *testing.T) {
+	re := regexp.MustCompile(methodRegexp("get  Post M-SEARCH"))
+	for m, want := range map[string]bool{"GET": true, "POST": true, "M-SEARCH": true, "GETX": false, "XPOST": false, "PUT": false, "": false} {
+		if re.MatchString(m) != want {
+			t.Errorf("%s: match %v, want %v", m, !want, want)
+		}
+	}
+}
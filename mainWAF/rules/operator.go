@@ -0,0 +1,346 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dlclark/regexp2"
+
+	"waf-engine/mainWAF/utils"
+)
+
+// Operator is a parsed ModSecurity operator expression, e.g. "@rx ^\d+$",
+// "!@within %{tx.allowed_methods}" or "@eq 0". A plain pattern without an
+// operator is an implicit @rx.
+type Operator struct {
+	Name   string // operator name without '@', e.g. "rx"
+	Negate bool   // expression started with '!'
+	Arg    string // raw argument, may contain %{...} macros
+	Macros bool   // Arg has to be macro-expanded before every match
+
+	rx       *rxPattern
+	phrases  []string
+	prefixes []netip.Prefix
+	literals []string // see Literals
+}
+
+// operatorNames lists the operators the engine can evaluate
+var operatorNames = map[string]bool{
+	"rx": true, "pm": true, "pmf": true, "pmFromFile": true,
+	"streq": true, "contains": true, "beginsWith": true, "endsWith": true, "within": true,
+	"eq": true, "ge": true, "gt": true, "le": true, "lt": true,
+	"ipMatch": true, "unconditionalMatch": true, "noMatch": true,
+}
+
+// ParseOperator parses an operator expression. dataDir is the directory
+// @pmFromFile data files are resolved against.
+func ParseOperator(expr, dataDir string) (*Operator, error) {
+	rest := strings.TrimSpace(expr)
+	if rest == "" {
+		return nil, fmt.Errorf("missing operator")
+	}
+	op := &Operator{Name: "rx", Arg: expr}
+	if strings.HasPrefix(rest, "!@") {
+		op.Negate = true
+		rest = rest[1:]
+	}
+	if strings.HasPrefix(rest, "@") {
+		name, arg, _ := strings.Cut(rest[1:], " ")
+		op.Name, op.Arg = name, strings.TrimSpace(arg)
+	}
+	if !operatorNames[op.Name] {
+		return nil, fmt.Errorf("unsupported operator @%s", op.Name)
+	}
+	op.Macros = strings.Contains(op.Arg, "%{")
+	if op.Macros {
+		// Prepared on every match from the expanded argument
+		if op.Name == "pmf" || op.Name == "pmFromFile" {
+			return nil, fmt.Errorf("macros are not allowed in @%s", op.Name)
+		}
+		return op, nil
+	}
+
+	var err error
+	switch op.Name {
+	case "rx":
+		op.rx, err = compileRx(op.Arg)
+	case "pm":
+		op.phrases = phrasesOf(op.Arg)
+	case "pmf", "pmFromFile":
+		op.phrases, err = readPhraseFiles(op.Arg, dataDir)
+	case "ipMatch":
+		op.prefixes, err = parsePrefixes(op.Arg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("@%s: %w", op.Name, err)
+	}
+	op.literals = operatorLiterals(op)
+	return op, nil
+}
+
+// Regexp returns the compiled pattern of a macro-free @rx operator; it is
+// nil for patterns only the backtracking engine supports
+func (o *Operator) Regexp() *regexp.Regexp {
+	if o.rx == nil {
+		return nil
+	}
+	return o.rx.re
+}
+
+// Backtracking reports whether the operator may run a backtracking regex,
+// whose time the caller has to bound. Macro patterns are only known when
+// they are expanded, so they count as backtracking.
+func (o *Operator) Backtracking() bool {
+	return o.Name == "rx" && (o.Macros || (o.rx != nil && o.rx.pcre != nil))
+}
+
+// Match evaluates the operator against one value. arg is the macro-expanded
+// argument and is only used when o.Macros is set.
+func (o *Operator) Match(value, arg string) bool {
+	match, _ := o.MatchErr(value, arg)
+	return match
+}
+
+// MatchErr is Match for callers that enforce regex time limits. A regex
+// that runs out of time reports no match and utils.ErrRegexTimeout,
+// whether or not the operator is negated.
+func (o *Operator) MatchErr(value, arg string) (bool, error) {
+	match, err := o.match(value, arg)
+	if err != nil {
+		return false, err
+	}
+	return match != o.Negate, nil
+}
+
+func (o *Operator) match(value, arg string) (bool, error) {
+	if !o.Macros {
+		arg = o.Arg
+	}
+	switch o.Name {
+	case "rx":
+		rx := o.rx
+		if rx == nil {
+			rx = dynamicRx(arg)
+		}
+		if rx == nil {
+			return false, nil
+		}
+		return rx.match(value)
+	}
+	return o.matchPlain(value, arg), nil
+}
+
+// matchPlain evaluates the operators other than @rx, which cannot fail
+func (o *Operator) matchPlain(value, arg string) bool {
+	switch o.Name {
+	case "pm", "pmf", "pmFromFile":
+		phrases := o.phrases
+		if o.Macros {
+			phrases = phrasesOf(arg)
+		}
+		value = strings.ToLower(value)
+		for _, p := range phrases {
+			if strings.Contains(value, p) {
+				return true
+			}
+		}
+		return false
+	case "streq":
+		return value == arg
+	case "contains":
+		return strings.Contains(value, arg)
+	case "beginsWith":
+		return strings.HasPrefix(value, arg)
+	case "endsWith":
+		return strings.HasSuffix(value, arg)
+	case "within":
+		return strings.Contains(arg, value)
+	case "eq", "ge", "gt", "le", "lt":
+		return compareInts(o.Name, toInt(value), toInt(arg))
+	case "ipMatch":
+		prefixes := o.prefixes
+		if o.Macros {
+			prefixes, _ = parsePrefixes(arg)
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return false
+		}
+		for _, p := range prefixes {
+			if p.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	case "unconditionalMatch":
+		return true
+	default: // noMatch
+		return false
+	}
+}
+
+// toInt converts like ModSecurity: leading blanks are ignored and anything
+// that is not a number counts as 0
+func toInt(s string) int64 {
+	n, _ := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	return n
+}
+
+func compareInts(name string, a, b int64) bool {
+	switch name {
+	case "eq":
+		return a == b
+	case "ge":
+		return a >= b
+	case "gt":
+		return a > b
+	case "le":
+		return a <= b
+	default:
+		return a < b
+	}
+}
+
+// ----------------------------
+// Operator argument helpers
+// ----------------------------
+
+// phrasesOf splits a @pm argument into lower-cased phrases
+func phrasesOf(arg string) []string {
+	fields := strings.Fields(arg)
+	for i, f := range fields {
+		fields[i] = strings.ToLower(f)
+	}
+	return fields
+}
+
+// readPhraseFiles loads the phrase lists of @pmFromFile, one phrase per line
+func readPhraseFiles(arg, dataDir string) ([]string, error) {
+	var phrases []string
+	for _, name := range strings.Fields(arg) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dataDir, name)
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				phrases = append(phrases, strings.ToLower(line))
+			}
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return phrases, nil
+}
+
+// parsePrefixes reads the comma separated addresses and CIDR blocks of @ipMatch
+func parsePrefixes(arg string) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for _, s := range strings.Split(arg, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if strings.Contains(s, "/") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return out, nil
+}
+
+// ----------------------------
+// @rx patterns
+// ----------------------------
+
+// rxPattern is a compiled @rx pattern. Go's RE2 engine runs in linear
+// time and is used whenever it accepts the pattern; PCRE-only syntax
+// (lookarounds, atomic groups, backreferences) falls back to regexp2,
+// whose matches are bounded by utils.RegexTimeout.
+type rxPattern struct {
+	re   *regexp.Regexp
+	pcre *regexp2.Regexp
+}
+
+// pcreFallback lets @rx patterns RE2 rejects (lookarounds, atomic groups,
+// backreferences) run on the backtracking engine instead of disabling
+// their rule
+var pcreFallback atomic.Bool
+
+// SetPCREFallback turns the backtracking fallback of @rx patterns on or off
+// (the default). It applies to patterns compiled afterwards, so it has to
+// be called before the rules are loaded.
+func SetPCREFallback(on bool) {
+	pcreFallback.Store(on)
+}
+
+func compileRx(pattern string) (*rxPattern, error) {
+	re, err := regexp.Compile(pattern)
+	if err == nil {
+		return &rxPattern{re: re}, nil
+	}
+	pcre, pcreErr := utils.CompilePCRE(pattern, regexp2.None)
+	if pcreErr != nil {
+		// The RE2 error is the more familiar one for patterns neither accepts
+		return nil, err
+	}
+	if !pcreFallback.Load() {
+		return nil, fmt.Errorf("%w (PCRE-only syntax and the PCRE fallback is off)", err)
+	}
+	return &rxPattern{pcre: pcre}, nil
+}
+
+func (p *rxPattern) match(value string) (bool, error) {
+	if p.re != nil {
+		return p.re.MatchString(value), nil
+	}
+	return utils.MatchPCRE(p.pcre, value)
+}
+
+// maxDynamicRegexps bounds the cache of patterns built from macros
+const maxDynamicRegexps = 1024
+
+var dynamicRegexps = struct {
+	sync.Mutex
+	m map[string]*rxPattern
+}{m: make(map[string]*rxPattern)}
+
+// dynamicRx compiles a macro-expanded @rx pattern, caching the result;
+// an invalid pattern yields nil
+func dynamicRx(pattern string) *rxPattern {
+	dynamicRegexps.Lock()
+	defer dynamicRegexps.Unlock()
+	if rx, ok := dynamicRegexps.m[pattern]; ok {
+		return rx
+	}
+	rx, _ := compileRx(pattern)
+	if len(dynamicRegexps.m) < maxDynamicRegexps {
+		dynamicRegexps.m[pattern] = rx
+	}
+	return rx
+}
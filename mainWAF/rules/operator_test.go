@@ -0,0 +1,31 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPCREFallback(t *testing.T) {
+	defer SetPCREFallback(false)
+	const lookbehind = `@rx (?<=user=)admin`
+
+	SetPCREFallback(false)
+	if _, err := ParseOperator(lookbehind, ""); err == nil || !strings.Contains(err.Error(), "PCRE fallback is off") {
+		t.Errorf("fallback off: err = %v, want the rule disabled", err)
+	}
+	if op, err := ParseOperator(`@rx ^admin$`, ""); err != nil || op.Backtracking() {
+		t.Errorf("RE2 pattern: %v, backtracking %v", err, op != nil && op.Backtracking())
+	}
+
+	SetPCREFallback(true)
+	op, err := ParseOperator(lookbehind, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Backtracking() || !op.Match("user=admin", "") || op.Match("admin", "") {
+		t.Errorf("fallback on: backtracking %v, want a working lookbehind", op.Backtracking())
+	}
+	if got := countPCRERules([]Rule{{Op: op}, {Chain: []Rule{{Op: op}}}, {}}); got != 2 {
+		t.Errorf("countPCRERules = %d, want 2", got)
+	}
+}
@@ -0,0 +1,156 @@
+package rules
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// ----------------------------
+// Required literals of an operator (regex prefilter)
+// ----------------------------
+
+// maxLiterals caps the alternatives a single operator may require; larger
+// sets filter too little to be worth checking
+const maxLiterals = 64
+
+// Literals returns strings of which at least one occurs, ASCII
+// case-insensitively, in every value the operator matches (before
+// negation). It is nil when no such set is known.
+func (o *Operator) Literals() []string {
+	return o.literals
+}
+
+// operatorLiterals computes Operator.literals at load time
+func operatorLiterals(o *Operator) []string {
+	switch o.Name {
+	case "rx":
+		re, err := syntax.Parse(o.Arg, syntax.Perl)
+		if err != nil {
+			return nil
+		}
+		return requiredLiterals(re.Simplify())
+	case "pm", "pmf", "pmFromFile":
+		if len(o.phrases) == 0 {
+			return nil
+		}
+		for _, p := range o.phrases {
+			if p == "" || !isASCII(p) {
+				return nil
+			}
+		}
+		return o.phrases
+	}
+	return nil
+}
+
+// requiredLiterals walks a regex: a literal is required as is, a
+// concatenation requires the most selective literal set of its parts and
+// an alternation requires one of the literals of every branch
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		s := string(re.Rune)
+		if s == "" || !isASCII(s) {
+			return nil
+		}
+		return []string{strings.ToLower(s)}
+
+	case syntax.OpCharClass:
+		// Small ASCII classes such as ['"`] require one of their bytes
+		var lits []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if hi >= 0x80 || hi-lo > 8 {
+				return nil
+			}
+			for r := lo; r <= hi; r++ {
+				lits = append(lits, strings.ToLower(string(r)))
+			}
+		}
+		return dedupeLiterals(lits)
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+		return nil
+
+	case syntax.OpConcat:
+		var best []string
+		for _, sub := range re.Sub {
+			if lits := requiredLiterals(sub); moreSelective(lits, best) {
+				best = lits
+			}
+		}
+		return best
+
+	case syntax.OpAlternate:
+		var lits []string
+		for _, sub := range re.Sub {
+			alt := requiredLiterals(sub)
+			if alt == nil {
+				return nil
+			}
+			lits = append(lits, alt...)
+		}
+		return dedupeLiterals(lits)
+	}
+	// Empty matches, anchors, wildcards, optional parts: nothing required
+	return nil
+}
+
+// moreSelective prefers longer shortest literals, then fewer literals
+func moreSelective(a, b []string) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	if la, lb := shortest(a), shortest(b); la != lb {
+		return la > lb
+	}
+	return len(a) < len(b)
+}
+
+func shortest(lits []string) int {
+	n := len(lits[0])
+	for _, l := range lits[1:] {
+		n = min(n, len(l))
+	}
+	return n
+}
+
+// dedupeLiterals removes duplicates and literals that contain a shorter
+// one of the set, since the shorter one occurs whenever they do
+func dedupeLiterals(lits []string) []string {
+	var out []string
+	for i, l := range lits {
+		redundant := false
+		for j, other := range lits {
+			if i != j && strings.Contains(l, other) && (len(other) < len(l) || j < i) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			out = append(out, l)
+		}
+	}
+	if len(out) == 0 || len(out) > maxLiterals {
+		return nil
+	}
+	return out
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
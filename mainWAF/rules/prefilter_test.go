@@ -0,0 +1,110 @@
+package rules
+
+import (
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"testing"
+
+	"waf-engine/mainWAF/utils"
+)
+
+func TestRequiredLiterals(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{`union\s+select`, []string{"select"}},
+		{`(?i)<SCRIPT`, []string{"<script"}},
+		{`^$`, nil},
+		{`.*`, nil},
+		{`x*`, nil},
+		// alternation needs one literal of every branch
+		{`foo|bar`, []string{"foo", "bar"}},
+		{`(?:foo|bar)\s*=`, []string{"foo", "bar"}},
+		{`foo|.*`, nil},
+		{`(?:foo|)bar`, []string{"bar"}},
+		// common prefixes are factored out by the parser
+		{`select|selection`, []string{"select"}},
+		{`abc|abd`, []string{"ab"}},
+		// optional parts are not required
+		{`(?:evil)?safe`, []string{"safe"}},
+		{`on(?:load)?error`, []string{"error"}},
+		{`(?:evil)?`, nil},
+		{`(?:evil){0,2}x`, []string{"x"}},
+		{`(?:evil){2,}`, []string{"evil"}},
+		{`(?:evil)+`, []string{"evil"}},
+		// small ASCII classes
+		{`["'\x60]`, []string{`"`, "'", "`"}},
+		{`[a-z]+`, nil},
+		{`[^a]`, nil},
+		// case folding: (?i)k and (?i)s also match U+212A and U+017F,
+		// which the scanner folds to k and s
+		{`(?i)k`, []string{"k"}},
+		{`(?i)s`, []string{"s"}},
+		{`(?i)[ks]ill`, []string{"ill"}},
+		// non-ASCII literals are not required
+		{`café`, nil},
+		{`café\s+bar`, []string{"bar"}},
+		{`(?i)straße`, nil},
+	} {
+		re, err := syntax.Parse(tc.pattern, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := requiredLiterals(re.Simplify()); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: literals %q, want %q", tc.pattern, got, tc.want)
+		}
+	}
+
+	// Too many alternatives filter too little
+	var words []string
+	for c := byte('!'); len(words) <= maxLiterals; c++ {
+		// distinct first bytes, so the parser cannot factor them, and no
+		// upper case letters, which would fold onto the lower case ones
+		if c < 'A' || c > 'Z' {
+			words = append(words, regexp.QuoteMeta(string(c))+"zz")
+		}
+	}
+	re, _ := syntax.Parse(strings.Join(words, "|"), syntax.Perl)
+	if got := requiredLiterals(re.Simplify()); got != nil {
+		t.Errorf("%d alternatives: literals %q, want none", len(words), got)
+	}
+}
+
+// Every value an operator matches contains one of its literals, as the
+// prefilter's scanner sees it
+func TestLiteralsNeverMissAMatch(t *testing.T) {
+	values := []string{
+		"kill", "KILL", "\u212aill", "\u212aelvin", "\u017fcript", "<\u017fCRIPT>", "adm\u0130n", "ADM\u0130N",
+		"union select", "UNION\tSELECT", "union \u017felect", "onerror", "onloaderror", "x=`id`",
+		"abd", "selection", "safe", "evilsafe", "café bar", "xx",
+	}
+	for _, arg := range []string{
+		`@rx (?i)kill`, `@rx (?i)kelvin`, `@rx (?i)<script`, `@rx (?i)union\s+select`, `@rx on(?:load)?error`,
+		`@rx ["'\x60]`, `@rx abc|abd`, `@rx (?:evil)?safe`, `@rx café\s+bar`, `@rx (?i)[ks]ill`,
+		`@pm kill admin select`, `@pm safe`,
+	} {
+		op, err := ParseOperator(arg, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lits := op.Literals()
+		if lits == nil {
+			t.Errorf("%s has no literals", arg)
+			continue
+		}
+		ac := utils.NewAhoCorasick(lits)
+		for _, v := range values {
+			if !op.Match(v, "") {
+				continue
+			}
+			found := make([]uint64, ac.Words())
+			ac.Scan(v, found)
+			if found[0] == 0 {
+				t.Errorf("%s matches %q, but none of %q is found in it", arg, v, lits)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package rules
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ----------------------------
+// Nested quantifier linter (ReDoS)
+// ----------------------------
+
+// NestedQuantifiers returns the groups of a regex that are repeated without
+// bound while containing a repetition themselves, e.g. "(a+)+" or
+// "(?:\w*,)*". On a backtracking engine the time such a group takes to
+// fail can grow exponentially with the input.
+func NestedQuantifiers(pattern string) []string {
+	type group struct {
+		start    int
+		repeated bool // contains a quantifier allowing more than one repetition
+	}
+	var (
+		stack  = []group{{start: -1}}
+		closed *group // the group just closed, if the previous token was ')'
+		found  []string
+	)
+
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		if n, unbounded, repeats := quantifierAt(pattern, i); n > 0 {
+			end := i + n
+			// Lazy (+?) and possessive (++) suffixes do not change the repetition
+			if end < len(pattern) && (pattern[end] == '?' || pattern[end] == '+') {
+				end++
+			}
+			if closed != nil && closed.repeated && unbounded {
+				found = append(found, pattern[closed.start:end])
+			}
+			if repeats {
+				stack[len(stack)-1].repeated = true
+			}
+			closed = nil
+			i = end
+			continue
+		}
+
+		closed = nil
+		switch c {
+		case '\\':
+			i += 2
+		case '[':
+			i = classEnd(pattern, i)
+		case '(':
+			stack = append(stack, group{start: i})
+			i++
+			// "(?:", "(?i)", "(?=": the '?' is not a quantifier
+			if i < len(pattern) && pattern[i] == '?' {
+				i++
+			}
+		case ')':
+			if len(stack) > 1 {
+				g := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if g.repeated {
+					stack[len(stack)-1].repeated = true
+				}
+				closed = &g
+			}
+			i++
+		default:
+			i++
+		}
+	}
+	return found
+}
+
+// quantifierAt returns the length of the quantifier at pattern[i], zero if
+// there is none, whether it is unbounded and whether it allows a varying
+// number of repetitions above one
+func quantifierAt(pattern string, i int) (n int, unbounded, repeats bool) {
+	switch pattern[i] {
+	case '*', '+':
+		return 1, true, true
+	case '?':
+		return 1, false, false
+	case '{':
+		end := strings.IndexByte(pattern[i:], '}')
+		if end < 0 {
+			return 0, false, false
+		}
+		lo, hi, hasComma := strings.Cut(pattern[i+1:i+end], ",")
+		if _, err := strconv.Atoi(lo); err != nil {
+			return 0, false, false // a literal '{'
+		}
+		if !hasComma {
+			// An exact count such as {4} leaves nothing to backtrack over
+			return end + 1, false, false
+		}
+		if hi == "" {
+			return end + 1, true, true
+		}
+		most, err := strconv.Atoi(hi)
+		if err != nil {
+			return 0, false, false
+		}
+		return end + 1, false, most > 1
+	}
+	return 0, false, false
+}
+
+// classEnd returns the index just past the character class starting at
+// pattern[i], which is '['
+func classEnd(pattern string, i int) int {
+	i++
+	if i < len(pattern) && pattern[i] == '^' {
+		i++
+	}
+	if i < len(pattern) && pattern[i] == ']' {
+		i++ // a leading ']' is a literal
+	}
+	for i < len(pattern) {
+		switch {
+		case pattern[i] == '\\':
+			i += 2
+		case pattern[i] == '[' && i+1 < len(pattern) && pattern[i+1] == ':':
+			// POSIX classes such as [:alpha:]
+			if end := strings.Index(pattern[i:], ":]"); end >= 0 {
+				i += end + 2
+			} else {
+				i++
+			}
+		case pattern[i] == ']':
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return i
+}
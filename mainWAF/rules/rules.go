@@ -2,62 +2,261 @@ package rules
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"waf-engine/mainWAF/utils"
 )
 
 // Rule defines a single WAF rule structure
 type Rule struct {
-	ID         string         `yaml:"id"`
-	Name       string         `yaml:"name"`
-	Variable   string         `yaml:"variable"`
-	Regex      string         `yaml:"regex"`
-	Phase      int            `yaml:"phase"`
-	Severity   string         `yaml:"severity"`
-	Block      bool           `yaml:"block"`
-	Transforms []string       `yaml:"transforms,omitempty"`
-	Tags       []string       `yaml:"tags,omitempty"`
-	Paranoia   int            `yaml:"paranoia_level,omitempty"`
-	Controls   []string       `yaml:"controls,omitempty"`
-	Chain      []Rule         `yaml:"chain,omitempty"`
-	Compiled   *regexp.Regexp `yaml:"-"`
-}
-
-// AllRules holds every rule loaded from YAML
+	ID           string        `yaml:"id"`
+	Name         string        `yaml:"name"`
+	Variable     string        `yaml:"variable"`
+	Regex        string        `yaml:"regex"` // regular expression or operator, e.g. "!@within %{tx.allowed_methods}"
+	Phase        int           `yaml:"phase"`
+	Severity     string        `yaml:"severity"`
+	Block        bool          `yaml:"block"`
+	NoLog        bool          `yaml:"nolog,omitempty"`
+	Transforms   []string      `yaml:"transforms,omitempty"`
+	Tags         []string      `yaml:"tags,omitempty"`
+	Paranoia     int           `yaml:"paranoia_level,omitempty"`
+	Controls     []string      `yaml:"controls,omitempty"`
+	Chain        []Rule        `yaml:"chain,omitempty"`
+	InitCol      []string      `yaml:"initcol,omitempty"`       // e.g. "ip=%{REMOTE_ADDR}"
+	SetVar       []string      `yaml:"setvar,omitempty"`        // e.g. "ip.bf_counter=+1"
+	ExpireVar    []string      `yaml:"expirevar,omitempty"`     // e.g. "ip.bf_counter=60"
+	Skip         int           `yaml:"skip,omitempty"`          // skip the next N rules of the phase
+	SkipAfter    string        `yaml:"skip_after,omitempty"`    // skip to the marker of that name
+	Marker       string        `yaml:"marker,omitempty"`        // SecMarker: a named position, not a rule
+	When         *Condition    `yaml:"when,omitempty"`          // higher-level conditions instead of variable/regex
+	VirtualPatch *VirtualPatch `yaml:"virtual_patch,omitempty"` // positive schema of one endpoint
+	Tests        []RuleTest    `yaml:"tests,omitempty"`         // run with `waf test-rules`
+	Category     string        `yaml:"-"`
+	Op           *Operator     `yaml:"-"` // nil when the operator is not supported
+}
+
+// RuleTest is an inline test case of a rule. Inputs are keyed by variable,
+// e.g. "ARGS:id", "REQUEST_HEADERS:User-Agent", "REQUEST_METHOD" or
+// "TX:blocking_paranoia_level"; Transformed holds the value a variable must
+// have after the rule's transformations.
+type RuleTest struct {
+	Name        string            `yaml:"name,omitempty"`
+	Inputs      map[string]string `yaml:"inputs"`
+	Match       bool              `yaml:"match"`
+	Transformed map[string]string `yaml:"transformed,omitempty"`
+}
+
+// categoryFromPath derives a rule category from its file name,
+// e.g. "parsed_rules/rules_sqli.yaml" -> "sqli" and
+// "rules/REQUEST-942-APPLICATION-ATTACK-SQLI.conf" -> "sqli"
+func categoryFromPath(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if m := crsFilePattern.FindStringSubmatch(name); m != nil && crsCategories[m[1]] != "" {
+		return crsCategories[m[1]]
+	}
+	return strings.TrimPrefix(name, "rules_")
+}
+
+// AllRules holds every rule loaded from YAML and SecLang files
 var AllRules []Rule
 
-// LoadRules walks through a directory and loads all YAML rule files
+// LoadRules walks through a directory and loads all YAML rule files and
+// ModSecurity .conf files. The .conf files share one loader, so
+// SecRuleRemoveById and friends reach rules of earlier files; their rules
+// are added after the YAML ones. YAML files of the anomaly evaluation
+// categories load after all other YAML files, since they act on the scores
+// the other rules of their phase add up.
 func LoadRules(dir string) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() || filepath.Ext(path) != ".yaml" {
+	before := len(AllRules)
+	secLang := newSecLangLoader()
+	var evaluation []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
 			return nil
 		}
-
-		data, err := os.ReadFile(path)
+		switch filepath.Ext(path) {
+		case ".conf":
+			if err := secLang.loadFile(path); err != nil {
+				return err
+			}
+			slog.Info("loaded SecLang file", "file", path, "rules_so_far", len(secLang.rules))
+		case ".yaml":
+			if evaluatedLast[categoryFromPath(path)] {
+				evaluation = append(evaluation, path)
+				return nil
+			}
+			return loadYAMLFile(path)
+		}
+		return nil
+	})
+	for _, path := range evaluation {
 		if err != nil {
-			log.Printf("⚠️ Could not read %s: %v", path, err)
-			return nil
+			break
 		}
+		err = loadYAMLFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	AllRules = append(AllRules, secLang.rules...)
+	if n := countPCRERules(AllRules[before:]); n > 0 {
+		slog.Info("PCRE fallback enabled rules RE2 cannot compile", "rules", n)
+	}
+	return nil
+}
 
-		var rules []Rule
-		if err := yaml.Unmarshal(data, &rules); err != nil {
-			// skip non-rule YAMLs (like configs)
-			return nil
-		}
+// evaluatedLast are the categories of the CRS 949/959 blocking evaluation
+// and 980 correlation files, which come last in CRS as well
+var evaluatedLast = map[string]bool{"blocking_evaluation": true, "correlation": true}
+
+// loadYAMLFile compiles the rules of one YAML file and adds them to AllRules
+func loadYAMLFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("could not read rule file", "file", path, "err", err)
+		return nil
+	}
+
+	var rules []Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		// skip non-rule YAMLs (like configs)
+		return nil
+	}
 
-		// ✅ Compile regex for each rule
-		for i := range rules {
-			if rules[i].Regex != "" {
-				rules[i].Compiled, _ = regexp.Compile(rules[i].Regex)
+	// ✅ Compile the operator of each rule and its chain
+	category := categoryFromPath(path)
+	loaded := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		if r.Marker != "" {
+			loaded = append(loaded, r)
+			continue
+		}
+		if r.ID == "" {
+			slog.Warn("skipping rule without id", "file", path, "variable", r.Variable)
+			continue
+		}
+		r.Category = category
+		if marker := chainMarker(r); marker != "" {
+			return fmt.Errorf("%s: rule %s: marker %q inside a chain", path, r.ID, marker)
+		}
+		if r.When != nil || r.VirtualPatch != nil {
+			// One chained rule per alternative or violation, sharing the ID
+			compile := compileConditions
+			if r.VirtualPatch != nil {
+				compile = compileVirtualPatch
 			}
+			alts, err := compile(r)
+			if err != nil {
+				return fmt.Errorf("%s: rule %s: %w", path, r.ID, err)
+			}
+			for i := range alts {
+				compileRule(&alts[i], r.ID, filepath.Dir(path))
+			}
+			loaded = append(loaded, alts...)
+			continue
 		}
+		compileRule(&r, r.ID, filepath.Dir(path))
+		loaded = append(loaded, r)
+	}
 
-		AllRules = append(AllRules, rules...)
-		fmt.Printf("📜 Loaded %d rules from %s\n", len(rules), path)
-		return nil
-	})
+	AllRules = append(AllRules, loaded...)
+	slog.Info("loaded rule file", "file", path, "rules", len(loaded))
+	return nil
+}
+
+// chainMarker returns the name of a marker used as a chain link, which
+// skipAfter could never reach
+func chainMarker(r Rule) string {
+	for _, link := range r.Chain {
+		if link.Marker != "" {
+			return link.Marker
+		}
+		if m := chainMarker(link); m != "" {
+			return m
+		}
+	}
+	return ""
+}
+
+// AddsAnomalyScore reports whether a rule or one of its chain links adds to
+// a CRS anomaly score, e.g. setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'.
+// In CRS such a rule only scores: its block action defers to the 949/959
+// blocking evaluation, which denies once the score reaches the threshold.
+func AddsAnomalyScore(r Rule) bool {
+	for _, spec := range r.SetVar {
+		target, value, _ := strings.Cut(spec, "=")
+		target = strings.ToLower(strings.TrimSpace(target))
+		if strings.HasPrefix(target, "tx.") && strings.Contains(target, "anomaly_score") && strings.HasPrefix(value, "+") {
+			return true
+		}
+	}
+	for _, link := range r.Chain {
+		if AddsAnomalyScore(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// countPCRERules counts the rules with an @rx pattern, in the rule or its
+// chain, that only compiled on the backtracking engine
+func countPCRERules(list []Rule) int {
+	n := 0
+	for _, r := range list {
+		if usesPCRE(r) {
+			n++
+		}
+	}
+	return n
+}
+
+func usesPCRE(r Rule) bool {
+	if r.Op != nil && r.Op.rx != nil && r.Op.rx.pcre != nil {
+		return true
+	}
+	for _, link := range r.Chain {
+		if usesPCRE(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileRule parses the operator of a rule and of every chained rule;
+// rules with an unsupported operator keep a nil Op and never match
+func compileRule(r *Rule, id, dataDir string) {
+	op, err := ParseOperator(r.Regex, dataDir)
+	if err != nil {
+		slog.Warn("rule operator not supported, rule disabled", "rule", id, "err", err)
+	}
+	r.Op = op
+	lintRegex(op, id)
+	for _, t := range r.Transforms {
+		if !utils.IsTransform(t) {
+			slog.Warn("unsupported transformation ignored", "rule", id, "transform", t)
+		}
+	}
+	for i := range r.Chain {
+		compileRule(&r.Chain[i], id, dataDir)
+	}
+}
+
+// lintRegex reports nested quantifiers of an @rx pattern. They only cost
+// time on the backtracking engine; RE2 matches them in linear time.
+func lintRegex(op *Operator, id string) {
+	if op == nil || op.Name != "rx" || op.Macros {
+		return
+	}
+	for _, group := range NestedQuantifiers(op.Arg) {
+		if op.Backtracking() {
+			slog.Warn("regex has nested quantifiers and may backtrack catastrophically", "rule", id, "group", group)
+		} else {
+			slog.Debug("regex has nested quantifiers, harmless under RE2", "rule", id, "group", group)
+		}
+	}
 }
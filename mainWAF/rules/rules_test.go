@@ -0,0 +1,75 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddsAnomalyScore(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule Rule
+		want bool
+	}{
+		{"inbound score", Rule{SetVar: []string{"tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}"}}, true},
+		{"upper case target", Rule{SetVar: []string{"TX.Outbound_Anomaly_Score_PL2=+5"}}, true},
+		{"score in a chain link", Rule{Chain: []Rule{{}, {SetVar: []string{"tx.inbound_anomaly_score_pl1=+3"}}}}, true},
+		{"score reset", Rule{SetVar: []string{"tx.inbound_anomaly_score_pl1=0"}}, false},
+		{"other TX variable", Rule{SetVar: []string{"tx.sql_injection_score=+5"}}, false},
+		{"collection variable", Rule{SetVar: []string{"ip.anomaly_score=+1"}}, false},
+		{"no setvar", Rule{}, false},
+	} {
+		if got := AddsAnomalyScore(tc.rule); got != tc.want {
+			t.Errorf("%s: AddsAnomalyScore = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadRulesOrder(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		// sorts before the attack categories
+		"rules_blocking_evaluation.yaml": `
+- id: "949110"
+  variable: TX:BLOCKING_INBOUND_ANOMALY_SCORE
+  regex: "@ge 5"
+  phase: 2
+  block: true
+`,
+		"rules_xss.yaml": `
+- id: "941100"
+  variable: ARGS
+  regex: "<script"
+  phase: 2
+`,
+		"REQUEST-942-APPLICATION-ATTACK-SQLI.conf": `
+SecRule ARGS "@rx union select" "id:942100,phase:2,block,setvar:'tx.inbound_anomaly_score_pl1=+5'"
+SecRule ARGS "@rx sleep\(" "id:942160,phase:2,block"
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	AllRules = nil
+	defer func() { AllRules = nil }()
+	if err := LoadRules(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	block := map[string]bool{}
+	for _, r := range AllRules {
+		ids = append(ids, r.ID)
+		block[r.ID] = r.Block
+	}
+	if len(ids) != 4 || ids[0] != "941100" || ids[1] != "949110" {
+		t.Errorf("rules loaded in the order %v, want the blocking evaluation after the other YAML rules", ids)
+	}
+	// A scoring block rule leaves blocking to the evaluation
+	if block["942100"] || !block["942160"] || !block["949110"] {
+		t.Errorf("block actions %v", block)
+	}
+}
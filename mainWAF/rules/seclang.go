@@ -0,0 +1,488 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------
+// Native ModSecurity (SecLang) configuration loader
+// ----------------------------
+
+// SyntaxError reports an invalid directive together with its location
+type SyntaxError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// directive is one logical configuration line split into its arguments
+type directive struct {
+	Name string
+	Args []string
+	File string
+	Line int
+}
+
+// secLangLoader turns directives into rules. Removals and target updates
+// apply to every rule loaded before them, across files.
+type secLangLoader struct {
+	rules  []Rule
+	loaded map[string]bool // absolute paths, guards against Include loops
+	chain  *Rule           // last rule of an open chain
+	block  bool            // the rule being built uses the block action
+}
+
+func newSecLangLoader() *secLangLoader {
+	return &secLangLoader{loaded: make(map[string]bool)}
+}
+
+// LoadSecLang reads a ModSecurity configuration file (and everything it
+// includes) and returns its rules, compiled and ready for the evaluator
+func LoadSecLang(path string) ([]Rule, error) {
+	l := newSecLangLoader()
+	if err := l.loadFile(path); err != nil {
+		return nil, err
+	}
+	return l.rules, nil
+}
+
+func (l *secLangLoader) loadFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+
+	directives, err := readDirectives(path)
+	if err != nil {
+		return err
+	}
+	for _, d := range directives {
+		if err := l.apply(d); err != nil {
+			return err
+		}
+	}
+	if l.chain != nil {
+		l.chain = nil
+		return &SyntaxError{File: path, Line: directives[len(directives)-1].Line, Msg: "chain is not terminated by a following SecRule"}
+	}
+	return nil
+}
+
+func (l *secLangLoader) apply(d directive) error {
+	fail := func(format string, args ...any) error {
+		return &SyntaxError{File: d.File, Line: d.Line, Msg: fmt.Sprintf(format, args...)}
+	}
+	if l.chain != nil && !strings.EqualFold(d.Name, "SecRule") {
+		return fail("%s cannot continue a chain, SecRule expected", d.Name)
+	}
+
+	switch strings.ToLower(d.Name) {
+	case "secrule":
+		if len(d.Args) < 2 || len(d.Args) > 3 {
+			return fail("SecRule takes 2 or 3 arguments, got %d", len(d.Args))
+		}
+		actions := ""
+		if len(d.Args) == 3 {
+			actions = d.Args[2]
+		}
+		return l.addRule(d, d.Args[0], d.Args[1], actions)
+
+	case "secaction":
+		if len(d.Args) != 1 {
+			return fail("SecAction takes 1 argument, got %d", len(d.Args))
+		}
+		return l.addRule(d, "", "@unconditionalMatch", d.Args[0])
+
+	case "secmarker":
+		if len(d.Args) != 1 {
+			return fail("SecMarker takes 1 argument, got %d", len(d.Args))
+		}
+		l.rules = append(l.rules, Rule{Marker: d.Args[0]})
+
+	case "secruleremovebyid":
+		if len(d.Args) == 0 {
+			return fail("SecRuleRemoveById needs at least one id")
+		}
+		var ranges [][2]int
+		for _, arg := range d.Args {
+			for _, field := range strings.Fields(arg) {
+				lo, hi, err := parseIDRange(field)
+				if err != nil {
+					return fail("%v", err)
+				}
+				ranges = append(ranges, [2]int{lo, hi})
+			}
+		}
+		kept := l.rules[:0]
+		for _, r := range l.rules {
+			if !idInRanges(r.ID, ranges) {
+				kept = append(kept, r)
+			}
+		}
+		l.rules = kept
+
+	case "secruleupdatetargetbyid":
+		if len(d.Args) != 2 {
+			return fail("SecRuleUpdateTargetById takes 2 arguments, got %d", len(d.Args))
+		}
+		found := false
+		for i := range l.rules {
+			if l.rules[i].ID == d.Args[0] {
+				l.rules[i].Variable += "|" + d.Args[1]
+				found = true
+			}
+		}
+		if !found {
+			return fail("SecRuleUpdateTargetById: rule %s is not defined", d.Args[0])
+		}
+
+	case "include":
+		if len(d.Args) != 1 {
+			return fail("Include takes 1 argument, got %d", len(d.Args))
+		}
+		pattern := d.Args[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(d.File), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fail("Include %s: %v", d.Args[0], err)
+		}
+		if len(matches) == 0 {
+			return fail("Include %s: no such file", d.Args[0])
+		}
+		for _, m := range matches {
+			if err := l.loadFile(m); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if !strings.HasPrefix(d.Name, "Sec") {
+			return fail("unknown directive %q", d.Name)
+		}
+		// Engine settings (SecRuleEngine, SecDefaultAction, ...) have no
+		// equivalent here
+		slog.Warn("SecLang directive not supported, ignored", "file", d.File, "line", d.Line, "directive", d.Name)
+	}
+	return nil
+}
+
+// addRule builds a rule from SecRule/SecAction arguments and attaches it
+// to an open chain when the previous rule asked for one
+func (l *secLangLoader) addRule(d directive, variable, operator, actions string) error {
+	r := Rule{Variable: variable, Regex: operator}
+	chained, block, err := parseSecActions(&r, actions)
+	if err != nil {
+		return &SyntaxError{File: d.File, Line: d.Line, Msg: err.Error()}
+	}
+
+	if l.chain != nil {
+		if r.ID != "" {
+			return &SyntaxError{File: d.File, Line: d.Line, Msg: "chained rule cannot have an id"}
+		}
+		l.chain.Chain = append(l.chain.Chain, r)
+		if chained {
+			l.chain = &l.chain.Chain[len(l.chain.Chain)-1]
+		} else {
+			l.chain = nil
+			l.finishRule(&l.rules[len(l.rules)-1], filepath.Dir(d.File))
+		}
+		return nil
+	}
+
+	if r.ID == "" {
+		return &SyntaxError{File: d.File, Line: d.Line, Msg: "rule has no id action"}
+	}
+	r.Category = categoryFromPath(d.File)
+	l.rules = append(l.rules, r)
+	l.block = block
+	if chained {
+		l.chain = &l.rules[len(l.rules)-1]
+	} else {
+		l.finishRule(&l.rules[len(l.rules)-1], filepath.Dir(d.File))
+	}
+	return nil
+}
+
+// finishRule compiles a rule once its chain is complete. The block action
+// of a rule adding to an anomaly score leaves blocking to the evaluation
+// rules (see AddsAnomalyScore); deny and drop always block.
+func (l *secLangLoader) finishRule(r *Rule, dataDir string) {
+	if l.block && AddsAnomalyScore(*r) {
+		r.Block = false
+	}
+	compileRule(r, r.ID, dataDir)
+}
+
+// parseSecActions fills the rule from an action list such as
+// "id:1,phase:2,block,msg:'x',setvar:'tx.a=+1'" and reports the chain and
+// block actions
+func parseSecActions(r *Rule, actions string) (chained, block bool, err error) {
+	for _, part := range splitActions(actions) {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), ":")
+		value = unquoteAction(strings.TrimSpace(value))
+		switch strings.ToLower(name) {
+		case "":
+		case "id":
+			if _, err := strconv.Atoi(value); err != nil {
+				return false, false, fmt.Errorf("invalid id %q", value)
+			}
+			r.ID = value
+		case "msg":
+			r.Name = value
+		case "phase":
+			if r.Phase, err = parsePhase(value); err != nil {
+				return false, false, err
+			}
+		case "severity":
+			r.Severity = parseSeverity(value)
+		case "block":
+			r.Block, block = true, true
+		case "deny", "drop":
+			r.Block = true
+		case "nolog":
+			r.NoLog = true
+		case "chain":
+			chained = true
+		case "t":
+			r.Transforms = append(r.Transforms, value)
+		case "tag":
+			r.Tags = append(r.Tags, value)
+			if lvl, ok := strings.CutPrefix(value, "paranoia-level/"); ok {
+				r.Paranoia, _ = strconv.Atoi(lvl)
+			}
+		case "ctl":
+			r.Controls = append(r.Controls, value)
+		case "initcol":
+			r.InitCol = append(r.InitCol, value)
+		case "setsid":
+			r.InitCol = append(r.InitCol, "session="+value)
+		case "setuid":
+			r.InitCol = append(r.InitCol, "user="+value)
+		case "setvar":
+			r.SetVar = append(r.SetVar, value)
+		case "expirevar":
+			r.ExpireVar = append(r.ExpireVar, value)
+		case "skip":
+			if r.Skip, err = strconv.Atoi(value); err != nil || r.Skip < 1 {
+				return false, false, fmt.Errorf("invalid skip %q", value)
+			}
+		case "skipafter":
+			r.SkipAfter = value
+		}
+	}
+	return chained, block, nil
+}
+
+func parsePhase(v string) (int, error) {
+	switch strings.ToLower(v) {
+	case "request":
+		return 2, nil
+	case "response":
+		return 4, nil
+	case "logging":
+		return 5, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > 5 {
+		return 0, fmt.Errorf("invalid phase %q", v)
+	}
+	return n, nil
+}
+
+// severityNames maps the numeric syslog severities to their names
+var severityNames = []string{"EMERGENCY", "ALERT", "CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+func parseSeverity(v string) string {
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(severityNames) {
+		return severityNames[n]
+	}
+	return strings.ToUpper(v)
+}
+
+// parseIDRange reads "942100" or "942100-942199"
+func parseIDRange(s string) (lo, hi int, err error) {
+	a, b, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(a); err != nil {
+		return 0, 0, fmt.Errorf("invalid rule id %q", s)
+	}
+	hi = lo
+	if isRange {
+		if hi, err = strconv.Atoi(b); err != nil || hi < lo {
+			return 0, 0, fmt.Errorf("invalid rule id range %q", s)
+		}
+	}
+	return lo, hi, nil
+}
+
+func idInRanges(id string, ranges [][2]int) bool {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// splitActions splits an action list on the commas outside single quotes
+func splitActions(actions string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(actions); i++ {
+		switch actions[i] {
+		case '\\':
+			i++
+		case '\'':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, actions[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, actions[start:])
+}
+
+// unquoteAction removes the single quotes around an action value
+func unquoteAction(v string) string {
+	if len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'' {
+		v = strings.ReplaceAll(v[1:len(v)-1], `\'`, `'`)
+	}
+	return v
+}
+
+// ----------------------------
+// Lexer
+// ----------------------------
+
+// readDirectives splits a configuration file into directives. Lines ending
+// in a backslash continue on the next line, '#' starts a comment line and
+// double-quoted arguments may contain spaces and \" escapes.
+func readDirectives(path string) ([]directive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []directive
+	var buf strings.Builder
+	start, lineNo := 0, 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 4<<20)
+	for sc.Scan() {
+		lineNo++
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if buf.Len() == 0 {
+			trimmed := strings.TrimSpace(line)
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			start = lineNo
+		}
+		if cont, ok := strings.CutSuffix(line, "\\"); ok {
+			buf.WriteString(cont)
+			continue
+		}
+		buf.WriteString(line)
+
+		args, err := splitDirective(buf.String())
+		buf.Reset()
+		if err != nil {
+			return nil, &SyntaxError{File: path, Line: start, Msg: err.Error()}
+		}
+		if len(args) == 0 {
+			// only blanks were continued
+			continue
+		}
+		out = append(out, directive{Name: args[0], Args: args[1:], File: path, Line: start})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > 0 {
+		return nil, &SyntaxError{File: path, Line: start, Msg: "unexpected end of file after line continuation"}
+	}
+	return out, nil
+}
+
+// splitDirective tokenizes one logical line
+func splitDirective(s string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i == len(s) {
+			break
+		}
+		if s[i] != '"' {
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '\t' {
+				j++
+			}
+			args = append(args, s[i:j])
+			i = j
+			continue
+		}
+
+		var arg strings.Builder
+		i++
+		closed := false
+		for i < len(s) {
+			c := s[i]
+			if c == '\\' && i+1 < len(s) && s[i+1] == '"' {
+				arg.WriteByte('"')
+				i += 2
+				continue
+			}
+			i++
+			if c == '"' {
+				closed = true
+				break
+			}
+			arg.WriteByte(c)
+		}
+		if !closed {
+			return nil, fmt.Errorf("unterminated quoted argument")
+		}
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// crsFilePattern recognises CRS rule files such as
+// "REQUEST-942-APPLICATION-ATTACK-SQLI.conf"
+var crsFilePattern = regexp.MustCompile(`^(?:REQUEST|RESPONSE)-(\d{3})-`)
+
+// crsCategories maps CRS file numbers to the categories used by the
+// converted YAML rule files
+var crsCategories = map[string]string{
+	"901": "initialization", "905": "common_exceptions", "911": "method_inforcement",
+	"913": "scanner_detection", "920": "protocol_inforcement", "921": "protocol_attack",
+	"922": "multipart_attack", "930": "rfi", "931": "lfi", "932": "rce", "933": "php",
+	"934": "generic_attack", "941": "xss", "942": "sqli", "943": "session_fixation",
+	"944": "java", "949": "blocking_evaluation", "959": "blocking_evaluation", "980": "correlation",
+}
@@ -0,0 +1,369 @@
+package rules
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfs writes the files into a new directory and returns its path
+func writeConfs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func loadConf(t *testing.T, content string) []Rule {
+	t.Helper()
+	dir := writeConfs(t, map[string]string{"rules.conf": content})
+	rules, err := LoadSecLang(filepath.Join(dir, "rules.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func ruleIDs(rules []Rule) []string {
+	var ids []string
+	for _, r := range rules {
+		if r.Marker != "" {
+			ids = append(ids, "marker:"+r.Marker)
+		} else {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+func TestSplitDirective(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{`SecMarker END`, []string{"SecMarker", "END"}, false},
+		{"SecRule\tARGS   \"@rx a b\"  \"id:1\"", []string{"SecRule", "ARGS", "@rx a b", "id:1"}, false},
+		{`SecRule ARGS "@rx [\"']on" "id:1,msg:'say \"hi\"'"`, []string{"SecRule", "ARGS", `@rx ["']on`, `id:1,msg:'say "hi"'`}, false},
+		// other escapes are left to the operator
+		{`SecRule ARGS "@rx \d+\s"`, []string{"SecRule", "ARGS", `@rx \d+\s`}, false},
+		// as in Apache, \\ is no escape, so the closing quote is escaped
+		{`SecRule ARGS "@rx \\"`, nil, true},
+		{`SecAction ""`, []string{"SecAction", ""}, false},
+		{`SecRule ARGS "@rx a`, nil, true},
+		{"   ", nil, false},
+	} {
+		got, err := splitDirective(tc.line)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tc.line, err, tc.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: split into %q, want %q", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestReadDirectives(t *testing.T) {
+	dir := writeConfs(t, map[string]string{"rules.conf": `# comment
+SecRule ARGS "@rx a" \
+    "id:1,\
+    phase:2"
+
+  # indented comment
+SecMarker END
+SecAction \
+    "id:2" \
+
+    \
+
+SecAction "id:3"
+`})
+	got, err := readDirectives(filepath.Join(dir, "rules.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "rules.conf")
+	want := []directive{
+		{Name: "SecRule", Args: []string{"ARGS", "@rx a", "id:1,    phase:2"}, File: path, Line: 2},
+		{Name: "SecMarker", Args: []string{"END"}, File: path, Line: 7},
+		{Name: "SecAction", Args: []string{"id:2"}, File: path, Line: 8},
+		{Name: "SecAction", Args: []string{"id:3"}, File: path, Line: 13},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestSplitActions(t *testing.T) {
+	got := splitActions(`id:1,msg:'a, b',setvar:'tx.x=a,b',logdata:'it\'s, here',t:none`)
+	want := []string{"id:1", "msg:'a, b'", "setvar:'tx.x=a,b'", `logdata:'it\'s, here'`, "t:none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("split into %q, want %q", got, want)
+	}
+
+	var r Rule
+	chained, block, err := parseSecActions(&r, `id:942100, phase:request,block,severity:2,msg:'SQL, injection',`+
+		`t:none,t:urlDecodeUni,tag:'paranoia-level/2',ctl:ruleRemoveTargetById=942100;ARGS:pwd,`+
+		`setvar:'tx.inbound_anomaly_score_pl2=+%{tx.critical_anomaly_score}',skip:2,skipAfter:END,chain`)
+	if err != nil || !chained || !block {
+		t.Fatalf("chained %v, block %v, err %v", chained, block, err)
+	}
+	want2 := Rule{
+		ID: "942100", Name: "SQL, injection", Phase: 2, Severity: "CRITICAL", Block: true,
+		Transforms: []string{"none", "urlDecodeUni"}, Tags: []string{"paranoia-level/2"}, Paranoia: 2,
+		Controls: []string{"ruleRemoveTargetById=942100;ARGS:pwd"},
+		SetVar:   []string{"tx.inbound_anomaly_score_pl2=+%{tx.critical_anomaly_score}"},
+		Skip:     2, SkipAfter: "END",
+	}
+	if !reflect.DeepEqual(r, want2) {
+		t.Errorf("parsed %+v\nwant   %+v", r, want2)
+	}
+}
+
+func TestSecLangChains(t *testing.T) {
+	rules := loadConf(t, `
+SecRule REQUEST_METHOD "@streq POST" "id:10,phase:2,deny,chain"
+    SecRule ARGS:a "@rx x" "t:lowercase,chain"
+        SecRule ARGS:b "@rx y" "setvar:tx.hit=1"
+SecRule ARGS "@rx z" "id:11,phase:2,pass"
+`)
+	if got := ruleIDs(rules); !reflect.DeepEqual(got, []string{"10", "11"}) {
+		t.Fatalf("rules %v", got)
+	}
+	r := rules[0]
+	if len(r.Chain) != 1 || len(r.Chain[0].Chain) != 1 || !r.Block {
+		t.Fatalf("rule 10 %+v, want a blocking chain of three", r)
+	}
+	link, last := r.Chain[0], r.Chain[0].Chain[0]
+	if link.Variable != "ARGS:a" || link.Transforms[0] != "lowercase" || link.Op == nil ||
+		last.Variable != "ARGS:b" || last.SetVar[0] != "tx.hit=1" || last.Op == nil {
+		t.Errorf("chain links %+v and %+v", link, last)
+	}
+}
+
+func TestSecRuleRemoveById(t *testing.T) {
+	rules := loadConf(t, `
+SecAction "id:100"
+SecAction "id:150"
+SecAction "id:199"
+SecAction "id:200"
+SecMarker END
+SecAction "id:300"
+SecAction "id:301"
+SecRuleRemoveById 100-150 "199 300"
+SecAction "id:100"
+`)
+	// Only rules loaded before the directive are removed
+	if got := ruleIDs(rules); !reflect.DeepEqual(got, []string{"200", "marker:END", "301", "100"}) {
+		t.Errorf("rules %v", got)
+	}
+}
+
+func TestSecRuleUpdateTargetById(t *testing.T) {
+	rules := loadConf(t, `
+SecRule ARGS "@rx a" "id:1,phase:2"
+SecRule ARGS "@rx b" "id:2,phase:2"
+SecRuleUpdateTargetById 1 "!ARGS:password"
+SecRuleUpdateTargetById 1 REQUEST_COOKIES
+`)
+	if rules[0].Variable != "ARGS|!ARGS:password|REQUEST_COOKIES" || rules[1].Variable != "ARGS" {
+		t.Errorf("targets %q and %q", rules[0].Variable, rules[1].Variable)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeConfs(t, map[string]string{
+		"main.conf":             "Include rules/*.conf\nSecAction \"id:9\"\n",
+		"rules/a.conf":          "SecAction \"id:1\"\nInclude ../main.conf\n",
+		"rules/b.conf":          "SecAction \"id:2\"\nInclude c/*.conf\n",
+		"rules/c/c.conf":        "SecAction \"id:3\"\n",
+		"rules/not-a-rule.data": "ignored",
+	})
+	rules, err := LoadSecLang(filepath.Join(dir, "main.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Globs expand in file name order; the loop back to main.conf is cut
+	if got := ruleIDs(rules); !reflect.DeepEqual(got, []string{"1", "2", "3", "9"}) {
+		t.Errorf("rules %v", got)
+	}
+
+	// An error in an included file points into that file
+	dir = writeConfs(t, map[string]string{
+		"main.conf":      "SecAction \"id:1\"\nInclude inc/bad.conf\n",
+		"inc/bad.conf":   "SecAction \"id:2\"\n\nSecRule ARGS\n",
+		"inc/other.conf": "",
+	})
+	_, err = LoadSecLang(filepath.Join(dir, "main.conf"))
+	var se *SyntaxError
+	if !errors.As(err, &se) || se.File != filepath.Join(dir, "inc", "bad.conf") || se.Line != 3 {
+		t.Errorf("err = %v, want a syntax error at inc/bad.conf:3", err)
+	}
+}
+
+func TestSecLangErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, conf string
+		line       int
+		msg        string
+	}{
+		{"unterminated quote", "SecAction \"id:1\"\nSecRule ARGS \"@rx a\n", 2, "unterminated quoted argument"},
+		{"continuation at end of file", "SecAction \"id:1\"\nSecAction \\\n", 2, "unexpected end of file after line continuation"},
+		{"SecRule arguments", "SecRule ARGS\n", 1, "SecRule takes 2 or 3 arguments, got 1"},
+		{"SecRule too many arguments", "SecRule ARGS \"@rx a\" \"id:1\" extra\n", 1, "SecRule takes 2 or 3 arguments, got 4"},
+		{"SecAction arguments", "SecAction \"id:1\" \"phase:2\"\n", 1, "SecAction takes 1 argument, got 2"},
+		{"SecMarker arguments", "SecMarker\n", 1, "SecMarker takes 1 argument, got 0"},
+		{"SecRuleRemoveById without id", "SecRuleRemoveById\n", 1, "SecRuleRemoveById needs at least one id"},
+		{"SecRuleRemoveById bad id", "SecRuleRemoveById abc\n", 1, `invalid rule id "abc"`},
+		{"SecRuleRemoveById bad range", "SecRuleRemoveById 200-100\n", 1, `invalid rule id range "200-100"`},
+		{"SecRuleUpdateTargetById arguments", "SecRuleUpdateTargetById 1\n", 1, "SecRuleUpdateTargetById takes 2 arguments, got 1"},
+		{"SecRuleUpdateTargetById unknown rule", "SecAction \"id:1\"\nSecRuleUpdateTargetById 2 ARGS\n", 2, "SecRuleUpdateTargetById: rule 2 is not defined"},
+		{"Include arguments", "Include\n", 1, "Include takes 1 argument, got 0"},
+		{"Include missing file", "Include missing/*.conf\n", 1, "Include missing/*.conf: no such file"},
+		{"Include bad pattern", "Include [\n", 1, "Include [: syntax error in pattern"},
+		{"unknown directive", "LoadModule security2_module x.so\n", 1, `unknown directive "LoadModule"`},
+		{"rule without id", "SecRule ARGS \"@rx a\" \"phase:2\"\n", 1, "rule has no id action"},
+		{"rule without actions", "SecRule ARGS \"@rx a\"\n", 1, "rule has no id action"},
+		{"invalid id", "SecAction \"id:abc\"\n", 1, `invalid id "abc"`},
+		{"invalid phase", "SecAction \"id:1,phase:6\"\n", 1, `invalid phase "6"`},
+		{"invalid skip", "SecAction \"id:1,skip:0\"\n", 1, `invalid skip "0"`},
+		{"chained rule with id", "SecAction \"id:1,chain\"\nSecRule ARGS \"@rx a\" \"id:2\"\n", 2, "chained rule cannot have an id"},
+		{"marker inside a chain", "SecAction \"id:1,chain\"\nSecMarker END\n", 2, "SecMarker cannot continue a chain, SecRule expected"},
+		{"unterminated chain", "SecAction \"id:1,chain\"\n\n", 1, "chain is not terminated by a following SecRule"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeConfs(t, map[string]string{"rules.conf": tc.conf})
+			path := filepath.Join(dir, "rules.conf")
+			_, err := LoadSecLang(path)
+			var se *SyntaxError
+			if !errors.As(err, &se) {
+				t.Fatalf("err = %v, want a syntax error", err)
+			}
+			if se.File != path || se.Line != tc.line || se.Msg != tc.msg {
+				t.Errorf("got %s:%d: %s, want line %d: %s", se.File, se.Line, se.Msg, tc.line, tc.msg)
+			}
+			if !strings.HasPrefix(err.Error(), path+":") {
+				t.Errorf("message %q does not start with the file", err)
+			}
+		})
+	}
+}
+
+// crsSQLi follows the layout of the CRS 4 REQUEST-942 file
+const crsSQLi = `# ------------------------------------------------------------------------
+# OWASP CRS ver.4.0.0
+# ------------------------------------------------------------------------
+
+SecRule TX:DETECTION_PARANOIA_LEVEL "@lt 1" "id:942011,phase:1,pass,nolog,tag:'OWASP_CRS',ver:'OWASP_CRS/4.0.0',skipAfter:END-REQUEST-942-APPLICATION-ATTACK-SQLI"
+SecRule TX:DETECTION_PARANOIA_LEVEL "@lt 1" "id:942012,phase:2,pass,nolog,tag:'OWASP_CRS',ver:'OWASP_CRS/4.0.0',skipAfter:END-REQUEST-942-APPLICATION-ATTACK-SQLI"
+
+SecRule REQUEST_COOKIES|!REQUEST_COOKIES:/__utm/|REQUEST_COOKIES_NAMES|ARGS_NAMES|ARGS|XML:/* "@detectSQLi" \
+    "id:942100,\
+    phase:2,\
+    block,\
+    capture,\
+    t:none,t:utf8toUnicode,t:urlDecodeUni,t:removeNulls,\
+    msg:'SQL Injection Attack Detected via libinjection',\
+    logdata:'Matched Data: %{TX.0} found within %{MATCHED_VAR_NAME}: %{MATCHED_VAR}',\
+    tag:'application-multi',\
+    tag:'attack-sqli',\
+    tag:'paranoia-level/1',\
+    ver:'OWASP_CRS/4.0.0',\
+    severity:'CRITICAL',\
+    multiMatch,\
+    setvar:'tx.sql_injection_score=+%{tx.critical_anomaly_score}',\
+    setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+
+SecRule ARGS "@rx (?i)[\"'\x60][\s]*(?:or|and)[\s]+[\"'\x60]?\d" \
+    "id:942130,\
+    phase:2,\
+    block,\
+    t:none,t:urlDecodeUni,t:replaceComments,\
+    msg:'SQL Injection Attack: SQL Boolean-based attack detected',\
+    tag:'paranoia-level/2',\
+    severity:'CRITICAL',\
+    setvar:'tx.inbound_anomaly_score_pl2=+%{tx.critical_anomaly_score}'"
+
+SecRule REQUEST_BASENAME "@endsWith .php" \
+    "id:942550,\
+    phase:2,\
+    deny,\
+    t:none,\
+    msg:'Chained rule',\
+    severity:'ERROR',\
+    chain"
+    SecRule ARGS:id "@rx ^\d+$" \
+        "t:none,t:length,\
+        setvar:'tx.sql_injection_score=+1'"
+
+SecMarker "END-REQUEST-942-APPLICATION-ATTACK-SQLI"
+`
+
+func TestLoadCRSLikeConf(t *testing.T) {
+	dir := writeConfs(t, map[string]string{"REQUEST-942-APPLICATION-ATTACK-SQLI.conf": crsSQLi})
+	rules, err := LoadSecLang(filepath.Join(dir, "REQUEST-942-APPLICATION-ATTACK-SQLI.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"942011", "942012", "942100", "942130", "942550", "marker:END-REQUEST-942-APPLICATION-ATTACK-SQLI"}
+	if got := ruleIDs(rules); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rules %v, want %v", got, want)
+	}
+	byID := map[string]Rule{}
+	for _, r := range rules {
+		byID[r.ID] = r
+	}
+
+	for id, phase := range map[string]int{"942011": 1, "942012": 2, "942100": 2, "942130": 2, "942550": 2} {
+		r := byID[id]
+		if r.Phase != phase || r.Category != "sqli" {
+			t.Errorf("%s: phase %d, category %q", id, r.Phase, r.Category)
+		}
+	}
+	if r := byID["942011"]; !r.NoLog || r.SkipAfter != "END-REQUEST-942-APPLICATION-ATTACK-SQLI" || r.Op == nil {
+		t.Errorf("942011 %+v, want a nolog skipAfter rule", r)
+	}
+
+	r := byID["942100"]
+	if r.Variable != "REQUEST_COOKIES|!REQUEST_COOKIES:/__utm/|REQUEST_COOKIES_NAMES|ARGS_NAMES|ARGS|XML:/*" ||
+		!reflect.DeepEqual(r.Transforms, []string{"none", "utf8toUnicode", "urlDecodeUni", "removeNulls"}) ||
+		r.Name != "SQL Injection Attack Detected via libinjection" || r.Severity != "CRITICAL" || r.Paranoia != 1 ||
+		len(r.SetVar) != 2 || len(r.Tags) != 3 {
+		t.Errorf("942100 %+v", r)
+	}
+	// libinjection is not available, the rule loads disabled
+	if r.Regex != "@detectSQLi" || r.Op != nil {
+		t.Errorf("942100 operator %q compiled to %v", r.Regex, r.Op)
+	}
+	// The anomaly score decides, not the block action
+	if r.Block || byID["942130"].Block {
+		t.Error("scoring block rules block on their own")
+	}
+
+	r = byID["942130"]
+	if r.Regex != `@rx (?i)["'\x60][\s]*(?:or|and)[\s]+["'\x60]?\d` || r.Paranoia != 2 || r.Op == nil {
+		t.Errorf("942130 operator %q, paranoia %d", r.Regex, r.Paranoia)
+	} else if !r.Op.Match(`' or 1`, "") {
+		t.Errorf("942130 does not match a boolean injection")
+	}
+
+	r = byID["942550"]
+	if !r.Block || r.Severity != "ERROR" || len(r.Chain) != 1 {
+		t.Fatalf("942550 %+v, want a blocking chain", r)
+	}
+	if link := r.Chain[0]; link.Variable != "ARGS:id" || !reflect.DeepEqual(link.Transforms, []string{"none", "length"}) || link.Op == nil {
+		t.Errorf("942550 chain link %+v", link)
+	}
+}
@@ -0,0 +1,166 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VirtualPatch locks one endpoint down to a positive parameter schema:
+// anything not declared, missing when required or outside its type, length
+// or pattern is blocked, e.g.
+//
+//	virtual_patch:
+//	  method: GET POST
+//	  path: /api/orders/*
+//	  params:
+//	    id:   {type: int, required: true, min: 1}
+//	    sort: {pattern: "^(asc|desc)$"}
+//	    q:    {max_length: 64}
+//
+// Parameter names are ARGS names, JSON body fields included
+// (e.g. json.order.id).
+type VirtualPatch struct {
+	Method       string                 `yaml:"method,omitempty"` // space separated, empty for any
+	Path         string                 `yaml:"path"`             // glob, see Condition.Path; matched normalized, trailing slash optional
+	Params       map[string]ParamSchema `yaml:"params"`
+	AllowUnknown bool                   `yaml:"allow_unknown,omitempty"` // let undeclared parameters through
+}
+
+// ParamSchema constrains a single parameter of a virtual patch
+type ParamSchema struct {
+	Type      string `yaml:"type,omitempty"` // string (default), int, number, bool, uuid, email, alnum
+	Required  bool   `yaml:"required,omitempty"`
+	MinLength int    `yaml:"min_length,omitempty"`
+	MaxLength int    `yaml:"max_length,omitempty"`
+	Pattern   string `yaml:"pattern,omitempty"` // the whole value must match, anchor it yourself
+	Min       *int64 `yaml:"min,omitempty"`     // int only
+	Max       *int64 `yaml:"max,omitempty"`     // int only
+}
+
+// paramTypes maps the schema types to the pattern a value must match
+var paramTypes = map[string]string{
+	"string": "",
+	"int":    `^-?[0-9]+$`,
+	"number": `^-?[0-9]+(?:\.[0-9]+)?$`,
+	"bool":   `^(?:true|false|0|1)$`,
+	"uuid":   `^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`,
+	"email":  `^[^@\s]+@[^@\s]+\.[^@\s]+$`,
+	"alnum":  `^[A-Za-z0-9]+$`,
+}
+
+// compileVirtualPatch turns a virtual patch into one blocking rule per
+// violation, all sharing the ID of r. Each rule tests the method, chains
+// the path and then the violation, so it only fires on that endpoint.
+func compileVirtualPatch(r Rule) ([]Rule, error) {
+	vp := r.VirtualPatch
+	if r.Variable != "" || r.Regex != "" || len(r.Chain) > 0 || r.When != nil {
+		return nil, fmt.Errorf("virtual_patch cannot be combined with variable, regex, chain or when")
+	}
+	if vp.Path == "" {
+		return nil, fmt.Errorf("virtual_patch needs a path")
+	}
+
+	var endpoint []Rule
+	if strings.TrimSpace(vp.Method) != "" {
+		endpoint = append(endpoint, Rule{Variable: "REQUEST_METHOD", Regex: "@rx " + methodRegexp(vp.Method)})
+	}
+	// The path is compared once normalized, so "//", "./" and "../" do not
+	// hide the endpoint, and with or without a trailing slash
+	path := strings.TrimSuffix(globRegexp(strings.TrimSuffix(vp.Path, "/")), "$") + "/?$"
+	endpoint = append(endpoint, Rule{Variable: "REQUEST_FILENAME", Regex: "@rx " + path, Transforms: []string{"normalizePath"}})
+
+	title := r.Name
+	if title == "" {
+		title = "Virtual patch " + vp.Path
+	}
+	var out []Rule
+	violation := func(reason string, test Rule) {
+		links := append(append([]Rule{}, endpoint...), test)
+		rule := r
+		rule.VirtualPatch = nil
+		rule.Block = true
+		rule.Name = fmt.Sprintf("%s (%s)", title, reason)
+		rule.Variable, rule.Regex, rule.Transforms = links[0].Variable, links[0].Regex, links[0].Transforms
+		rule.Chain = links[1:]
+		out = append(out, rule)
+	}
+
+	names := make([]string, 0, len(vp.Params))
+	for name := range vp.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if !vp.AllowUnknown {
+		quoted := make([]string, len(names))
+		for i, name := range names {
+			quoted[i] = regexp.QuoteMeta(name)
+		}
+		violation("undeclared parameter", Rule{Variable: "ARGS_NAMES", Regex: "!@rx (?i)^(?:" + strings.Join(quoted, "|") + ")$"})
+	}
+
+	// Transformations of the rule apply to parameter values
+	value := func(arg, regex string, transforms ...string) Rule {
+		return Rule{Variable: arg, Regex: regex, Transforms: append(append([]string{}, r.Transforms...), transforms...)}
+	}
+	for _, name := range names {
+		p := vp.Params[name]
+		arg := "ARGS:" + name
+		if p.Required {
+			violation("missing parameter "+name, Rule{Variable: "&" + arg, Regex: "@eq 0"})
+		}
+
+		typ := p.Type
+		if typ == "" {
+			typ = "string"
+		}
+		pattern, ok := paramTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("parameter %s: unknown type %q", name, p.Type)
+		}
+		if pattern != "" {
+			violation(fmt.Sprintf("parameter %s is not of type %s", name, typ), value(arg, "!@rx "+pattern))
+		}
+		if p.Pattern != "" {
+			if _, err := regexp.Compile(p.Pattern); err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", name, err)
+			}
+			if strings.Contains(p.Pattern, "%{") {
+				return nil, fmt.Errorf("parameter %s: pattern must not contain %%{", name)
+			}
+			violation(fmt.Sprintf("parameter %s does not match its pattern", name), value(arg, "!@rx "+p.Pattern))
+		}
+
+		if p.MinLength < 0 || p.MaxLength < 0 || (p.MaxLength > 0 && p.MinLength > p.MaxLength) {
+			return nil, fmt.Errorf("parameter %s: invalid length bounds", name)
+		}
+		if p.MinLength > 0 {
+			violation(fmt.Sprintf("parameter %s is shorter than %d", name, p.MinLength),
+				value(arg, "@lt "+strconv.Itoa(p.MinLength), "length"))
+		}
+		if p.MaxLength > 0 {
+			violation(fmt.Sprintf("parameter %s is longer than %d", name, p.MaxLength),
+				value(arg, "@gt "+strconv.Itoa(p.MaxLength), "length"))
+		}
+
+		if (p.Min != nil || p.Max != nil) && typ != "int" {
+			return nil, fmt.Errorf("parameter %s: min/max need type int", name)
+		}
+		if p.Min != nil {
+			violation(fmt.Sprintf("parameter %s is below %d", name, *p.Min),
+				value(arg, "@lt "+strconv.FormatInt(*p.Min, 10)))
+		}
+		if p.Max != nil {
+			violation(fmt.Sprintf("parameter %s is above %d", name, *p.Max),
+				value(arg, "@gt "+strconv.FormatInt(*p.Max, 10)))
+		}
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("virtual_patch allows everything (allow_unknown without constraints)")
+	}
+	return out, nil
+}
@@ -0,0 +1,29 @@
+package rules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVirtualPatchTransforms(t *testing.T) {
+	rules, err := compileVirtualPatch(Rule{ID: "1", Transforms: []string{"trim"}, VirtualPatch: &VirtualPatch{
+		Path:   "/api/orders/",
+		Params: map[string]ParamSchema{"q": {MaxLength: 8}},
+	}})
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("%d rules, err %v", len(rules), err)
+	}
+	// Without a method the path test heads each rule and keeps its own
+	// transformation; the transformations of the rule go to the values
+	for _, r := range rules {
+		if r.Variable != "REQUEST_FILENAME" || r.Regex != "@rx ^/api/orders/?$" || !reflect.DeepEqual(r.Transforms, []string{"normalizePath"}) {
+			t.Errorf("head %s %s %v", r.Variable, r.Regex, r.Transforms)
+		}
+	}
+	if got := rules[0].Chain[0]; got.Variable != "ARGS_NAMES" || got.Transforms != nil {
+		t.Errorf("undeclared parameter test %+v", got)
+	}
+	if got := rules[1].Chain[0]; got.Variable != "ARGS:q" || !reflect.DeepEqual(got.Transforms, []string{"trim", "length"}) {
+		t.Errorf("length test %+v", got)
+	}
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"sort"
+	"strings"
+)
+
+// ----------------------------
+// Aho-Corasick multi-literal matcher
+// ----------------------------
+
+// AhoCorasick finds which of a fixed set of ASCII literals occur in a
+// string in a single pass. Matching is ASCII case-insensitive, and the
+// runes that (?i) regexes or strings.ToLower turn into ASCII letters
+// (Kelvin sign, long s, dotted capital I) are folded as well.
+type AhoCorasick struct {
+	states   []acState
+	patterns int
+}
+
+type acState struct {
+	edges []acEdge // sorted by byte
+	fail  int32
+	out   []int32 // patterns ending here, including those of fail states
+}
+
+type acEdge struct {
+	b    byte
+	next int32
+}
+
+// NewAhoCorasick builds a matcher; pattern i is reported as bit i
+func NewAhoCorasick(patterns []string) *AhoCorasick {
+	a := &AhoCorasick{states: []acState{{}}, patterns: len(patterns)}
+	for id, p := range patterns {
+		s := int32(0)
+		for i := 0; i < len(p); i++ {
+			b := lowerASCII(p[i])
+			next, ok := a.edge(s, b)
+			if !ok {
+				next = int32(len(a.states))
+				a.states = append(a.states, acState{})
+				st := &a.states[s]
+				st.edges = append(st.edges, acEdge{b, next})
+				sort.Slice(st.edges, func(i, j int) bool { return st.edges[i].b < st.edges[j].b })
+			}
+			s = next
+		}
+		a.states[s].out = append(a.states[s].out, int32(id))
+	}
+
+	// Breadth-first failure links; outputs are merged along them
+	queue := []int32{}
+	for _, e := range a.states[0].edges {
+		queue = append(queue, e.next)
+	}
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+		for _, e := range a.states[s].edges {
+			f := a.states[s].fail
+			for {
+				if next, ok := a.edge(f, e.b); ok {
+					a.states[e.next].fail = next
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = a.states[f].fail
+			}
+			fail := a.states[e.next].fail
+			a.states[e.next].out = append(a.states[e.next].out, a.states[fail].out...)
+			queue = append(queue, e.next)
+		}
+	}
+	return a
+}
+
+func (a *AhoCorasick) edge(s int32, b byte) (int32, bool) {
+	edges := a.states[s].edges
+	i := sort.Search(len(edges), func(i int) bool { return edges[i].b >= b })
+	if i < len(edges) && edges[i].b == b {
+		return edges[i].next, true
+	}
+	return 0, false
+}
+
+// Words returns the length of the bitset Scan fills
+func (a *AhoCorasick) Words() int {
+	return (a.patterns + 63) / 64
+}
+
+// Scan sets bit i of found for every pattern i that occurs in s
+func (a *AhoCorasick) Scan(s string, found []uint64) {
+	if hasFoldedRunes(s) {
+		s = foldRunes.Replace(s)
+	}
+	state := int32(0)
+	for i := 0; i < len(s); i++ {
+		b := lowerASCII(s[i])
+		for {
+			if next, ok := a.edge(state, b); ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = a.states[state].fail
+		}
+		for _, id := range a.states[state].out {
+			found[id/64] |= 1 << (id % 64)
+		}
+	}
+}
+
+func lowerASCII(b byte) byte {
+	if 'A' <= b && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+
+// foldRunes maps the non-ASCII runes that case-fold onto ASCII letters
+var foldRunes = strings.NewReplacer("\u212a", "k", "\u017f", "s", "\u0130", "i")
+
+// hasFoldedRunes looks for the lead bytes of the foldRunes first
+func hasFoldedRunes(s string) bool {
+	return (strings.IndexByte(s, 0xe2) >= 0 && strings.Contains(s, "\u212a")) ||
+		(strings.IndexByte(s, 0xc5) >= 0 && strings.Contains(s, "\u017f")) ||
+		(strings.IndexByte(s, 0xc4) >= 0 && strings.Contains(s, "\u0130"))
+}
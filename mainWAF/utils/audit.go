@@ -0,0 +1,414 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------
+// Audit log (ModSecurity SecAuditLog compatible)
+// ----------------------------
+
+// AuditConfig mirrors the SecAuditEngine/SecAuditLog* directives
+type AuditConfig struct {
+	Engine     string `yaml:"engine"`      // off, on or relevant_only
+	Parts      string `yaml:"parts"`       // e.g. "ABCFHKZ"; A and Z are always written
+	Type       string `yaml:"type"`        // serial (one file) or concurrent (one file per transaction)
+	Format     string `yaml:"format"`      // native or json
+	Path       string `yaml:"path"`        // serial log, or the index of the concurrent logs
+	StorageDir string `yaml:"storage_dir"` // concurrent: directory of the per-transaction files
+	BodyLimit  int    `yaml:"body_limit"`  // bytes of request body kept in part C
+
+	// Where the serial log or index goes; empty writes the file at path
+	Output SinkConfig `yaml:"output"`
+}
+
+// auditParts lists the supported parts in the order they are written:
+// A header, B request headers, C request body, F response headers,
+// H trailer with the rule messages and verdict, K matched rules, Z end
+const auditParts = "ABCFHKZ"
+
+// AuditEntry is everything the audit log knows about one transaction
+type AuditEntry struct {
+	ID             string
+	Time           time.Time
+	ClientIP       string
+	ClientPort     int
+	Method         string
+	URI            string
+	Protocol       string
+	RequestHeaders map[string]string
+	RequestBody    string
+	Status         int
+	Score          int
+	Blocked        bool
+	Matches        []MatchedRuleLog
+}
+
+// relevant reports whether RelevantOnly mode logs the transaction
+func (e *AuditEntry) relevant() bool {
+	return e.Blocked || e.Score > 0 || len(e.Matches) > 0
+}
+
+// AuditLogger writes audit log entries
+type AuditLogger struct {
+	cfg   AuditConfig
+	parts string
+	mu    sync.Mutex
+	out   io.WriteCloser // the serial log or the concurrent index
+}
+
+// OpenAuditLog opens the audit log described by cfg; it returns nil when
+// the audit engine is off
+func OpenAuditLog(cfg AuditConfig) (*AuditLogger, error) {
+	switch cfg.Engine {
+	case "", "off":
+		return nil, nil
+	case "on", "relevant_only":
+	default:
+		return nil, fmt.Errorf("unknown audit engine %q", cfg.Engine)
+	}
+	switch cfg.Type {
+	case "", "serial", "concurrent":
+	default:
+		return nil, fmt.Errorf("unknown audit log type %q", cfg.Type)
+	}
+	switch cfg.Format {
+	case "", "native", "json":
+	default:
+		return nil, fmt.Errorf("unknown audit log format %q", cfg.Format)
+	}
+
+	parts := "AZ"
+	for _, p := range strings.ToUpper(cfg.Parts) {
+		if !strings.ContainsRune(auditParts, p) {
+			return nil, fmt.Errorf("unsupported audit log part %q (supported: %s)", p, auditParts)
+		}
+		parts += string(p)
+	}
+	// Keep the canonical order without duplicates
+	ordered := ""
+	for _, p := range auditParts {
+		if strings.ContainsRune(parts, p) {
+			ordered += string(p)
+		}
+	}
+
+	if cfg.Type == "concurrent" {
+		if cfg.StorageDir == "" {
+			return nil, fmt.Errorf("concurrent audit log needs a storage_dir")
+		}
+		if err := os.MkdirAll(cfg.StorageDir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+	sink := cfg.Output
+	if sink.Type == "" {
+		sink = SinkConfig{Type: "file", Path: cfg.Path}
+	}
+	out, err := OpenSink(sink)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLogger{cfg: cfg, parts: ordered, out: out}, nil
+}
+
+// redacted masks credentials and personal data before the entry is written;
+// the body is masked before it is cut to body_limit so JSON still parses
+func (e AuditEntry) redacted(r *Redactor) AuditEntry {
+	e.URI = r.URI(e.URI)
+	e.RequestHeaders = r.Headers(e.RequestHeaders)
+	e.RequestBody = r.Body(e.RequestBody)
+	matches := make([]MatchedRuleLog, len(e.Matches))
+	for i, m := range e.Matches {
+		m.RuleName = r.Text(m.RuleName)
+		m.MatchedData = r.Value(m.Parameter, m.MatchedData)
+		matches[i] = m
+	}
+	e.Matches = matches
+	return e
+}
+
+// Log writes one transaction, honouring relevant_only
+func (a *AuditLogger) Log(e AuditEntry) error {
+	if a.cfg.Engine == "relevant_only" && !e.relevant() {
+		return nil
+	}
+	if e.ID == "" {
+		e.ID = NewTransactionID()
+	}
+	e = e.redacted(Redaction())
+	if a.cfg.BodyLimit > 0 && len(e.RequestBody) > a.cfg.BodyLimit {
+		e.RequestBody = e.RequestBody[:a.cfg.BodyLimit]
+	}
+
+	var data []byte
+	if a.cfg.Format == "json" {
+		var err error
+		if data, err = json.Marshal(a.jsonEntry(e)); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		data = []byte(a.nativeEntry(e))
+	}
+
+	if a.cfg.Type != "concurrent" {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		_, err := a.out.Write(data)
+		return err
+	}
+
+	// Concurrent: storage_dir/20261018/20261018-1949/20261018-194904-<id>
+	rel := filepath.Join(e.Time.Format("20060102"), e.Time.Format("20060102-1504"), e.Time.Format("20060102-150405")+"-"+e.ID)
+	path := filepath.Join(a.cfg.StorageDir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o640); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err := io.WriteString(a.out, a.indexLine(e, "/"+filepath.ToSlash(rel), data))
+	return err
+}
+
+// Close closes the serial log or index
+func (a *AuditLogger) Close() error {
+	return a.out.Close()
+}
+
+// NewTransactionID returns a unique transaction id (ModSecurity UNIQUE_ID)
+func NewTransactionID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b[:])
+}
+
+// indexLine is the Apache style summary of a concurrent entry
+func (a *AuditLogger) indexLine(e AuditEntry, rel string, data []byte) string {
+	return fmt.Sprintf("%s %s - - [%s] %q %d - %q %q %s \"-\" %s 0 %d md5:%x\n",
+		orDash(e.RequestHeaders["host"]), e.ClientIP, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method+" "+e.URI+" "+e.Protocol, e.Status,
+		orDash(e.RequestHeaders["referer"]), orDash(e.RequestHeaders["user-agent"]),
+		e.ID, rel, len(data), md5.Sum(data))
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// ----------------------------
+// Native format
+// ----------------------------
+
+func (a *AuditLogger) nativeEntry(e AuditEntry) string {
+	boundary := e.ID
+	if len(boundary) > 8 {
+		boundary = boundary[len(boundary)-8:]
+	}
+	var b strings.Builder
+	for _, part := range a.parts {
+		fmt.Fprintf(&b, "--%s-%c--\n", boundary, part)
+		switch part {
+		case 'A':
+			fmt.Fprintf(&b, "[%s] %s %s %d - -\n", e.Time.Format("02/Jan/2006:15:04:05.000000 -0700"), e.ID, e.ClientIP, e.ClientPort)
+		case 'B':
+			fmt.Fprintf(&b, "%s %s %s\n", e.Method, e.URI, e.Protocol)
+			for _, name := range sortedHeaderNames(e.RequestHeaders) {
+				fmt.Fprintf(&b, "%s: %s\n", http.CanonicalHeaderKey(name), e.RequestHeaders[name])
+			}
+			b.WriteString("\n")
+		case 'C':
+			if e.RequestBody != "" {
+				b.WriteString(e.RequestBody)
+				b.WriteString("\n")
+			}
+			b.WriteString("\n")
+		case 'F':
+			fmt.Fprintf(&b, "%s %d %s\n\n", e.Protocol, e.Status, http.StatusText(e.Status))
+		case 'H':
+			for _, m := range e.Matches {
+				fmt.Fprintf(&b, "Message: %s\n", nativeMessage(e, m))
+			}
+			if e.Blocked {
+				fmt.Fprintf(&b, "Action: Intercepted (phase %d)\n", lastPhase(e.Matches))
+			}
+			fmt.Fprintf(&b, "Anomaly-Score: %d\n", e.Score)
+			b.WriteString("Producer: waf-engine\n")
+			b.WriteString("Engine-Mode: \"ENABLED\"\n\n")
+		case 'K':
+			for _, m := range e.Matches {
+				fmt.Fprintf(&b, "SecRule %s \"%s\" \"id:%s,phase:%d,msg:'%s'\"\n",
+					m.Variable, strings.ReplaceAll(m.Operator, `"`, `\"`), m.RuleID, m.Phase, strings.ReplaceAll(m.RuleName, "'", `\'`))
+			}
+			b.WriteString("\n")
+		case 'Z':
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// nativeMessage formats a rule match like ModSecurity's "Message:" lines
+func nativeMessage(e AuditEntry, m MatchedRuleLog) string {
+	action := "Warning."
+	if m.Block && e.Blocked {
+		action = fmt.Sprintf("Access denied with code %d (phase %d).", e.Status, m.Phase)
+	}
+	msg := fmt.Sprintf("%s Matched \"Operator `%s' against variable `%s' (Value: `%s' )\" [id %q] [msg %q] [data %q] [severity %q]",
+		action, m.Operator, m.Parameter, m.MatchedData, m.RuleID, m.RuleName,
+		"Matched Data: "+m.MatchedData+" found within "+m.Parameter, m.Severity)
+	for _, t := range m.Tags {
+		msg += fmt.Sprintf(" [tag %q]", t)
+	}
+	return msg + fmt.Sprintf(" [hostname %q] [uri %q] [unique_id %q]", e.RequestHeaders["host"], e.URI, e.ID)
+}
+
+func lastPhase(matches []MatchedRuleLog) int {
+	phase := 0
+	for _, m := range matches {
+		if m.Phase > phase {
+			phase = m.Phase
+		}
+	}
+	return phase
+}
+
+func sortedHeaderNames(h map[string]string) []string {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ----------------------------
+// JSON format (ModSecurity v3 layout)
+// ----------------------------
+
+type auditJSON struct {
+	Transaction auditTransaction `json:"transaction"`
+}
+
+type auditTransaction struct {
+	ClientIP   string         `json:"client_ip"`
+	TimeStamp  string         `json:"time_stamp"`
+	ServerID   string         `json:"server_id"`
+	ClientPort int            `json:"client_port"`
+	HostIP     string         `json:"host_ip"`
+	HostPort   int            `json:"host_port"`
+	UniqueID   string         `json:"unique_id"`
+	Request    *auditRequest  `json:"request,omitempty"`
+	Response   *auditResponse `json:"response,omitempty"`
+	Producer   *auditProducer `json:"producer,omitempty"`
+	Messages   []auditMessage `json:"messages,omitempty"`
+}
+
+type auditRequest struct {
+	Method      string            `json:"method"`
+	HTTPVersion string            `json:"http_version"`
+	URI         string            `json:"uri"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        string            `json:"body,omitempty"`
+}
+
+type auditResponse struct {
+	HTTPCode int `json:"http_code"`
+}
+
+type auditProducer struct {
+	Connector      string `json:"connector"`
+	SecrulesEngine string `json:"secrules_engine"`
+	AnomalyScore   int    `json:"anomaly_score"`
+	Intercepted    bool   `json:"intercepted"`
+}
+
+type auditMessage struct {
+	Message string       `json:"message"`
+	Details auditDetails `json:"details"`
+}
+
+type auditDetails struct {
+	Match     string   `json:"match"`
+	Reference string   `json:"reference"`
+	RuleID    string   `json:"ruleId"`
+	Data      string   `json:"data"`
+	Severity  string   `json:"severity"`
+	Phase     int      `json:"phase"`
+	Tags      []string `json:"tags"`
+}
+
+func (a *AuditLogger) jsonEntry(e AuditEntry) auditJSON {
+	t := auditTransaction{
+		ClientIP:   e.ClientIP,
+		TimeStamp:  e.Time.Format(time.ANSIC),
+		ServerID:   "waf-engine",
+		ClientPort: e.ClientPort,
+		UniqueID:   e.ID,
+	}
+	for _, part := range a.parts {
+		switch part {
+		case 'B', 'C':
+			if t.Request == nil {
+				t.Request = &auditRequest{
+					Method:      e.Method,
+					HTTPVersion: strings.TrimPrefix(e.Protocol, "HTTP/"),
+					URI:         e.URI,
+				}
+			}
+			if part == 'B' {
+				t.Request.Headers = e.RequestHeaders
+			} else {
+				t.Request.Body = e.RequestBody
+			}
+		case 'F':
+			t.Response = &auditResponse{HTTPCode: e.Status}
+		case 'H':
+			t.Producer = &auditProducer{Connector: "waf-engine", SecrulesEngine: "Enabled", AnomalyScore: e.Score, Intercepted: e.Blocked}
+			fallthrough
+		case 'K':
+			if t.Messages != nil {
+				continue
+			}
+			t.Messages = make([]auditMessage, 0, len(e.Matches))
+			for _, m := range e.Matches {
+				tags := m.Tags
+				if tags == nil {
+					tags = []string{}
+				}
+				t.Messages = append(t.Messages, auditMessage{
+					Message: m.RuleName,
+					Details: auditDetails{
+						Match:     fmt.Sprintf("Matched \"Operator `%s' against variable `%s' (Value: `%s' )", m.Operator, m.Parameter, m.MatchedData),
+						Reference: m.Parameter,
+						RuleID:    m.RuleID,
+						Data:      m.MatchedData,
+						Severity:  m.Severity,
+						Phase:     m.Phase,
+						Tags:      tags,
+					},
+				})
+			}
+		}
+	}
+	return auditJSON{Transaction: t}
+}
@@ -2,22 +2,66 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
 // Logger is global
 var Logger *log.Logger
 
+// traceHandler writes per-request debug traces; it logs at debug level
+// whatever the level of the process log is
+var traceHandler slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+// SetupLogging installs the process-wide slog logger. level is one of
+// debug, info, warn or error; format is text or json.
+func SetupLogging(w io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log level %q: %w", level, err)
+	}
+
+	var handler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		handler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, o) }
+	case "json":
+		handler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, o) }
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler(w, &slog.HandlerOptions{Level: lvl})))
+	traceHandler = handler(w, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return nil
+}
+
+// TraceLogger returns a debug-level logger for tracing a single request
+func TraceLogger() *slog.Logger {
+	return slog.New(traceHandler)
+}
+
 // MatchedRuleLog represents a structured log entry for a single matched rule
 type MatchedRuleLog struct {
 	RuleID      string `json:"rule_id"`
 	RuleName    string `json:"rule_name"`
 	Variable    string `json:"variable"`
+	Parameter   string `json:"parameter,omitempty"`
 	Severity    string `json:"severity"`
+	Category    string `json:"category,omitempty"`
 	Block       bool   `json:"block"`
 	Description string `json:"description"`
+
+	// Audit log only: kept out of waf.log and API responses
+	Phase       int      `json:"-"`
+	Operator    string   `json:"-"` // operator expression, e.g. "@rx union.*select"
+	MatchedData string   `json:"-"` // the (transformed) value that matched
+	Tags        []string `json:"-"`
 }
 
 // RequestLog represents the full request log
@@ -31,22 +75,33 @@ type RequestLog struct {
 	Blocked      bool             `json:"blocked"`
 }
 
-// InitLogger initializes the global logger
-func InitLogger() {
-	file, err := os.OpenFile("waf.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// InitLogger opens the request log sink. Files keep the "[WAF] date time"
+// line prefix; stdout and syslog get bare JSON lines.
+func InitLogger(cfg SinkConfig) error {
+	w, err := OpenSink(cfg)
 	if err != nil {
-		log.Fatal("Failed to open waf.log:", err)
+		return fmt.Errorf("request log: %w", err)
+	}
+	if strings.EqualFold(cfg.Type, "file") {
+		Logger = log.New(w, "[WAF] ", log.LstdFlags)
+	} else {
+		Logger = log.New(w, "", 0)
 	}
-	Logger = log.New(file, "[WAF] ", log.LstdFlags)
+	return nil
 }
 
 // LogRequest logs a request in structured JSON format
 func LogRequest(clientIP, method, uri string, matchedRules []MatchedRuleLog, totalScore int, blocked bool) {
+	r := Redaction()
+	matchedRules = append([]MatchedRuleLog(nil), matchedRules...)
+	for i := range matchedRules {
+		matchedRules[i].RuleName = r.Text(matchedRules[i].RuleName)
+	}
 	logEntry := RequestLog{
 		Timestamp:    time.Now().Format(time.RFC3339),
 		ClientIP:     clientIP,
 		Method:       method,
-		URI:          uri,
+		URI:          r.URI(uri),
 		MatchedRules: matchedRules,
 		TotalScore:   totalScore,
 		Blocked:      blocked,
@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------
+// Prometheus metrics (text exposition format 0.0.4)
+// ----------------------------
+
+// Metrics is the registry served on /metrics
+var Metrics = &Registry{}
+
+// Registry holds metrics in registration order
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// WritePrometheus writes every metric in the text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.ReplaceAll(help, "\n", " "), name, typ)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelPairs renders {a="x",b="y"}; extra is appended as is (e.g. le="0.5")
+func labelPairs(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// atomicFloat is a float64 updated with compare-and-swap
+type atomicFloat struct{ bits atomic.Uint64 }
+
+func (f *atomicFloat) Add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) Set(v float64) { f.bits.Store(math.Float64bits(v)) }
+
+func (f *atomicFloat) Load() float64 { return math.Float64frombits(f.bits.Load()) }
+
+// ----------------------------
+// Counters and gauges
+// ----------------------------
+
+// Counter only goes up
+type Counter struct{ v atomicFloat }
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(v float64) { c.v.Add(v) }
+
+// Value returns the current count
+func (c *Counter) Value() float64 { return c.v.Load() }
+
+// Gauge can go up and down
+type Gauge struct{ v atomicFloat }
+
+func (g *Gauge) Set(v float64) { g.v.Set(v) }
+func (g *Gauge) Add(v float64) { g.v.Add(v) }
+
+// Value returns the current value
+func (g *Gauge) Value() float64 { return g.v.Load() }
+
+type scalar struct {
+	name, help, typ string
+	value           func() float64
+}
+
+func (s *scalar) write(w *bufio.Writer) {
+	writeHeader(w, s.name, s.help, s.typ)
+	fmt.Fprintf(w, "%s %s\n", s.name, formatFloat(s.value()))
+}
+
+// NewCounter registers a counter without labels
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.add(&scalar{name, help, "counter", c.Value})
+	return c
+}
+
+// NewGauge registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.add(&scalar{name, help, "gauge", g.Value})
+	return g
+}
+
+// NewCounterFunc registers a counter read from fn at scrape time
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.add(&scalar{name, help, "counter", fn})
+}
+
+// NewGaugeFunc registers a gauge read from fn at scrape time
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.add(&scalar{name, help, "gauge", fn})
+}
+
+// ----------------------------
+// Labelled series
+// ----------------------------
+
+// series maps label values to one child metric each
+type series[T any] struct {
+	labels   []string
+	mu       sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (s *series[T]) with(values []string) *T {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: got %d label values for %v", len(values), s.labels))
+	}
+	key := values[0]
+	if len(values) > 1 {
+		key = strings.Join(values, "\xff")
+	}
+	s.mu.RLock()
+	c, ok := s.children[key]
+	s.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok = s.children[key]; !ok {
+		c = s.newChild()
+		s.children[key] = c
+		s.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// each calls fn for every child in label order
+func (s *series[T]) each(fn func(values []string, c *T)) {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.children))
+	for k := range s.children {
+		keys = append(keys, k)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.mu.RLock()
+		c, values := s.children[k], s.values[k]
+		s.mu.RUnlock()
+		fn(values, c)
+	}
+}
+
+func newSeries[T any](labels []string, newChild func() *T) series[T] {
+	return series[T]{labels: labels, children: make(map[string]*T), values: make(map[string][]string), newChild: newChild}
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	name, help string
+	series[Counter]
+}
+
+// NewCounterVec registers a labelled counter
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{name: name, help: help, series: newSeries(labels, func() *Counter { return &Counter{} })}
+	r.add(v)
+	return v
+}
+
+// With returns the counter of the given label values
+func (v *CounterVec) With(values ...string) *Counter { return v.with(values) }
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.each(func(values []string, c *Counter) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelPairs(v.labels, values, ""), formatFloat(c.Value()))
+	})
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	name, help string
+	series[Gauge]
+}
+
+// NewGaugeVec registers a labelled gauge
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	v := &GaugeVec{name: name, help: help, series: newSeries(labels, func() *Gauge { return &Gauge{} })}
+	r.add(v)
+	return v
+}
+
+// With returns the gauge of the given label values
+func (v *GaugeVec) With(values ...string) *Gauge { return v.with(values) }
+
+func (v *GaugeVec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "gauge")
+	v.each(func(values []string, g *Gauge) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, labelPairs(v.labels, values, ""), formatFloat(g.Value()))
+	})
+}
+
+// ----------------------------
+// Histograms
+// ----------------------------
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	upper  []float64
+	counts []atomic.Uint64 // per bucket, the last one is +Inf
+	sum    atomicFloat
+	count  atomic.Uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{upper: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+func (h *Histogram) writeTo(w *bufio.Writer, name string, labels, values []string) {
+	var cum uint64
+	for i, upper := range h.upper {
+		cum += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, values, `le="`+formatFloat(upper)+`"`), cum)
+	}
+	cum += h.counts[len(h.upper)].Load()
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, values, `le="+Inf"`), cum)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelPairs(labels, values, ""), formatFloat(h.sum.Load()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelPairs(labels, values, ""), h.count.Load())
+}
+
+type histogramMetric struct {
+	name, help string
+	h          *Histogram
+}
+
+func (m *histogramMetric) write(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, "histogram")
+	m.h.writeTo(w, m.name, nil, nil)
+}
+
+// NewHistogram registers a histogram; buckets are sorted upper bounds
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.add(&histogramMetric{name, help, h})
+	return h
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	name, help string
+	series[Histogram]
+}
+
+// NewHistogramVec registers a labelled histogram
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, series: newSeries(labels, func() *Histogram { return newHistogram(buckets) })}
+	r.add(v)
+	return v
+}
+
+// With returns the histogram of the given label values
+func (v *HistogramVec) With(values ...string) *Histogram { return v.with(values) }
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	v.each(func(values []string, h *Histogram) {
+		h.writeTo(w, v.name, v.labels, values)
+	})
+}
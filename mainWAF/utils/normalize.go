@@ -3,12 +3,13 @@ package utils
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -22,39 +23,76 @@ func FlattenJSON(data any) string {
 	switch v := data.(type) {
 	case map[string]any:
 		parts := []string{}
-		fmt.Println("FlattenJSON: entering map =>", v)
 		for key, val := range v {
 			flattened := FlattenJSON(val)
 			kv := key + "=" + flattened
-			fmt.Println("FlattenJSON: map entry =>", kv)
 			parts = append(parts, kv)
 		}
 		joined := strings.Join(parts, "&")
-		fmt.Println("FlattenJSON: map joined =>", joined)
 		return joined
 
 	case []any:
 		parts := []string{}
-		fmt.Println("FlattenJSON: entering slice =>", v)
 		for _, val := range v {
 			flattened := FlattenJSON(val)
-			fmt.Println("FlattenJSON: slice element =>", flattened)
 			parts = append(parts, flattened)
 		}
 		joined := strings.Join(parts, ",")
-		fmt.Println("FlattenJSON: slice joined =>", joined)
 		return joined
 
 	case string:
-		fmt.Println("FlattenJSON: string =>", v)
 		return v
 
 	default:
-		fmt.Println("FlattenJSON: unknown type =>", v)
 		return ""
 	}
 }
 
+// ----------------------------
+// JSONArgs: names every scalar of a JSON document like ModSecurity's JSON
+// body processor, e.g. {"user":{"roles":["admin"]}} -> json.user.roles.0=admin
+// ----------------------------
+func JSONArgs(data any) map[string]string {
+	out := make(map[string]string)
+	jsonArgs("json", data, out)
+	return out
+}
+
+func jsonArgs(name string, data any, out map[string]string) {
+	switch v := data.(type) {
+	case map[string]any:
+		for key, val := range v {
+			jsonArgs(name+"."+key, val, out)
+		}
+	case []any:
+		for i, val := range v {
+			jsonArgs(name+"."+strconv.Itoa(i), val, out)
+		}
+	case string:
+		out[name] = v
+	case float64:
+		out[name] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		out[name] = strconv.FormatBool(v)
+	case nil:
+		out[name] = ""
+	}
+}
+
+// JSONPointerArg converts a JSON pointer (RFC 6901) to the argument name
+// JSONArgs uses, e.g. "/user/roles/0" -> "json.user.roles.0"
+func JSONPointerArg(pointer string) string {
+	name := "json"
+	if pointer == "" {
+		return name
+	}
+	for _, seg := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		seg = strings.ReplaceAll(strings.ReplaceAll(seg, "~1", "/"), "~0", "~")
+		name += "." + seg
+	}
+	return name
+}
+
 // ----------------------------
 // Helper: lowerKeys converts all map keys to lowercase
 // ----------------------------
@@ -99,13 +137,10 @@ func NormalizeHTTP(r *http.Request) (method, path string, query map[string][]str
 	if r.Body != nil {
 		raw, err := io.ReadAll(r.Body)
 		if err != nil {
-			fmt.Println("❌ Error reading body:", err)
+			slog.Warn("reading request body failed", "err", err)
 		}
 		r.Body.Close()
 
-		fmt.Println("=== Raw Body (as received) ===")
-		fmt.Println(string(raw))
-
 		// Reset body so it can still be parsed later
 		r.Body = io.NopCloser(bytes.NewBuffer(raw))
 
@@ -143,13 +178,8 @@ func NormalizeHTTP(r *http.Request) (method, path string, query map[string][]str
 		}
 	}
 
-	// Print everything after normalization
-	fmt.Println("=== Normalized Request ===")
-	fmt.Println("Method:", method)
-	fmt.Println("Path:", path)
-	fmt.Println("Query:", query)
-	fmt.Println("Headers:", headers)
-	fmt.Println("Body:", body)
+	// Sizes only: values may carry credentials
+	slog.Debug("normalized request", "method", method, "query_params", len(query), "headers", len(headers), "body_fields", len(body))
 
 	return
 }
@@ -158,11 +188,12 @@ func NormalizeHTTP(r *http.Request) (method, path string, query map[string][]str
 // Ingest struct for JSON ingestion
 // ----------------------------
 type Ingest struct {
-	Headers map[string]string   `json:"headers"`
-	Body    map[string]any      `json:"body"`
-	Query   map[string][]string `json:"query"`
-	Path    string              `json:"path"`
-	Method  string              `json:"method"`
+	Headers  map[string]string   `json:"headers"`
+	Body     map[string]any      `json:"body"`
+	Query    map[string][]string `json:"query"`
+	Path     string              `json:"path"`
+	Method   string              `json:"method"`
+	ClientIP string              `json:"client_ip,omitempty"`
 }
 
 // ----------------------------
@@ -170,7 +201,7 @@ type Ingest struct {
 // ----------------------------
 func NormalizeIngest(i *Ingest) (method, path string, query map[string][]string, headers map[string]string, body map[string]any, flatBody string) {
 	// Default method to POST if not provided
-	method = i.Method
+	method = strings.ToUpper(i.Method)
 	if method == "" {
 		method = "POST"
 	}
@@ -195,14 +226,7 @@ func NormalizeIngest(i *Ingest) (method, path string, query map[string][]string,
 	// Flatten body for regex matching
 	flatBody = FlattenJSON(body)
 
-	// Debug prints
-	fmt.Println("=== Normalized Ingest ===")
-	fmt.Println("Method:", method)
-	fmt.Println("Path:", path)
-	fmt.Println("Query:", query)
-	fmt.Println("Headers:", headers)
-	fmt.Println("Body (map):", body)
-	fmt.Println("Flat Body (string):", flatBody)
+	slog.Debug("normalized ingest event", "method", method, "query_params", len(query), "headers", len(headers), "body_fields", len(body))
 
 	return
 }
@@ -0,0 +1,277 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// ----------------------------
+// Redaction of sensitive data before it is logged
+// ----------------------------
+
+// RedactionConfig selects what is masked in waf.log, the audit log and
+// debug traces
+type RedactionConfig struct {
+	Headers        []string `yaml:"headers"`          // header names, case-insensitive
+	Args           []string `yaml:"args"`             // regexes on argument names, e.g. "(?i)passw"
+	JSONPaths      []string `yaml:"json_paths"`       // JSON pointers into bodies, e.g. /user/pin
+	Patterns       []string `yaml:"patterns"`         // regexes masked in any value
+	Mask           string   `yaml:"mask"`             // replacement text
+	MaxMatchedData int      `yaml:"max_matched_data"` // matched data excerpts are cut to this many bytes
+}
+
+// DefaultRedaction masks credentials, cookies, card numbers, bearer
+// tokens and e-mail addresses
+func DefaultRedaction() RedactionConfig {
+	return RedactionConfig{
+		Headers: []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key", "X-Auth-Token", "X-WAF-Debug"},
+		Args:    []string{`(?i)passw|secret|token|api[_-]?key|session|credit|card|cvv|ssn`},
+		Patterns: []string{
+			`\b(?:\d[ -]?){12,18}\d\b`,                            // card numbers
+			`(?i)\bbearer\s+[A-Za-z0-9._~+/-]+=*`,                 // bearer tokens
+			`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`, // JWTs
+			`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,      // e-mail addresses
+		},
+		Mask:           "****",
+		MaxMatchedData: 100,
+	}
+}
+
+// Redactor applies a RedactionConfig
+type Redactor struct {
+	headers   map[string]bool
+	args      []*regexp.Regexp
+	jsonPaths map[string]bool // as argument names, e.g. json.user.pin
+	patterns  []*regexp.Regexp
+	mask      string
+	maxData   int
+}
+
+// NewRedactor compiles a redaction config
+func NewRedactor(cfg RedactionConfig) (*Redactor, error) {
+	r := &Redactor{
+		headers:   make(map[string]bool),
+		jsonPaths: make(map[string]bool),
+		mask:      cfg.Mask,
+		maxData:   cfg.MaxMatchedData,
+	}
+	if r.mask == "" {
+		r.mask = "****"
+	}
+	for _, h := range cfg.Headers {
+		r.headers[strings.ToLower(h)] = true
+	}
+	for _, p := range cfg.JSONPaths {
+		r.jsonPaths[strings.ToLower(JSONPointerArg(p))] = true
+	}
+	for _, expr := range cfg.Args {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("redaction arg %q: %w", expr, err)
+		}
+		r.args = append(r.args, re)
+	}
+	for _, expr := range cfg.Patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("redaction pattern %q: %w", expr, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+var redactor atomic.Pointer[Redactor]
+
+func init() {
+	r, _ := NewRedactor(DefaultRedaction())
+	redactor.Store(r)
+}
+
+// SetRedaction replaces the process-wide redaction rules
+func SetRedaction(cfg RedactionConfig) error {
+	r, err := NewRedactor(cfg)
+	if err != nil {
+		return err
+	}
+	redactor.Store(r)
+	return nil
+}
+
+// Redaction returns the process-wide redactor
+func Redaction() *Redactor {
+	return redactor.Load()
+}
+
+// sensitiveArg reports whether an argument (e.g. "password" or
+// "json.user.pin") must be masked
+func (r *Redactor) sensitiveArg(name string) bool {
+	if r.jsonPaths[strings.ToLower(name)] {
+		return true
+	}
+	for _, re := range r.args {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Text masks every configured pattern in s
+func (r *Redactor) Text(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllString(s, r.mask)
+	}
+	return s
+}
+
+// Headers returns a copy of lower-cased headers with sensitive ones masked
+func (r *Redactor) Headers(h map[string]string) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if r.headers[strings.ToLower(k)] {
+			out[k] = r.mask
+		} else {
+			out[k] = r.Text(v)
+		}
+	}
+	return out
+}
+
+// Value masks the value of a variable such as "ARGS:password",
+// "REQUEST_HEADERS:authorization" or "REQUEST_COOKIES:sid"
+func (r *Redactor) Value(variable, value string) string {
+	col, name, _ := strings.Cut(variable, ":")
+	switch strings.ToUpper(col) {
+	case "REQUEST_HEADERS":
+		if r.headers[strings.ToLower(name)] {
+			return r.mask
+		}
+	case "REQUEST_COOKIES":
+		if r.headers["cookie"] || r.sensitiveArg(name) {
+			return r.mask
+		}
+	case "ARGS", "ARGS_GET", "ARGS_POST":
+		if r.sensitiveArg(name) {
+			return r.mask
+		}
+	case "REQUEST_BODY":
+		return r.Body(value)
+	case "REQUEST_URI":
+		return r.URI(value)
+	}
+	return r.Text(value)
+}
+
+// MatchedData masks a matched value and cuts it to MaxMatchedData bytes
+func (r *Redactor) MatchedData(variable, value string) string {
+	value = r.Value(variable, value)
+	if r.maxData > 0 && len(value) > r.maxData {
+		cut := r.maxData
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		value = value[:cut] + "..."
+	}
+	return value
+}
+
+// URI masks sensitive query arguments of a request URI
+func (r *Redactor) URI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return r.Text(uri)
+	}
+	return r.Text(path) + "?" + r.form(query)
+}
+
+// Body masks a JSON or urlencoded body; other bodies only get the patterns
+func (r *Redactor) Body(body string) string {
+	trimmed := strings.TrimSpace(body)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var doc any
+		if err := json.Unmarshal([]byte(trimmed), &doc); err == nil {
+			var out strings.Builder
+			enc := json.NewEncoder(&out)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(r.jsonValue("json", doc)); err == nil {
+				return strings.TrimSuffix(out.String(), "\n")
+			}
+		}
+	}
+	// Form bodies read from files or raw requests often end in a newline
+	if looksLikeForm(strings.TrimRight(body, "\r\n")) {
+		return r.form(body)
+	}
+	return r.Text(body)
+}
+
+// looksLikeForm reports whether body is a single line of name=value pairs
+func looksLikeForm(body string) bool {
+	if !strings.Contains(body, "=") || strings.ContainsAny(body, "\r\n") {
+		return false
+	}
+	for _, pair := range strings.Split(body, "&") {
+		if k, _, _ := strings.Cut(pair, "="); strings.ContainsAny(k, " \t") {
+			return false
+		}
+	}
+	return true
+}
+
+// form masks the values of sensitive arguments in a urlencoded string,
+// keeping the original order and encoding
+func (r *Redactor) form(s string) string {
+	pairs := strings.Split(s, "&")
+	for i, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(k)
+		if err != nil {
+			name = k
+		}
+		if r.sensitiveArg(name) {
+			pairs[i] = k + "=" + r.mask
+			continue
+		}
+		if value, err := url.QueryUnescape(v); err == nil {
+			if masked := r.Text(value); masked != value {
+				pairs[i] = k + "=" + url.QueryEscape(masked)
+			}
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// jsonValue masks a JSON document; name is its JSONArgs style path
+func (r *Redactor) jsonValue(name string, data any) any {
+	switch v := data.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, val := range v {
+			path := name + "." + key
+			if r.sensitiveArg(path) || r.sensitiveArg(key) {
+				out[key] = r.mask
+				continue
+			}
+			out[key] = r.jsonValue(path, val)
+		}
+		return out
+	case []any:
+		out := make([]any, len(v))
+		for i, val := range v {
+			out[i] = r.jsonValue(fmt.Sprintf("%s.%d", name, i), val)
+		}
+		return out
+	case string:
+		return r.Text(v)
+	}
+	return data
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// secrets must never reach a log once redacted
+var secrets = []string{"hunter2", "s3cr3t-cookie", "abc.def-ghi", "4111 1111 1111 1111", "bob@example.com", "9876"}
+
+func testRedactor(t *testing.T) *Redactor {
+	t.Helper()
+	cfg := DefaultRedaction()
+	cfg.JSONPaths = []string{"/user/pin"}
+	r, err := NewRedactor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func checkNoSecrets(t *testing.T, where, s string) {
+	t.Helper()
+	for _, secret := range secrets {
+		if strings.Contains(s, secret) {
+			t.Errorf("%s contains %q:\n%s", where, secret, s)
+		}
+	}
+}
+
+func TestRedactValue(t *testing.T) {
+	r := testRedactor(t)
+	for _, tc := range []struct {
+		variable, value, want string
+	}{
+		{"ARGS:password", "hunter2", "****"},
+		{"ARGS_POST:api_key", "k", "****"},
+		{"ARGS_GET:Session", "s", "****"},
+		{"ARGS:json.user.pin", "9876", "****"},
+		{"ARGS:json.user.name", "bob", "bob"},
+		{"ARGS:q", "card 4111 1111 1111 1111 please", "card **** please"},
+		{"ARGS:q", "mail bob@example.com", "mail ****"},
+		{"ARGS:q", "eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig", "****"},
+		{"REQUEST_HEADERS:Authorization", "Basic Ym9iOmh1bnRlcjI=", "****"},
+		{"REQUEST_HEADERS:x-forwarded-auth", "Bearer abc.def-ghi", "****"},
+		{"REQUEST_HEADERS:user-agent", "curl/8.0", "curl/8.0"},
+		{"REQUEST_COOKIES:theme", "dark", "****"},
+		{"REQUEST_URI", "/login?user=bob&password=hunter2", "/login?user=bob&password=****"},
+		{"REQUEST_BODY", `{"password":"hunter2"}`, `{"password":"****"}`},
+		{"REQUEST_FILENAME", "/users/bob@example.com", "/users/****"},
+	} {
+		if got := r.Value(tc.variable, tc.value); got != tc.want {
+			t.Errorf("Value(%s, %q) = %q, want %q", tc.variable, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	r := testRedactor(t)
+	for _, tc := range []struct {
+		name, body, want string
+	}{
+		{"json", `{"user":{"name":"bob","password":"hunter2","pin":"9876"},"items":[{"token":"t"},"mail bob@example.com"],"n":1}`,
+			`{"items":[{"token":"****"},"mail ****"],"n":1,"user":{"name":"bob","password":"****","pin":"****"}}`},
+		{"json array", ` [{"secret":"x"}, "<a&b>"]`, `[{"secret":"****"},"<a&b>"]`},
+		{"form", "user=bob&password=hunter2&note=card+4111+1111+1111+1111", "user=bob&password=****&note=card+%2A%2A%2A%2A"},
+		{"form with encoded name", "pass%77ord=hunter2&x=1", "pass%77ord=****&x=1"},
+		{"form ending in a newline", "user=bob&password=hunter2\r\n", "user=bob&password=****"},
+		{"broken json", `{"password": "hunter2"`, `{"password": "hunter2"`},
+		{"text", "hello\nBearer abc.def-ghi\n", "hello\n****\n"},
+	} {
+		if got := r.Body(tc.body); got != tc.want {
+			t.Errorf("%s: Body = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRedactURI(t *testing.T) {
+	r := testRedactor(t)
+	for uri, want := range map[string]string{
+		"/search":                         "/search",
+		"/users/bob@example.com":          "/users/****",
+		"/a?token=x&q=1&token=y":          "/a?token=****&q=1&token=****",
+		"/a?q=bob%40example.com&flag&z=":  "/a?q=%2A%2A%2A%2A&flag&z=",
+		"/a?apiKey=1&api-key=2&API_KEY=3": "/a?apiKey=****&api-key=****&API_KEY=****",
+	} {
+		if got := r.URI(uri); got != want {
+			t.Errorf("URI(%q) = %q, want %q", uri, got, want)
+		}
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	r := testRedactor(t)
+	in := map[string]string{"authorization": "Bearer abc.def-ghi", "Cookie": "sid=s3cr3t-cookie", "x-note": "bearer abc.def-ghi", "host": "example.com"}
+	got := r.Headers(in)
+	want := map[string]string{"authorization": "****", "Cookie": "****", "x-note": "****", "host": "example.com"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("header %s = %q, want %q", k, got[k], v)
+		}
+	}
+	if in["authorization"] != "Bearer abc.def-ghi" {
+		t.Error("Headers changed its argument")
+	}
+}
+
+func TestMatchedDataTruncation(t *testing.T) {
+	cfg := DefaultRedaction()
+	cfg.MaxMatchedData = 10
+	r, err := NewRedactor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{"0123456789", "0123456789"},
+		{"0123456789a", "0123456789..."},
+		{"01234567é", "01234567é"},
+		// "é" takes bytes 9 and 10, so the cut moves before it
+		{"012345678é", "012345678..."},
+		{"0123456€", "0123456€"},
+		// "€" takes bytes 8 to 10
+		{"01234567€", "01234567..."},
+		{"0123456789€", "0123456789..."},
+	} {
+		got := r.MatchedData("ARGS:q", tc.value)
+		if got != tc.want || !utf8.ValidString(got) {
+			t.Errorf("MatchedData(%q) = %q, want %q", tc.value, got, tc.want)
+		}
+	}
+	// Masking comes first, so a cut cannot leave part of a secret
+	if got := r.MatchedData("ARGS:q", "4111 1111 1111 1111 and more"); got != "**** and m..." {
+		t.Errorf("MatchedData of a card number = %q", got)
+	}
+	if got := r.MatchedData("ARGS:password", "hunter2hunter2"); got != "****" {
+		t.Errorf("MatchedData of a password = %q", got)
+	}
+}
+
+func TestRedactionConfigErrors(t *testing.T) {
+	defer SetRedaction(DefaultRedaction())
+	if err := SetRedaction(RedactionConfig{Args: []string{"("}}); err == nil {
+		t.Error("invalid arg regex accepted")
+	}
+	if err := SetRedaction(RedactionConfig{Patterns: []string{"[a-"}}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+	// A failed update keeps the redaction in place
+	if got := Redaction().Value("ARGS:password", "hunter2"); got != "****" {
+		t.Errorf("after a failed update, password logged as %q", got)
+	}
+	if err := SetRedaction(RedactionConfig{Headers: []string{"X-Custom"}, Mask: ""}); err != nil {
+		t.Fatal(err)
+	}
+	if got := Redaction().Value("REQUEST_HEADERS:x-custom", "v"); got != "****" {
+		t.Errorf("custom header logged as %q, want the default mask", got)
+	}
+}
+
+// sensitiveEntry carries a secret in every field an audit log writes
+func sensitiveEntry() AuditEntry {
+	return AuditEntry{
+		ID:       "txn-1",
+		ClientIP: "192.0.2.1",
+		Method:   "POST",
+		URI:      "/login?password=hunter2&email=bob@example.com",
+		Protocol: "HTTP/1.1",
+		RequestHeaders: map[string]string{
+			"host":          "example.com",
+			"authorization": "Bearer abc.def-ghi",
+			"cookie":        "sid=s3cr3t-cookie",
+			"x-debug":       "bearer abc.def-ghi",
+		},
+		RequestBody: `{"user":{"password":"hunter2","pin":"9876","card":"4111 1111 1111 1111"}}`,
+		Status:      403,
+		Score:       1,
+		Blocked:     true,
+		Matches: []MatchedRuleLog{{
+			RuleID: "1", RuleName: "token Bearer abc.def-ghi", Variable: "ARGS", Parameter: "ARGS:password",
+			Block: true, Phase: 2, Operator: "@rx .", MatchedData: "hunter2",
+		}, {
+			RuleID: "2", RuleName: "cookie", Variable: "REQUEST_COOKIES", Parameter: "REQUEST_COOKIES:sid",
+			Phase: 1, Operator: "@rx .", MatchedData: "s3cr3t-cookie",
+		}},
+	}
+}
+
+func TestAuditLogRedacted(t *testing.T) {
+	defer SetRedaction(DefaultRedaction())
+	cfg := DefaultRedaction()
+	cfg.JSONPaths = []string{"/user/pin"}
+	if err := SetRedaction(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"native", "json"} {
+		path := filepath.Join(t.TempDir(), "audit.log")
+		a, err := OpenAuditLog(AuditConfig{Engine: "on", Parts: "ABCFHKZ", Format: format, Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Log(sensitiveEntry()); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "****") {
+			t.Errorf("%s audit log has no masked value:\n%s", format, data)
+		}
+		checkNoSecrets(t, format+" audit log", string(data))
+	}
+}
+
+func TestLogRequestRedacted(t *testing.T) {
+	defer func(l *log.Logger) { Logger = l }(Logger)
+	var buf bytes.Buffer
+	Logger = log.New(&buf, "", 0)
+
+	e := sensitiveEntry()
+	LogRequest(e.ClientIP, e.Method, e.URI, e.Matches, e.Score, e.Blocked)
+	if !strings.Contains(buf.String(), `password=****`) {
+		t.Errorf("request log has no masked password:\n%s", buf.String())
+	}
+	checkNoSecrets(t, "request log", buf.String())
+}
@@ -1,10 +1,110 @@
 package utils
 
-import "github.com/dlclark/regexp2"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 
-// MatchRegex using regexp2 (PCRE-like, supports lookahead, atomic groups, etc.)
+	"github.com/dlclark/regexp2"
+)
+
+// RegexTimeouts counts regex evaluations abandoned at their match timeout
+var RegexTimeouts = Metrics.NewCounter("waf_regex_timeouts_total",
+	"Regex evaluations abandoned because they exceeded their match timeout.")
+
+// ErrRegexTimeout is returned for a backtracking regex that ran out of time
+var ErrRegexTimeout = errors.New("regex match timeout")
+
+// DefaultRegexTimeout bounds a single backtracking regex match
+const DefaultRegexTimeout = 50 * time.Millisecond
+
+var regexTimeout atomic.Int64
+
+// clockLag is how far regexp2's timeout clock may run behind: the longest
+// check period set so far, which the clock may still be sleeping for, plus
+// one of its ticks of about a millisecond
+var clockLag atomic.Int64
+
+func init() {
+	SetRegexTimeout(DefaultRegexTimeout)
+}
+
+// SetRegexTimeout sets the match timeout of backtracking (regexp2)
+// patterns. It applies to patterns compiled afterwards, so it has to be
+// called before the rules are loaded.
+func SetRegexTimeout(d time.Duration) {
+	if d <= 0 {
+		d = DefaultRegexTimeout
+	}
+	regexTimeout.Store(int64(d))
+	// regexp2 checks timeouts on a clock ticking every 100ms by default,
+	// which would let a short timeout overrun several times over
+	period := min(regexp2.DefaultClockPeriod, max(time.Millisecond, d/4))
+	regexp2.SetTimeoutCheckPeriod(period)
+	if lag := int64(period + 1<<20); lag > clockLag.Load() {
+		clockLag.Store(lag)
+	}
+}
+
+// RegexTimeout returns the match timeout of backtracking patterns
+func RegexTimeout() time.Duration {
+	return time.Duration(regexTimeout.Load())
+}
+
+// CompilePCRE compiles a PCRE-style pattern (lookarounds, atomic groups,
+// backreferences) with the configured match timeout
+func CompilePCRE(pattern string, opts regexp2.RegexOptions) (*regexp2.Regexp, error) {
+	re, err := regexp2.Compile(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+	re.MatchTimeout = RegexTimeout()
+	return re, nil
+}
+
+// MatchPCRE runs a pattern of CompilePCRE; a match that runs out of time
+// reports ErrRegexTimeout
+func MatchPCRE(re *regexp2.Regexp, input string) (bool, error) {
+	start := time.Now()
+	match, err := re.MatchString(input)
+	if err != nil {
+		// regexp2 has no timeout error type: a match stopped at its
+		// deadline ran for the timeout, give or take the clock lag
+		if time.Since(start) >= re.MatchTimeout-time.Duration(clockLag.Load()) {
+			RegexTimeouts.Inc()
+			return false, ErrRegexTimeout
+		}
+		return false, err
+	}
+	return match, nil
+}
+
+// maxCachedRegexes bounds the patterns MatchRegex keeps compiled
+const maxCachedRegexes = 4096
+
+var regexCache = struct {
+	sync.RWMutex
+	m map[string]*regexp2.Regexp
+}{m: make(map[string]*regexp2.Regexp)}
+
+// MatchRegex using regexp2 (PCRE-like, supports lookahead, atomic groups, etc.).
+// Invalid patterns and matches that time out report false.
 func MatchRegex(pattern, input string) bool {
-	re := regexp2.MustCompile(pattern, regexp2.IgnoreCase|regexp2.Multiline)
-	match, _ := re.MatchString(input)
+	regexCache.RLock()
+	re, ok := regexCache.m[pattern]
+	regexCache.RUnlock()
+	if !ok {
+		var err error
+		if re, err = CompilePCRE(pattern, regexp2.IgnoreCase|regexp2.Multiline); err != nil {
+			return false
+		}
+		regexCache.Lock()
+		if len(regexCache.m) < maxCachedRegexes {
+			regexCache.m[pattern] = re
+		}
+		regexCache.Unlock()
+	}
+	match, _ := MatchPCRE(re, input)
 	return match
 }
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dlclark/regexp2"
+)
+
+func TestMain(m *testing.M) {
+	// regexp2 reads its check period concurrently once matching started,
+	// so the timeout of the tests is set once, up front
+	SetRegexTimeout(5 * time.Millisecond)
+	os.Exit(m.Run())
+}
+
+func TestMatchPCRETimeout(t *testing.T) {
+	re, err := CompilePCRE(`^(?=a)(a+)+$`, regexp2.None)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if match, err := MatchPCRE(re, "aaaa"); !match || err != nil {
+		t.Errorf("short input: %v, %v", match, err)
+	}
+	before := RegexTimeouts.Value()
+	start := time.Now()
+	match, err := MatchPCRE(re, strings.Repeat("a", 40)+"!")
+	if match || !errors.Is(err, ErrRegexTimeout) {
+		t.Errorf("catastrophic input: %v, %v, want ErrRegexTimeout", match, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("match ran %v with a 5ms timeout", elapsed)
+	}
+	if RegexTimeouts.Value() != before+1 {
+		t.Error("timeout not counted")
+	}
+}
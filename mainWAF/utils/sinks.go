@@ -0,0 +1,413 @@
+package utils
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ----------------------------
+// Log output sinks
+// ----------------------------
+
+// SinkConfig selects where a log is written
+type SinkConfig struct {
+	Type string `yaml:"type"` // file, syslog, stdout or stderr
+
+	// file
+	Path       string        `yaml:"path"`
+	MaxSizeMB  int           `yaml:"max_size_mb"` // rotate when the file would grow past this, 0 = never
+	MaxAge     time.Duration `yaml:"max_age"`     // rotate when the file is older than this, 0 = never
+	MaxBackups int           `yaml:"max_backups"` // rotated files kept, 0 = all
+	Compress   bool          `yaml:"compress"`    // gzip rotated files
+
+	// syslog (RFC 5424)
+	Network  string `yaml:"network"`  // udp, tcp, unix or unixgram
+	Address  string `yaml:"address"`  // host:port or socket path
+	Facility string `yaml:"facility"` // e.g. local0 (default), daemon, auth
+	Severity string `yaml:"severity"` // e.g. info (default), notice, warning
+	Tag      string `yaml:"tag"`      // APP-NAME, default "waf"
+
+	// Writes queued before new ones are dropped, default 4096. Sinks never
+	// block the caller: a slow disk or syslog server loses lines instead.
+	Buffer int `yaml:"buffer"`
+}
+
+// DroppedLogWrites counts writes dropped because a sink queue was full
+var DroppedLogWrites atomic.Uint64
+
+var (
+	sinksMu   sync.Mutex
+	openSinks []io.Closer
+)
+
+// OpenSink opens the sink described by cfg behind a non-blocking queue.
+// Each Write should carry one complete log record.
+func OpenSink(cfg SinkConfig) (io.WriteCloser, error) {
+	var w io.WriteCloser
+	var err error
+	switch strings.ToLower(cfg.Type) {
+	case "", "stderr":
+		w = nopCloser{os.Stderr}
+	case "stdout":
+		w = nopCloser{os.Stdout}
+	case "file":
+		w, err = openRotatingFile(cfg)
+	case "syslog":
+		w, err = openSyslog(cfg)
+	default:
+		err = fmt.Errorf("unknown log sink type %q", cfg.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := newAsyncWriter(w, cfg.Buffer)
+	sinksMu.Lock()
+	openSinks = append(openSinks, a)
+	sinksMu.Unlock()
+	return a, nil
+}
+
+// CloseSinks flushes and closes every sink opened by OpenSink; call it
+// before the process exits
+func CloseSinks() {
+	sinksMu.Lock()
+	sinks := openSinks
+	openSinks = nil
+	sinksMu.Unlock()
+	for _, s := range sinks {
+		_ = s.Close()
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// ----------------------------
+// Non-blocking writes
+// ----------------------------
+
+// asyncWriter hands writes to a goroutine so a slow sink never stalls
+// request handling
+type asyncWriter struct {
+	out    io.WriteCloser
+	queue  chan []byte
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newAsyncWriter(out io.WriteCloser, size int) *asyncWriter {
+	if size <= 0 {
+		size = 4096
+	}
+	a := &asyncWriter{out: out, queue: make(chan []byte, size), done: make(chan struct{})}
+	go a.run()
+	return a
+}
+
+func (a *asyncWriter) run() {
+	defer close(a.done)
+	for p := range a.queue {
+		if _, err := a.out.Write(p); err != nil {
+			// The error log may be this very sink, so report on stderr
+			fmt.Fprintf(os.Stderr, "log sink write failed: %v\n", err)
+		}
+	}
+}
+
+// Write queues a copy of p; it drops p when the queue is full
+func (a *asyncWriter) Write(p []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return 0, os.ErrClosed
+	}
+	select {
+	case a.queue <- append([]byte(nil), p...):
+	default:
+		DroppedLogWrites.Add(1)
+	}
+	return len(p), nil
+}
+
+// Close drains the queue and closes the sink
+func (a *asyncWriter) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.queue)
+	a.mu.Unlock()
+	<-a.done
+	return a.out.Close()
+}
+
+// ----------------------------
+// Rotating file
+// ----------------------------
+
+// rotatingFile is only written from its asyncWriter goroutine
+type rotatingFile struct {
+	cfg    SinkConfig
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(cfg SinkConfig) (*rotatingFile, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("file log sink needs a path")
+	}
+	r := &rotatingFile{cfg: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if dir := filepath.Dir(r.cfg.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(r.cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	if info.Size() > 0 {
+		r.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && r.due(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// due reports whether writing n more bytes needs a new file
+func (r *rotatingFile) due(n int) bool {
+	if r.cfg.MaxSizeMB > 0 && r.size+int64(n) > int64(r.cfg.MaxSizeMB)<<20 {
+		return true
+	}
+	return r.cfg.MaxAge > 0 && time.Since(r.opened) >= r.cfg.MaxAge
+}
+
+// rotate renames the current file to <path>.<timestamp>[.gz] and starts
+// a new one
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	backup := r.cfg.Path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.cfg.Path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.cfg.Compress {
+		if err := gzipFile(backup); err != nil {
+			return err
+		}
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files beyond max_backups
+func (r *rotatingFile) prune() error {
+	if r.cfg.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(r.cfg.Path + ".2*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups) // timestamps sort chronologically
+	for len(backups) > r.cfg.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ----------------------------
+// RFC 5424 syslog
+// ----------------------------
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3, "warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// syslogWriter sends each Write as one RFC 5424 message. Stream transports
+// use octet-counting framing (RFC 6587) on TCP and newline framing on unix
+// sockets, the way rsyslog and syslog-ng expect them.
+type syslogWriter struct {
+	network, address string
+	pri              int
+	hostname, tag    string
+	pid              string
+	conn             net.Conn
+}
+
+func openSyslog(cfg SinkConfig) (*syslogWriter, error) {
+	network := strings.ToLower(cfg.Network)
+	if network == "" {
+		network = "udp"
+	}
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unknown syslog network %q", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("syslog log sink needs an address")
+	}
+
+	facility, severity := cfg.Facility, cfg.Severity
+	if facility == "" {
+		facility = "local0"
+	}
+	if severity == "" {
+		severity = "info"
+	}
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+	}
+	sev, ok := syslogSeverities[strings.ToLower(severity)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog severity %q", cfg.Severity)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "waf"
+	}
+	s := &syslogWriter{
+		network: network, address: cfg.Address,
+		pri: fac*8 + sev, hostname: hostname, tag: tag, pid: strconv.Itoa(os.Getpid()),
+	}
+	// A syslog server that is down must not keep the WAF from starting;
+	// Write retries the connection
+	if err := s.connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "syslog %s %s unreachable, will retry: %v\n", network, cfg.Address, err)
+	}
+	return s, nil
+}
+
+func (s *syslogWriter) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// FormatSyslog builds an RFC 5424 message without structured data
+func FormatSyslog(pri int, t time.Time, hostname, app, procID, msg string) string {
+	return fmt.Sprintf("<%d>1 %s %s %s %s - - %s", pri, t.UTC().Format("2006-01-02T15:04:05.000000Z"), hostname, app, procID, msg)
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	msg := FormatSyslog(s.pri, time.Now(), s.hostname, s.tag, s.pid, strings.TrimRight(string(p), "\n"))
+	switch s.network {
+	case "tcp":
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	case "unix":
+		msg += "\n"
+	}
+
+	// Reconnect once: stream connections drop when the server restarts
+	if s.conn != nil {
+		if _, err := io.WriteString(s.conn, msg); err == nil {
+			return len(p), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	if err := s.connect(); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(s.conn, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *syslogWriter) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,266 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rfc5424 matches the messages of a local0.info sink tagged "waf"
+var rfc5424 = regexp.MustCompile(`^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z (\S+) waf (\d+) - - (.*)$`)
+
+func checkSyslogMessage(t *testing.T, got, wantMsg string) {
+	t.Helper()
+	m := rfc5424.FindStringSubmatch(got)
+	if m == nil {
+		t.Fatalf("%q is not an RFC 5424 message of local0.info", got)
+	}
+	if m[2] != strconv.Itoa(os.Getpid()) || m[3] != wantMsg {
+		t.Errorf("%q: procid %s, message %q, want %d and %q", got, m[2], m[3], os.Getpid(), wantMsg)
+	}
+}
+
+func TestFormatSyslog(t *testing.T) {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.FixedZone("CET", 3600))
+	got := FormatSyslog(4*8+5, at, "gw1", "waf", "42", `{"rule":"942100"}`)
+	want := `<37>1 2024-03-01T11:30:45.123456Z gw1 waf 42 - - {"rule":"942100"}`
+	if got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("no UDP listener: %v", err)
+	}
+	defer conn.Close()
+
+	w, err := openSyslog(SinkConfig{Network: "udp", Address: conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, msg := range []string{"first record\n", "second record"} {
+		if _, err := w.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64<<10)
+	for _, want := range []string{"first record", "second record"} {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSyslogMessage(t, string(buf[:n]), want)
+	}
+}
+
+func TestSyslogStreamFraming(t *testing.T) {
+	for _, network := range []string{"unix", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			addr := "127.0.0.1:0"
+			if network == "unix" {
+				addr = filepath.Join(t.TempDir(), "syslog.sock")
+			}
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				t.Skipf("no %s listener: %v", network, err)
+			}
+			defer ln.Close()
+
+			w, err := openSyslog(SinkConfig{Network: network, Address: ln.Addr().String()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			records := []string{"one", "two with spaces"}
+			for _, rec := range records {
+				if _, err := w.Write([]byte(rec + "\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := bufio.NewReader(conn)
+			for _, want := range records {
+				var msg string
+				if network == "unix" {
+					// newline framing
+					line, err := r.ReadString('\n')
+					if err != nil {
+						t.Fatal(err)
+					}
+					msg = strings.TrimSuffix(line, "\n")
+				} else {
+					// octet counting: "<len> <msg>"
+					length, err := r.ReadString(' ')
+					if err != nil {
+						t.Fatal(err)
+					}
+					n, err := strconv.Atoi(strings.TrimSpace(length))
+					if err != nil {
+						t.Fatalf("bad frame length %q", length)
+					}
+					b := make([]byte, n)
+					if _, err := io.ReadFull(r, b); err != nil {
+						t.Fatal(err)
+					}
+					msg = string(b)
+				}
+				checkSyslogMessage(t, msg, want)
+			}
+		})
+	}
+}
+
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "waf.log")
+	r, err := openRotatingFile(SinkConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	record := strings.Repeat("x", 600<<10) + "\n"
+	for i := 0; i < 4; i++ {
+		if i > 0 {
+			// rotated files are named by the millisecond
+			time.Sleep(5 * time.Millisecond)
+		}
+		if _, err := r.Write([]byte(record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every record after the first fills the file past 1 MB, so each
+	// starts a new file; only the two newest rotated files are kept
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 2 {
+		t.Fatalf("rotated files %v, want 2", backups)
+	}
+	for _, b := range backups {
+		if !strings.HasSuffix(b, ".gz") {
+			t.Errorf("%s is not compressed", b)
+		} else if got := readGzip(t, b); got != record {
+			t.Errorf("%s holds %d bytes, want one record", b, len(got))
+		}
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(record)) {
+		t.Errorf("current file: %v, want one record", err)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waf.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	// The age of an existing file counts from its last write
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	r, err := openRotatingFile(SinkConfig{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, rec := range []string{"new\n", "newer\n"} {
+		if _, err := r.Write([]byte(rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 1 {
+		t.Fatalf("rotated files %v, want 1", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != "old\n" {
+		t.Errorf("rotated file holds %q, want the old records", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\nnewer\n" {
+		t.Errorf("current file holds %q, want both new records", data)
+	}
+}
+
+// blockedSink stalls every write until it is released
+type blockedSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	written int
+}
+
+func (b *blockedSink) Write(p []byte) (int, error) {
+	<-b.release
+	b.mu.Lock()
+	b.written++
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+func (b *blockedSink) Close() error { return nil }
+
+func TestBlockedSinkDropsRecords(t *testing.T) {
+	sink := &blockedSink{release: make(chan struct{})}
+	a := newAsyncWriter(sink, 2)
+	before := DroppedLogWrites.Load()
+
+	const records = 10
+	start := time.Now()
+	for i := 0; i < records; i++ {
+		if n, err := a.Write([]byte("record\n")); err != nil || n != 7 {
+			t.Fatalf("write %d: %d, %v", i, n, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("writes to a stalled sink took %v", elapsed)
+	}
+
+	close(sink.release)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// At most the queue and the write in progress got through
+	dropped := int(DroppedLogWrites.Load() - before)
+	if sink.written+dropped != records || sink.written > 3 {
+		t.Errorf("%d records written and %d dropped, want at most 3 written and the rest dropped", sink.written, dropped)
+	}
+	if _, err := a.Write([]byte("late\n")); err == nil {
+		t.Error("write after Close succeeded")
+	}
+}
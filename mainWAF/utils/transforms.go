@@ -0,0 +1,487 @@
+package utils
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ----------------------------
+// Rule transformations (t:...)
+// ----------------------------
+
+// TransformFunc rewrites a value before it is handed to a rule operator
+type TransformFunc func(string) string
+
+// transforms maps the lower-cased ModSecurity transformation names
+var transforms = map[string]TransformFunc{
+	"none":               func(s string) string { return s },
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"urldecode":          urlDecode,
+	"urldecodeuni":       urlDecodeUni,
+	"utf8tounicode":      utf8ToUnicode,
+	"htmlentitydecode":   html.UnescapeString,
+	"jsdecode":           jsDecode,
+	"escapeseqdecode":    escapeSeqDecode,
+	"cmdline":            cmdLine,
+	"normalizepath":      normalizePath,
+	"normalisepath":      normalizePath,
+	"normalizepathwin":   normalizePathWin,
+	"normalisepathwin":   normalizePathWin,
+	"compresswhitespace": compressWhitespace,
+	"removewhitespace":   removeWhitespace,
+	"removenulls":        func(s string) string { return strings.ReplaceAll(s, "\x00", "") },
+	"replacenulls":       func(s string) string { return strings.ReplaceAll(s, "\x00", " ") },
+	"removecomments":     func(s string) string { return replaceComments(s, "") },
+	"replacecomments":    func(s string) string { return replaceComments(s, " ") },
+	"removecommentschar": removeCommentsChar,
+	"trim":               func(s string) string { return strings.TrimFunc(s, unicode.IsSpace) },
+	"trimleft":           func(s string) string { return strings.TrimLeftFunc(s, unicode.IsSpace) },
+	"trimright":          func(s string) string { return strings.TrimRightFunc(s, unicode.IsSpace) },
+	"length":             func(s string) string { return strconv.Itoa(len(s)) },
+	"base64decode":       base64Decode,
+	"base64decodeext":    base64Decode,
+	"hexdecode":          hexDecode,
+	"hexencode":          func(s string) string { return hex.EncodeToString([]byte(s)) },
+	"md5":                func(s string) string { sum := md5.Sum([]byte(s)); return string(sum[:]) },
+	"sha1":               func(s string) string { sum := sha1.Sum([]byte(s)); return string(sum[:]) },
+	"sqlhexdecode":       sqlHexDecode,
+	"cssdecode":          cssDecode,
+	"urlencode":          urlEncode,
+	"replacewhitespace":  func(s string) string { return strings.Map(spaceToBlank, s) },
+}
+
+// IsTransform reports whether a transformation name is supported
+func IsTransform(name string) bool {
+	_, ok := transforms[strings.ToLower(name)]
+	return ok
+}
+
+// ApplyTransforms runs the named transformations in order. Like in
+// ModSecurity, "none" discards every transformation listed before it;
+// unknown names are skipped.
+func ApplyTransforms(names []string, value string) string {
+	for i := len(names) - 1; i >= 0; i-- {
+		if strings.EqualFold(names[i], "none") {
+			names = names[i+1:]
+			break
+		}
+	}
+	for _, name := range names {
+		if fn, ok := transforms[strings.ToLower(name)]; ok {
+			value = fn(value)
+		}
+	}
+	return value
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// hexByte decodes the two hex digits at s[i:i+2]
+func hexByte(s string, i int) (byte, bool) {
+	if i+1 >= len(s) {
+		return 0, false
+	}
+	hi, ok1 := unhex(s[i])
+	lo, ok2 := unhex(s[i+1])
+	return hi<<4 | lo, ok1 && ok2
+}
+
+// urlDecode decodes %XX and '+'; invalid escapes are left as they are
+func urlDecode(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%':
+			if v, ok := hexByte(s, i+1); ok {
+				b.WriteByte(v)
+				i += 2
+				continue
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// urlDecodeUni is urlDecode plus the IIS %uXXXX form
+func urlDecodeUni(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' && i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+			if hi, ok := hexByte(s, i+2); ok {
+				if lo, ok := hexByte(s, i+4); ok {
+					b.WriteRune(rune(hi)<<8 | rune(lo))
+					i += 5
+					continue
+				}
+			}
+		}
+		switch {
+		case c == '+':
+			b.WriteByte(' ')
+		case c == '%':
+			if v, ok := hexByte(s, i+1); ok {
+				b.WriteByte(v)
+				i += 2
+				continue
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func urlEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ':
+			b.WriteByte('+')
+		case c < 0x80 && (unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)) || strings.IndexByte("-_.*", c) >= 0):
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToLower(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+// utf8ToUnicode rewrites every multi-byte UTF-8 character as %uXXXX
+func utf8ToUnicode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteString("%u" + strings.ToLower(strconv.FormatInt(int64(r&0xffff)|0x10000, 16)[1:]))
+	}
+	return b.String()
+}
+
+// jsDecode decodes JavaScript escapes: \xHH, \uHHHH, \OOO and \n style
+func jsDecode(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch n := s[i+1]; {
+		case n == 'x':
+			if v, ok := hexByte(s, i+2); ok {
+				b.WriteByte(v)
+				i += 3
+				continue
+			}
+		case n == 'u':
+			if hi, ok := hexByte(s, i+2); ok {
+				if lo, ok := hexByte(s, i+4); ok {
+					b.WriteRune(rune(hi)<<8 | rune(lo))
+					i += 5
+					continue
+				}
+			}
+		case n >= '0' && n <= '7':
+			j, v := i+1, 0
+			for ; j < len(s) && j < i+4 && s[j] >= '0' && s[j] <= '7'; j++ {
+				v = v*8 + int(s[j]-'0')
+			}
+			b.WriteByte(byte(v))
+			i = j - 1
+			continue
+		}
+		b.WriteByte(simpleEscape(s[i+1]))
+		i++
+	}
+	return b.String()
+}
+
+// escapeSeqDecode decodes ANSI C escapes (\n, \xHH, \OOO, ...)
+func escapeSeqDecode(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch n := s[i+1]; {
+		case n == 'x' || n == 'X':
+			if v, ok := hexByte(s, i+2); ok {
+				b.WriteByte(v)
+				i += 3
+				continue
+			}
+			b.WriteString(s[i : i+2])
+		case n >= '0' && n <= '7':
+			j, v := i+1, 0
+			for ; j < len(s) && j < i+4 && s[j] >= '0' && s[j] <= '7'; j++ {
+				v = v*8 + int(s[j]-'0')
+			}
+			b.WriteByte(byte(v))
+			i = j - 1
+			continue
+		default:
+			b.WriteByte(simpleEscape(n))
+		}
+		i++
+	}
+	return b.String()
+}
+
+func simpleEscape(c byte) byte {
+	switch c {
+	case 'a':
+		return '\a'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'v':
+		return '\v'
+	}
+	return c
+}
+
+// cssDecode decodes CSS 2.x escapes (\HHHHHH with an optional trailing space)
+func cssDecode(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		j, v := i+1, 0
+		for ; j < len(s) && j < i+7; j++ {
+			d, ok := unhex(s[j])
+			if !ok {
+				break
+			}
+			v = v<<4 | int(d)
+		}
+		if j == i+1 {
+			if s[j] != '\n' {
+				b.WriteByte(s[j])
+			}
+			i = j
+			continue
+		}
+		b.WriteRune(rune(v))
+		if j < len(s) && s[j] == ' ' {
+			j++
+		}
+		i = j - 1
+	}
+	return b.String()
+}
+
+// cmdLine normalizes shell command lines the way CRS expects: drops the
+// characters used to obfuscate commands and lower-cases the result
+func cmdLine(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"', '\'', '^':
+			continue
+		case ' ', '\t', '\n', '\r', ',', ';':
+			space = true
+			continue
+		case '/', '(':
+			// Spaces before a slash or parenthesis are dropped
+			space = false
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return strings.ToLower(b.String())
+}
+
+// normalizePath removes multiple slashes and resolves ./ and ../ segments
+func normalizePath(s string) string {
+	if s == "" {
+		return s
+	}
+	abs := strings.HasPrefix(s, "/")
+	trailing := strings.HasSuffix(s, "/") || strings.HasSuffix(s, "/.") || strings.HasSuffix(s, "/..")
+	var out []string
+	for _, seg := range strings.Split(s, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(out) > 0 && out[len(out)-1] != ".." {
+				out = out[:len(out)-1]
+			} else if !abs {
+				out = append(out, "..")
+			}
+		default:
+			out = append(out, seg)
+		}
+	}
+	res := strings.Join(out, "/")
+	if abs {
+		res = "/" + res
+	}
+	if trailing && !strings.HasSuffix(res, "/") {
+		res += "/"
+	}
+	return res
+}
+
+func normalizePathWin(s string) string {
+	return normalizePath(strings.ReplaceAll(s, `\`, "/"))
+}
+
+func spaceToBlank(r rune) rune {
+	if unicode.IsSpace(r) {
+		return ' '
+	}
+	return r
+}
+
+// compressWhitespace turns every run of whitespace into a single space
+func compressWhitespace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if unicode.IsSpace(r) {
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func removeWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// replaceComments replaces C style /* ... */ comments (an unterminated one
+// runs to the end of the value)
+func replaceComments(s, with string) string {
+	for {
+		start := strings.Index(s, "/*")
+		if start < 0 {
+			return s
+		}
+		end := strings.Index(s[start+2:], "*/")
+		if end < 0 {
+			return s[:start] + with
+		}
+		s = s[:start] + with + s[start+2+end+2:]
+	}
+}
+
+// removeCommentsChar deletes the comment markers /*, */, --, # and <!--, -->
+func removeCommentsChar(s string) string {
+	for _, m := range []string{"/*", "*/", "<!--", "-->", "--", "#"} {
+		s = strings.ReplaceAll(s, m, "")
+	}
+	return s
+}
+
+// base64Decode decodes standard or unpadded base64, ignoring invalid input
+func base64Decode(s string) string {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return string(b)
+	}
+	if b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "=")); err == nil {
+		return string(b)
+	}
+	return s
+}
+
+func hexDecode(s string) string {
+	if b, err := hex.DecodeString(s); err == nil {
+		return string(b)
+	}
+	return s
+}
+
+// sqlHexDecode decodes 0xHEX literals
+func sqlHexDecode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '0' && i+3 < len(s) && (s[i+1] == 'x' || s[i+1] == 'X') {
+			j := i + 2
+			for j+1 < len(s) {
+				if _, ok := hexByte(s, j); !ok {
+					break
+				}
+				j += 2
+			}
+			if j > i+2 {
+				decoded, _ := hex.DecodeString(s[i+2 : j])
+				b.Write(decoded)
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
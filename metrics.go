@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Engine metrics (served on /metrics)
+// ==========================
+
+var (
+	requestsTotal = utils.Metrics.NewCounterVec("waf_requests_total",
+		"Inspected requests by decision: allow, detect (scored but not blocked) or block.", "decision")
+	ruleBlocksTotal = utils.Metrics.NewCounterVec("waf_rule_blocks_total",
+		"Matches of blocking rules by rule ID and category.", "rule_id", "category")
+	anomalyScore = utils.Metrics.NewHistogram("waf_anomaly_score",
+		"Anomaly score of inspected requests.", []float64{0, 1, 2, 3, 5, 8, 13, 21})
+	phaseDuration = utils.Metrics.NewHistogramVec("waf_phase_duration_seconds",
+		"Time spent evaluating the rules of one phase.",
+		[]float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}, "phase")
+	ruleEvaluations = utils.Metrics.NewCounterVec("waf_rule_evaluations_total",
+		"Rule evaluations, chained rules included in their chain starter.", "rule_id")
+	ruleEvaluationSeconds = utils.Metrics.NewCounterVec("waf_rule_evaluation_seconds_total",
+		"Cumulative time spent evaluating a rule.", "rule_id")
+	regexBudgetExceeded = utils.Metrics.NewCounter("waf_regex_budget_exceeded_total",
+		"Requests whose backtracking regexes used up the per-transaction time budget.")
+	bodyParseErrors = utils.Metrics.NewCounterVec("waf_body_parse_errors_total",
+		"Request bodies that could not be read or parsed, by kind (read, json, form).", "type")
+	rulesLoaded = utils.Metrics.NewGaugeVec("waf_rules",
+		"Loaded rules by state: active, or disabled because the operator is unsupported.", "state")
+	rulesLoadSuccess = utils.Metrics.NewGauge("waf_rules_load_success",
+		"1 if the last rule load succeeded, 0 if it failed.")
+	rulesLoadTimestamp = utils.Metrics.NewGauge("waf_rules_load_timestamp_seconds",
+		"Unix time of the last rule load.")
+)
+
+func init() {
+	utils.Metrics.NewCounterFunc("waf_log_writes_dropped_total",
+		"Log and audit records dropped because a sink queue was full.",
+		func() float64 { return float64(utils.DroppedLogWrites.Load()) })
+}
+
+// decisionLabel is the waf_requests_total decision of a verdict
+func decisionLabel(dec Decision) string {
+	switch {
+	case dec.Block:
+		return "block"
+	case dec.Score > 0:
+		return "detect"
+	}
+	return "allow"
+}
+
+// recordDecision updates the per-request metrics of an inspection
+func recordDecision(dec Decision, matchedRules []utils.MatchedRuleLog) {
+	requestsTotal.With(decisionLabel(dec)).Inc()
+	anomalyScore.Observe(float64(dec.Score))
+	for _, m := range matchedRules {
+		if m.Block {
+			ruleBlocksTotal.With(m.RuleID, m.Category).Inc()
+		}
+	}
+}
+
+// recordRuleLoad publishes the outcome of rules.LoadRules
+func recordRuleLoad(loaded []rules.Rule, err error) {
+	rulesLoadTimestamp.Set(float64(time.Now().Unix()))
+	if err != nil {
+		rulesLoadSuccess.Set(0)
+		return
+	}
+	rulesLoadSuccess.Set(1)
+	active, disabled := 0, 0
+	for _, r := range loaded {
+		switch {
+		case r.Marker != "":
+		case r.Op == nil:
+			disabled++
+		default:
+			active++
+		}
+	}
+	rulesLoaded.With("active").Set(float64(active))
+	rulesLoaded.With("disabled").Set(float64(disabled))
+}
+
+// phaseLabels avoids formatting the phase number on every request
+var phaseLabels = func() map[int]string {
+	m := make(map[int]string, len(phases))
+	for _, p := range phases {
+		m[p] = strconv.Itoa(p)
+	}
+	return m
+}()
+
+// MetricsHandler serves the Prometheus text exposition of utils.Metrics
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := utils.Metrics.WritePrometheus(w); err != nil {
+			slog.Warn("writing metrics failed", "err", err)
+		}
+	})
+}
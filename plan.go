@@ -0,0 +1,332 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"waf-engine/mainWAF/collections"
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Compiled rule plan
+// ==========================
+
+// selectorKind is what a rule target reads, decided once at load time
+type selectorKind int
+
+const (
+	selNone         selectorKind = iota // a variable the engine does not collect
+	selArgs                             // ARGS
+	selArgsNames                        // ARGS_NAMES
+	selArg                              // ARGS:name, matched case-insensitively
+	selArgsGet                          // ARGS_GET
+	selArgsGetNames                     // ARGS_GET_NAMES
+	selArgGet                           // ARGS_GET:name, matched case-insensitively
+	selField                            // one flatten cache entry, e.g. REQUEST_URI
+	selMethod                           // REQUEST_METHOD
+	selCount                            // &VAR
+	selTX                               // TX or TX:name
+	selCollection                       // IP, SESSION, ... or IP:name
+	selMatched                          // MATCHED_VAR or MATCHED_VARS
+)
+
+// selector is a parsed rule target such as "REQUEST_HEADERS:User-Agent"
+type selector struct {
+	kind  selectorKind
+	name  string    // the target as written
+	key   string    // flatten cache key, or the upper-cased TX/collection target
+	inner *selector // the counted target of &VAR
+}
+
+// viewMask tells which parts of a request a rule reads
+type viewMask uint8
+
+const (
+	viewArgs viewMask = 1 << iota
+	viewBody
+	viewHeaders
+	viewCookies
+	viewAlways // values every request has, or that come from the transaction
+)
+
+// parseSelector classifies a single target of a rule's variable list
+func parseSelector(variable string) selector {
+	upper := strings.ToUpper(variable)
+	s := selector{name: variable}
+
+	switch {
+	case upper == "ARGS":
+		s.kind = selArgs
+	case upper == "ARGS_NAMES":
+		s.kind = selArgsNames
+	case strings.HasPrefix(upper, "ARGS:"):
+		s.kind = selArg
+	case upper == "ARGS_GET":
+		s.kind = selArgsGet
+	case upper == "ARGS_GET_NAMES":
+		s.kind = selArgsGetNames
+	case strings.HasPrefix(upper, "ARGS_GET:"):
+		s.kind = selArgGet
+	case upper == "REQUEST_BODY", upper == "REQUEST_PROTOCOL", upper == "REQUEST_URI",
+		upper == "REQUEST_URI_RAW", upper == "REQUEST_LINE", upper == "REQUEST_FILENAME",
+		upper == "REQUEST_BASENAME", upper == "QUERY_STRING", upper == "REMOTE_ADDR":
+		s.kind, s.key = selField, upper
+	case strings.HasPrefix(upper, "&"):
+		inner := parseSelector(variable[1:])
+		s.kind, s.inner = selCount, &inner
+	case strings.HasPrefix(upper, "REQUEST_HEADERS:"):
+		// Header names are stored lower-cased in the flatten cache
+		s.kind, s.key = selField, "REQUEST_HEADERS:"+strings.ToLower(variable[len("REQUEST_HEADERS:"):])
+	case strings.HasPrefix(upper, "REQUEST_HEADERS"), strings.HasPrefix(upper, "REQUEST_COOKIES"):
+		s.kind, s.key = selField, variable
+	case upper == "REQUEST_METHOD":
+		s.kind = selMethod
+	case upper == "TX" || strings.HasPrefix(upper, "TX:"):
+		s.kind, s.key = selTX, upper
+	case collections.IsCollection(strings.SplitN(upper, ":", 2)[0]):
+		s.kind, s.key = selCollection, upper
+	case upper == "MATCHED_VAR", upper == "MATCHED_VARS":
+		s.kind = selMatched
+	}
+	return s
+}
+
+// reads returns the request parts the selector can produce values from
+func (s selector) reads() viewMask {
+	switch s.kind {
+	case selNone:
+		return 0
+	case selArgs, selArgsNames, selArg, selArgsGet, selArgsGetNames, selArgGet:
+		return viewArgs
+	case selField:
+		switch {
+		case s.key == "REQUEST_BODY":
+			return viewBody
+		case strings.HasPrefix(strings.ToUpper(s.key), "REQUEST_HEADERS"):
+			return viewHeaders
+		case strings.HasPrefix(strings.ToUpper(s.key), "REQUEST_COOKIES"):
+			return viewCookies
+		}
+	}
+	// &VAR yields a count even when VAR is empty
+	return viewAlways
+}
+
+// planRule is a rule with its targets parsed and its chain compiled
+type planRule struct {
+	rules.Rule
+	targets []selector
+	skipped []string // "!REQUEST_HEADERS:Referer" removes a single variable
+	reads   viewMask // zero for rules that cannot match any request
+	chain   []*planRule
+
+	metricsOnce sync.Once
+	evaluations *utils.Counter
+	seconds     *utils.Counter
+}
+
+func newPlanRule(rule rules.Rule) *planRule {
+	p := &planRule{Rule: rule}
+	if rule.Variable == "" {
+		p.reads = viewAlways
+	}
+	for _, varName := range strings.Split(rule.Variable, "|") {
+		if varName == "" {
+			continue
+		}
+		if name, ok := strings.CutPrefix(varName, "!"); ok {
+			p.skipped = append(p.skipped, name)
+			continue
+		}
+		s := parseSelector(varName)
+		p.targets = append(p.targets, s)
+		p.reads |= s.reads()
+	}
+	for _, link := range rule.Chain {
+		p.chain = append(p.chain, newPlanRule(link))
+	}
+	return p
+}
+
+// metrics returns the evaluation counters of the rule, looked up once
+func (p *planRule) metrics() (*utils.Counter, *utils.Counter) {
+	p.metricsOnce.Do(func() {
+		p.evaluations = ruleEvaluations.With(p.ID)
+		p.seconds = ruleEvaluationSeconds.With(p.ID)
+	})
+	return p.evaluations, p.seconds
+}
+
+// rulePlan holds the rules of every phase in load order. SecMarkers are
+// part of every phase, since skipAfter may jump to any of them.
+type rulePlan struct {
+	phases [6][]*planRule
+}
+
+func buildPlan(rs []rules.Rule) *rulePlan {
+	plan := &rulePlan{}
+	var dead []string
+	for _, rule := range rs {
+		if rule.Marker != "" {
+			p := &planRule{Rule: rule}
+			for _, phase := range phases {
+				plan.phases[phase] = append(plan.phases[phase], p)
+			}
+			continue
+		}
+		if phase := rulePhase(rule); phase > 0 && phase < len(plan.phases) {
+			p := newPlanRule(rule)
+			if p.dead() {
+				dead = append(dead, rule.ID)
+			}
+			plan.phases[phase] = append(plan.phases[phase], p)
+		}
+	}
+	if len(dead) > 0 {
+		slog.Warn("rules read only variables the engine does not collect and never match",
+			"count", len(dead), "rules", strings.Join(dead, ","))
+	}
+	return plan
+}
+
+// dead reports whether the rule or one of its chain links reads nothing
+// but variables the engine does not collect (XML, FILES, RESPONSE_BODY, ...)
+func (p *planRule) dead() bool {
+	if p.reads == 0 {
+		return true
+	}
+	for _, link := range p.chain {
+		if link.dead() {
+			return true
+		}
+	}
+	return false
+}
+
+// ==========================
+// Per-request collection views
+// ==========================
+
+// requestView holds the collections of a request that rules read, built
+// once per transaction and shared by every rule
+type requestView struct {
+	argKeys     []string    // flatten cache keys of arguments, sorted
+	args        []candidate // ARGS
+	argNames    []candidate // ARGS_NAMES
+	getKeys     []string    // flatten cache keys of query string arguments, sorted
+	getArgs     []candidate // ARGS_GET
+	getArgNames []candidate // ARGS_GET_NAMES
+	present     viewMask
+}
+
+func newRequestView(req *Request) *requestView {
+	v := &requestView{present: viewAlways}
+	for k := range req.FlattenCache {
+		switch {
+		case strings.HasPrefix(k, "ARGS:") || strings.HasPrefix(k, "BODY:"):
+			v.argKeys = append(v.argKeys, k)
+		case strings.HasPrefix(k, "ARGS_GET:"):
+			v.getKeys = append(v.getKeys, k)
+		}
+	}
+	sort.Strings(v.argKeys)
+	sort.Strings(v.getKeys)
+
+	for _, k := range v.argKeys {
+		for _, val := range req.FlattenCache[k] {
+			v.args = append(v.args, candidate{Name: k, Value: val})
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(k, "ARGS:"), "BODY:")
+		v.argNames = append(v.argNames, candidate{Name: "ARGS_NAMES:" + name, Value: name})
+	}
+	for _, k := range v.getKeys {
+		v.getArgs = append(v.getArgs, candidatesOf(k, req.FlattenCache[k])...)
+		name := strings.TrimPrefix(k, "ARGS_GET:")
+		v.getArgNames = append(v.getArgNames, candidate{Name: "ARGS_GET_NAMES:" + name, Value: name})
+	}
+	if len(v.argKeys) > 0 {
+		v.present |= viewArgs
+	}
+
+	if len(req.FlattenCache["REQUEST_BODY"]) > 0 {
+		v.present |= viewBody
+	}
+	for k := range req.FlattenCache {
+		switch {
+		case strings.HasPrefix(strings.ToUpper(k), "REQUEST_HEADERS"):
+			v.present |= viewHeaders
+		case strings.HasPrefix(strings.ToUpper(k), "REQUEST_COOKIES"):
+			v.present |= viewCookies
+		}
+	}
+	return v
+}
+
+// requestView returns the view of req, building it on first use
+func (tx *Transaction) requestView(req *Request) *requestView {
+	if tx.view == nil {
+		tx.view = newRequestView(req)
+	}
+	return tx.view
+}
+
+// candidates returns the values a selector reads from the request
+func (e *Evaluator) candidates(s selector, req *Request, tx *Transaction) []candidate {
+	switch s.kind {
+	case selArgs:
+		return tx.requestView(req).args
+	case selArgsNames:
+		return tx.requestView(req).argNames
+	case selArg:
+		return argCandidates(tx.requestView(req).argKeys, s.name, req)
+	case selArgsGet:
+		return tx.requestView(req).getArgs
+	case selArgsGetNames:
+		return tx.requestView(req).getArgNames
+	case selArgGet:
+		return argCandidates(tx.requestView(req).getKeys, s.name, req)
+	case selField:
+		return candidatesOf(s.key, req.FlattenCache[s.key])
+	case selMethod:
+		return []candidate{{Name: "REQUEST_METHOD", Value: req.Method}}
+	case selCount:
+		n := len(e.candidates(*s.inner, req, tx))
+		return []candidate{{Name: s.name, Value: strconv.Itoa(n)}}
+	case selTX:
+		return txCandidates(s.key, tx)
+	case selCollection:
+		return e.collectionCandidates(s.key, tx)
+	case selMatched:
+		return matchedCandidates(tx)
+	}
+	// Variables the engine does not collect (XML, RESPONSE_BODY, ...) are empty
+	tx.trace("unsupported variable", "variable", s.name)
+	return nil
+}
+
+// argCandidates returns the values of the arguments in keys named like
+// target, e.g. "ARGS:id", compared case-insensitively
+func argCandidates(keys []string, target string, req *Request) []candidate {
+	var out []candidate
+	for _, k := range keys {
+		if strings.EqualFold(k, target) {
+			out = append(out, candidatesOf(k, req.FlattenCache[k])...)
+		}
+	}
+	return out
+}
+
+// matchedCandidates returns the variable the previous rule of a chain
+// matched. The engine stops at the first match of a rule, so MATCHED_VARS
+// holds that one variable as well.
+func matchedCandidates(tx *Transaction) []candidate {
+	if tx.MatchedVarName == "" {
+		return nil
+	}
+	return []candidate{{Name: tx.MatchedVarName, Value: tx.MatchedVar}}
+}
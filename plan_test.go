@@ -0,0 +1,345 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"waf-engine/mainWAF/collections"
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// The legacy* functions are the evaluation path the compiled plan replaced:
+// every rule of every phase is visited and its variable list is split and
+// expanded again for each request. They are kept here as the reference the
+// plan must agree with.
+
+// legacyInspect returns the decision and matched rule IDs of req
+func (e *Evaluator) legacyInspect(req *Request) (Decision, []string) {
+	var dec Decision
+	var matched []string
+	tx := e.newTransaction()
+	fired := make(map[string]bool)
+	excluded := &exclusions{rules: make(map[string]bool), targets: make(map[string][]string)}
+
+	for _, phase := range phases {
+		skipN, skipTo := 0, ""
+		for _, rule := range e.rules {
+			if rule.Marker != "" {
+				if rule.Marker == skipTo {
+					skipTo = ""
+				}
+				continue
+			}
+			if rulePhase(rule) != phase || excluded.rules[rule.ID] || skipTo != "" {
+				continue
+			}
+			if skipN > 0 {
+				skipN--
+				continue
+			}
+			if rule.Op == nil || fired[rule.ID] {
+				continue
+			}
+			if !e.legacyMatchRule(rule, rule.ID, req, tx, excluded) {
+				continue
+			}
+			fired[rule.ID] = true
+			for _, r := range chainOf(rule) {
+				e.runActions(r, req, tx)
+				excluded.apply(r.Controls)
+				if r.Skip > 0 {
+					skipN = r.Skip
+				}
+				if r.SkipAfter != "" {
+					skipTo = r.SkipAfter
+				}
+			}
+			if rule.NoLog || (len(rule.Controls) > 0 && !rule.Block) {
+				continue
+			}
+			dec.Score++
+			dec.Block = dec.Block || rule.Block
+			matched = append(matched, rule.ID)
+		}
+	}
+	return dec, matched
+}
+
+func (e *Evaluator) legacyMatchRule(rule rules.Rule, id string, req *Request, tx *Transaction, excluded *exclusions) bool {
+	if rule.Op == nil {
+		return false
+	}
+	arg := rule.Op.Arg
+	if rule.Op.Macros {
+		arg = e.expandMacros(arg, rule, req, tx)
+	}
+	if rule.Variable == "" {
+		return rule.Op.Match("", arg) && e.legacyMatchChain(rule, id, req, tx, excluded)
+	}
+
+	var targets, skipped []string
+	for _, varName := range strings.Split(rule.Variable, "|") {
+		if name, ok := strings.CutPrefix(varName, "!"); ok {
+			skipped = append(skipped, name)
+		} else {
+			targets = append(targets, varName)
+		}
+	}
+	for _, varName := range targets {
+		for _, c := range e.legacyExpandVariable(varName, req, tx) {
+			if c.Value == "" || excluded.removed(id, c.Name) || isSkipped(skipped, c.Name) {
+				continue
+			}
+			c.Value = utils.ApplyTransforms(rule.Transforms, c.Value)
+			if !e.prefilter.mayMatch(rule.Op, c.Value, tx) {
+				continue
+			}
+			if ok, err := e.matchOperator(rule.Op, c.Value, arg, tx); !ok || err != nil {
+				continue
+			}
+			tx.MatchedVar, tx.MatchedVarName = c.Value, c.Name
+			return e.legacyMatchChain(rule, id, req, tx, excluded)
+		}
+	}
+	return false
+}
+
+func (e *Evaluator) legacyMatchChain(rule rules.Rule, id string, req *Request, tx *Transaction, excluded *exclusions) bool {
+	for _, link := range rule.Chain {
+		if !e.legacyMatchRule(link, id, req, tx, excluded) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Evaluator) legacyExpandVariable(variable string, req *Request, tx *Transaction) []candidate {
+	upper := strings.ToUpper(variable)
+	isArg := func(k string) bool {
+		return strings.HasPrefix(k, "ARGS:") || (strings.HasPrefix(k, "BODY:") && k != "_raw")
+	}
+
+	switch {
+	case upper == "ARGS":
+		var out []candidate
+		for k, vs := range req.FlattenCache {
+			if isArg(k) {
+				out = append(out, candidatesOf(k, vs)...)
+			}
+		}
+		return out
+	case upper == "ARGS_NAMES":
+		var out []candidate
+		for k := range req.FlattenCache {
+			if isArg(k) {
+				name := strings.TrimPrefix(strings.TrimPrefix(k, "ARGS:"), "BODY:")
+				out = append(out, candidate{Name: "ARGS_NAMES:" + name, Value: name})
+			}
+		}
+		return out
+	case upper == "ARGS_GET":
+		var out []candidate
+		for k, vs := range req.FlattenCache {
+			if strings.HasPrefix(k, "ARGS_GET:") {
+				out = append(out, candidatesOf(k, vs)...)
+			}
+		}
+		return out
+	case upper == "ARGS_GET_NAMES":
+		var out []candidate
+		for k := range req.FlattenCache {
+			if name, ok := strings.CutPrefix(k, "ARGS_GET:"); ok {
+				out = append(out, candidate{Name: "ARGS_GET_NAMES:" + name, Value: name})
+			}
+		}
+		return out
+	case strings.HasPrefix(upper, "ARGS:"), strings.HasPrefix(upper, "ARGS_GET:"):
+		var out []candidate
+		for k, vs := range req.FlattenCache {
+			if strings.EqualFold(k, variable) {
+				out = append(out, candidatesOf(k, vs)...)
+			}
+		}
+		return out
+	case upper == "REQUEST_BODY", upper == "REQUEST_PROTOCOL", upper == "REQUEST_URI",
+		upper == "REQUEST_URI_RAW", upper == "REQUEST_LINE", upper == "REQUEST_FILENAME",
+		upper == "REQUEST_BASENAME", upper == "QUERY_STRING", upper == "REMOTE_ADDR":
+		return candidatesOf(upper, req.FlattenCache[upper])
+	case strings.HasPrefix(upper, "&"):
+		n := len(e.legacyExpandVariable(variable[1:], req, tx))
+		return []candidate{{Name: variable, Value: strconv.Itoa(n)}}
+	case strings.HasPrefix(upper, "REQUEST_HEADERS:"):
+		name := "REQUEST_HEADERS:" + strings.ToLower(variable[len("REQUEST_HEADERS:"):])
+		return candidatesOf(name, req.FlattenCache[name])
+	case strings.HasPrefix(upper, "REQUEST_HEADERS"), strings.HasPrefix(upper, "REQUEST_COOKIES"):
+		return candidatesOf(variable, req.FlattenCache[variable])
+	case upper == "REQUEST_METHOD":
+		return candidatesOf("REQUEST_METHOD", []string{req.Method})
+	case upper == "TX" || strings.HasPrefix(upper, "TX:"):
+		return txCandidates(upper, tx)
+	case collections.IsCollection(strings.SplitN(upper, ":", 2)[0]):
+		return e.collectionCandidates(upper, tx)
+	case upper == "MATCHED_VAR", upper == "MATCHED_VARS":
+		return matchedCandidates(tx)
+	}
+	return nil
+}
+
+// loadParsedRules loads the converted CRS rules shipped in parsed_rules
+func loadParsedRules(t testing.TB) []rules.Rule {
+	t.Helper()
+	rules.AllRules = nil
+	defer func() { rules.AllRules = nil }()
+	if err := rules.LoadRules("parsed_rules"); err != nil {
+		t.Fatalf("loading parsed_rules: %v", err)
+	}
+	return rules.AllRules
+}
+
+// TestPlanMatchesLegacy runs the benign and attack benchmark requests
+// through the compiled plan and the per-request path it replaced
+func TestPlanMatchesLegacy(t *testing.T) {
+	loaded := loadParsedRules(t)
+	// Separate evaluators, so persistent collections evolve the same way
+	plan, legacy := NewEvaluator(loaded), NewEvaluator(loaded)
+
+	attacks := 0
+	for _, bc := range benchCases() {
+		req := BuildRequest(bc.build())
+		dec, matchedRules := plan.InspectPhases(req)
+		var got []string
+		for _, m := range matchedRules {
+			got = append(got, m.RuleID)
+		}
+		wantDec, want := legacy.legacyInspect(req)
+		sort.Strings(got)
+		sort.Strings(want)
+
+		if dec.Block != wantDec.Block || dec.Score != wantDec.Score || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: plan block=%v score=%d rules %v, per-request path block=%v score=%d rules %v",
+				bc.name, dec.Block, dec.Score, got, wantDec.Block, wantDec.Score, want)
+		}
+		if dec.Block {
+			attacks++
+		}
+	}
+	if attacks == 0 {
+		t.Error("no request was blocked, the comparison proves nothing")
+	}
+}
+
+func TestRequestLineVariables(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "1"
+  name: request line
+  variable: REQUEST_LINE
+  regex: ^GET /static/app\.js\?v=1 HTTP/1\.1$
+  phase: 1
+- id: "2"
+  name: raw uri
+  variable: REQUEST_URI_RAW
+  regex: "%2e%2e"
+  phase: 1
+- id: "3"
+  name: basename
+  variable: REQUEST_BASENAME
+  regex: ^app\.js$
+  phase: 1
+- id: "4"
+  name: query string
+  variable: QUERY_STRING
+  regex: ^v=1$
+  phase: 1
+- id: "5"
+  name: query argument
+  variable: ARGS_GET:V
+  regex: ^1$
+  phase: 2
+- id: "6"
+  name: query argument names
+  variable: ARGS_GET_NAMES|ARGS_GET
+  regex: ^(?:user|bob)$
+  phase: 2
+`))
+
+	r := httptest.NewRequest(http.MethodGet, "/static/app.js?v=1", nil)
+	if got, want := matches(eval, r), []string{"1@REQUEST_LINE", "3@REQUEST_BASENAME", "4@QUERY_STRING", "5@ARGS_GET:v"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matched %v, want %v", got, want)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/a/%2e%2e/b", nil)
+	if got, want := matches(eval, r), []string{"2@REQUEST_URI_RAW"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matched %v, want %v", got, want)
+	}
+
+	// Form fields are ARGS but not ARGS_GET
+	r = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader("user=bob"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := matches(eval, r); len(got) != 0 {
+		t.Errorf("form body matched %v", got)
+	}
+	r = httptest.NewRequest(http.MethodGet, "/login?user=alice", nil)
+	if got, want := matches(eval, r), []string{"6@ARGS_GET_NAMES:user"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("matched %v, want %v", got, want)
+	}
+
+	// Ingested events have the same variables, except the request line
+	_, matched := eval.InspectPhases(NewRequestFromIngest(&utils.Ingest{Method: "GET", Path: "/static/app.js?v=1"}))
+	var got []string
+	for _, m := range matched {
+		got = append(got, m.RuleID)
+	}
+	if want := []string{"3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ingested event matched %v, want %v", got, want)
+	}
+}
+
+func TestMatchedVarInChain(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "1"
+  name: shell command in an argument
+  variable: ARGS
+  regex: (?i)\b(?:cat|ls)\b
+  phase: 2
+  block: true
+  chain:
+    - variable: MATCHED_VARS
+      regex: /etc/
+`))
+	for target, want := range map[string]bool{
+		"/?cmd=cat+/etc/passwd": true,
+		"/?cmd=cat+notes.txt":   false,
+		"/?path=/etc/hosts":     false,
+	} {
+		dec, _ := eval.InspectPhases(BuildRequest(httptest.NewRequest(http.MethodGet, target, nil)))
+		if dec.Block != want {
+			t.Errorf("%s: blocked %v, want %v", target, dec.Block, want)
+		}
+	}
+}
+
+// The CRS rules below only read variables the engine did not collect
+// before; they must reach the plan as live rules
+func TestCRSRequestVariableRulesAreLive(t *testing.T) {
+	plan := buildPlan(loadParsedRules(t))
+	live := make(map[string]bool)
+	for _, phase := range plan.phases {
+		for _, p := range phase {
+			if p.Marker == "" && !p.dead() {
+				live[p.ID] = true
+			}
+		}
+	}
+	for _, id := range []string{"905100", "920100", "920201", "920202", "920440", "920610", "921151",
+		"921160", "921240", "942441", "942442", "932200", "932205", "942440", "941310"} {
+		if !live[id] {
+			t.Errorf("rule %s never matches", id)
+		}
+	}
+}
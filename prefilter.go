@@ -0,0 +1,106 @@
+package main
+
+import (
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Regex prefilter
+// ==========================
+
+// prefilter skips operators whose required literals (see
+// rules.Operator.Literals) do not occur in a value. The literals of all
+// operators sharing a target are matched together in one pass.
+type prefilter struct {
+	ops map[*rules.Operator]prefilterEntry
+}
+
+// literalGroup is the combined matcher of one rule target, e.g. "ARGS|REQUEST_URI"
+type literalGroup struct {
+	ac *utils.AhoCorasick
+}
+
+// prefilterEntry tells which literals of its group an operator needs
+type prefilterEntry struct {
+	group *literalGroup
+	mask  []uint64
+}
+
+// prefilterKey caches one scan per group and transformed value
+type prefilterKey struct {
+	group *literalGroup
+	value string
+}
+
+// buildPrefilter indexes the operators of rs and of the rules chained to them
+func buildPrefilter(rs []rules.Rule) *prefilter {
+	type pending struct {
+		op   *rules.Operator
+		lits []string
+	}
+	byTarget := make(map[string][]pending)
+	for _, rule := range rs {
+		for _, r := range chainOf(rule) {
+			// A negated operator matches exactly when the literals are absent
+			if r.Op == nil || r.Op.Negate || r.Op.Macros || r.Op.Literals() == nil {
+				continue
+			}
+			byTarget[r.Variable] = append(byTarget[r.Variable], pending{r.Op, r.Op.Literals()})
+		}
+	}
+
+	p := &prefilter{ops: make(map[*rules.Operator]prefilterEntry)}
+	for _, ops := range byTarget {
+		ids := make(map[string]int)
+		var patterns []string
+		for _, o := range ops {
+			for _, l := range o.lits {
+				if _, ok := ids[l]; !ok {
+					ids[l] = len(patterns)
+					patterns = append(patterns, l)
+				}
+			}
+		}
+
+		g := &literalGroup{ac: utils.NewAhoCorasick(patterns)}
+		for _, o := range ops {
+			mask := make([]uint64, g.ac.Words())
+			for _, l := range o.lits {
+				id := ids[l]
+				mask[id/64] |= 1 << (id % 64)
+			}
+			p.ops[o.op] = prefilterEntry{group: g, mask: mask}
+		}
+	}
+	return p
+}
+
+// mayMatch reports whether op can match value; false means the operator
+// is certain not to match and need not run
+func (p *prefilter) mayMatch(op *rules.Operator, value string, tx *Transaction) bool {
+	if p == nil {
+		return true
+	}
+	entry, ok := p.ops[op]
+	if !ok {
+		return true
+	}
+
+	key := prefilterKey{entry.group, value}
+	found, ok := tx.literalsFound[key]
+	if !ok {
+		found = make([]uint64, len(entry.mask))
+		entry.group.ac.Scan(value, found)
+		if tx.literalsFound == nil {
+			tx.literalsFound = make(map[prefilterKey][]uint64)
+		}
+		tx.literalsFound[key] = found
+	}
+	for i, m := range entry.mask {
+		if found[i]&m != 0 {
+			return true
+		}
+	}
+	return false
+}
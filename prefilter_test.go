@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"waf-engine/mainWAF/utils"
+)
+
+func sortedRuleIDs(matched []utils.MatchedRuleLog) []string {
+	ids := make([]string, 0, len(matched))
+	for _, m := range matched {
+		ids = append(ids, m.RuleID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TestPrefilterKeepsVerdicts runs the benchmark requests, and attacks
+// spelled with the runes (?i) folds onto ASCII letters, through the
+// converted CRS rules with the prefilter on and off
+func TestPrefilterKeepsVerdicts(t *testing.T) {
+	loaded := loadParsedRules(t)
+	// Separate evaluators, so persistent collections evolve the same way
+	on, off := NewEvaluator(loaded), NewEvaluator(loaded)
+	off.SetPrefilter(false)
+	if len(on.prefilter.ops) == 0 {
+		t.Fatal("no operator has literals, the comparison proves nothing")
+	}
+
+	cases := append(benchCases(),
+		// U+017F long s, U+212A Kelvin sign and U+0130 dotted capital I
+		benchCase{"unicode/xss", benchGet("/search?q=%3C%C5%BFcript%3Ealert(1)%3C/%C5%BFcript%3E", browserHeaders)},
+		benchCase{"unicode/sqli", benchGet("/items?id=1+UNION+%C5%BFELECT+password+FROM+u%C5%BFers--", browserHeaders)},
+		benchCase{"unicode/rce", benchGet("/ping?host=x%3B%E2%84%AAill+-9+1", browserHeaders)},
+		benchCase{"unicode/php", benchGet("/?x=%3C%3Fphp+%C4%B0NCLUDE+%24_GET%5Bf%5D", browserHeaders)},
+	)
+	blocked := 0
+	for _, bc := range cases {
+		req := BuildRequest(bc.build())
+		dec, matchedOn := on.InspectPhases(req)
+		wantDec, matchedOff := off.InspectPhases(req)
+		got, want := sortedRuleIDs(matchedOn), sortedRuleIDs(matchedOff)
+		if dec.Block != wantDec.Block || dec.Score != wantDec.Score || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: prefilter on block=%v score=%d rules %v, off block=%v score=%d rules %v",
+				bc.name, dec.Block, dec.Score, got, wantDec.Block, wantDec.Score, want)
+		}
+		if dec.Block {
+			blocked++
+		}
+	}
+	if blocked == 0 {
+		t.Error("no request was blocked, the comparison proves nothing")
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"waf-engine/mainWAF/rules"
+)
+
+// ==========================
+// Per-rule profiler (waf profile, /admin/profile)
+// ==========================
+
+// profileSamples is the size of the per-rule reservoir the p99 comes from
+const profileSamples = 2048
+
+// ruleStats accumulates the evaluations of one rule ID
+type ruleStats struct {
+	mu         sync.Mutex
+	name       string
+	count      int64
+	total, max time.Duration
+	inputs     int64 // values the operator ran on
+	inputBytes int64
+	maxInput   int
+	samples    []time.Duration // reservoir sample of evaluation times
+}
+
+func (s *ruleStats) record(d time.Duration, inputs, inputBytes, maxInput int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.total += d
+	s.max = max(s.max, d)
+	s.inputs += int64(inputs)
+	s.inputBytes += int64(inputBytes)
+	s.maxInput = max(s.maxInput, maxInput)
+	if len(s.samples) < profileSamples {
+		s.samples = append(s.samples, d)
+	} else if i := rand.Int64N(s.count); i < profileSamples {
+		s.samples[i] = d
+	}
+}
+
+// ruleProfiler records how expensive every rule is
+type ruleProfiler struct {
+	started time.Time
+	mu      sync.RWMutex
+	rules   map[string]*ruleStats
+}
+
+func newRuleProfiler() *ruleProfiler {
+	return &ruleProfiler{started: time.Now(), rules: make(map[string]*ruleStats)}
+}
+
+func (p *ruleProfiler) stats(rule rules.Rule) *ruleStats {
+	p.mu.RLock()
+	s, ok := p.rules[rule.ID]
+	p.mu.RUnlock()
+	if ok {
+		return s
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, ok = p.rules[rule.ID]; !ok {
+		s = &ruleStats{name: rule.Name}
+		p.rules[rule.ID] = s
+	}
+	return s
+}
+
+// RuleProfile is the cost of one rule ID; times are in nanoseconds
+type RuleProfile struct {
+	RuleID      string  `json:"rule_id"`
+	Name        string  `json:"name"`
+	Evaluations int64   `json:"evaluations"`
+	TotalNS     int64   `json:"total_ns"`
+	MeanNS      int64   `json:"mean_ns"`
+	P99NS       int64   `json:"p99_ns"`
+	MaxNS       int64   `json:"max_ns"`
+	Share       float64 `json:"share"` // fraction of the time of all rules
+	Inputs      int64   `json:"inputs"`
+	MeanInput   int64   `json:"mean_input_bytes"`
+	MaxInput    int     `json:"max_input_bytes"`
+}
+
+// ProfileReport lists rules by descending cost
+type ProfileReport struct {
+	Since   time.Time     `json:"since"`
+	TotalNS int64         `json:"total_ns"`
+	Rules   []RuleProfile `json:"rules"`
+}
+
+// profileSorts orders a report by the named column
+var profileSorts = map[string]func(a, b RuleProfile) bool{
+	"total": func(a, b RuleProfile) bool { return a.TotalNS > b.TotalNS },
+	"p99":   func(a, b RuleProfile) bool { return a.P99NS > b.P99NS },
+	"mean":  func(a, b RuleProfile) bool { return a.MeanNS > b.MeanNS },
+	"max":   func(a, b RuleProfile) bool { return a.MaxNS > b.MaxNS },
+	"count": func(a, b RuleProfile) bool { return a.Evaluations > b.Evaluations },
+}
+
+// report returns the top rules ordered by sortBy; top <= 0 returns all
+func (p *ruleProfiler) report(sortBy string, top int) ProfileReport {
+	less, ok := profileSorts[sortBy]
+	if !ok {
+		less = profileSorts["total"]
+	}
+
+	p.mu.RLock()
+	ids := make([]string, 0, len(p.rules))
+	for id := range p.rules {
+		ids = append(ids, id)
+	}
+	p.mu.RUnlock()
+
+	rep := ProfileReport{Since: p.started}
+	for _, id := range ids {
+		p.mu.RLock()
+		s := p.rules[id]
+		p.mu.RUnlock()
+
+		s.mu.Lock()
+		samples := append([]time.Duration(nil), s.samples...)
+		rp := RuleProfile{
+			RuleID:      id,
+			Name:        s.name,
+			Evaluations: s.count,
+			TotalNS:     int64(s.total),
+			MaxNS:       int64(s.max),
+			Inputs:      s.inputs,
+			MaxInput:    s.maxInput,
+		}
+		if s.count > 0 {
+			rp.MeanNS = int64(s.total) / s.count
+		}
+		if s.inputs > 0 {
+			rp.MeanInput = s.inputBytes / s.inputs
+		}
+		s.mu.Unlock()
+
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		if len(samples) > 0 {
+			rp.P99NS = int64(samples[len(samples)*99/100])
+		}
+		rep.TotalNS += rp.TotalNS
+		rep.Rules = append(rep.Rules, rp)
+	}
+
+	for i := range rep.Rules {
+		if rep.TotalNS > 0 {
+			rep.Rules[i].Share = float64(rep.Rules[i].TotalNS) / float64(rep.TotalNS)
+		}
+	}
+	sort.Slice(rep.Rules, func(i, j int) bool {
+		if less(rep.Rules[i], rep.Rules[j]) != less(rep.Rules[j], rep.Rules[i]) {
+			return less(rep.Rules[i], rep.Rules[j])
+		}
+		return rep.Rules[i].RuleID < rep.Rules[j].RuleID
+	})
+	if top > 0 && len(rep.Rules) > top {
+		rep.Rules = rep.Rules[:top]
+	}
+	return rep
+}
+
+// SetProfiling turns per-rule profiling on or off; turning it on starts
+// a fresh profile
+func (e *Evaluator) SetProfiling(on bool) {
+	if on {
+		e.profiler.Store(newRuleProfiler())
+	} else {
+		e.profiler.Store(nil)
+	}
+}
+
+// ProfileReport returns the current profile, false when profiling is off
+func (e *Evaluator) ProfileReport(sortBy string, top int) (ProfileReport, bool) {
+	p := e.profiler.Load()
+	if p == nil {
+		return ProfileReport{}, false
+	}
+	return p.report(sortBy, top), true
+}
+
+// ==========================
+// Admin endpoint
+// ==========================
+
+// ProfileHandler serves the profile as JSON.
+//
+//	GET  /admin/profile?sort=total|p99|mean|max|count&top=N
+//	POST /admin/profile?action=start|stop
+func ProfileHandler(eval *Evaluator) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			top, _ := strconv.Atoi(r.URL.Query().Get("top"))
+			rep, ok := eval.ProfileReport(r.URL.Query().Get("sort"), top)
+			if !ok {
+				writeJSON(w, http.StatusConflict, inspectError{"profiling is off, POST ?action=start to enable it"})
+				return
+			}
+			writeJSON(w, http.StatusOK, rep)
+		case http.MethodPost:
+			switch action := r.URL.Query().Get("action"); action {
+			case "start":
+				eval.SetProfiling(true)
+			case "stop":
+				eval.SetProfiling(false)
+			default:
+				writeJSON(w, http.StatusBadRequest, inspectError{fmt.Sprintf("unknown action %q (start or stop)", action)})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSON(w, http.StatusMethodNotAllowed, inspectError{"method not allowed"})
+		}
+	})
+}
+
+// ==========================
+// CLI (waf profile)
+// ==========================
+
+// runProfile replays request files with profiling on and prints the
+// costliest rules
+func runProfile(args []string) {
+	fs := flag.NewFlagSet("profile", flag.ExitOnError)
+	rulesDir := fs.String("rules", "parsed_rules", "directory with YAML rules")
+	top := fs.Int("top", 20, "number of rules to print, 0 for all")
+	sortBy := fs.String("sort", "total", "order by total, p99, mean, max or count")
+	repeat := fs.Int("repeat", 1, "replay the files this many times")
+	noPrefilter := fs.Bool("no-prefilter", false, "run every regex, to measure what the prefilter saves")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: waf profile [flags] file.jsonl|file.har|file.http ...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if _, ok := profileSorts[*sortBy]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown sort %q\n", *sortBy)
+		os.Exit(2)
+	}
+
+	if err := rules.LoadRules(*rulesDir); err != nil {
+		log.Fatalf("❌ Failed to load rules: %v", err)
+	}
+	eval := NewEvaluator(rules.AllRules)
+	eval.SetProfiling(true)
+	eval.SetPrefilter(!*noPrefilter)
+
+	requests := 0
+	start := time.Now()
+	for i := 0; i < *repeat; i++ {
+		for _, path := range fs.Args() {
+			err := readReplayFile(path, func(_ string, req *Request) error {
+				eval.InspectPhases(req)
+				requests++
+				return nil
+			})
+			if err != nil {
+				log.Fatalf("❌ Replay of %s failed: %v", path, err)
+			}
+		}
+	}
+	elapsed := time.Since(start)
+
+	rep, _ := eval.ProfileReport(*sortBy, *top)
+	printProfile(os.Stdout, rep, requests, elapsed)
+}
+
+func printProfile(w io.Writer, rep ProfileReport, requests int, elapsed time.Duration) {
+	fmt.Fprintf(w, "Profiled %d requests in %s, %s in rules\n\n", requests, elapsed.Round(time.Millisecond), time.Duration(rep.TotalNS).Round(time.Microsecond))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "RULE\tEVALS\tTOTAL\tSHARE\tMEAN\tP99\tMAX\tINPUTS\tAVG IN\tMAX IN\t NAME")
+	for _, r := range rep.Rules {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%.1f%%\t%s\t%s\t%s\t%d\t%d\t%d\t %s\n",
+			r.RuleID, r.Evaluations,
+			time.Duration(r.TotalNS).Round(time.Microsecond), r.Share*100,
+			time.Duration(r.MeanNS), time.Duration(r.P99NS), time.Duration(r.MaxNS),
+			r.Inputs, r.MeanInput, r.MaxInput, r.Name)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ==========================
+// Minimal protobuf wire format helpers
+// ==========================
+// Only what the ext_authz messages need: varints and length-delimited
+// fields. Unknown fields are decoded and ignored by the callers, which is
+// how protobuf stays forward compatible.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// protoField is one decoded field of a protobuf message
+type protoField struct {
+	Num    int
+	Type   int
+	Varint uint64
+	Bytes  []byte
+}
+
+// decodeProto splits a serialized message into its fields
+func decodeProto(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errProtoTruncated
+		}
+		b = b[n:]
+
+		f := protoField{Num: int(key >> 3), Type: int(key & 7)}
+		switch f.Type {
+		case wireVarint:
+			f.Varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, errProtoTruncated
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, errProtoTruncated
+			}
+			f.Varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, errProtoTruncated
+			}
+			f.Varint = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < size {
+				return nil, errProtoTruncated
+			}
+			f.Bytes = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("protobuf: unsupported wire type %d", f.Type)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// protoMessage builds a serialized message field by field
+type protoMessage []byte
+
+func (m protoMessage) appendVarint(num int, v uint64) protoMessage {
+	m = binary.AppendUvarint(m, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(m, v)
+}
+
+func (m protoMessage) appendBytes(num int, b []byte) protoMessage {
+	m = binary.AppendUvarint(m, uint64(num)<<3|wireBytes)
+	m = binary.AppendUvarint(m, uint64(len(b)))
+	return append(m, b...)
+}
+
+func (m protoMessage) appendString(num int, s string) protoMessage {
+	if s == "" {
+		return m
+	}
+	return m.appendBytes(num, []byte(s))
+}
+
+// appendMapEntry encodes one entry of a map<string, string> field
+func (m protoMessage) appendMapEntry(num int, key, value string) protoMessage {
+	entry := protoMessage{}.appendString(1, key).appendString(2, value)
+	return m.appendBytes(num, entry)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecodeProto(t *testing.T) {
+	msg := protoMessage{}.
+		appendVarint(1, 300).
+		appendString(2, "GET").
+		appendString(3, ""). // empty strings are omitted
+		appendMapEntry(4, "host", "example.com")
+	msg = append(msg, 0x2d, 1, 0, 0, 0)             // field 5, fixed32
+	msg = append(msg, 0x31, 2, 0, 0, 0, 0, 0, 0, 0) // field 6, fixed64
+
+	fields, err := decodeProto(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 5 {
+		t.Fatalf("decoded %d fields, want 5: %+v", len(fields), fields)
+	}
+	if f := fields[0]; f.Num != 1 || f.Type != wireVarint || f.Varint != 300 {
+		t.Errorf("field 1: %+v", f)
+	}
+	if f := fields[1]; f.Num != 2 || f.Type != wireBytes || string(f.Bytes) != "GET" {
+		t.Errorf("field 2: %+v", f)
+	}
+	if k, v, err := decodeStringPair(fields[2].Bytes); fields[2].Num != 4 || k != "host" || v != "example.com" || err != nil {
+		t.Errorf("map entry: %q=%q, %v", k, v, err)
+	}
+	if f := fields[3]; f.Num != 5 || f.Type != wireFixed32 || f.Varint != 1 {
+		t.Errorf("field 5: %+v", f)
+	}
+	if f := fields[4]; f.Num != 6 || f.Type != wireFixed64 || f.Varint != 2 {
+		t.Errorf("field 6: %+v", f)
+	}
+
+	if fields, err := decodeProto(nil); len(fields) != 0 || err != nil {
+		t.Errorf("empty message: %v, %v", fields, err)
+	}
+}
+
+func TestDecodeProtoMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"truncated key", []byte{0x80}},
+		{"missing varint", []byte{0x08}},
+		{"truncated varint", []byte{0x08, 0xff}},
+		{"overlong varint", []byte{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"missing length", []byte{0x12}},
+		{"short bytes", []byte{0x12, 0x05, 'a', 'b'}},
+		{"huge length", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 'a'}},
+		{"short fixed32", []byte{0x2d, 1, 0}},
+		{"short fixed64", []byte{0x31, 1, 0, 0, 0}},
+	} {
+		if _, err := decodeProto(tc.msg); !errors.Is(err, errProtoTruncated) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, errProtoTruncated)
+		}
+	}
+
+	// Groups (wire types 3 and 4) are deprecated and never used by Envoy
+	if _, err := decodeProto([]byte{0x0b}); err == nil || errors.Is(err, errProtoTruncated) {
+		t.Errorf("start group: err = %v, want unsupported wire type", err)
+	}
+}
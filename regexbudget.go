@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Regex time limits
+// ==========================
+
+// errRegexBudget stops the backtracking regexes of a transaction that used
+// up its budget
+var errRegexBudget = errors.New("regex budget of the transaction exhausted")
+
+// regexTimeoutActions are the accepted values of regex.on_timeout
+var regexTimeoutActions = map[string]bool{"fail_open": true, "fail_closed": true, "score": true}
+
+// regexLimits decides how long the backtracking regexes of one request may
+// run and what happens to a request that hits a limit
+type regexLimits struct {
+	budget       time.Duration // zero disables the per-transaction budget
+	onTimeout    string
+	timeoutScore int
+}
+
+// defaultRegexConfig is the regex section of DefaultConfig. A request
+// whose regexes hit a limit is blocked: "score" only blocks once the CRS
+// blocking evaluation sees the inbound anomaly score reach its threshold,
+// and without those rules lets the request through partly uninspected.
+func defaultRegexConfig() RegexConfig {
+	return RegexConfig{
+		MatchTimeout:      utils.DefaultRegexTimeout,
+		TransactionBudget: 250 * time.Millisecond,
+		OnTimeout:         "fail_closed",
+		TimeoutScore:      5,
+	}
+}
+
+// SetRegexLimits applies the budget and timeout action of cfg. The match
+// timeout is applied by utils.SetRegexTimeout, before the rules are loaded.
+func (e *Evaluator) SetRegexLimits(cfg RegexConfig) error {
+	if !regexTimeoutActions[cfg.OnTimeout] {
+		return fmt.Errorf("unknown on_timeout %q (fail_closed, fail_open or score)", cfg.OnTimeout)
+	}
+	e.regex = regexLimitsOf(cfg)
+	return nil
+}
+
+func regexLimitsOf(cfg RegexConfig) regexLimits {
+	return regexLimits{budget: cfg.TransactionBudget, onTimeout: cfg.OnTimeout, timeoutScore: cfg.TimeoutScore}
+}
+
+// regexFailure is the first regex of a transaction that hit a limit
+type regexFailure struct {
+	variable string
+	err      error
+	handled  bool // the on_timeout action was applied
+}
+
+// matchOperator runs the operator of a rule, keeping backtracking regexes
+// within the budget of the transaction
+func (e *Evaluator) matchOperator(op *rules.Operator, value, arg string, tx *Transaction) (bool, error) {
+	if !op.Backtracking() {
+		return op.Match(value, arg), nil
+	}
+	if e.regex.budget > 0 && tx.regexTime >= e.regex.budget {
+		return false, errRegexBudget
+	}
+	start := time.Now()
+	matched, err := op.MatchErr(value, arg)
+	tx.regexTime += time.Since(start)
+	if e.regex.budget > 0 && tx.regexTime >= e.regex.budget {
+		regexBudgetExceeded.Inc()
+	}
+	return matched, err
+}
+
+// regexFailed applies the on_timeout action the first time a regex of the
+// transaction hit a limit. The regex itself counted as not matching; the
+// returned entry, if any, is logged like a matched rule, and stop is set
+// when inspection ends here.
+func (e *Evaluator) regexFailed(rule *planRule, phase int, req *Request, tx *Transaction, dec *Decision) (entry *utils.MatchedRuleLog, stop bool) {
+	f := tx.regexFailure
+	if f == nil || f.handled {
+		return nil, false
+	}
+	f.handled = true
+	slog.Warn("regex limit hit", "rule", rule.ID, "variable", f.variable, "err", f.err,
+		"action", e.regex.onTimeout, "client", req.ClientIP, "uri", utils.Redaction().URI(req.Path))
+	tx.trace("regex limit hit", "rule", rule.ID, "variable", f.variable, "err", f.err.Error())
+
+	closed := e.regex.onTimeout == "fail_closed"
+	verdict := "⚠️ Detected"
+	switch e.regex.onTimeout {
+	case "fail_closed":
+		dec.Block = true
+		verdict = "🚫 Blocked"
+	case "score":
+		dec.Score += e.regex.timeoutScore
+		// Counted at paranoia level 1 like a CRS rule, for the 949 evaluation
+		current, _ := strconv.Atoi(tx.TX["inbound_anomaly_score_pl1"])
+		tx.TX["inbound_anomaly_score_pl1"] = strconv.Itoa(current + e.regex.timeoutScore)
+	default: // fail_open
+		return nil, false
+	}
+	return &utils.MatchedRuleLog{
+		RuleID:      rule.ID,
+		RuleName:    e.expandMacros(rule.Name, rule.Rule, req, tx),
+		Variable:    f.variable,
+		Parameter:   f.variable,
+		Severity:    rule.Severity,
+		Category:    rule.Category,
+		Block:       closed,
+		Phase:       phase,
+		Operator:    rule.Regex,
+		Tags:        []string{"regex-timeout"},
+		Description: fmt.Sprintf("%s by rule %s: %v in %s", verdict, rule.ID, f.err, f.variable),
+	}, closed
+}
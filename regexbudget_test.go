@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"waf-engine/mainWAF/rules"
+)
+
+func TestRegexTimeoutAction(t *testing.T) {
+	// TestMain set a 5ms match timeout
+	rules.SetPCREFallback(true)
+	defer rules.SetPCREFallback(false)
+	// The lookahead needs the backtracking engine, where (a+)+ is exponential
+	eval := NewEvaluator(loadTestRules(t, `
+- id: "200"
+  name: nested quantifier
+  variable: ARGS
+  regex: ^(?=a)(a+)+$
+  phase: 2
+`))
+	req := BuildRequest(httptest.NewRequest(http.MethodGet, "/?q="+strings.Repeat("a", 40)+"!", nil))
+
+	for _, tc := range []struct {
+		action string
+		block  bool
+		score  int
+	}{
+		{"", true, 0}, // the default
+		{"score", false, 5},
+		{"fail_open", false, 0},
+	} {
+		cfg := defaultRegexConfig()
+		if tc.action != "" {
+			cfg.OnTimeout = tc.action
+		}
+		if err := eval.SetRegexLimits(cfg); err != nil {
+			t.Fatal(err)
+		}
+		dec, matched := eval.InspectPhases(req)
+		if dec.Block != tc.block || dec.Score != tc.score {
+			t.Errorf("on_timeout %q: block=%v score=%d, want %v and %d", cfg.OnTimeout, dec.Block, dec.Score, tc.block, tc.score)
+		}
+		if tc.action != "fail_open" && (len(matched) != 1 || matched[0].Tags[0] != "regex-timeout") {
+			t.Errorf("on_timeout %q: logged %+v, want the timeout", cfg.OnTimeout, matched)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Offline replay (waf replay)
+// ==========================
+
+// replayDecision is one line of the decisions JSONL output
+type replayDecision struct {
+	Source       string                 `json:"source"`
+	Method       string                 `json:"method"`
+	URI          string                 `json:"uri"`
+	Blocked      bool                   `json:"blocked"`
+	Score        int                    `json:"score"`
+	MatchedRules []utils.MatchedRuleLog `json:"matched_rules"`
+}
+
+// replaySummary counts blocks per rule and per category
+type replaySummary struct {
+	Total      int
+	Blocked    int
+	RuleBlocks map[string]int
+	RuleNames  map[string]string
+	CatBlocks  map[string]int
+}
+
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	rulesDir := fs.String("rules", "parsed_rules", "directory with YAML rules")
+	out := fs.String("out", "decisions.jsonl", "per-request decisions (JSONL), \"-\" for stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: waf replay [flags] file.jsonl|file.har|file.http ...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := rules.LoadRules(*rulesDir); err != nil {
+		log.Fatalf("❌ Failed to load rules: %v", err)
+	}
+	eval := NewEvaluator(rules.AllRules)
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("❌ Failed to create %s: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+
+	sum := &replaySummary{
+		RuleBlocks: make(map[string]int),
+		RuleNames:  make(map[string]string),
+		CatBlocks:  make(map[string]int),
+	}
+
+	for _, path := range fs.Args() {
+		err := readReplayFile(path, func(source string, req *Request) error {
+			dec, matched := eval.InspectPhases(req)
+			sum.add(dec, matched)
+			return enc.Encode(replayDecision{
+				Source:       source,
+				Method:       req.Method,
+				URI:          req.Path,
+				Blocked:      dec.Block,
+				Score:        dec.Score,
+				MatchedRules: matched,
+			})
+		})
+		if err != nil {
+			log.Fatalf("❌ Replay of %s failed: %v", path, err)
+		}
+	}
+
+	sum.print(os.Stderr)
+}
+
+func (s *replaySummary) add(dec Decision, matched []utils.MatchedRuleLog) {
+	s.Total++
+	if !dec.Block {
+		return
+	}
+	s.Blocked++
+	for _, m := range matched {
+		if !m.Block {
+			continue
+		}
+		s.RuleBlocks[m.RuleID]++
+		s.RuleNames[m.RuleID] = m.RuleName
+		s.CatBlocks[m.Category]++
+	}
+}
+
+func (s *replaySummary) print(w io.Writer) {
+	fmt.Fprintf(w, "\nReplayed %d requests, %d blocked\n", s.Total, s.Blocked)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nCATEGORY\tBLOCKS")
+	for _, cat := range sortedByCount(s.CatBlocks) {
+		fmt.Fprintf(tw, "%s\t%d\n", cat, s.CatBlocks[cat])
+	}
+	fmt.Fprintln(tw, "\nRULE\tBLOCKS\tNAME")
+	for _, id := range sortedByCount(s.RuleBlocks) {
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", id, s.RuleBlocks[id], s.RuleNames[id])
+	}
+	tw.Flush()
+}
+
+// sortedByCount returns the map keys, highest count first
+func sortedByCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// ==========================
+// Replay sources
+// ==========================
+
+// readReplayFile feeds every request stored in path to fn. The format is
+// picked from the extension: .jsonl/.ndjson hold utils.Ingest records,
+// .har holds a browser HAR export, anything else raw HTTP/1.x requests.
+func readReplayFile(path string, fn func(source string, req *Request) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return readIngestJSONL(path, f, fn)
+	case ".har":
+		return readHAR(path, f, fn)
+	default:
+		return readRawHTTP(path, f, fn)
+	}
+}
+
+func readIngestJSONL(path string, r io.Reader, fn func(string, *Request) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), utils.MaxJSONSize)
+	line := 0
+	for sc.Scan() {
+		line++
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var in utils.Ingest
+		if err := json.Unmarshal(sc.Bytes(), &in); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if err := fn(fmt.Sprintf("%s:%d", path, line), NewRequestFromIngest(&in)); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// harFile covers the subset of the HAR 1.2 format needed to rebuild requests
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string `json:"method"`
+				URL     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+func readHAR(path string, r io.Reader, fn func(string, *Request) error) error {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, entry := range har.Log.Entries {
+		hr := entry.Request
+		// A POST without postData still needs a body BuildRequest can read
+		var body io.Reader = http.NoBody
+		if hr.PostData != nil {
+			body = strings.NewReader(hr.PostData.Text)
+		}
+		httpReq, err := http.NewRequest(hr.Method, hr.URL, body)
+		if err != nil {
+			return fmt.Errorf("%s: entry %d: %w", path, i, err)
+		}
+		for _, h := range hr.Headers {
+			// HTTP/2 pseudo-headers (":authority", ...) are not real headers
+			if strings.HasPrefix(h.Name, ":") {
+				continue
+			}
+			if strings.EqualFold(h.Name, "Host") {
+				httpReq.Host = h.Value
+				continue
+			}
+			httpReq.Header.Add(h.Name, h.Value)
+		}
+		if hr.PostData != nil && httpReq.Header.Get("Content-Type") == "" {
+			httpReq.Header.Set("Content-Type", hr.PostData.MimeType)
+		}
+
+		if err := fn(fmt.Sprintf("%s#%d", path, i), BuildRequest(httpReq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRawHTTP(path string, r io.Reader, fn func(string, *Request) error) error {
+	br := bufio.NewReader(r)
+	for i := 0; ; i++ {
+		// Tolerate blank lines between consecutive requests
+		for {
+			b, err := br.Peek(1)
+			if err != nil || (b[0] != '\r' && b[0] != '\n') {
+				break
+			}
+			_, _ = br.ReadByte()
+		}
+
+		httpReq, err := http.ReadRequest(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: request %d: %w", path, i, err)
+		}
+
+		req := BuildRequest(httpReq)
+		// Drain whatever BuildRequest did not consume so the next request parses
+		_, _ = io.Copy(io.Discard, httpReq.Body)
+
+		if err := fn(fmt.Sprintf("%s#%d", path, i), req); err != nil {
+			return err
+		}
+	}
+}
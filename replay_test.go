@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// replayed is the part of a Request the replay readers are checked on
+type replayed struct {
+	Source  string
+	Method  string
+	URI     string
+	Headers []string // header names
+	Host    string
+	Args    map[string]string
+}
+
+type replayCase struct {
+	name    string
+	input   string
+	want    []replayed
+	wantErr string
+}
+
+func runReplayCases(t *testing.T, read func(string, io.Reader, func(string, *Request) error) error, cases []replayCase) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []replayed
+			err := read("in", strings.NewReader(tc.input), func(source string, req *Request) error {
+				r := replayed{Source: source, Method: req.Method, URI: req.Path, Host: req.Headers["host"], Args: map[string]string{}}
+				for name := range req.Headers {
+					r.Headers = append(r.Headers, name)
+				}
+				sort.Strings(r.Headers)
+				for k, vs := range req.FlattenCache {
+					if name, ok := strings.CutPrefix(k, "ARGS:"); ok {
+						r.Args[name] = strings.Join(vs, ",")
+					}
+				}
+				got = append(got, r)
+				return nil
+			})
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadHAR(t *testing.T) {
+	runReplayCases(t, readHAR, []replayCase{
+		{
+			name: "post without body",
+			input: `{"log":{"entries":[{"request":{"method":"POST","url":"http://example.com/submit?a=1",
+				"headers":[{"name":"Host","value":"example.com"}]}}]}}`,
+			want: []replayed{{Source: "in#0", Method: "POST", URI: "/submit?a=1", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{"a": "1"}}},
+		},
+		{
+			name: "form body",
+			input: `{"log":{"entries":[{"request":{"method":"POST","url":"http://example.com/login",
+				"headers":[],"postData":{"mimeType":"application/x-www-form-urlencoded","text":"user=bob&pass=x"}}}]}}`,
+			want: []replayed{{Source: "in#0", Method: "POST", URI: "/login", Headers: []string{"content-type", "host"}, Host: "example.com",
+				Args: map[string]string{"user": "bob", "pass": "x"}}},
+		},
+		{
+			name: "http2 pseudo-headers",
+			input: `{"log":{"entries":[{"request":{"method":"GET","url":"https://example.com/a",
+				"headers":[{"name":":authority","value":"example.com"},{"name":":method","value":"GET"},
+				{"name":":path","value":"/a"},{"name":"accept","value":"*/*"}]}},
+				{"request":{"method":"GET","url":"https://example.com/b","headers":[]}}]}}`,
+			want: []replayed{
+				{Source: "in#0", Method: "GET", URI: "/a", Headers: []string{"accept", "host"}, Host: "example.com", Args: map[string]string{}},
+				{Source: "in#1", Method: "GET", URI: "/b", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{}},
+			},
+		},
+		{name: "malformed json", input: `{"log":{"entries":[`, wantErr: "in: "},
+		{
+			name:    "bad url",
+			input:   `{"log":{"entries":[{"request":{"method":"GET","url":"http://[::1","headers":[]}}]}}`,
+			wantErr: "in: entry 0: ",
+		},
+	})
+}
+
+func TestReadRawHTTP(t *testing.T) {
+	runReplayCases(t, readRawHTTP, []replayCase{
+		{
+			name: "post without body",
+			input: "POST /submit?a=1 HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+				"GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			want: []replayed{
+				{Source: "in#0", Method: "POST", URI: "/submit?a=1", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{"a": "1"}},
+				{Source: "in#1", Method: "GET", URI: "/next", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{}},
+			},
+		},
+		{
+			name: "form body and blank lines between requests",
+			input: "POST /login HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-www-form-urlencoded\r\n" +
+				"Content-Length: 15\r\n\r\nuser=bob&pass=x\r\n\r\n\n" +
+				"GET /?q=1 HTTP/1.0\r\n\r\n",
+			want: []replayed{
+				{Source: "in#0", Method: "POST", URI: "/login", Headers: []string{"content-length", "content-type", "host"}, Host: "example.com",
+					Args: map[string]string{"user": "bob", "pass": "x"}},
+				{Source: "in#1", Method: "GET", URI: "/?q=1", Args: map[string]string{"q": "1"}},
+			},
+		},
+		{
+			name:  "http2 request line",
+			input: "GET /h2 HTTP/2.0\r\nHost: example.com\r\n\r\n",
+			want:  []replayed{{Source: "in#0", Method: "GET", URI: "/h2", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{}}},
+		},
+		{
+			// A pseudo-header line is not a valid HTTP/1.x header
+			name:    "http2 pseudo-header",
+			input:   "GET / HTTP/1.1\r\nHost: example.com\r\n\r\nGET / HTTP/1.1\r\n:authority: example.com\r\n\r\n",
+			wantErr: "in: request 1: ",
+		},
+		{name: "malformed request line", input: "NOT A REQUEST\r\n\r\n", wantErr: "in: request 0: "},
+	})
+}
+
+func TestReadIngestJSONL(t *testing.T) {
+	runReplayCases(t, readIngestJSONL, []replayCase{
+		{
+			name:  "post without body",
+			input: `{"method":"post","path":"/submit?a=1","headers":{"Host":"example.com"}}` + "\n",
+			want:  []replayed{{Source: "in:1", Method: "POST", URI: "/submit?a=1", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{"a": "1"}}},
+		},
+		{
+			name: "json body and blank lines",
+			input: "\n" + `{"method":"POST","path":"/api","body":{"user":{"name":"bob"}}}` + "\n\n" +
+				`{"method":"GET","path":"/search","query":{"q":["x"]}}` + "\n",
+			want: []replayed{
+				{Source: "in:2", Method: "POST", URI: "/api", Args: map[string]string{"json.user.name": "bob"}},
+				{Source: "in:4", Method: "GET", URI: "/search?q=x", Args: map[string]string{"q": "x"}},
+			},
+		},
+		{
+			name: "http2 pseudo-headers",
+			input: `{"method":"GET","path":"/a","headers":{":authority":"example.com",":path":"/a","accept":"*/*"}}` + "\n" +
+				`{"method":"GET","path":"/b","headers":{":authority":"ignored","host":"example.com"}}` + "\n",
+			want: []replayed{
+				{Source: "in:1", Method: "GET", URI: "/a", Headers: []string{"accept", "host"}, Host: "example.com", Args: map[string]string{}},
+				{Source: "in:2", Method: "GET", URI: "/b", Headers: []string{"host"}, Host: "example.com", Args: map[string]string{}},
+			},
+		},
+		{
+			name:    "malformed line",
+			input:   `{"method":"GET","path":"/"}` + "\n" + `{"method":` + "\n",
+			wantErr: "in:2: ",
+		},
+	})
+}
+
+// Ingest callers build http.Requests by hand and may leave Body nil
+func TestBuildRequestWithoutBody(t *testing.T) {
+	for _, method := range []string{http.MethodPost, http.MethodPut} {
+		u, _ := url.Parse("/x?a=1")
+		r := &http.Request{Method: method, URL: u, Header: http.Header{}}
+		req := BuildRequest(r)
+		if got := req.FlattenCache["ARGS:a"]; len(got) != 1 || got[0] != "1" {
+			t.Errorf("%s: ARGS:a = %v", method, got)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Inline rule tests (waf test-rules)
+// ==========================
+
+// ruleTestResult is the outcome of one `tests:` entry of a rule
+type ruleTestResult struct {
+	RuleID  string
+	Test    string
+	Passed  bool
+	Reasons []string
+}
+
+// runTestRules executes the tests: blocks of the loaded rules against the
+// compiled rule, with the same transformations and operators as serve
+func runTestRules(args []string) {
+	fs := flag.NewFlagSet("test-rules", flag.ExitOnError)
+	rulesDir := fs.String("rules", "parsed_rules", "directory with YAML or .conf rules")
+	only := fs.String("rule", "", "only run the tests of this rule id")
+	verbose := fs.Bool("v", false, "print why each failed test failed")
+	requireTests := fs.Bool("require-tests", false, "fail when a rule has no tests")
+	_ = fs.Parse(args)
+
+	if err := rules.LoadRules(*rulesDir); err != nil {
+		log.Fatalf("❌ Failed to load rules: %v", err)
+	}
+	eval := NewEvaluator(rules.AllRules)
+
+	// Rules written with when: conditions load as several alternatives
+	// sharing one ID; a test matches when any of them does
+	var ids []string
+	alternatives := make(map[string][]rules.Rule)
+	for _, rule := range rules.AllRules {
+		if rule.ID == "" || (*only != "" && rule.ID != *only) {
+			continue
+		}
+		if _, seen := alternatives[rule.ID]; !seen {
+			ids = append(ids, rule.ID)
+		}
+		alternatives[rule.ID] = append(alternatives[rule.ID], rule)
+	}
+
+	var results []ruleTestResult
+	var untested []string
+	for _, id := range ids {
+		alts := alternatives[id]
+		if len(alts[0].Tests) == 0 {
+			untested = append(untested, id)
+			continue
+		}
+		for i, t := range alts[0].Tests {
+			res := ruleTestResult{RuleID: id, Test: t.Name}
+			if res.Test == "" {
+				res.Test = fmt.Sprintf("%s-%d", id, i+1)
+			}
+			res.Reasons = eval.runRuleTest(alts, t)
+			res.Passed = len(res.Reasons) == 0
+			results = append(results, res)
+		}
+	}
+
+	failed := printRuleTestSummary(os.Stderr, results, *verbose)
+	if *requireTests && len(untested) > 0 {
+		fmt.Fprintf(os.Stderr, "%d rules have no tests: %s\n", len(untested), strings.Join(untested, " "))
+		failed += len(untested)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runRuleTest evaluates one test case and returns the unmet expectations
+func (e *Evaluator) runRuleTest(alts []rules.Rule, t rules.RuleTest) []string {
+	req, tx, err := e.ruleTestRequest(t.Inputs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var reasons []string
+	for _, name := range sortedKeys(t.Transformed) {
+		in, ok := t.Inputs[name]
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("transformed %s has no input", name))
+			continue
+		}
+		if got := utils.ApplyTransforms(transformsFor(alts, name), in); got != t.Transformed[name] {
+			reasons = append(reasons, fmt.Sprintf("%s transformed to %q, expected %q", name, got, t.Transformed[name]))
+		}
+	}
+
+	matched := false
+	var c candidate
+	var unsupported []string
+	for _, rule := range alts {
+		if rule.Op == nil {
+			unsupported = append(unsupported, fmt.Sprintf("operator %q is not supported", rule.Regex))
+			continue
+		}
+		excluded := &exclusions{rules: make(map[string]bool), targets: make(map[string][]string)}
+		if _, c, matched = e.matchRule(newPlanRule(rule), rule.ID, req, tx, excluded); matched {
+			break
+		}
+	}
+	// An unsupported alternative only explains a test that nothing matched
+	if !matched {
+		reasons = append(reasons, unsupported...)
+	}
+	switch {
+	case matched && !t.Match:
+		reasons = append(reasons, fmt.Sprintf("matched %s (%q), expected no match", c.Name, c.Value))
+	case !matched && t.Match:
+		reasons = append(reasons, "no match, expected a match")
+	}
+	return reasons
+}
+
+// transformsFor returns the transformations applied to a variable: those of
+// the first rule or chain link targeting it (or its whole collection)
+func transformsFor(alts []rules.Rule, name string) []string {
+	collection, _, _ := strings.Cut(name, ":")
+	for _, alt := range alts {
+		for _, link := range chainOf(alt) {
+			for _, target := range strings.Split(link.Variable, "|") {
+				if strings.EqualFold(target, name) || strings.EqualFold(target, collection) {
+					return link.Transforms
+				}
+			}
+		}
+	}
+	return alts[0].Transforms
+}
+
+// ruleTestRequest builds the request and transaction a test runs against
+// from its variable -> value inputs
+func (e *Evaluator) ruleTestRequest(inputs map[string]string) (*Request, *Transaction, error) {
+	req := &Request{
+		Method:       "GET",
+		Path:         "/",
+		Query:        make(map[string][]string),
+		Headers:      make(map[string]string),
+		Body:         make(map[string]any),
+		FlattenCache: make(map[string][]string),
+	}
+	tx := e.newTransaction()
+
+	for _, key := range sortedKeys(inputs) {
+		value := inputs[key]
+		col, member, _ := strings.Cut(key, ":")
+		switch col = strings.ToUpper(col); {
+		case (col == "ARGS" || col == "ARGS_GET") && member != "":
+			// Test arguments come from the query string
+			req.Query[member] = append(req.Query[member], value)
+			req.FlattenCache["ARGS:"+member] = append(req.FlattenCache["ARGS:"+member], value)
+			req.FlattenCache["ARGS_GET:"+member] = append(req.FlattenCache["ARGS_GET:"+member], value)
+		case col == "REQUEST_HEADERS" && member != "":
+			req.Headers[strings.ToLower(member)] = value
+			req.FlattenCache["REQUEST_HEADERS:"+strings.ToLower(member)] = []string{value}
+		case col == "REQUEST_COOKIES" && member != "":
+			req.FlattenCache["REQUEST_COOKIES:"+member] = []string{value}
+		case col == "TX" && member != "":
+			tx.TX[strings.ToLower(member)] = value
+		case col == "REQUEST_METHOD" && member == "":
+			req.Method = value
+		case col == "REQUEST_URI" && member == "":
+			req.Path = value
+			req.FlattenCache["REQUEST_URI"] = []string{value}
+		case col == "REMOTE_ADDR" && member == "":
+			req.ClientIP = value
+			req.FlattenCache["REMOTE_ADDR"] = []string{value}
+		case (col == "REQUEST_FILENAME" || col == "REQUEST_BASENAME" || col == "REQUEST_BODY" || col == "REQUEST_PROTOCOL" ||
+			col == "REQUEST_LINE" || col == "REQUEST_URI_RAW" || col == "QUERY_STRING") && member == "":
+			req.FlattenCache[col] = []string{value}
+		default:
+			return nil, nil, fmt.Errorf("unsupported test input %s", key)
+		}
+	}
+	return req, tx, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// printRuleTestSummary prints failures and a per-rule table, and returns the
+// number of failed tests
+func printRuleTestSummary(w io.Writer, results []ruleTestResult, verbose bool) int {
+	type ruleStats struct{ passed, failed int }
+	perRule := make(map[string]*ruleStats)
+	var ids []string
+	failed := 0
+	for _, r := range results {
+		st := perRule[r.RuleID]
+		if st == nil {
+			st = &ruleStats{}
+			perRule[r.RuleID] = st
+			ids = append(ids, r.RuleID)
+		}
+		if r.Passed {
+			st.passed++
+			continue
+		}
+		st.failed++
+		failed++
+		if verbose {
+			fmt.Fprintf(w, "FAIL %s\n", r.Test)
+			for _, reason := range r.Reasons {
+				fmt.Fprintf(w, "     %s\n", reason)
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nRULE\tTESTS\tPASSED\tFAILED")
+	for _, id := range ids {
+		st := perRule[id]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", id, st.passed+st.failed, st.passed, st.failed)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nRan %d tests: %d passed, %d failed\n", len(results), len(results)-failed, failed)
+	return failed
+}
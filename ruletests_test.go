@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"waf-engine/mainWAF/rules"
+)
+
+func TestRunRuleTestUnsupportedAlternative(t *testing.T) {
+	supported := loadTestRules(t, xssRule)[0]
+	unsupported := supported
+	unsupported.Regex, unsupported.Op = "@inspectFile check.lua", nil
+	alts := []rules.Rule{unsupported, supported}
+	eval := NewEvaluator(alts)
+
+	for _, tc := range []struct {
+		name string
+		test rules.RuleTest
+		want []string
+	}{
+		{"another alternative matched", rules.RuleTest{Inputs: map[string]string{"ARGS:q": "<script>"}, Match: true}, nil},
+		{"nothing matched", rules.RuleTest{Inputs: map[string]string{"ARGS:q": "shoes"}, Match: true},
+			[]string{`operator "@inspectFile check.lua" is not supported`, "no match, expected a match"}},
+		{"no match expected", rules.RuleTest{Inputs: map[string]string{"ARGS:q": "shoes"}},
+			[]string{`operator "@inspectFile check.lua" is not supported`}},
+	} {
+		if got := eval.runRuleTest(alts, tc.test); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: reasons %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
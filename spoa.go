@@ -0,0 +1,600 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==========================
+// HAProxy SPOE agent (SPOP 2.0)
+// ==========================
+// HAProxy sends the request through a spoe-message such as
+//
+//	spoe-message waf-req
+//	    args method=method path=path query=query headers=req.hdrs_bin body=req.body ip=src
+//	    event on-frontend-http-request
+//
+// and the agent answers with transaction variables waf.block, waf.score and
+// waf.rules (with "option var-prefix waf").
+
+const (
+	spoeFrameHAProxyHello      = 1
+	spoeFrameHAProxyDisconnect = 2
+	spoeFrameNotify            = 3
+	spoeFrameAgentHello        = 101
+	spoeFrameAgentDisconnect   = 102
+	spoeFrameAck               = 103
+
+	spoeFlagFin = 0x00000001
+
+	spoeTypeNull   = 0
+	spoeTypeBool   = 1
+	spoeTypeInt32  = 2
+	spoeTypeUint32 = 3
+	spoeTypeInt64  = 4
+	spoeTypeUint64 = 5
+	spoeTypeIPv4   = 6
+	spoeTypeIPv6   = 7
+	spoeTypeString = 8
+	spoeTypeBinary = 9
+
+	spoeActionSetVar = 1
+	spoeScopeTxn     = 2
+	spoeMaxFrameSize = 16384
+	spoeVersion      = "2.0"
+
+	// AGENT-DISCONNECT status codes
+	spoeStatusNormal  = 0
+	spoeStatusIO      = 1
+	spoeStatusTooBig  = 3
+	spoeStatusInvalid = 4
+	spoeStatusVersion = 5
+	spoeStatusNoFrag  = 9
+)
+
+var (
+	errSPOETruncated = errors.New("spoe: truncated frame")
+	errSPOETooBig    = errors.New("spoe: frame exceeds max-frame-size")
+)
+
+// spoeFrame is one decoded SPOP frame
+type spoeFrame struct {
+	Type     byte
+	Flags    uint32
+	StreamID uint64
+	FrameID  uint64
+	Payload  []byte
+}
+
+// spoeKV is a named typed value (HELLO/DISCONNECT items, message arguments)
+type spoeKV struct {
+	Name  string
+	Value any
+}
+
+// ==========================
+// Encoding primitives
+// ==========================
+
+// appendSPOEVarint uses HAProxy's variable-length integer encoding (not LEB128)
+func appendSPOEVarint(b []byte, i uint64) []byte {
+	if i < 240 {
+		return append(b, byte(i))
+	}
+	b = append(b, byte(i)|240)
+	i = (i - 240) >> 4
+	for i >= 128 {
+		b = append(b, byte(i)|128)
+		i = (i - 128) >> 7
+	}
+	return append(b, byte(i))
+}
+
+func readSPOEVarint(b []byte) (uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errSPOETruncated
+	}
+	r := uint64(b[0])
+	if r < 240 {
+		return r, b[1:], nil
+	}
+	shift := 4
+	for i := 1; i < len(b); i++ {
+		r += uint64(b[i]) << shift
+		shift += 7
+		if b[i] < 128 {
+			return r, b[i+1:], nil
+		}
+	}
+	return 0, nil, errSPOETruncated
+}
+
+func appendSPOEString(b []byte, s string) []byte {
+	b = appendSPOEVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readSPOEString(b []byte) (string, []byte, error) {
+	n, b, err := readSPOEVarint(b)
+	if err != nil || uint64(len(b)) < n {
+		return "", nil, errSPOETruncated
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+// appendSPOETyped encodes a Go value as SPOP typed data
+func appendSPOETyped(b []byte, v any) []byte {
+	switch x := v.(type) {
+	case nil:
+		return append(b, spoeTypeNull)
+	case bool:
+		if x {
+			return append(b, spoeTypeBool|0x10)
+		}
+		return append(b, spoeTypeBool)
+	case int:
+		return appendSPOEVarint(append(b, spoeTypeInt32), uint64(int32(x)))
+	case uint32:
+		return appendSPOEVarint(append(b, spoeTypeUint32), uint64(x))
+	case net.IP:
+		if ip4 := x.To4(); ip4 != nil {
+			return append(append(b, spoeTypeIPv4), ip4...)
+		}
+		return append(append(b, spoeTypeIPv6), x.To16()...)
+	case []byte:
+		b = appendSPOEVarint(append(b, spoeTypeBinary), uint64(len(x)))
+		return append(b, x...)
+	default:
+		return appendSPOEString(append(b, spoeTypeString), fmt.Sprint(x))
+	}
+}
+
+// readSPOETyped decodes SPOP typed data; strings and binaries come back as
+// string and []byte, integers as int64/uint64, addresses as net.IP
+func readSPOETyped(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errSPOETruncated
+	}
+	t, flags, b := b[0]&0x0f, b[0]&0xf0, b[1:]
+	switch t {
+	case spoeTypeNull:
+		return nil, b, nil
+	case spoeTypeBool:
+		return flags&0x10 != 0, b, nil
+	case spoeTypeInt32, spoeTypeInt64:
+		v, rest, err := readSPOEVarint(b)
+		return int64(v), rest, err
+	case spoeTypeUint32, spoeTypeUint64:
+		return readSPOEVarint(b)
+	case spoeTypeIPv4, spoeTypeIPv6:
+		size := 4
+		if t == spoeTypeIPv6 {
+			size = 16
+		}
+		if len(b) < size {
+			return nil, nil, errSPOETruncated
+		}
+		return net.IP(bytes.Clone(b[:size])), b[size:], nil
+	case spoeTypeString:
+		return readSPOEString(b)
+	case spoeTypeBinary:
+		s, rest, err := readSPOEString(b)
+		return []byte(s), rest, err
+	default:
+		return nil, nil, fmt.Errorf("spoe: unknown data type %d", t)
+	}
+}
+
+func readSPOEKVList(b []byte) ([]spoeKV, error) {
+	var kvs []spoeKV
+	for len(b) > 0 {
+		name, rest, err := readSPOEString(b)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := readSPOETyped(rest)
+		if err != nil {
+			return nil, err
+		}
+		kvs = append(kvs, spoeKV{Name: name, Value: value})
+		b = rest
+	}
+	return kvs, nil
+}
+
+func appendSPOEKVList(b []byte, kvs []spoeKV) []byte {
+	for _, kv := range kvs {
+		b = appendSPOEString(b, kv.Name)
+		b = appendSPOETyped(b, kv.Value)
+	}
+	return b
+}
+
+// ==========================
+// Frames
+// ==========================
+
+func readSPOEFrame(r io.Reader, maxSize uint32) (*spoeFrame, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxSize {
+		return nil, errSPOETooBig
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if len(buf) < 5 {
+		return nil, errSPOETruncated
+	}
+
+	f := &spoeFrame{Type: buf[0], Flags: binary.BigEndian.Uint32(buf[1:5])}
+	rest := buf[5:]
+	var err error
+	if f.StreamID, rest, err = readSPOEVarint(rest); err != nil {
+		return nil, err
+	}
+	if f.FrameID, rest, err = readSPOEVarint(rest); err != nil {
+		return nil, err
+	}
+	f.Payload = rest
+	return f, nil
+}
+
+func writeSPOEFrame(w io.Writer, f *spoeFrame) error {
+	buf := make([]byte, 4, 4+16+len(f.Payload))
+	buf = append(buf, f.Type)
+	buf = binary.BigEndian.AppendUint32(buf, f.Flags)
+	buf = appendSPOEVarint(buf, f.StreamID)
+	buf = appendSPOEVarint(buf, f.FrameID)
+	buf = append(buf, f.Payload...)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-4))
+	_, err := w.Write(buf)
+	return err
+}
+
+// ==========================
+// Agent
+// ==========================
+
+// ServeSPOA accepts HAProxy SPOE connections until the listener is closed
+func ServeSPOA(ln net.Listener, eval *Evaluator) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleSPOEConn(conn, eval)
+	}
+}
+
+func handleSPOEConn(conn net.Conn, eval *Evaluator) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	maxSize := uint32(spoeMaxFrameSize)
+
+	disconnect := func(status int, msg string) {
+		payload := appendSPOEKVList(nil, []spoeKV{
+			{Name: "status-code", Value: uint32(status)},
+			{Name: "message", Value: msg},
+		})
+		_ = writeSPOEFrame(conn, &spoeFrame{Type: spoeFrameAgentDisconnect, Flags: spoeFlagFin, Payload: payload})
+	}
+
+	// Handshake: HAPROXY-HELLO -> AGENT-HELLO
+	hello, err := readSPOEFrame(r, maxSize)
+	if err != nil || hello.Type != spoeFrameHAProxyHello {
+		disconnect(spoeStatusInvalid, "expected HAPROXY-HELLO")
+		return
+	}
+	items, err := readSPOEKVList(hello.Payload)
+	if err != nil {
+		disconnect(spoeStatusInvalid, err.Error())
+		return
+	}
+	healthcheck := false
+	versionOK := false
+	for _, kv := range items {
+		switch kv.Name {
+		case "supported-versions":
+			for _, v := range strings.Split(fmt.Sprint(kv.Value), ",") {
+				if strings.TrimSpace(v) == spoeVersion {
+					versionOK = true
+				}
+			}
+		case "max-frame-size":
+			if size, ok := kv.Value.(uint64); ok && size < uint64(maxSize) {
+				maxSize = uint32(size)
+			}
+		case "healthcheck":
+			healthcheck, _ = kv.Value.(bool)
+		}
+	}
+	if !versionOK {
+		disconnect(spoeStatusVersion, "unsupported SPOP version")
+		return
+	}
+
+	payload := appendSPOEKVList(nil, []spoeKV{
+		{Name: "version", Value: spoeVersion},
+		{Name: "max-frame-size", Value: maxSize},
+		{Name: "capabilities", Value: ""},
+	})
+	if err := writeSPOEFrame(conn, &spoeFrame{Type: spoeFrameAgentHello, Flags: spoeFlagFin, Payload: payload}); err != nil || healthcheck {
+		return
+	}
+
+	for {
+		f, err := readSPOEFrame(r, maxSize)
+		switch {
+		case errors.Is(err, io.EOF):
+			return
+		case errors.Is(err, errSPOETooBig):
+			disconnect(spoeStatusTooBig, err.Error())
+			return
+		case errors.Is(err, errSPOETruncated):
+			disconnect(spoeStatusInvalid, err.Error())
+			return
+		case err != nil:
+			disconnect(spoeStatusIO, err.Error())
+			return
+		}
+
+		switch f.Type {
+		case spoeFrameNotify:
+			if f.Flags&spoeFlagFin == 0 {
+				disconnect(spoeStatusNoFrag, "fragmentation is not supported")
+				return
+			}
+			actions, err := spoeNotify(eval, f.Payload, conn.RemoteAddr().String())
+			if err != nil {
+				disconnect(spoeStatusInvalid, err.Error())
+				return
+			}
+			ack := &spoeFrame{Type: spoeFrameAck, Flags: spoeFlagFin, StreamID: f.StreamID, FrameID: f.FrameID, Payload: actions}
+			if err := writeSPOEFrame(conn, ack); err != nil {
+				return
+			}
+		case spoeFrameHAProxyDisconnect:
+			disconnect(spoeStatusNormal, "bye")
+			return
+		default:
+			disconnect(spoeStatusInvalid, "unexpected frame type "+strconv.Itoa(int(f.Type)))
+			return
+		}
+	}
+}
+
+// spoeNotify inspects every message of a NOTIFY frame and returns the ACK
+// payload setting waf.block, waf.score and waf.rules
+func spoeNotify(eval *Evaluator, payload []byte, peer string) ([]byte, error) {
+	var actions []byte
+	for len(payload) > 0 {
+		_, rest, err := readSPOEString(payload) // message name
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			return nil, errSPOETruncated
+		}
+		nbArgs := int(rest[0])
+		rest = rest[1:]
+
+		args := make(map[string]any, nbArgs)
+		for i := 0; i < nbArgs; i++ {
+			var name string
+			var value any
+			if name, rest, err = readSPOEString(rest); err != nil {
+				return nil, err
+			}
+			if value, rest, err = readSPOETyped(rest); err != nil {
+				return nil, err
+			}
+			args[name] = value
+		}
+		payload = rest
+
+		httpReq, err := spoeHTTPRequest(args, peer)
+		if err != nil {
+			return nil, err
+		}
+		req := BuildRequest(httpReq)
+		dec, matchedRules := eval.InspectPhases(req)
+		logTransaction(httpReq.RemoteAddr, req, dec, matchedRules)
+
+		ids := make([]string, 0, len(matchedRules))
+		for _, m := range matchedRules {
+			ids = append(ids, m.RuleID)
+		}
+		for _, v := range []spoeKV{
+			{Name: "block", Value: dec.Block},
+			{Name: "score", Value: dec.Score},
+			{Name: "rules", Value: strings.Join(ids, ",")},
+		} {
+			actions = append(actions, spoeActionSetVar, 3, spoeScopeTxn)
+			actions = appendSPOEString(actions, v.Name)
+			actions = appendSPOETyped(actions, v.Value)
+		}
+	}
+	return actions, nil
+}
+
+// spoeHTTPRequest rebuilds the client request from the message arguments
+func spoeHTTPRequest(args map[string]any, peer string) (*http.Request, error) {
+	str := func(name string) string {
+		switch v := args[name].(type) {
+		case string:
+			return v
+		case []byte:
+			return string(v)
+		}
+		return ""
+	}
+
+	method := str("method")
+	if method == "" {
+		method = http.MethodGet
+	}
+	uri := str("path")
+	if uri == "" {
+		uri = "/"
+	}
+	if q := str("query"); q != "" {
+		uri += "?" + q
+	}
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &http.Request{
+		Method:     method,
+		URL:        u,
+		RequestURI: uri,
+		Proto:      "HTTP/" + strings.TrimPrefix(str("reqver"), "HTTP/"),
+		Header:     make(http.Header),
+		RemoteAddr: peer,
+		Body:       http.NoBody,
+	}
+	if hdrs, ok := args["headers"].([]byte); ok {
+		if err := decodeHdrsBin(hdrs, r.Header); err != nil {
+			return nil, err
+		}
+	}
+	r.Host = r.Header.Get("Host")
+	if ip, ok := args["ip"].(net.IP); ok {
+		r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+	}
+	if body, ok := args["body"].([]byte); ok && len(body) > 0 {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	} else if body := str("body"); body != "" {
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	return r, nil
+}
+
+// decodeHdrsBin parses HAProxy's req.hdrs_bin: name/value string pairs
+// terminated by an empty pair
+func decodeHdrsBin(b []byte, h http.Header) error {
+	for len(b) > 0 {
+		name, rest, err := readSPOEString(b)
+		if err != nil {
+			return err
+		}
+		value, rest, err := readSPOEString(rest)
+		if err != nil {
+			return err
+		}
+		if name == "" && value == "" {
+			return nil
+		}
+		h.Add(name, value)
+		b = rest
+	}
+	return nil
+}
+
+// ==========================
+// Frame-level test client (waf spoa-check)
+// ==========================
+
+// runSPOACheck plays the HAProxy side of the protocol against the agent
+func runSPOACheck(args []string) {
+	fs := flag.NewFlagSet("spoa-check", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:12345", "SPOA listener")
+	method := fs.String("method", "GET", "request method")
+	path := fs.String("path", "/", "request path")
+	query := fs.String("query", "", "query string without '?'")
+	body := fs.String("body", "", "request body")
+	src := fs.String("ip", "127.0.0.1", "client address")
+	var headers headerFlags
+	fs.Var(&headers, "H", "request header \"Name: value\" (repeatable)")
+	_ = fs.Parse(args)
+
+	conn, err := net.DialTimeout("tcp", *addr, 5*time.Second)
+	if err != nil {
+		log.Fatalf("❌ Cannot reach SPOA: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	hello := appendSPOEKVList(nil, []spoeKV{
+		{Name: "supported-versions", Value: spoeVersion},
+		{Name: "max-frame-size", Value: uint32(spoeMaxFrameSize)},
+		{Name: "capabilities", Value: ""},
+		{Name: "engine-id", Value: "spoa-check"},
+	})
+	must(writeSPOEFrame(conn, &spoeFrame{Type: spoeFrameHAProxyHello, Flags: spoeFlagFin, Payload: hello}))
+	agentHello, err := readSPOEFrame(r, spoeMaxFrameSize)
+	must(err)
+	items, _ := readSPOEKVList(agentHello.Payload)
+	fmt.Printf("AGENT-HELLO: %v\n", items)
+
+	var hdrs []byte
+	for _, h := range headers {
+		k, v, _ := strings.Cut(h, ":")
+		hdrs = appendSPOEString(hdrs, strings.TrimSpace(k))
+		hdrs = appendSPOEString(hdrs, strings.TrimSpace(v))
+	}
+	hdrs = appendSPOEString(appendSPOEString(hdrs, ""), "")
+
+	msg := appendSPOEString(nil, "waf-req")
+	msg = append(msg, 6)
+	msg = appendSPOEKVList(msg, []spoeKV{
+		{Name: "method", Value: *method},
+		{Name: "path", Value: *path},
+		{Name: "query", Value: *query},
+		{Name: "headers", Value: hdrs},
+		{Name: "body", Value: []byte(*body)},
+		{Name: "ip", Value: net.ParseIP(*src)},
+	})
+	must(writeSPOEFrame(conn, &spoeFrame{Type: spoeFrameNotify, Flags: spoeFlagFin, StreamID: 1, FrameID: 1, Payload: msg}))
+
+	ack, err := readSPOEFrame(r, spoeMaxFrameSize)
+	must(err)
+	if ack.Type != spoeFrameAck {
+		kvs, _ := readSPOEKVList(ack.Payload)
+		log.Fatalf("❌ Expected ACK, got frame type %d: %v", ack.Type, kvs)
+	}
+	rest := ack.Payload
+	for len(rest) >= 3 {
+		scope := rest[2]
+		var name string
+		var value any
+		name, rest, err = readSPOEString(rest[3:])
+		must(err)
+		value, rest, err = readSPOETyped(rest)
+		must(err)
+		fmt.Printf("set-var scope=%d waf.%s=%v\n", scope, name, value)
+	}
+
+	bye := appendSPOEKVList(nil, []spoeKV{{Name: "status-code", Value: uint32(0)}, {Name: "message", Value: "done"}})
+	must(writeSPOEFrame(conn, &spoeFrame{Type: spoeFrameHAProxyDisconnect, Flags: spoeFlagFin, Payload: bye}))
+	if f, err := readSPOEFrame(r, spoeMaxFrameSize); err == nil {
+		kvs, _ := readSPOEKVList(f.Payload)
+		fmt.Printf("AGENT-DISCONNECT: %v\n", kvs)
+	}
+}
+
+func must(err error) {
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+}
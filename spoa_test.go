@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSPOEVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 239, 240, 241, 2287, 2288, 264431, 264432, 1 << 32, 1<<64 - 1} {
+		b := appendSPOEVarint(nil, v)
+		got, rest, err := readSPOEVarint(append(b, 0xaa))
+		if err != nil || got != v || len(rest) != 1 {
+			t.Errorf("%d: encoded % x, decoded %d (rest %d, %v)", v, b, got, len(rest), err)
+		}
+		if _, _, err := readSPOEVarint(b[:len(b)-1]); !errors.Is(err, errSPOETruncated) {
+			t.Errorf("%d: truncated encoding: err = %v", v, err)
+		}
+	}
+}
+
+func TestSPOETypedRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		in, want any
+	}{
+		{nil, nil},
+		{true, true},
+		{false, false},
+		{-5, int64(-5)},
+		{uint32(16384), uint64(16384)},
+		{"waf", "waf"},
+		{[]byte{0, 1}, []byte{0, 1}},
+		{net.ParseIP("192.0.2.1"), net.IP{192, 0, 2, 1}},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1")},
+	} {
+		got, rest, err := readSPOETyped(appendSPOETyped(nil, tc.in))
+		if err != nil || len(rest) != 0 || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#v: decoded %#v (rest %d, %v), want %#v", tc.in, got, len(rest), err, tc.want)
+		}
+	}
+	for _, b := range [][]byte{{}, {spoeTypeIPv4, 1, 2}, {spoeTypeString, 5, 'a'}, {0x0f}} {
+		if _, _, err := readSPOETyped(b); err == nil {
+			t.Errorf("% x: decoded malformed typed data", b)
+		}
+	}
+}
+
+// spoeHAProxy is the HAProxy end of a pipe to an agent connection
+type spoeHAProxy struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startSPOEAgent(t *testing.T) *spoeHAProxy {
+	t.Helper()
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	haproxy, agent := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleSPOEConn(agent, eval)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		haproxy.Close()
+		<-done
+	})
+	_ = haproxy.SetDeadline(time.Now().Add(5 * time.Second))
+	return &spoeHAProxy{conn: haproxy, r: bufio.NewReader(haproxy)}
+}
+
+func (h *spoeHAProxy) send(t *testing.T, f *spoeFrame) {
+	t.Helper()
+	if err := writeSPOEFrame(h.conn, f); err != nil {
+		t.Fatalf("writing frame %d: %v", f.Type, err)
+	}
+}
+
+func (h *spoeHAProxy) receive(t *testing.T) *spoeFrame {
+	t.Helper()
+	f, err := readSPOEFrame(h.r, spoeMaxFrameSize)
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	return f
+}
+
+// hello performs the handshake and returns the AGENT-HELLO items
+func (h *spoeHAProxy) hello(t *testing.T, items ...spoeKV) map[string]any {
+	t.Helper()
+	h.send(t, &spoeFrame{Type: spoeFrameHAProxyHello, Flags: spoeFlagFin, Payload: appendSPOEKVList(nil, items)})
+	f := h.receive(t)
+	if f.Type != spoeFrameAgentHello {
+		t.Fatalf("got frame type %d, want AGENT-HELLO", f.Type)
+	}
+	return kvMap(t, f.Payload)
+}
+
+// disconnected reads the AGENT-DISCONNECT the agent ends with and returns
+// its status code
+func (h *spoeHAProxy) disconnected(t *testing.T) uint64 {
+	t.Helper()
+	f := h.receive(t)
+	if f.Type != spoeFrameAgentDisconnect {
+		t.Fatalf("got frame type %d, want AGENT-DISCONNECT", f.Type)
+	}
+	status, _ := kvMap(t, f.Payload)["status-code"].(uint64)
+	return status
+}
+
+func kvMap(t *testing.T, payload []byte) map[string]any {
+	t.Helper()
+	kvs, err := readSPOEKVList(payload)
+	if err != nil {
+		t.Fatalf("decoding items: %v", err)
+	}
+	m := make(map[string]any, len(kvs))
+	for _, kv := range kvs {
+		m[kv.Name] = kv.Value
+	}
+	return m
+}
+
+var spoeHello = []spoeKV{
+	{Name: "supported-versions", Value: "2.0"},
+	{Name: "max-frame-size", Value: uint32(spoeMaxFrameSize)},
+	{Name: "capabilities", Value: "pipelining"},
+	{Name: "engine-id", Value: "test"},
+}
+
+// spoeMessage encodes one waf-req message like the spoe-message of the
+// documented HAProxy configuration
+func spoeMessage(method, path, query string, headers map[string]string) []byte {
+	var hdrs []byte
+	for k, v := range headers {
+		hdrs = appendSPOEString(appendSPOEString(hdrs, k), v)
+	}
+	hdrs = appendSPOEString(appendSPOEString(hdrs, ""), "")
+
+	args := []spoeKV{
+		{Name: "method", Value: method},
+		{Name: "path", Value: path},
+		{Name: "query", Value: query},
+		{Name: "headers", Value: hdrs},
+		{Name: "body", Value: []byte{}},
+		{Name: "ip", Value: net.ParseIP("198.51.100.4")},
+	}
+	msg := appendSPOEString(nil, "waf-req")
+	msg = append(msg, byte(len(args)))
+	return appendSPOEKVList(msg, args)
+}
+
+// ackVars decodes the set-var actions of an ACK
+func ackVars(t *testing.T, payload []byte) []spoeKV {
+	t.Helper()
+	var vars []spoeKV
+	for len(payload) > 0 {
+		if len(payload) < 3 || payload[0] != spoeActionSetVar || payload[1] != 3 || payload[2] != spoeScopeTxn {
+			t.Fatalf("unexpected action % x", payload)
+		}
+		name, rest, err := readSPOEString(payload[3:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, rest, err := readSPOETyped(rest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars = append(vars, spoeKV{Name: name, Value: value})
+		payload = rest
+	}
+	return vars
+}
+
+func TestSPOEAgent(t *testing.T) {
+	h := startSPOEAgent(t)
+
+	hello := h.hello(t, append(spoeHello[:1:1], spoeKV{Name: "max-frame-size", Value: uint32(8192)})...)
+	if hello["version"] != spoeVersion || hello["max-frame-size"] != uint64(8192) {
+		t.Errorf("AGENT-HELLO %v, want version 2.0 and the smaller max-frame-size", hello)
+	}
+
+	headers := map[string]string{"Host": "shop.example.com", "User-Agent": "Mozilla/5.0"}
+	for i, tc := range []struct {
+		query string
+		want  []spoeKV
+	}{
+		{"q=shoes", []spoeKV{{"block", false}, {"score", int64(0)}, {"rules", ""}}},
+		{"q=%3Cscript%3E", []spoeKV{{"block", true}, {"score", int64(1)}, {"rules", "100"}}},
+	} {
+		stream := uint64(i + 1)
+		h.send(t, &spoeFrame{Type: spoeFrameNotify, Flags: spoeFlagFin, StreamID: stream, FrameID: 7,
+			Payload: spoeMessage("GET", "/search", tc.query, headers)})
+		ack := h.receive(t)
+		if ack.Type != spoeFrameAck || ack.StreamID != stream || ack.FrameID != 7 {
+			t.Fatalf("%s: got frame %d for stream %d/%d, want ACK of %d/7", tc.query, ack.Type, ack.StreamID, ack.FrameID, stream)
+		}
+		if got := ackVars(t, ack.Payload); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: set %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// One NOTIFY may carry several messages; each gets its own variables
+	two := append(spoeMessage("GET", "/", "a=1", headers), spoeMessage("GET", "/", "b=%3Cscript%3E", headers)...)
+	h.send(t, &spoeFrame{Type: spoeFrameNotify, Flags: spoeFlagFin, StreamID: 3, FrameID: 1, Payload: two})
+	if got := ackVars(t, h.receive(t).Payload); len(got) != 6 || got[0].Value != false || got[3].Value != true {
+		t.Errorf("two messages: set %v", got)
+	}
+
+	h.send(t, &spoeFrame{Type: spoeFrameHAProxyDisconnect, Flags: spoeFlagFin,
+		Payload: appendSPOEKVList(nil, []spoeKV{{Name: "status-code", Value: uint32(0)}, {Name: "message", Value: "bye"}})})
+	if status := h.disconnected(t); status != spoeStatusNormal {
+		t.Errorf("disconnect status %d, want %d", status, spoeStatusNormal)
+	}
+}
+
+func TestSPOEAgentHealthcheck(t *testing.T) {
+	h := startSPOEAgent(t)
+	h.hello(t, append(spoeHello[:1:1], spoeKV{Name: "healthcheck", Value: true})...)
+	if _, err := readSPOEFrame(h.r, spoeMaxFrameSize); !errors.Is(err, io.EOF) {
+		t.Errorf("after a healthcheck: %v, want the connection closed", err)
+	}
+}
+
+func TestSPOEAgentErrors(t *testing.T) {
+	// rawFrame is a frame header announcing size bytes followed by body
+	rawFrame := func(size uint32, body ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, size), body...)
+	}
+	notify := func(flags uint32, payload []byte) []byte {
+		f := binary.BigEndian.AppendUint32([]byte{spoeFrameNotify}, flags)
+		f = append(f, 1, 1) // stream and frame id
+		return rawFrame(uint32(len(f)+len(payload)), append(f, payload...)...)
+	}
+	truncatedArgs := spoeMessage("GET", "/", "", nil)
+	truncatedArgs = truncatedArgs[:len(truncatedArgs)-3]
+
+	for _, tc := range []struct {
+		name      string
+		handshake []spoeKV // nil sends no HAPROXY-HELLO
+		send      []byte
+		status    uint64
+	}{
+		{"no hello", nil, notify(spoeFlagFin, nil), spoeStatusInvalid},
+		{"unsupported version", []spoeKV{{Name: "supported-versions", Value: "1.0"}}, nil, spoeStatusVersion},
+		{"too big", spoeHello, rawFrame(spoeMaxFrameSize + 1), spoeStatusTooBig},
+		{"too big for negotiated size", []spoeKV{spoeHello[0], {Name: "max-frame-size", Value: uint32(1024)}}, rawFrame(1025), spoeStatusTooBig},
+		{"shorter than a header", spoeHello, rawFrame(3, spoeFrameNotify, 0, 0), spoeStatusInvalid},
+		{"missing stream id", spoeHello, rawFrame(5, spoeFrameNotify, 0, 0, 0, 1), spoeStatusInvalid},
+		{"truncated message", spoeHello, notify(spoeFlagFin, truncatedArgs), spoeStatusInvalid},
+		{"missing argument count", spoeHello, notify(spoeFlagFin, appendSPOEString(nil, "waf-req")), spoeStatusInvalid},
+		{"fragmented", spoeHello, notify(0, spoeMessage("GET", "/", "", nil)), spoeStatusNoFrag},
+		{"unknown frame", spoeHello, rawFrame(7, 50, 0, 0, 0, 1, 0, 0), spoeStatusInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := startSPOEAgent(t)
+			if tc.handshake != nil {
+				if tc.status == spoeStatusVersion {
+					h.send(t, &spoeFrame{Type: spoeFrameHAProxyHello, Flags: spoeFlagFin, Payload: appendSPOEKVList(nil, tc.handshake)})
+				} else {
+					h.hello(t, tc.handshake...)
+				}
+			}
+			if tc.send != nil {
+				// The agent stops reading at the error, so the rest of an
+				// oversized frame is never sent
+				if _, err := h.conn.Write(tc.send); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if status := h.disconnected(t); status != tc.status {
+				t.Errorf("disconnect status %d, want %d", status, tc.status)
+			}
+		})
+	}
+}
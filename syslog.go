@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ==========================
+// Local syslog listener (for testing syslog sinks)
+// ==========================
+
+// runSyslogListen prints every syslog message it receives, one per line
+func runSyslogListen(args []string) {
+	fs := flag.NewFlagSet("syslog-listen", flag.ExitOnError)
+	network := fs.String("network", "udp", "udp, tcp, unix or unixgram")
+	addr := fs.String("addr", "127.0.0.1:5514", "listen address or socket path")
+	_ = fs.Parse(args)
+
+	out := bufio.NewWriter(os.Stdout)
+	emit := func(msg string) {
+		fmt.Fprintln(out, strings.TrimRight(msg, "\n"))
+		out.Flush()
+	}
+
+	switch *network {
+	case "udp", "unixgram":
+		conn, err := net.ListenPacket(*network, *addr)
+		if err != nil {
+			log.Fatalf("❌ Failed to listen: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "listening for syslog on %s %s\n", *network, conn.LocalAddr())
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Fatalf("❌ Failed to read: %v", err)
+			}
+			emit(string(buf[:n]))
+		}
+	case "tcp", "unix":
+		ln, err := net.Listen(*network, *addr)
+		if err != nil {
+			log.Fatalf("❌ Failed to listen: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "listening for syslog on %s %s\n", *network, ln.Addr())
+		msgs := make(chan string)
+		go func() {
+			for msg := range msgs {
+				emit(msg)
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Fatalf("❌ Failed to accept: %v", err)
+			}
+			go readSyslogStream(conn, msgs)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown network %q\n", *network)
+		os.Exit(2)
+	}
+}
+
+// readSyslogStream splits a stream into messages using octet-counting
+// framing ("<len> <msg>") or, for messages starting with '<', newlines
+func readSyslogStream(conn net.Conn, msgs chan<- string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		if first[0] == '<' {
+			line, err := r.ReadString('\n')
+			if line != "" {
+				msgs <- line
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil || n <= 0 {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		msgs <- string(msg)
+	}
+}
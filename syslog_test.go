@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"waf-engine/mainWAF/utils"
+)
+
+func TestReadSyslogStream(t *testing.T) {
+	// What the tcp and unix syslog sinks send: octet-counted and
+	// newline-framed messages
+	msg := utils.FormatSyslog(134, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC), "gw1", "waf", "7", "blocked")
+	client, server := net.Pipe()
+	go func() {
+		_, _ = io.WriteString(client, "7 <13>1 x"+"12 with\nnewline"+msg+"\n"+msg+"\n")
+		client.Close()
+	}()
+
+	msgs := make(chan string, 4)
+	readSyslogStream(server, msgs)
+	close(msgs)
+	var got []string
+	for m := range msgs {
+		got = append(got, m)
+	}
+	want := []string{"<13>1 x", "with\nnewline", msg + "\n", msg + "\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"waf-engine/mainWAF/rules"
 )
 
 type Rule struct {
@@ -20,20 +26,117 @@ type Rule struct {
 	Phase      int      `yaml:"phase"`
 	Severity   string   `yaml:"severity"`
 	Block      bool     `yaml:"block"`
+	NoLog      bool     `yaml:"nolog,omitempty"`
 	Transforms []string `yaml:"transforms,omitempty"`
 	Tags       []string `yaml:"tags,omitempty"`
 	Paranoia   int      `yaml:"paranoia_level,omitempty"`
 	Controls   []string `yaml:"controls,omitempty"`
 	Chain      []Rule   `yaml:"chain,omitempty"`
+	InitCol    []string `yaml:"initcol,omitempty"`
+	SetVar     []string `yaml:"setvar,omitempty"`
+	ExpireVar  []string `yaml:"expirevar,omitempty"`
+	Skip       int      `yaml:"skip,omitempty"`
+	SkipAfter  string   `yaml:"skip_after,omitempty"`
+	Marker     string   `yaml:"marker,omitempty"`
+}
+
+// reportEntry records what the converter did with one directive
+type reportEntry struct {
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Directive string `json:"directive"`
+	ID        string `json:"id,omitempty"`
+	ChainLink int    `json:"chain_link,omitempty"` // position in the chain of ID, 0 = starter
+	Category  string `json:"category,omitempty"`
+	Status    string `json:"status"` // converted, approximated, unsupported or skipped
+	Reason    string `json:"reason,omitempty"`
+}
+
+type conversionReport struct {
+	Summary map[string]int `json:"summary"`
+	Rules   []reportEntry  `json:"rules"`
+}
+
+func (rep *conversionReport) add(e reportEntry) int {
+	rep.Summary[e.Status]++
+	rep.Rules = append(rep.Rules, e)
+	return len(rep.Rules) - 1
+}
+
+// skip marks an already reported entry as skipped
+func (rep *conversionReport) skip(i int, reason string) {
+	rep.Summary[rep.Rules[i].Status]--
+	rep.Summary["skipped"]++
+	rep.Rules[i].Status, rep.Rules[i].Reason = "skipped", reason
 }
 
+// idAction and chainAction recover what they can from unparseable rules
+var (
+	idAction    = regexp.MustCompile(`\bid:'?(\d+)`)
+	chainAction = regexp.MustCompile(`[",]\s*chain\s*[",]`)
+)
+
 func main() {
-	crsPath := "crs/rules"
-	outDir := "parsed_rules"
-	_ = os.MkdirAll(outDir, 0o755)
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		if err := runDiff(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	crsPath := flag.String("crs", "crs/rules", "directory with the CRS .conf and .data files")
+	outDir := flag.String("out", "parsed_rules", "output directory of the YAML rules")
+	reportPath := flag.String("report", "conversion_report.json", "where to write the conversion report (empty = none)")
+	flag.Parse()
+	_ = os.MkdirAll(*outDir, 0o755)
 
+	catRules, report := convert(*crsPath, *outDir)
+
+	// Save per-category rules
+	var cfg struct {
+		LoadRules []string `yaml:"load_rules"`
+	}
+	for cat, list := range catRules {
+		if len(list) == 0 {
+			continue
+		}
+		fn := fmt.Sprintf("rules_%s.yaml", cat)
+		fp := filepath.Join(*outDir, fn)
+		saveYAML(fp, list)
+		cfg.LoadRules = append(cfg.LoadRules, fn)
+	}
+	saveYAML(filepath.Join(*outDir, "ruleset_config.yaml"), cfg)
+
+	if *reportPath != "" {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*reportPath, append(data, '\n'), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "could not write report:", err)
+		}
+	}
+	fmt.Println("Parsing complete! Rules saved to", *outDir)
+	fmt.Printf("converted=%d approximated=%d unsupported=%d skipped=%d\n",
+		report.Summary["converted"], report.Summary["approximated"], report.Summary["unsupported"], report.Summary["skipped"])
+}
+
+// convert turns the CRS .conf files under crsPath into rules grouped by
+// category and copies the .data files they read to outDir
+func convert(crsPath, outDir string) (map[string][]Rule, *conversionReport) {
 	catRules := make(map[string][]Rule)
+	report := &conversionReport{Summary: make(map[string]int)}
 	secRule := regexp.MustCompile(`(?i)^SecRule\s+(\S+)\s+"([^"]+)"\s+"([^"]+)"`)
+	secAction := regexp.MustCompile(`(?i)^SecAction\s+"([^"]+)"`)
+	secMarker := regexp.MustCompile(`(?i)^SecMarker\s+"?([^"\s]+)"?`)
+
+	// @pmFromFile data files are resolved next to the YAML rules
+	filepath.Walk(crsPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(info.Name(), ".data") {
+			if err := copyFile(path, filepath.Join(outDir, info.Name())); err != nil {
+				fmt.Fprintf(os.Stderr, "could not copy %s: %v\n", path, err)
+			}
+		}
+		return nil
+	})
 
 	filepath.Walk(crsPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), ".conf") {
@@ -46,9 +149,17 @@ func main() {
 		sc := bufio.NewScanner(f)
 		var buf string
 		var lastRule *Rule
+		chainID, chainLink, chainEntry := "", 0, 0
+		chainBlock := false  // the chain starter uses the block action
+		brokenChain := false // the rest of a chain whose starter was dropped
+		lineNo, start := 0, 0
 
 		for sc.Scan() {
+			lineNo++
 			line := strings.TrimSpace(sc.Text())
+			if buf == "" {
+				start = lineNo
+			}
 			if strings.HasSuffix(line, "\\") {
 				buf += strings.TrimSuffix(line, "\\") + " "
 				continue
@@ -57,37 +168,96 @@ func main() {
 				line = buf + line
 				buf = ""
 			}
-			if line == "" || strings.HasPrefix(line, "#") || !strings.HasPrefix(strings.ToUpper(line), "SECRULE") {
+			if line == "" || strings.HasPrefix(line, "#") {
 				continue
 			}
+			directive, _, _ := strings.Cut(line, " ")
+			entry := reportEntry{File: path, Line: start, Directive: directive, Category: category, Status: "converted"}
 
-			m := secRule.FindStringSubmatch(line)
-			if len(m) < 4 {
+			if m := secMarker.FindStringSubmatch(line); len(m) == 2 {
+				catRules[category] = append(catRules[category], Rule{Marker: m[1]})
+				entry.ID = m[1]
+				report.add(entry)
 				continue
 			}
-			variable := m[1]
-			pattern := m[2]
-			actions := m[3]
 
-			// Filter meta/control rules
-			if strings.HasPrefix(strings.ToUpper(variable), "TX:") {
+			var variable, pattern, actions string
+			parsed := true
+			if m := secRule.FindStringSubmatch(line); len(m) == 4 {
+				variable, pattern, actions = m[1], m[2], m[3]
+			} else if m := secAction.FindStringSubmatch(line); len(m) == 2 {
+				// SecAction is a rule without target that always matches
+				pattern, actions = "@unconditionalMatch", m[1]
+			} else if strings.EqualFold(directive, "SecRule") || strings.EqualFold(directive, "SecAction") {
+				parsed = false
+			} else {
 				continue
 			}
-			if strings.HasPrefix(pattern, "@lt") || strings.HasPrefix(pattern, "@eq") || strings.HasPrefix(pattern, "@gt") {
+			regex, approximation := normalizeOperator(pattern)
+			r := parseActions(variable, regex, actions)
+			chained := hasAction(actions, "chain")
+			if !parsed {
+				if m := idAction.FindStringSubmatch(line); m != nil {
+					r.ID = m[1]
+				}
+				chained = chainAction.MatchString(line)
+			}
+			entry.ID = r.ID
+			if lastRule != nil || brokenChain {
+				chainLink++
+				entry.ID, entry.ChainLink = chainID, chainLink
+			}
+			if brokenChain {
+				entry.Status, entry.Reason = "skipped", "belongs to a skipped chain"
+				report.add(entry)
+				brokenChain = chained
 				continue
 			}
 
-			r := parseActions(variable, normalizeOperator(pattern), actions)
-			if r.Regex == "" {
+			switch {
+			case !parsed:
+				entry.Status, entry.Reason = "skipped", "directive could not be parsed (escaped quotes or missing actions)"
+			case r.Regex == "":
+				entry.Status, entry.Reason = "skipped", "empty operator"
+			case lastRule == nil && r.ID == "":
+				entry.Status, entry.Reason = "skipped", "rule has no id"
+			case approximation != "":
+				entry.Status, entry.Reason = "approximated", approximation
+			}
+			if dropped := droppedActions(actions); entry.Status != "skipped" && len(dropped) > 0 {
+				entry.Status = "approximated"
+				entry.Reason = strings.TrimPrefix(entry.Reason+"; dropped actions: "+strings.Join(dropped, ", "), "; ")
+			}
+			if _, err := rules.ParseOperator(r.Regex, outDir); entry.Status != "skipped" && err != nil {
+				entry.Status, entry.Reason = "unsupported", "engine: "+err.Error()
+			}
+			i := report.add(entry)
+
+			if entry.Status == "skipped" {
+				// Without one of its links a chain would match more than
+				// upstream, so the whole chain is dropped
+				if lastRule != nil {
+					list := catRules[category]
+					catRules[category] = list[:len(list)-1]
+					for k := chainEntry; k < i; k++ {
+						report.skip(k, fmt.Sprintf("chain link %d skipped: %s", chainLink, entry.Reason))
+					}
+					lastRule = nil
+				} else {
+					chainID, chainLink, chainEntry = r.ID, 0, i
+				}
+				brokenChain = chained
 				continue
 			}
 
 			// Handle chain
-			if strings.Contains(actions, "chain") {
+			if chained {
 				if lastRule == nil {
 					// Start of new chain
 					catRules[category] = append(catRules[category], r)
 					lastRule = &catRules[category][len(catRules[category])-1]
+					chainID, chainLink, chainEntry = r.ID, 0, i
+					chainBlock = hasAction(actions, "block")
 				} else {
 					// Continuation of existing chain
 					lastRule.Chain = append(lastRule.Chain, r)
@@ -97,55 +267,266 @@ func main() {
 				// Final chain link
 				lastRule.Chain = append(lastRule.Chain, r)
 				lastRule = nil
+				deferAnomalyBlock(&catRules[category][len(catRules[category])-1], chainBlock)
 			} else {
 				// Normal rule
+				deferAnomalyBlock(&r, hasAction(actions, "block"))
 				catRules[category] = append(catRules[category], r)
 			}
 		}
 		return nil
 	})
+	return catRules, report
+}
 
-	// Save per-category rules
-	var cfg struct {
-		LoadRules []string `yaml:"load_rules"`
+// deferAnomalyBlock leaves blocking to the 949/959 evaluation when the
+// block action belongs to a rule adding to an anomaly score (see
+// rules.AddsAnomalyScore)
+func deferAnomalyBlock(r *Rule, block bool) {
+	if block && rules.AddsAnomalyScore(toEngineRule(*r)) {
+		r.Block = false
 	}
-	for cat, list := range catRules {
-		if len(list) == 0 {
-			continue
+}
+
+// toEngineRule copies the actions and chain of a converted rule into an
+// engine rule
+func toEngineRule(r Rule) rules.Rule {
+	out := rules.Rule{SetVar: r.SetVar}
+	for _, link := range r.Chain {
+		out.Chain = append(out.Chain, toEngineRule(link))
+	}
+	return out
+}
+
+// --- Diff mode ---
+
+// ruleChange is one difference between two generated rule directories
+type ruleChange struct {
+	ID     string `json:"id"`
+	Change string `json:"change"` // added, removed or changed
+	Field  string `json:"field,omitempty"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// runDiff compares two generated rule directories rule by rule:
+//
+//	go run tools/parser.go diff [-json] old_dir new_dir
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the changes as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: parser diff [-json] <old_dir> <new_dir>")
+	}
+	oldRules, err := loadRuleDir(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newRules, err := loadRuleDir(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(oldRules)+len(newRules))
+	for id := range oldRules {
+		ids = append(ids, id)
+	}
+	for id := range newRules {
+		if _, ok := oldRules[id]; !ok {
+			ids = append(ids, id)
 		}
-		fn := fmt.Sprintf("rules_%s.yaml", cat)
-		fp := filepath.Join(outDir, fn)
-		saveYAML(fp, list)
-		cfg.LoadRules = append(cfg.LoadRules, fn)
 	}
-	saveYAML(filepath.Join(outDir, "ruleset_config.yaml"), cfg)
-	fmt.Println("Parsing complete! Rules saved to", outDir)
+	sort.Strings(ids)
+
+	var changes []ruleChange
+	unchanged := 0
+	for _, id := range ids {
+		o, inOld := oldRules[id]
+		n, inNew := newRules[id]
+		switch {
+		case !inOld:
+			changes = append(changes, ruleChange{ID: id, Change: "added"})
+		case !inNew:
+			changes = append(changes, ruleChange{ID: id, Change: "removed"})
+		default:
+			fields := compareRules(o, n)
+			for _, c := range fields {
+				c.ID, c.Change = id, "changed"
+				changes = append(changes, c)
+			}
+			if len(fields) == 0 {
+				unchanged++
+			}
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	counts := map[string]int{}
+	seen := map[string]bool{}
+	for _, c := range changes {
+		switch c.Change {
+		case "added":
+			fmt.Printf("+ %s\n", c.ID)
+		case "removed":
+			fmt.Printf("- %s\n", c.ID)
+		default:
+			fmt.Printf("~ %s %s: %q -> %q\n", c.ID, c.Field, c.Old, c.New)
+		}
+		if !seen[c.ID] {
+			seen[c.ID] = true
+			counts[c.Change]++
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d changed, %d unchanged\n",
+		counts["added"], counts["removed"], counts["changed"], unchanged)
+	return nil
+}
+
+// loadRuleDir reads every YAML rule file of a directory, keyed by rule id
+// (markers as "marker:NAME")
+func loadRuleDir(dir string) (map[string]Rule, error) {
+	out := make(map[string]Rule)
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s: no YAML rule files", dir)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var list []Rule
+		if yaml.Unmarshal(data, &list) != nil {
+			continue // ruleset_config.yaml and other non-rule files
+		}
+		for _, r := range list {
+			switch {
+			case r.Marker != "":
+				out["marker:"+r.Marker] = r
+			case r.ID != "":
+				out[r.ID] = r
+			}
+		}
+	}
+	return out, nil
+}
+
+// compareRules lists the fields that differ between two versions of a rule
+func compareRules(o, n Rule) []ruleChange {
+	var out []ruleChange
+	diff := func(field string, a, b any) {
+		if !reflect.DeepEqual(a, b) {
+			out = append(out, ruleChange{Field: field, Old: fmt.Sprint(a), New: fmt.Sprint(b)})
+		}
+	}
+	diff("variable", o.Variable, n.Variable)
+	diff("regex", o.Regex, n.Regex)
+	diff("msg", o.Name, n.Name)
+	diff("phase", o.Phase, n.Phase)
+	diff("severity", o.Severity, n.Severity)
+	diff("block", o.Block, n.Block)
+	diff("nolog", o.NoLog, n.NoLog)
+	diff("transforms", o.Transforms, n.Transforms)
+	diff("paranoia_level", o.Paranoia, n.Paranoia)
+	diff("controls", o.Controls, n.Controls)
+	diff("initcol", o.InitCol, n.InitCol)
+	diff("setvar", o.SetVar, n.SetVar)
+	diff("expirevar", o.ExpireVar, n.ExpireVar)
+	diff("skip", o.Skip, n.Skip)
+	diff("skip_after", o.SkipAfter, n.SkipAfter)
+	if a, b := chainString(o.Chain), chainString(n.Chain); a != b {
+		out = append(out, ruleChange{Field: "chain", Old: a, New: b})
+	}
+	return out
+}
+
+// chainString renders chained rules for comparison
+func chainString(chain []Rule) string {
+	if len(chain) == 0 {
+		return ""
+	}
+	data, _ := yaml.Marshal(chain)
+	return string(data)
 }
 
 // --- Helpers ---
 
-func normalizeOperator(pattern string) string {
+// normalizeOperator turns an operator into the YAML regex field; the
+// second result explains how the operator was approximated, if it was
+func normalizeOperator(pattern string) (string, string) {
 	switch {
 	case strings.HasPrefix(pattern, "@rx "):
-		return strings.TrimPrefix(pattern, "@rx ")
+		return strings.TrimPrefix(pattern, "@rx "), ""
 	case strings.HasPrefix(pattern, "@pm "):
 		words := strings.Fields(strings.TrimPrefix(pattern, "@pm "))
 		if len(words) == 0 {
-			return ""
+			return "", ""
+		}
+		for i, w := range words {
+			words[i] = regexp.QuoteMeta(w)
 		}
-		return "(?i)(" + strings.Join(words, "|") + ")"
+		return "(?i)(" + strings.Join(words, "|") + ")", ""
 	case strings.HasPrefix(pattern, "@streq "):
 		val := strings.TrimPrefix(pattern, "@streq ")
-		return "^" + regexp.QuoteMeta(strings.TrimSpace(val)) + "$"
+		return "^" + regexp.QuoteMeta(strings.TrimSpace(val)) + "$", ""
 	case strings.HasPrefix(pattern, "@detectSQLi"):
 		// basic libinjection regex approximation
-		return `(?i)(union(\s+all)?\s+select|select.+from|insert\s+into|drop\s+table|update.+set|or\s+1=1)`
+		return `(?i)(union(\s+all)?\s+select|select.+from|insert\s+into|drop\s+table|update.+set|or\s+1=1)`,
+			"@detectSQLi (libinjection) approximated by a regex"
 	case strings.HasPrefix(pattern, "@detectXSS"):
-		return `(?i)(<script|onerror\s*=|onload\s*=|javascript:|alert\s*\()`
+		return `(?i)(<script|onerror\s*=|onload\s*=|javascript:|alert\s*\()`,
+			"@detectXSS (libinjection) approximated by a regex"
 	default:
 		// Some CRS rules put plain regex without @rx
-		return pattern
+		return pattern, ""
+	}
+}
+
+// unsupportedActions change what a rule does but have no YAML equivalent
+var unsupportedActions = map[string]bool{
+	"allow": true, "append": true, "capture": true, "deprecatevar": true, "exec": true,
+	"multiMatch": true, "pause": true, "prepend": true, "proxy": true, "redirect": true,
+	"sanitiseArg": true, "sanitiseMatched": true, "sanitiseMatchedBytes": true,
+	"sanitiseRequestHeader": true, "sanitiseResponseHeader": true, "setenv": true, "status": true,
+}
+
+// droppedActions lists the unsupported actions of an action list
+func droppedActions(actions string) []string {
+	var out []string
+	for _, part := range splitActions(actions) {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), ":")
+		if unsupportedActions[name] {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// hasAction reports whether an action list contains a bare action
+func hasAction(actions, name string) bool {
+	for _, part := range splitActions(actions) {
+		if strings.TrimSpace(part) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// copyFile copies a CRS data file next to the generated rules
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(dst, data, 0o644)
 }
 
 func detectCategory(filename string) string {
@@ -182,7 +563,7 @@ func detectCategory(filename string) string {
 		return "session_fixation"
 	case strings.Contains(filename, "944"):
 		return "java"
-	case strings.Contains(filename, "959"):
+	case strings.Contains(filename, "949"), strings.Contains(filename, "959"):
 		return "blocking_evaluation"
 	case strings.Contains(filename, "980"):
 		return "correlation"
@@ -195,11 +576,14 @@ func parseActions(variable, pattern, actions string) Rule {
 	r := Rule{
 		Variable: variable,
 		Regex:    pattern,
-		Block:    strings.Contains(actions, "block") || strings.Contains(actions, "deny"),
 	}
-	for _, part := range strings.Split(actions, ",") {
+	for _, part := range splitActions(actions) {
 		part = strings.TrimSpace(part)
 		switch {
+		case part == "block" || part == "deny":
+			r.Block = true
+		case part == "nolog":
+			r.NoLog = true
 		case strings.HasPrefix(part, "id:"):
 			r.ID = strings.TrimPrefix(part, "id:")
 		case strings.HasPrefix(part, "msg:"):
@@ -219,11 +603,51 @@ func parseActions(variable, pattern, actions string) Rule {
 			}
 		case strings.HasPrefix(part, "ctl:"):
 			r.Controls = append(r.Controls, strings.TrimPrefix(part, "ctl:"))
+		case strings.HasPrefix(part, "initcol:"):
+			r.InitCol = append(r.InitCol, actionValue(part, "initcol:"))
+		case strings.HasPrefix(part, "setsid:"):
+			r.InitCol = append(r.InitCol, "session="+actionValue(part, "setsid:"))
+		case strings.HasPrefix(part, "setuid:"):
+			r.InitCol = append(r.InitCol, "user="+actionValue(part, "setuid:"))
+		case strings.HasPrefix(part, "setvar:"):
+			r.SetVar = append(r.SetVar, actionValue(part, "setvar:"))
+		case strings.HasPrefix(part, "expirevar:"):
+			r.ExpireVar = append(r.ExpireVar, actionValue(part, "expirevar:"))
+		case strings.HasPrefix(part, "skip:"):
+			r.Skip, _ = strconv.Atoi(actionValue(part, "skip:"))
+		case strings.HasPrefix(part, "skipAfter:"):
+			r.SkipAfter = actionValue(part, "skipAfter:")
 		}
 	}
 	return r
 }
 
+// splitActions splits an action list on the commas outside single quotes,
+// so values like msg:'a, b' or setvar:'tx.x=a,b' stay in one piece
+func splitActions(actions string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(actions); i++ {
+		switch actions[i] {
+		case '\\':
+			i++
+		case '\'':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, actions[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, actions[start:])
+}
+
+// actionValue strips the action name and the optional quotes around its value
+func actionValue(part, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(part, prefix), "'\"")
+}
+
 func saveYAML(path string, data any) {
 	f, _ := os.Create(path)
 	defer f.Close()
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestNormalizePhraseMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    string
+		matches []string
+	}{
+		// 933190: unquoted, "?>" turned into an empty atomic group
+		{"@pm ?>", `(?i)(\?>)`, []string{"echo 1 ?>"}},
+		// 941180: unquoted, "<![cdata[" did not compile and "." matched anything
+		{"@pm document.cookie <![cdata[", `(?i)(document\.cookie|<!\[cdata\[)`, []string{"DOCUMENT.COOKIE", "<![CDATA[x"}},
+	} {
+		got, approximation := normalizeOperator(tc.pattern)
+		if got != tc.want || approximation != "" {
+			t.Errorf("%s: converted to %q (%q), want %q", tc.pattern, got, approximation, tc.want)
+			continue
+		}
+		re := regexp.MustCompile(got)
+		for _, s := range tc.matches {
+			if !re.MatchString(s) {
+				t.Errorf("%s: %q does not match %q", tc.pattern, got, s)
+			}
+		}
+		if re.MatchString("documentXcookie") {
+			t.Errorf("%s: '.' of a phrase matches any character", tc.pattern)
+		}
+	}
+}
+
+func TestConvertAnomalyScoring(t *testing.T) {
+	crs := t.TempDir()
+	files := map[string]string{
+		"REQUEST-941-APPLICATION-ATTACK-XSS.conf": `
+SecRule ARGS "@rx <script" "id:941100,phase:2,block,t:lowercase,severity:'CRITICAL',setvar:'tx.inbound_anomaly_score_pl1=+%{tx.critical_anomaly_score}'"
+SecRule ARGS "@rx javascript:" "id:941200,phase:2,block,chain"
+    SecRule MATCHED_VAR "@rx alert" "setvar:'tx.inbound_anomaly_score_pl1=+%{tx.warning_anomaly_score}'"
+SecRule ARGS "@rx evil" "id:941999,phase:2,deny"
+SecRule ARGS "@rx loud" "id:941998,phase:2,block,setvar:'tx.xss_score=+1'"
+`,
+		"REQUEST-949-BLOCKING-EVALUATION.conf": `
+SecMarker "BEGIN-REQUEST-BLOCKING-EVAL"
+SecRule TX:BLOCKING_INBOUND_ANOMALY_SCORE "@ge %{tx.inbound_anomaly_score_threshold}" "id:949110,phase:2,deny,t:none"
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(crs, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	catRules, _ := convert(crs, t.TempDir())
+	blocks := map[string]bool{}
+	for _, r := range catRules["xss"] {
+		blocks[r.ID] = r.Block
+	}
+	for id, want := range map[string]bool{
+		"941100": false, // scores, so the evaluation blocks
+		"941200": false, // the score is added by a chain link
+		"941999": true,  // deny blocks on its own
+		"941998": true,  // a plain TX variable is not an anomaly score
+	} {
+		if got, ok := blocks[id]; !ok || got != want {
+			t.Errorf("%s: block %v (converted %v), want %v", id, got, ok, want)
+		}
+	}
+
+	eval := catRules["blocking_evaluation"]
+	if len(eval) != 2 || eval[0].Marker != "BEGIN-REQUEST-BLOCKING-EVAL" || eval[1].ID != "949110" || !eval[1].Block {
+		t.Errorf("blocking evaluation converted to %+v", eval)
+	}
+}
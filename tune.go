@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"waf-engine/mainWAF/rules"
+	"waf-engine/mainWAF/utils"
+)
+
+// ==========================
+// Tuning assistant (waf tune)
+// ==========================
+
+// tuneKey identifies one group of matches in the request log
+type tuneKey struct {
+	RuleID    string
+	Variable  string
+	Path      string
+	Parameter string
+}
+
+// tuneGroup aggregates every logged match sharing a tuneKey
+type tuneGroup struct {
+	tuneKey
+	RuleName string
+	Hits     int
+	Blocked  int
+	Clients  map[string]int
+	Score    float64
+}
+
+func runTune(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	logPath := fs.String("log", "waf.log", "request log written by utils.LogRequest")
+	out := fs.String("out", "", "write exclusion YAML to this file instead of stdout")
+	minHits := fs.Int("min-hits", 5, "ignore groups with fewer matches")
+	top := fs.Int("top", 20, "maximum number of exclusions to propose")
+	startID := fs.Int("start-id", 10000, "first rule ID used for generated exclusions")
+	_ = fs.Parse(args)
+
+	f, err := os.Open(*logPath)
+	if err != nil {
+		log.Fatalf("❌ Failed to open request log: %v", err)
+	}
+	defer f.Close()
+
+	groups, err := groupMatches(f)
+	if err != nil {
+		log.Fatalf("❌ Failed to read request log: %v", err)
+	}
+
+	ranked := rankGroups(groups, *minHits)
+	if len(ranked) > *top {
+		ranked = ranked[:*top]
+	}
+	log.Printf("✅ %d candidate exclusions from %d match groups", len(ranked), len(groups))
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("❌ Failed to create %s: %v", *out, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if err := writeExclusions(w, ranked, *startID); err != nil {
+		log.Fatalf("❌ Failed to write exclusions: %v", err)
+	}
+}
+
+// groupMatches reads RequestLog lines and groups their matched rules.
+// Lines written through utils.Logger carry a "[WAF] date time" prefix,
+// so everything before the first '{' is ignored; non-JSON lines are skipped.
+func groupMatches(r io.Reader) (map[tuneKey]*tuneGroup, error) {
+	groups := make(map[tuneKey]*tuneGroup)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		start := strings.IndexByte(line, '{')
+		if start < 0 {
+			continue
+		}
+
+		var entry utils.RequestLog
+		if err := json.Unmarshal([]byte(line[start:]), &entry); err != nil {
+			continue
+		}
+
+		path, _, _ := strings.Cut(entry.URI, "?")
+		client := entry.ClientIP
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+
+		for _, m := range entry.MatchedRules {
+			if m.RuleID == "" {
+				continue
+			}
+			key := tuneKey{RuleID: m.RuleID, Variable: m.Variable, Path: path, Parameter: m.Parameter}
+			g, ok := groups[key]
+			if !ok {
+				g = &tuneGroup{tuneKey: key, RuleName: m.RuleName, Clients: make(map[string]int)}
+				groups[key] = g
+			}
+			g.Hits++
+			g.Clients[client]++
+			if entry.Blocked {
+				g.Blocked++
+			}
+		}
+	}
+	return groups, sc.Err()
+}
+
+// rankGroups scores every group and returns those with at least minHits
+// matches, most likely false positive first. The score combines:
+//   - volume: log-scaled number of matches
+//   - client concentration: few distinct clients relative to the volume
+//   - parameter consistency: share of the rule's matches on this path that
+//     land on this one parameter
+func rankGroups(groups map[tuneKey]*tuneGroup, minHits int) []*tuneGroup {
+	perRulePath := make(map[[2]string]int)
+	for _, g := range groups {
+		perRulePath[[2]string{g.RuleID, g.Path}] += g.Hits
+	}
+
+	var ranked []*tuneGroup
+	for _, g := range groups {
+		if g.Hits < minHits {
+			continue
+		}
+		volume := math.Log2(1 + float64(g.Hits))
+		concentration := 1 - float64(len(g.Clients)-1)/float64(g.Hits)
+		consistency := float64(g.Hits) / float64(perRulePath[[2]string{g.RuleID, g.Path}])
+		g.Score = volume * concentration * consistency
+		ranked = append(ranked, g)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score > ranked[j].Score
+		}
+		return ranked[i].Hits > ranked[j].Hits
+	})
+	return ranked
+}
+
+// exclusionRule turns a match group into a phase-1 ctl rule scoped to its path
+func exclusionRule(g *tuneGroup, id int) rules.Rule {
+	ctl := "ruleRemoveById=" + g.RuleID
+	name := fmt.Sprintf("Tuning: disable rule %s on %s", g.RuleID, g.Path)
+	if g.Parameter != "" {
+		ctl = fmt.Sprintf("ruleRemoveTargetById=%s;%s", g.RuleID, g.Parameter)
+		name = fmt.Sprintf("Tuning: exclude %s from rule %s on %s", g.Parameter, g.RuleID, g.Path)
+	}
+
+	return rules.Rule{
+		ID:       strconv.Itoa(id),
+		Name:     name,
+		Variable: "REQUEST_FILENAME",
+		Regex:    "^" + regexp.QuoteMeta(g.Path) + "$",
+		Phase:    1,
+		Tags:     []string{"tuning", "rule-" + g.RuleID},
+		Controls: []string{ctl},
+	}
+}
+
+// writeExclusions emits the proposed rules as YAML, each preceded by a
+// comment summarizing the evidence so reviewers can accept or drop it.
+func writeExclusions(w io.Writer, ranked []*tuneGroup, startID int) error {
+	doc := &yaml.Node{Kind: yaml.SequenceNode}
+	for i, g := range ranked {
+		var node yaml.Node
+		if err := node.Encode(exclusionRule(g, startID+i)); err != nil {
+			return err
+		}
+		node.HeadComment = fmt.Sprintf("rule %s (%s) matched %d times in %s from %d client(s), %d blocked; score %.2f",
+			g.RuleID, g.RuleName, g.Hits, g.Variable, len(g.Clients), g.Blocked, g.Score)
+		doc.Content = append(doc.Content, &node)
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+	return enc.Encode(doc)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// ==========================
+// TX defaults (CRS 901 initialization)
+// ==========================
+
+// defaultTX returns the TX variables every transaction starts with: the
+// defaults CRS sets in REQUEST-901-INITIALIZATION for variables that
+// crs-setup.conf left unset. Converted rules expand them in macros such as
+// %{tx.allowed_methods}, so they are seeded here instead of being added by
+// hand to the generated rules.
+func defaultTX() map[string]string {
+	tx := map[string]string{
+		"inbound_anomaly_score_threshold":  "5",
+		"outbound_anomaly_score_threshold": "4",
+		"blocking_paranoia_level":          "1",
+		"detection_paranoia_level":         "1",
+		"early_blocking":                   "0",
+		"critical_anomaly_score":           "5",
+		"error_anomaly_score":              "4",
+		"warning_anomaly_score":            "3",
+		"notice_anomaly_score":             "2",
+		"allowed_methods":                  "GET HEAD POST OPTIONS",
+		"allowed_request_content_type": "|application/x-www-form-urlencoded| |multipart/form-data| |multipart/related| " +
+			"|text/xml| |application/xml| |application/soap+xml| |application/json| " +
+			"|application/cloudevents+json| |application/cloudevents-batch+json|",
+		"allowed_http_versions": "HTTP/1.0 HTTP/1.1 HTTP/2 HTTP/2.0 HTTP/3 HTTP/3.0",
+		"restricted_extensions": ".asa/ .asax/ .ascx/ .backup/ .bak/ .bat/ .cdx/ .cer/ .cfg/ .cmd/ .com/ .config/ " +
+			".conf/ .cs/ .csproj/ .csr/ .dat/ .db/ .dbf/ .dll/ .dos/ .htr/ .htw/ .ida/ .idc/ .idq/ .inc/ .ini/ " +
+			".key/ .licx/ .lnk/ .log/ .mdb/ .old/ .pass/ .pdb/ .pol/ .printer/ .pwd/ .rdb/ .resources/ .resx/ " +
+			".sql/ .swp/ .sys/ .vb/ .vbs/ .vbproj/ .vsdisco/ .webinfo/ .xsd/ .xsx/",
+		"restricted_headers_basic": "/content-encoding/ /proxy/ /lock-token/ /content-range/ /if/ " +
+			"/x-http-method-override/ /x-http-method/ /x-method-override/ /x-middleware-subrequest/",
+	}
+	for _, dir := range []string{"inbound", "outbound"} {
+		tx["blocking_"+dir+"_anomaly_score"] = "0"
+		tx["detection_"+dir+"_anomaly_score"] = "0"
+		for pl := 1; pl <= 4; pl++ {
+			tx[dir+"_anomaly_score_pl"+strconv.Itoa(pl)] = "0"
+		}
+	}
+	return tx
+}
+
+// SetTXDefaults replaces the TX variables transactions start with; names
+// are case-insensitive like TX itself
+func (e *Evaluator) SetTXDefaults(vars map[string]string) {
+	e.txDefaults = make(map[string]string, len(vars))
+	for name, value := range vars {
+		e.txDefaults[strings.ToLower(name)] = value
+	}
+}
+
+// newTransaction starts a transaction with its own copy of the TX defaults
+func (e *Evaluator) newTransaction() *Transaction {
+	tx := maps.Clone(e.txDefaults)
+	if tx == nil {
+		tx = make(map[string]string)
+	}
+	return &Transaction{TX: tx, Collections: make(map[string]string)}
+}
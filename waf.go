@@ -1,9 +1,15 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"waf-engine/mainWAF/rules"
@@ -11,29 +17,175 @@ import (
 )
 
 func main() {
-	utils.InitLogger()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tune":
+			runTune(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "ftw":
+			runFTW(os.Args[2:])
+			return
+		case "test-rules":
+			runTestRules(os.Args[2:])
+			return
+		case "loadtest":
+			runLoadTest(os.Args[2:])
+			return
+		case "profile":
+			runProfile(os.Args[2:])
+			return
+		case "debug-token":
+			runDebugToken(os.Args[2:])
+			return
+		case "syslog-listen":
+			runSyslogListen(os.Args[2:])
+			return
+		case "extauthz-check":
+			runExtAuthzCheck(os.Args[2:])
+			return
+		case "spoa-check":
+			runSPOACheck(os.Args[2:])
+			return
+		case "serve":
+			serve(os.Args[2:])
+			return
+		}
+	}
+	serve(os.Args[1:])
+}
+
+// serve loads the ruleset and runs the WAF HTTP server
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "", "YAML config file (see config.go for defaults)")
+	_ = fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fatal("failed to load config", err)
+	}
+	errorLog, err := utils.OpenSink(cfg.Logging.Output)
+	if err != nil {
+		fatal("failed to open log output", err)
+	}
+	if err := utils.SetupLogging(errorLog, cfg.Logging.Level, cfg.Logging.Format); err != nil {
+		fatal("invalid logging config", err)
+	}
+	defer utils.CloseSinks()
+
+	if err := utils.SetRedaction(cfg.Redaction); err != nil {
+		fatal("invalid redaction config", err)
+	}
+	if err := utils.InitLogger(cfg.Logging.RequestLog); err != nil {
+		fatal("failed to open request log", err)
+	}
+	if auditLog, err = utils.OpenAuditLog(cfg.AuditLog); err != nil {
+		fatal("failed to open audit log", err)
+	}
 
 	// 1️⃣ Load parsed rules directly
-	err := rules.LoadRules("parsed_rules")
+	utils.SetRegexTimeout(cfg.Regex.MatchTimeout)
+	rules.SetPCREFallback(cfg.Regex.PCREFallback)
+	err = rules.LoadRules(cfg.RulesDir)
+	recordRuleLoad(rules.AllRules, err)
 	if err != nil {
-		log.Fatalf("❌ Failed to load rules: %v", err)
+		fatal("failed to load rules", err)
 	}
-	log.Printf("✅ Loaded %d rules", len(rules.AllRules))
+	slog.Info("rules loaded", "rules", len(rules.AllRules))
 
 	// 2️⃣ Build engine with global rules and precompiled regex
 	enf := NewEvaluator(rules.AllRules)
+	enf.SetDebugTracing(cfg.Logging.DebugSecret, cfg.Logging.DebugSampleRate)
+	enf.SetTXDefaults(cfg.TX)
+	if err := enf.SetRegexLimits(cfg.Regex); err != nil {
+		fatal("invalid regex config", err)
+	}
+	store, err := openCollectionStore(cfg.Collections)
+	if err != nil {
+		fatal("failed to open collections", err)
+	}
+	enf.SetCollectionStore(store)
+	defer store.Close()
 
 	// 3️⃣ Setup HTTP mux with WAF handler
-	mux := http.NewServeMux()
-	mux.Handle("/", HTTPHandler(enf))
+	mux := newServeMux(enf)
+
+	// Metrics and the profiler only on their own admin listener: on the
+	// main listener they would be reachable by every client the WAF protects
+	if cfg.Admin.Listen != "" {
+		adminSrv := &http.Server{Addr: cfg.Admin.Listen, Handler: newAdminMux(enf), ReadHeaderTimeout: 5 * time.Second}
+		slog.Info("admin listening", "addr", cfg.Admin.Listen)
+		go func() { fatal("admin server stopped", adminSrv.ListenAndServe()) }()
+	} else if cfg.Admin.Profile {
+		slog.Warn("profiling is on but no admin listener serves /admin/profile")
+	}
+	enf.SetProfiling(cfg.Admin.Profile)
 
-	// 4️⃣ Start server
+	// 4️⃣ Optional HAProxy SPOE agent
+	if cfg.SPOA.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.SPOA.Listen)
+		if err != nil {
+			fatal("failed to start SPOA listener", err)
+		}
+		slog.Info("SPOE agent listening", "addr", cfg.SPOA.Listen)
+		go func() { fatal("SPOE agent stopped", ServeSPOA(ln, enf)) }()
+	}
+
+	// 5️⃣ Start server
 	srv := &http.Server{
-		Addr:              ":8080",
+		Addr:              cfg.Listen,
 		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
+		Protocols:         new(http.Protocols),
+	}
+	// h2c lets Envoy reach the ext_authz gRPC service on the same port
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	// Shut down on SIGINT/SIGTERM so queued log lines are flushed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdown)
+	}()
+
+	slog.Info("WAF listening", "addr", cfg.Listen)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fatal("HTTP server stopped", err)
 	}
+	slog.Info("WAF stopped")
+}
+
+// newServeMux routes the main listener: the WAF itself and its inspection
+// APIs for proxies
+func newServeMux(enf *Evaluator) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", HTTPHandler(enf))
+	mux.Handle("/inspect", InspectHandler(enf))
+	mux.Handle("/inspect/batch", InspectBatchHandler(enf))
+	mux.Handle(extAuthzGRPCPath, ExtAuthzGRPCHandler(enf))
+	mux.Handle(extAuthzHTTPPrefix+"/", ExtAuthzHTTPHandler(enf))
+	mux.Handle(authRequestPath, AuthRequestHandler(enf))
+	return mux
+}
+
+// newAdminMux routes the admin listener
+func newAdminMux(enf *Evaluator) *http.ServeMux {
+	admin := http.NewServeMux()
+	admin.Handle("/metrics", MetricsHandler())
+	admin.Handle("/admin/profile", ProfileHandler(enf))
+	return admin
+}
 
-	fmt.Println("🚀 WAF listening on :8080")
-	log.Fatal(srv.ListenAndServe())
+// fatal logs a startup or server failure of serve and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	utils.CloseSinks()
+	os.Exit(1)
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMainListenerRoutes(t *testing.T) {
+	mux := newServeMux(NewEvaluator(loadTestRules(t, xssRule)))
+
+	// Admin paths are ordinary requests the WAF inspects
+	for _, target := range []string{"/metrics", "/admin/profile"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if !strings.HasPrefix(rec.Body.String(), "✅ Allowed") {
+			t.Errorf("%s on the main listener served %q (%s), want the WAF handler", target, rec.Body.String(), rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestAdminListenerRoutes(t *testing.T) {
+	eval := NewEvaluator(loadTestRules(t, xssRule))
+	admin := newAdminMux(eval)
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusOK || !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("/metrics: HTTP %d (%s), want Prometheus text", rec.Code, ct)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/admin/profile?action=start", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("starting the profiler: HTTP %d", rec.Code)
+	}
+	if _, on := eval.ProfileReport("total", 0); !on {
+		t.Error("profiling is still off")
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/search?q=1", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("WAF path on the admin listener: HTTP %d, want 404", rec.Code)
+	}
+}